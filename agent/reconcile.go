@@ -146,6 +146,14 @@ func desiredAgentState(a *Agent, reg registry.Registry) (*AgentState, error) {
 			log.Debugf("Agent unable to run global unit %s: missing required metadata", u.Name)
 			continue
 		}
+		if u.IsGlobal() && !machine.HasRoles(&ms, u.RequiredRoles()) {
+			log.Debugf("Agent unable to run global unit %s: missing required roles", u.Name)
+			continue
+		}
+		if u.IsGlobal() && !machine.HasConstraints(&ms, u.RequiredConstraints()) {
+			log.Debugf("Agent unable to run global unit %s: unmet constraints", u.Name)
+			continue
+		}
 		if !u.IsGlobal() {
 			sUnit, ok := sUnitMap[u.Name]
 			if !ok || sUnit.TargetMachineID == "" || sUnit.TargetMachineID != ms.ID {
@@ -386,6 +386,42 @@ func TestAbleToRun(t *testing.T) {
 			job:  newTestJobWithXFleetValues(t, "Conflicts=ping.service"),
 			want: false,
 		},
+
+		// below maximum number of units
+		{
+			dState: &AgentState{
+				MState: &machine.MachineState{ID: "123", MaxUnits: 2},
+				Units: map[string]*job.Unit{
+					"ping.service": &job.Unit{Name: "ping.service"},
+				},
+			},
+			job:  &job.Job{Name: "easy-street.service", Unit: unit.UnitFile{}},
+			want: true,
+		},
+
+		// at maximum number of units
+		{
+			dState: &AgentState{
+				MState: &machine.MachineState{ID: "123", MaxUnits: 1},
+				Units: map[string]*job.Unit{
+					"ping.service": &job.Unit{Name: "ping.service"},
+				},
+			},
+			job:  &job.Job{Name: "easy-street.service", Unit: unit.UnitFile{}},
+			want: false,
+		},
+
+		// units already scheduled locally count towards their own maximum
+		{
+			dState: &AgentState{
+				MState: &machine.MachineState{ID: "123", MaxUnits: 1},
+				Units: map[string]*job.Unit{
+					"easy-street.service": &job.Unit{Name: "easy-street.service"},
+				},
+			},
+			job:  &job.Job{Name: "easy-street.service", Unit: unit.UnitFile{}},
+			want: true,
+		},
 	}
 
 	for i, tt := range tests {
@@ -81,6 +81,7 @@ func globMatches(pattern, target string) bool {
 //   - Agent must have all of the Job's required metadata (if any)
 //   - Agent must have all required Peers of the Job scheduled locally (if any)
 //   - Job must not conflict with any other Units scheduled to the agent
+//   - Agent must not already run its maximum number of Units (if any)
 func (as *AgentState) AbleToRun(j *job.Job) (bool, string) {
 	if tgt, ok := j.RequiredTarget(); ok && !as.MState.MatchID(tgt) {
 		return false, fmt.Sprintf("agent ID %q does not match required %q", as.MState.ID, tgt)
@@ -93,6 +94,14 @@ func (as *AgentState) AbleToRun(j *job.Job) (bool, string) {
 		}
 	}
 
+	if !machine.HasRoles(as.MState, j.RequiredRoles()) {
+		return false, "local Machine lacks required roles"
+	}
+
+	if !machine.HasConstraints(as.MState, j.RequiredConstraints()) {
+		return false, "local Machine metadata does not meet constraints"
+	}
+
 	peers := j.Peers()
 	if len(peers) != 0 {
 		for _, peer := range peers {
@@ -106,5 +115,9 @@ func (as *AgentState) AbleToRun(j *job.Job) (bool, string) {
 		return false, fmt.Sprintf("found conflict with locally-scheduled Unit(%s)", cJobName)
 	}
 
+	if max := as.MState.MaxUnits; max > 0 && !as.unitScheduled(j.Name) && len(as.Units) >= max {
+		return false, fmt.Sprintf("local Machine already runs its maximum of %d Units", max)
+	}
+
 	return true, ""
 }
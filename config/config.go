@@ -29,10 +29,13 @@ type Config struct {
 	PublicIP                string
 	Verbosity               int
 	RawMetadata             string
+	RawRoles                string
+	MaxUnits                int
 	AgentTTL                string
 	TokenLimit              int
 	DisableEngine           bool
 	DisableWatches          bool
+	EnsureKeyspace          bool
 	VerifyUnits             bool
 	AuthorizedKeysFile      string
 }
@@ -54,3 +57,18 @@ func (c *Config) Metadata() map[string]string {
 
 	return meta
 }
+
+func (c *Config) Roles() []string {
+	roles := make([]string, 0)
+
+	for _, role := range strings.Split(c.RawRoles, ",") {
+		role = strings.TrimSpace(role)
+		if len(role) == 0 {
+			continue
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles
+}
@@ -44,3 +44,17 @@ func TestConfigMetadataNotSet(t *testing.T) {
 		t.Errorf("Parsed %d keys, expected 0", len(metadata))
 	}
 }
+
+func TestConfigRoles(t *testing.T) {
+	cfg := Config{RawRoles: "web, worker,,"}
+	roles := cfg.Roles()
+
+	if len(roles) != 2 || roles[0] != "web" || roles[1] != "worker" {
+		t.Errorf("Unexpected roles %v", roles)
+	}
+
+	cfg = Config{}
+	if roles = cfg.Roles(); len(roles) != 0 {
+		t.Errorf("Parsed %d roles, expected 0", len(roles))
+	}
+}
@@ -41,6 +41,11 @@ func (lls *leastLoadedScheduler) Decide(clust *clusterState, j *job.Job) (*decis
 
 	var target *agent.AgentState
 	for _, as := range agents {
+		// Degraded machines keep the Units already scheduled to them
+		// for their grace period, but receive no new ones
+		if as.MState.Degraded {
+			continue
+		}
 		if able, _ := as.AbleToRun(j); !able {
 			continue
 		}
@@ -93,7 +93,7 @@ func (cs *clusterState) agents() map[string]*agent.AgentState {
 	for _, gu := range cs.gUnits {
 		gu := gu
 		for _, a := range agents {
-			if machine.HasMetadata(a.MState, gu.RequiredTargetMetadata()) {
+			if machine.HasMetadata(a.MState, gu.RequiredTargetMetadata()) && machine.HasRoles(a.MState, gu.RequiredRoles()) && machine.HasConstraints(a.MState, gu.RequiredConstraints()) {
 				a.Units[gu.Name] = gu
 			}
 		}
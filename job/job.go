@@ -16,8 +16,11 @@ package job
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/coreos/fleet/machine"
 	"github.com/coreos/fleet/pkg"
 	"github.com/coreos/fleet/unit"
 )
@@ -44,8 +47,18 @@ const (
 	fleetConflicts = "Conflicts"
 	// Machine metadata key in the unit file
 	fleetMachineMetadata = "MachineMetadata"
+	// Limit eligible machines to those which have been assigned a specific role.
+	fleetMachineRole = "MachineRole"
+	// Limit eligible machines to those whose metadata meets a constraint expression.
+	fleetMachineConstraint = "MachineConstraint"
 	// Require that the unit be scheduled on every machine in the cluster
 	fleetGlobal = "Global"
+	// Order in which units scheduled to the same machine are launched.
+	fleetPriority = "Priority"
+	// Order in which units are moved off a machine being drained or rebalanced.
+	fleetEvictionPriority = "EvictionPriority"
+	// Time after which a unit which has finished running is removed.
+	fleetRemoveAfter = "RemoveAfter"
 
 	deprecatedXPrefix          = "X-"
 	deprecatedXConditionPrefix = "X-Condition"
@@ -62,7 +75,12 @@ var validRequirements = pkg.NewUnsafeSet(
 	fleetConflicts,
 	deprecatedXConditionPrefix+fleetMachineMetadata,
 	fleetMachineMetadata,
+	fleetMachineRole,
+	fleetMachineConstraint,
 	fleetGlobal,
+	fleetPriority,
+	fleetEvictionPriority,
+	fleetRemoveAfter,
 )
 
 func ParseJobState(s string) (JobState, error) {
@@ -91,6 +109,10 @@ type ScheduledUnit struct {
 	Name            string
 	State           *JobState
 	TargetMachineID string
+	// ScheduledAt records when the Unit was last scheduled to its
+	// target machine. It is zero if the Unit is not scheduled, or was
+	// scheduled by a version of fleet which did not record it.
+	ScheduledAt time.Time
 }
 
 // Unit represents a Unit that has been submitted to fleet
@@ -99,6 +121,9 @@ type Unit struct {
 	Name        string
 	Unit        unit.UnitFile
 	TargetState JobState
+	// Annotations hold free-form metadata about the Unit which is
+	// persisted by fleet but has no effect on scheduling
+	Annotations map[string]string
 }
 
 // IsGlobal returns whether a Unit is considered a global unit
@@ -162,6 +187,46 @@ func (u *Unit) RequiredTargetMetadata() map[string]pkg.Set {
 	return j.RequiredTargetMetadata()
 }
 
+func (u *Unit) RequiredRoles() []string {
+	j := &Job{
+		Name: u.Name,
+		Unit: u.Unit,
+	}
+	return j.RequiredRoles()
+}
+
+func (u *Unit) RequiredConstraints() []string {
+	j := &Job{
+		Name: u.Name,
+		Unit: u.Unit,
+	}
+	return j.RequiredConstraints()
+}
+
+func (u *Unit) Priority() int {
+	j := &Job{
+		Name: u.Name,
+		Unit: u.Unit,
+	}
+	return j.Priority()
+}
+
+func (u *Unit) EvictionPriority() int {
+	j := &Job{
+		Name: u.Name,
+		Unit: u.Unit,
+	}
+	return j.EvictionPriority()
+}
+
+func (u *Unit) RemoveAfter() time.Duration {
+	j := &Job{
+		Name: u.Name,
+		Unit: u.Unit,
+	}
+	return j.RemoveAfter()
+}
+
 // requirements returns all relevant options from the [X-Fleet] section of a unit file.
 // Relevant options are identified with a `X-` prefix in the unit.
 // This prefix is stripped from relevant options before being returned.
@@ -192,10 +257,31 @@ func (j *Job) requirements() map[string][]string {
 // the job's associated unit file are known keys. If not, an error is
 // returned.
 func (j *Job) ValidateRequirements() error {
-	for key, _ := range j.requirements() {
+	for key, values := range j.requirements() {
 		if !validRequirements.Contains(key) {
 			return fmt.Errorf("unrecognized requirement in [X-Fleet] section: %q", key)
 		}
+		if key == fleetPriority || key == fleetEvictionPriority {
+			for _, v := range values {
+				if _, err := strconv.Atoi(strings.TrimSpace(v)); err != nil {
+					return fmt.Errorf("invalid value for %s in [X-Fleet] section: %q", key, v)
+				}
+			}
+		}
+		if key == fleetRemoveAfter {
+			for _, v := range values {
+				if d, err := time.ParseDuration(strings.TrimSpace(v)); err != nil || d < 0 {
+					return fmt.Errorf("invalid value for %s in [X-Fleet] section: %q", key, v)
+				}
+			}
+		}
+		if key == fleetMachineConstraint {
+			for _, v := range values {
+				if _, err := machine.ParseConstraint(v); err != nil {
+					return fmt.Errorf("invalid value for %s in [X-Fleet] section: %v", fleetMachineConstraint, err)
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -283,6 +369,73 @@ func (j *Job) RequiredTargetMetadata() map[string]pkg.Set {
 	return metadata
 }
 
+// RequiredRoles returns the roles a machine must have been assigned in
+// order to be eligible to run this Job. A machine must have all of the
+// returned roles.
+func (j *Job) RequiredRoles() []string {
+	roles := make([]string, 0)
+	for _, role := range j.requirements()[fleetMachineRole] {
+		if role = strings.TrimSpace(role); len(role) != 0 {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// RequiredConstraints returns the constraint expressions, as parsed by
+// machine.ParseConstraint, which the metadata of a machine must meet in
+// order for it to be eligible to run this Job. A machine must meet all of
+// the returned constraints.
+func (j *Job) RequiredConstraints() []string {
+	exprs := make([]string, 0)
+	for _, expr := range j.requirements()[fleetMachineConstraint] {
+		if expr = strings.TrimSpace(expr); len(expr) != 0 {
+			exprs = append(exprs, expr)
+		}
+	}
+	return exprs
+}
+
+// Priority returns the launch priority of this Job. Jobs with a higher
+// priority are launched before others scheduled to the same machine. The
+// default priority is zero, and the last valid value found wins.
+func (j *Job) Priority() int {
+	return j.intRequirement(fleetPriority)
+}
+
+// EvictionPriority returns the eviction priority of this Job. When Jobs
+// are moved off a machine, those with a lower eviction priority are moved
+// first, so Jobs with a higher one stay in place as long as possible. The
+// default eviction priority is zero, and the last valid value found wins.
+func (j *Job) EvictionPriority() int {
+	return j.intRequirement(fleetEvictionPriority)
+}
+
+// RemoveAfter returns how long this Job may remain dead, having finished
+// running, before it is eligible to be removed. Zero, the default, means
+// the Job is never removed automatically. The last valid value found wins.
+func (j *Job) RemoveAfter() time.Duration {
+	var d time.Duration
+	for _, v := range j.requirements()[fleetRemoveAfter] {
+		if parsed, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && parsed >= 0 {
+			d = parsed
+		}
+	}
+	return d
+}
+
+// intRequirement returns the last valid integer value of the given
+// requirement, or zero if there is none
+func (j *Job) intRequirement(key string) int {
+	var n int
+	for _, v := range j.requirements()[key] {
+		if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			n = i
+		}
+	}
+	return n
+}
+
 func (j *Job) Scheduled() bool {
 	return len(j.TargetMachineID) > 0
 }
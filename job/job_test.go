@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coreos/fleet/pkg"
 	"github.com/coreos/fleet/unit"
@@ -429,6 +430,101 @@ X-ConditionMachineMetadata="one=abc" "two=def"`,
 	}
 }
 
+func TestJobRequiredRoles(t *testing.T) {
+	testCases := []struct {
+		unit string
+		out  []string
+	}{
+		{`[X-Fleet]`, []string{}},
+		{"[X-Fleet]\nMachineRole=web", []string{"web"}},
+		{"[X-Fleet]\nMachineRole=web\nMachineRole=db", []string{"web", "db"}},
+		{`[X-Fleet]
+MachineRole="web" "db"`, []string{"web", "db"}},
+		{"[X-Fleet]\nMachineRole=", []string{}},
+	}
+	for i, tt := range testCases {
+		j := NewJob("echo.service", *newUnit(t, tt.unit))
+		if roles := j.RequiredRoles(); !reflect.DeepEqual(roles, tt.out) {
+			t.Errorf("case %d: got roles %#v, want %#v", i, roles, tt.out)
+		}
+	}
+}
+
+func TestJobRequiredConstraints(t *testing.T) {
+	testCases := []struct {
+		unit string
+		out  []string
+	}{
+		{`[X-Fleet]`, []string{}},
+		{"[X-Fleet]\nMachineConstraint=region in [us-east, us-west]", []string{"region in [us-east, us-west]"}},
+		{"[X-Fleet]\nMachineConstraint=gpu != false\nMachineConstraint=region == us-east", []string{"gpu != false", "region == us-east"}},
+		{"[X-Fleet]\nMachineConstraint=", []string{}},
+	}
+	for i, tt := range testCases {
+		j := NewJob("echo.service", *newUnit(t, tt.unit))
+		if exprs := j.RequiredConstraints(); !reflect.DeepEqual(exprs, tt.out) {
+			t.Errorf("case %d: got constraints %#v, want %#v", i, exprs, tt.out)
+		}
+	}
+}
+
+func TestJobPriority(t *testing.T) {
+	testCases := []struct {
+		unit string
+		out  int
+	}{
+		{`[X-Fleet]`, 0},
+		{"[X-Fleet]\nPriority=10", 10},
+		{"[X-Fleet]\nPriority=-3", -3},
+		{"[X-Fleet]\nPriority=1\nPriority=2", 2},
+		{"[X-Fleet]\nPriority=5\nPriority=high", 5},
+	}
+	for i, tt := range testCases {
+		j := NewJob("echo.service", *newUnit(t, tt.unit))
+		if prio := j.Priority(); prio != tt.out {
+			t.Errorf("case %d: got priority %d, want %d", i, prio, tt.out)
+		}
+	}
+}
+
+func TestJobEvictionPriority(t *testing.T) {
+	testCases := []struct {
+		unit string
+		out  int
+	}{
+		{`[X-Fleet]`, 0},
+		{"[X-Fleet]\nEvictionPriority=10", 10},
+		{"[X-Fleet]\nEvictionPriority=-3", -3},
+		{"[X-Fleet]\nEvictionPriority=5\nEvictionPriority=high", 5},
+		// launch priority is independent
+		{"[X-Fleet]\nPriority=7", 0},
+	}
+	for i, tt := range testCases {
+		j := NewJob("echo.service", *newUnit(t, tt.unit))
+		if prio := j.EvictionPriority(); prio != tt.out {
+			t.Errorf("case %d: got eviction priority %d, want %d", i, prio, tt.out)
+		}
+	}
+}
+
+func TestJobRemoveAfter(t *testing.T) {
+	testCases := []struct {
+		unit string
+		out  time.Duration
+	}{
+		{`[X-Fleet]`, 0},
+		{"[X-Fleet]\nRemoveAfter=90s", 90 * time.Second},
+		{"[X-Fleet]\nRemoveAfter=1h\nRemoveAfter=later", time.Hour},
+		{"[X-Fleet]\nRemoveAfter=-5m", 0},
+	}
+	for i, tt := range testCases {
+		j := NewJob("echo.service", *newUnit(t, tt.unit))
+		if d := j.RemoveAfter(); d != tt.out {
+			t.Errorf("case %d: got RemoveAfter %v, want %v", i, d, tt.out)
+		}
+	}
+}
+
 func TestInstanceUnitPrintf(t *testing.T) {
 	u := unit.NewUnitNameInfo("foo@bar.waldo")
 	if u == nil {
@@ -534,7 +630,12 @@ func TestValidateRequirements(t *testing.T) {
 		"Conflicts=foo",
 		"X-ConditionMachineMetadata=up=down",
 		"MachineMetadata=true=false",
+		"MachineRole=web",
 		"Global=true",
+		"Priority=10",
+		"EvictionPriority=-1",
+		"RemoveAfter=1h30m",
+		"MachineConstraint=region in [us-east, us-west]",
 	}
 	for i, req := range tests {
 		contents := fmt.Sprintf("[X-Fleet]\n%s", req)
@@ -556,6 +657,11 @@ func TestBadValidateRequirements(t *testing.T) {
 		"MachineId=true",
 		"X-MachineMetadata=none",
 		"X-ConditionMetadata=foo=foo",
+		"Priority=high",
+		"EvictionPriority=low",
+		"RemoveAfter=soon",
+		"RemoveAfter=-1h",
+		"MachineConstraint=region = us-east",
 	}
 	for i, req := range tests {
 		contents := fmt.Sprintf("[X-Fleet]\n%s", req)
@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/fleet/log"
+)
+
+// ConstraintOperator compares a Metadata value against the values of a
+// Constraint
+type ConstraintOperator string
+
+const (
+	// The Metadata value must equal the single value
+	ConstraintEqual = ConstraintOperator("==")
+	// The Metadata value must be absent or differ from the single value
+	ConstraintNotEqual = ConstraintOperator("!=")
+	// The Metadata value must equal one of the values
+	ConstraintIn = ConstraintOperator("in")
+)
+
+var (
+	comparisonConstraint = regexp.MustCompile(`^([^\s=!\[\],]+)\s*(==|!=)\s*([^\s\[\],]+)$`)
+	inConstraint         = regexp.MustCompile(`^([^\s=!\[\],]+)\s+in\s+\[(.*)\]$`)
+)
+
+// Constraint is a requirement on the Metadata of a machine, such as
+// `region in [us-east, us-west]` or `gpu != false`
+type Constraint struct {
+	Key      string
+	Operator ConstraintOperator
+	Values   []string
+}
+
+// ParseConstraint parses an expression of the form `key == value`,
+// `key != value` or `key in [value, ...]` into a Constraint
+func ParseConstraint(expr string) (*Constraint, error) {
+	expr = strings.TrimSpace(expr)
+	if m := comparisonConstraint.FindStringSubmatch(expr); m != nil {
+		return &Constraint{Key: m[1], Operator: ConstraintOperator(m[2]), Values: []string{m[3]}}, nil
+	}
+	if m := inConstraint.FindStringSubmatch(expr); m != nil {
+		c := &Constraint{Key: m[1], Operator: ConstraintIn}
+		for _, v := range strings.Split(m[2], ",") {
+			v = strings.TrimSpace(v)
+			if len(v) == 0 || strings.ContainsAny(v, " \t[]") {
+				return nil, fmt.Errorf("invalid value %q in constraint %q", v, expr)
+			}
+			c.Values = append(c.Values, v)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("invalid constraint %q", expr)
+}
+
+// SatisfiedBy determines whether the Metadata of the given MachineState
+// meets the Constraint
+func (c *Constraint) SatisfiedBy(state *MachineState) bool {
+	local, ok := state.Metadata[c.Key]
+	switch c.Operator {
+	case ConstraintEqual:
+		return ok && local == c.Values[0]
+	case ConstraintNotEqual:
+		return !ok || local != c.Values[0]
+	case ConstraintIn:
+		for _, v := range c.Values {
+			if ok && local == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasConstraints determines if the Metadata of the given MachineState meets
+// all of the indicated constraint expressions, as parsed by ParseConstraint.
+// An expression which cannot be parsed is never met, so a Unit with a
+// malformed constraint is run nowhere rather than anywhere.
+func HasConstraints(state *MachineState, exprs []string) bool {
+	for _, expr := range exprs {
+		c, err := ParseConstraint(expr)
+		if err != nil {
+			log.Debugf("Unable to evaluate Constraint(%s): %v", expr, err)
+			return false
+		}
+		if !c.SatisfiedBy(state) {
+			log.Debugf("Local Metadata does not meet Constraint(%s)", expr)
+			return false
+		}
+	}
+	return true
+}
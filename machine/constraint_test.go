@@ -0,0 +1,79 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConstraint(t *testing.T) {
+	for i, tt := range []struct {
+		expr string
+		want *Constraint
+	}{
+		{"region == us-east", &Constraint{"region", ConstraintEqual, []string{"us-east"}}},
+		{"gpu!=false", &Constraint{"gpu", ConstraintNotEqual, []string{"false"}}},
+		{" region in [us-east, us-west] ", &Constraint{"region", ConstraintIn, []string{"us-east", "us-west"}}},
+		{"region in [us-east]", &Constraint{"region", ConstraintIn, []string{"us-east"}}},
+		{"region", nil},
+		{"region = us-east", nil},
+		{"== us-east", nil},
+		{"region ==", nil},
+		{"region == us east", nil},
+		{"region in us-east", nil},
+		{"region in []", nil},
+		{"region in [us-east,]", nil},
+		{"regionin [us-east]", nil},
+	} {
+		got, err := ParseConstraint(tt.expr)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("case %d: expected error parsing %q, got %#v", i, tt.expr, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: ParseConstraint(%q) = %#v, %v, want %#v", i, tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestHasConstraints(t *testing.T) {
+	ms := &MachineState{Metadata: map[string]string{"region": "us-west", "gpu": "true"}}
+	for i, tt := range []struct {
+		exprs []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"region in [us-east, us-west]"}, true},
+		{[]string{"region in [eu-west, eu-central]"}, false},
+		{[]string{"gpu != false"}, true},
+		{[]string{"gpu == false"}, false},
+		// absent metadata differs from any value, but is in no set
+		{[]string{"disk != hdd"}, true},
+		{[]string{"disk == hdd"}, false},
+		{[]string{"disk in [ssd, hdd]"}, false},
+		// every constraint must be met
+		{[]string{"region in [us-east, us-west]", "gpu != false"}, true},
+		{[]string{"region in [us-east, us-west]", "gpu == false"}, false},
+		// malformed constraints are never met
+		{[]string{"region ~ us"}, false},
+	} {
+		if got := HasConstraints(ms, tt.exprs); got != tt.want {
+			t.Errorf("case %d: HasConstraints(%v) = %t, want %t", i, tt.exprs, got, tt.want)
+		}
+	}
+}
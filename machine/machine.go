@@ -45,3 +45,22 @@ func HasMetadata(state *MachineState, metadata map[string]pkg.Set) bool {
 
 	return true
 }
+
+// HasRoles determines if the given MachineState has been assigned all of
+// the indicated roles.
+func HasRoles(state *MachineState, roles []string) bool {
+	for _, role := range roles {
+		found := false
+		for _, local := range state.Roles {
+			if local == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Debugf("Local Machine lacks Role(%s)", role)
+			return false
+		}
+	}
+	return true
+}
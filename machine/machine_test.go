@@ -81,3 +81,23 @@ func TestHasMetadata(t *testing.T) {
 		}
 	}
 }
+
+func TestHasRoles(t *testing.T) {
+	for i, tt := range []struct {
+		roles []string
+		match []string
+		want  bool
+	}{
+		{nil, nil, true},
+		{[]string{"web"}, nil, true},
+		{[]string{"web"}, []string{"web"}, true},
+		{[]string{"web", "db"}, []string{"db", "web"}, true},
+		{[]string{"web"}, []string{"web", "db"}, false},
+		{nil, []string{"web"}, false},
+	} {
+		ms := &MachineState{Roles: tt.roles}
+		if got := HasRoles(ms, tt.match); got != tt.want {
+			t.Errorf("case %d: HasRoles(%v, %v) = %t, want %t", i, tt.roles, tt.match, got, tt.want)
+		}
+	}
+}
@@ -24,7 +24,27 @@ type MachineState struct {
 	ID       string
 	PublicIP string
 	Metadata map[string]string
-	Version  string
+	// Roles assigned to the machine by its operator, which units may
+	// require through the MachineRole option. It is omitted when empty
+	// so machines without roles serialize as they always have.
+	Roles []string `json:",omitempty"`
+	// MaxUnits limits the number of units that may be scheduled to the
+	// machine. Zero means no limit.
+	MaxUnits int `json:",omitempty"`
+	// Cordoned reports whether the machine has been cordoned, barring
+	// new Units from being placed on it. Like StatusMessage, it is kept
+	// by the Registry rather than published by the machine.
+	Cordoned bool `json:",omitempty"`
+	// Degraded reports whether the machine has stopped publishing its
+	// state, but did so too recently to be considered gone. It is only
+	// ever set if the Registry has been given a grace period for
+	// machines.
+	Degraded bool `json:",omitempty"`
+	// StatusMessage is a free-form note left on the machine by an
+	// operator. It is purely informational, and is stored separately from
+	// the state the machine publishes itself.
+	StatusMessage string `json:",omitempty"`
+	Version       string
 }
 
 func (ms MachineState) ShortID() string {
@@ -58,6 +78,14 @@ func stackState(top, bottom MachineState) MachineState {
 		state.Metadata = top.Metadata
 	}
 
+	if len(top.Roles) > 0 {
+		state.Roles = top.Roles
+	}
+
+	if top.MaxUnits != 0 {
+		state.MaxUnits = top.MaxUnits
+	}
+
 	if top.Version != "" {
 		state.Version = top.Version
 	}
@@ -21,12 +21,14 @@ func TestStackState(t *testing.T) {
 		ID:       "c31e44e1-f858-436e-933e-59c642517860",
 		PublicIP: "1.2.3.4",
 		Metadata: map[string]string{"ping": "pong"},
+		Roles:    []string{"web"},
 		Version:  "1",
 	}
 	bottom := MachineState{
 		ID:       "595989bb-cbb7-49ce-8726-722d6e157b4e",
 		PublicIP: "5.6.7.8",
 		Metadata: map[string]string{"foo": "bar"},
+		Roles:    []string{"db"},
 		Version:  "",
 	}
 	stacked := stackState(top, bottom)
@@ -43,6 +45,10 @@ func TestStackState(t *testing.T) {
 		t.Errorf("Unexpected Metadata %v", stacked.Metadata)
 	}
 
+	if len(stacked.Roles) != 1 || stacked.Roles[0] != "web" {
+		t.Errorf("Unexpected Roles %v", stacked.Roles)
+	}
+
 	if stacked.Version != "1" {
 		t.Errorf("Unexpected Version value %s", stacked.Version)
 	}
@@ -89,6 +95,11 @@ var shortIDTests = []struct {
 			"595989bb-cbb7-49ce-8726-722d6e157b4e",
 			"5.6.7.8",
 			map[string]string{"foo": "bar"},
+			nil,
+			0,
+			false,
+			false,
+			"",
 			"",
 		},
 		s: "595989bb",
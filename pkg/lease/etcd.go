@@ -17,6 +17,7 @@ package lease
 import (
 	"encoding/json"
 	"path"
+	"sync"
 	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
@@ -96,14 +97,61 @@ func serializeLeaseMetadata(machID string, ver int) (string, error) {
 	return string(b), nil
 }
 
+// LeaseStats counts the attempts made through a Manager to take a Lease,
+// by AcquireLease or StealLease
+type LeaseStats struct {
+	// Acquisitions is the number of attempts which took the Lease
+	Acquisitions uint64
+	// Contentions is the number of attempts which failed because the
+	// Lease was held, or had changed hands since it was last read
+	Contentions uint64
+}
+
 type etcdLeaseManager struct {
 	kAPI       etcd.KeysAPI
 	keyPrefix  string
 	reqTimeout time.Duration
+
+	// statsMu guards stats
+	statsMu sync.Mutex
+	stats   map[string]*LeaseStats
 }
 
 func NewEtcdLeaseManager(kAPI etcd.KeysAPI, keyPrefix string, reqTimeout time.Duration) *etcdLeaseManager {
-	return &etcdLeaseManager{kAPI: kAPI, keyPrefix: keyPrefix, reqTimeout: reqTimeout}
+	return &etcdLeaseManager{kAPI: kAPI, keyPrefix: keyPrefix, reqTimeout: reqTimeout, stats: make(map[string]*LeaseStats)}
+}
+
+// LeaseStats returns the statistics of every Lease this manager has
+// attempted to take, keyed by lease name. The counts accumulate for the
+// lifetime of the manager; contention over a window is found by comparing
+// the results of two calls.
+func (r *etcdLeaseManager) LeaseStats() map[string]LeaseStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+
+	stats := make(map[string]LeaseStats, len(r.stats))
+	for name, s := range r.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// recordAttempt counts an attempt to take the named Lease, based on the
+// error returned by etcd for the write
+func (r *etcdLeaseManager) recordAttempt(name string, err error) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+
+	s, ok := r.stats[name]
+	if !ok {
+		s = &LeaseStats{}
+		r.stats[name] = s
+	}
+	if err == nil {
+		s.Acquisitions++
+	} else if isEtcdError(err, etcd.ErrorCodeNodeExist) || isEtcdError(err, etcd.ErrorCodeTestFailed) {
+		s.Contentions++
+	}
 }
 
 func (r *etcdLeaseManager) ctx() context.Context {
@@ -115,9 +163,17 @@ func (r *etcdLeaseManager) leasePath(name string) string {
 	return path.Join(r.keyPrefix, leasePrefix, name)
 }
 
+// GetLease always reads through a quorum of the etcd cluster, regardless
+// of how other reads from the cluster are made. A Lease read from a
+// lagging member could appear free, or appear to be held at an old index,
+// causing AcquireLease or StealLease to be attempted on stale grounds.
+// Writes to leases are always made through the etcd leader.
 func (r *etcdLeaseManager) GetLease(name string) (Lease, error) {
 	key := r.leasePath(name)
-	resp, err := r.kAPI.Get(r.ctx(), key, nil)
+	opts := &etcd.GetOptions{
+		Quorum: true,
+	}
+	resp, err := r.kAPI.Get(r.ctx(), key, opts)
 	if err != nil {
 		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
 			err = nil
@@ -141,6 +197,7 @@ func (r *etcdLeaseManager) StealLease(name, machID string, ver int, period time.
 		TTL:       period,
 	}
 	resp, err := r.kAPI.Set(r.ctx(), key, val, opts)
+	r.recordAttempt(name, err)
 	if err != nil {
 		if isEtcdError(err, etcd.ErrorCodeNodeExist) {
 			err = nil
@@ -165,6 +222,7 @@ func (r *etcdLeaseManager) AcquireLease(name string, machID string, ver int, per
 	}
 
 	resp, err := r.kAPI.Set(r.ctx(), key, val, opts)
+	r.recordAttempt(name, err)
 	if err != nil {
 		if isEtcdError(err, etcd.ErrorCodeNodeExist) {
 			err = nil
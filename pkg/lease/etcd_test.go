@@ -20,6 +20,7 @@ import (
 	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 func TestSerializeLeaseMetadata(t *testing.T) {
@@ -129,3 +130,68 @@ func TestLeaseFromResponse(t *testing.T) {
 		}
 	}
 }
+
+// getRecorder is an etcd.KeysAPI recording the options of every Get
+type getRecorder struct {
+	etcd.KeysAPI
+	opts []*etcd.GetOptions
+}
+
+func (g *getRecorder) Get(_ context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	g.opts = append(g.opts, opts)
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: `{"MachineID":"XXX"}`}}, nil
+}
+
+func TestGetLeaseQuorum(t *testing.T) {
+	kAPI := &getRecorder{}
+	mgr := NewEtcdLeaseManager(kAPI, "/fleet/", time.Second)
+	l, err := mgr.GetLease("engine-leader")
+	if err != nil || l == nil || l.MachineID() != "XXX" {
+		t.Fatalf("unexpected result from GetLease: %v, %v", l, err)
+	}
+	if len(kAPI.opts) != 1 || kAPI.opts[0] == nil || !kAPI.opts[0].Quorum {
+		t.Errorf("lease read not issued with quorum: %#v", kAPI.opts)
+	}
+}
+
+// setRecorder is an etcd.KeysAPI which accepts only the first write to
+// each key, failing the others as etcd would fail a contended write
+type setRecorder struct {
+	etcd.KeysAPI
+	keys map[string]bool
+}
+
+func (s *setRecorder) Set(_ context.Context, key, val string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if s.keys[key] {
+		if opts.PrevExist == etcd.PrevNoExist {
+			return nil, etcd.Error{Code: etcd.ErrorCodeNodeExist}
+		}
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+	}
+	s.keys[key] = true
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: val}}, nil
+}
+
+func TestLeaseStats(t *testing.T) {
+	mgr := NewEtcdLeaseManager(&setRecorder{keys: make(map[string]bool)}, "/fleet/", time.Second)
+	if l, err := mgr.AcquireLease("engine-leader", "XXX", 0, time.Second); err != nil || l == nil {
+		t.Fatalf("unexpected result from AcquireLease: %v, %v", l, err)
+	}
+	if l, err := mgr.AcquireLease("engine-leader", "YYY", 0, time.Second); err != nil || l != nil {
+		t.Fatalf("unexpected result from contended AcquireLease: %v, %v", l, err)
+	}
+	if l, err := mgr.StealLease("engine-leader", "YYY", 0, time.Second, 1); err == nil || l != nil {
+		t.Fatalf("unexpected result from contended StealLease: %v, %v", l, err)
+	}
+	if l, err := mgr.AcquireLease("unit/foo.service", "XXX", 0, time.Second); err != nil || l == nil {
+		t.Fatalf("unexpected result from AcquireLease: %v, %v", l, err)
+	}
+
+	want := map[string]LeaseStats{
+		"engine-leader":    {Acquisitions: 1, Contentions: 2},
+		"unit/foo.service": {Acquisitions: 1},
+	}
+	if got := mgr.LeaseStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected LeaseStats\nwant=%#v\ngot=%#v", want, got)
+	}
+}
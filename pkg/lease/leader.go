@@ -0,0 +1,114 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/fleet/log"
+)
+
+// Leader contends for leadership on behalf of a machine, leadership being
+// held by whichever machine holds the named Lease
+type Leader struct {
+	mgr    Manager
+	name   string
+	machID string
+	ver    int
+	ttl    time.Duration
+
+	lease Lease
+}
+
+// NewLeader creates a Leader contending for the named Lease as the given
+// machine, operating at the given version. The Lease is acquired and
+// renewed with the given TTL, so leadership passes to another machine
+// within that time of the Leader ceasing to renew it.
+func NewLeader(mgr Manager, name, machID string, ver int, ttl time.Duration) *Leader {
+	return &Leader{mgr: mgr, name: name, machID: machID, ver: ver, ttl: ttl}
+}
+
+// RunPeriodicAsLeader runs the given task every interval, but only while
+// the Leader holds leadership, until the stop channel is closed. Before
+// each run the Lease is renewed or, if not held, acquired; ticks on which
+// leadership cannot be held are skipped, and the task resumes running once
+// leadership is regained. Errors returned by the task are logged, and do
+// not end the loop. The task should return well within the TTL of the
+// Lease, as leadership can lapse while it runs. Once stopped, any Lease
+// held is released so another machine can take over immediately. An error
+// is returned only if the interval is not shorter than the TTL, as
+// leadership would lapse between runs.
+func (l *Leader) RunPeriodicAsLeader(interval time.Duration, task func() error, stop <-chan struct{}) error {
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if interval >= l.ttl {
+		return fmt.Errorf("interval %v must be shorter than the lease TTL %v", interval, l.ttl)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if l.hold() {
+			if err := task(); err != nil {
+				log.Errorf("Periodic task of Lease(%s) leader failed: %v", l.name, err)
+			}
+		}
+
+		select {
+		case <-stop:
+			l.release()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// hold renews the Lease if it is held, and otherwise attempts to acquire
+// it, returning whether the Leader now holds leadership
+func (l *Leader) hold() bool {
+	if l.lease != nil {
+		err := l.lease.Renew(l.ttl)
+		if err == nil {
+			return true
+		}
+		log.Errorf("Leadership of Lease(%s) lost, renewal failed: %v", l.name, err)
+		l.lease = nil
+	}
+
+	lease, err := l.mgr.AcquireLease(l.name, l.machID, l.ver, l.ttl)
+	if err != nil {
+		log.Errorf("Leadership acquisition of Lease(%s) failed: %v", l.name, err)
+		return false
+	} else if lease == nil {
+		return false
+	}
+	log.Infof("Leadership of Lease(%s) acquired", l.name)
+	l.lease = lease
+	return true
+}
+
+// release gives up leadership, if held
+func (l *Leader) release() {
+	if l.lease == nil {
+		return
+	}
+	if err := l.lease.Release(); err != nil {
+		log.Errorf("Failed releasing Lease(%s): %v", l.name, err)
+	}
+	l.lease = nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunPeriodicAsLeader(t *testing.T) {
+	mgr := newMemManager()
+	l := NewLeader(mgr, "gc", "XXX", 1, time.Minute)
+
+	var runs int32
+	task := func() error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+	// waitForRuns waits until the task has run more than n times
+	waitForRuns := func(n int32) {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&runs) <= n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for task to run more than %d times", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := l.RunPeriodicAsLeader(time.Hour, task, nil); err == nil {
+		t.Errorf("expected error for interval exceeding the TTL")
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- l.RunPeriodicAsLeader(5*time.Millisecond, task, stop)
+	}()
+	waitForRuns(2)
+
+	// The task does not run while leadership is held by another machine
+	mgr.hold("gc", "YYY")
+	time.Sleep(20 * time.Millisecond)
+	lost := atomic.LoadInt32(&runs)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != lost {
+		t.Errorf("task ran %d times while leadership was lost", n-lost)
+	}
+
+	// Once the other machine lets go, leadership is regained
+	mgr.hold("gc", "")
+	waitForRuns(lost)
+
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error from RunPeriodicAsLeader: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for RunPeriodicAsLeader to stop")
+	}
+	if holders := mgr.holders(); !reflect.DeepEqual(holders, []string(nil)) {
+		t.Errorf("leadership not released on stop, leases held: %v", holders)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"sort"
+	"time"
+
+	"github.com/coreos/fleet/log"
+)
+
+// AcquireLeases acquires all of the named leases, or none of them. The
+// leases are acquired one at a time in sorted order, so that callers
+// contending for overlapping sets cannot each end up waiting on a lease
+// the other holds. If any of the leases is currently held, or acquiring
+// it fails, the leases already acquired are released again before
+// returning. A nil slice is returned if the set could not be acquired
+// because of contention; an error is returned only if there is a failure
+// communicating with the Registry. On success, the leases are returned in
+// the same sorted order.
+func AcquireLeases(mgr Manager, names []string, machID string, ver int, period time.Duration) ([]Lease, error) {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+
+	leases := make([]Lease, 0, len(sorted))
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+		l, err := mgr.AcquireLease(name, machID, ver, period)
+		if err != nil || l == nil {
+			releaseAll(leases)
+			return nil, err
+		}
+		leases = append(leases, l)
+	}
+
+	return leases, nil
+}
+
+// releaseAll releases each of the given leases, logging any failures. A
+// lease which cannot be released will expire at the end of its TTL.
+func releaseAll(leases []Lease) {
+	for _, l := range leases {
+		if err := l.Release(); err != nil {
+			log.Errorf("Failed releasing partially acquired lease: %v", err)
+		}
+	}
+}
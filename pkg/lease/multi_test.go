@@ -0,0 +1,149 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memManager is a Manager holding leases in memory, recording the order
+// in which they were acquired
+type memManager struct {
+	mu       sync.Mutex
+	held     map[string]string
+	acquired []string
+}
+
+func newMemManager() *memManager {
+	return &memManager{held: make(map[string]string)}
+}
+
+func (m *memManager) GetLease(name string) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if machID, ok := m.held[name]; ok {
+		return &memLease{mgr: m, name: name, machID: machID}, nil
+	}
+	return nil, nil
+}
+
+func (m *memManager) AcquireLease(name, machID string, ver int, period time.Duration) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.held[name]; ok {
+		return nil, nil
+	}
+	m.held[name] = machID
+	m.acquired = append(m.acquired, name)
+	return &memLease{mgr: m, name: name, machID: machID}, nil
+}
+
+func (m *memManager) StealLease(name, machID string, ver int, period time.Duration, idx uint64) (Lease, error) {
+	return nil, errors.New("not implemented")
+}
+
+// hold makes the named lease held by the given machine, or by none if
+// machID is empty, as if it had changed hands behind the lessee's back
+func (m *memManager) hold(name, machID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if machID == "" {
+		delete(m.held, name)
+	} else {
+		m.held[name] = machID
+	}
+}
+
+func (m *memManager) holders() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name, machID := range m.held {
+		names = append(names, name+"="+machID)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type memLease struct {
+	mgr    *memManager
+	name   string
+	machID string
+}
+
+func (l *memLease) MachineID() string            { return l.machID }
+func (l *memLease) Version() int                 { return 0 }
+func (l *memLease) Index() uint64                { return 0 }
+func (l *memLease) TimeRemaining() time.Duration { return time.Minute }
+
+func (l *memLease) Renew(time.Duration) error {
+	l.mgr.mu.Lock()
+	defer l.mgr.mu.Unlock()
+	if l.mgr.held[l.name] != l.machID {
+		return errors.New("lease not held")
+	}
+	return nil
+}
+
+func (l *memLease) Release() error {
+	l.mgr.mu.Lock()
+	defer l.mgr.mu.Unlock()
+	if l.mgr.held[l.name] != l.machID {
+		return errors.New("lease not held")
+	}
+	delete(l.mgr.held, l.name)
+	return nil
+}
+
+func TestAcquireLeases(t *testing.T) {
+	mgr := newMemManager()
+
+	leases, err := AcquireLeases(mgr, []string{"c", "a", "b", "a"}, "XXX", 1, time.Minute)
+	if err != nil || len(leases) != 3 {
+		t.Fatalf("expected 3 leases, got %v, %v", leases, err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(mgr.acquired, want) {
+		t.Errorf("expected leases acquired in order %v, got %v", want, mgr.acquired)
+	}
+
+	// A second caller contending for part of the set gets the leases
+	// ordered before the held one, and must release them again
+	mgr.acquired = nil
+	got, err := AcquireLeases(mgr, []string{"d", "b", "0"}, "YYY", 1, time.Minute)
+	if err != nil || got != nil {
+		t.Fatalf("expected contended set not to be acquired, got %v, %v", got, err)
+	}
+	if want := []string{"0"}; !reflect.DeepEqual(mgr.acquired, want) {
+		t.Errorf("expected leases acquired in order %v, got %v", want, mgr.acquired)
+	}
+	if want := []string{"a=XXX", "b=XXX", "c=XXX"}; !reflect.DeepEqual(mgr.holders(), want) {
+		t.Errorf("expected partial set to be released, leases held: %v", mgr.holders())
+	}
+
+	// Once the first caller releases its set, the second can acquire
+	releaseAll(leases)
+	got, err = AcquireLeases(mgr, []string{"d", "b", "0"}, "YYY", 1, time.Minute)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("expected 3 leases, got %v, %v", got, err)
+	}
+	if want := []string{"0=YYY", "b=YYY", "d=YYY"}; !reflect.DeepEqual(mgr.holders(), want) {
+		t.Errorf("unexpected leases held: %v", mgr.holders())
+	}
+}
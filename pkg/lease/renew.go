@@ -0,0 +1,120 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMaxLifetimeExceeded is returned by KeepAlive once a Lease has been
+// held for the maximum lifetime allowed by its RenewalPolicy
+var ErrMaxLifetimeExceeded = errors.New("lease: maximum lifetime exceeded")
+
+// minRenewalTTL is the shortest TTL with which KeepAlive will renew a
+// Lease. etcd only honors whole seconds, and a TTL which rounds down to
+// zero would not expire at all.
+var minRenewalTTL = time.Second
+
+// RenewalPolicy controls how KeepAlive renews a Lease.
+//
+// Each renewal sets the TTL of the Lease, and the next renewal is attempted
+// once half of that TTL has elapsed, leaving the other half to absorb a
+// slow or failed renewal. The first renewal uses InitialTTL. Every
+// successful renewal multiplies the TTL by Multiplier, up to MaxTTL, so a
+// Lease which has been renewed reliably for a while will survive a
+// progressively longer pause of its holder, such as a long garbage
+// collection or an overloaded host.
+//
+// MaxLifetime bounds how long the Lease may be held in total, measured from
+// the call to KeepAlive. A renewal never extends the Lease beyond that
+// point: the TTL is shortened as the limit approaches, and no further
+// renewal is attempted once less than one second remains. This ensures a
+// misbehaving holder cannot keep the Lease indefinitely, and it lets other
+// contenders know when it will be released at the latest.
+type RenewalPolicy struct {
+	// InitialTTL is the TTL of the first renewal
+	InitialTTL time.Duration
+	// Multiplier is applied to the TTL after every successful renewal.
+	// Values of one or less keep the TTL constant.
+	Multiplier float64
+	// MaxTTL caps the TTL of any single renewal. It is ignored if zero.
+	MaxTTL time.Duration
+	// MaxLifetime caps the total time for which the Lease is renewed.
+	// It is ignored if zero.
+	MaxLifetime time.Duration
+}
+
+func (p RenewalPolicy) next(ttl time.Duration) time.Duration {
+	if p.Multiplier > 1 {
+		ttl = time.Duration(float64(ttl) * p.Multiplier)
+	}
+	if p.MaxTTL > 0 && ttl > p.MaxTTL {
+		ttl = p.MaxTTL
+	}
+	return ttl
+}
+
+// KeepAlive renews the given Lease in the background according to the given
+// RenewalPolicy. The first renewal is attempted once half of the Lease's
+// remaining time has elapsed. Renewal continues until the stop channel is
+// closed, a renewal fails or the policy's MaxLifetime is reached, at which
+// point the returned channel delivers nil, the renewal error or
+// ErrMaxLifetimeExceeded respectively. The Lease is not released when
+// renewal stops; it simply expires at the end of its last TTL.
+func KeepAlive(l Lease, p RenewalPolicy, stop <-chan struct{}) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- keepAlive(l, p, stop)
+	}()
+	return errc
+}
+
+func keepAlive(l Lease, p RenewalPolicy, stop <-chan struct{}) error {
+	var deadline time.Time
+	if p.MaxLifetime > 0 {
+		deadline = time.Now().Add(p.MaxLifetime)
+	}
+
+	ttl := p.InitialTTL
+	if p.MaxTTL > 0 && ttl > p.MaxTTL {
+		ttl = p.MaxTTL
+	}
+	wait := l.TimeRemaining() / 2
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+
+		renewal := ttl
+		if !deadline.IsZero() {
+			rem := deadline.Sub(time.Now())
+			if rem < minRenewalTTL {
+				return ErrMaxLifetimeExceeded
+			}
+			if rem < renewal {
+				renewal = rem
+			}
+		}
+
+		if err := l.Renew(renewal); err != nil {
+			return err
+		}
+		wait = renewal / 2
+		ttl = p.next(ttl)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// renewRecorder is a Lease recording the TTL of every renewal
+type renewRecorder struct {
+	Lease
+	mu   sync.Mutex
+	ttls []time.Duration
+	fail int
+}
+
+func (r *renewRecorder) Renew(ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 && len(r.ttls) == r.fail {
+		return errors.New("renewal failed")
+	}
+	r.ttls = append(r.ttls, ttl)
+	return nil
+}
+
+func (r *renewRecorder) TimeRemaining() time.Duration {
+	return 0
+}
+
+func (r *renewRecorder) renewals() []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Duration(nil), r.ttls...)
+}
+
+func TestRenewalPolicyNext(t *testing.T) {
+	p := RenewalPolicy{Multiplier: 2, MaxTTL: 5 * time.Second}
+	ttl := time.Second
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		ttl = p.next(ttl)
+		got = append(got, ttl)
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("renewal %d: got TTL %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if ttl := (RenewalPolicy{}).next(time.Second); ttl != time.Second {
+		t.Errorf("TTL changed without a multiplier: %v", ttl)
+	}
+}
+
+func TestKeepAliveMaxLifetime(t *testing.T) {
+	defer func(orig time.Duration) { minRenewalTTL = orig }(minRenewalTTL)
+	minRenewalTTL = 5 * time.Millisecond
+
+	l := &renewRecorder{}
+	p := RenewalPolicy{
+		InitialTTL:  10 * time.Millisecond,
+		Multiplier:  2,
+		MaxTTL:      40 * time.Millisecond,
+		MaxLifetime: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	select {
+	case err := <-KeepAlive(l, p, make(chan struct{})):
+		if err != ErrMaxLifetimeExceeded {
+			t.Fatalf("expected ErrMaxLifetimeExceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("renewal did not stop after max lifetime")
+	}
+
+	ttls := l.renewals()
+	if len(ttls) < 3 {
+		t.Fatalf("expected several renewals, got %v", ttls)
+	}
+	if ttls[0] != 10*time.Millisecond || ttls[1] != 20*time.Millisecond {
+		t.Errorf("TTL did not grow as expected: %v", ttls)
+	}
+	// No renewal may extend the Lease beyond its max lifetime
+	var elapsed time.Duration
+	for i, ttl := range ttls {
+		if ttl > p.MaxTTL {
+			t.Errorf("renewal %d exceeded max TTL: %v", i, ttl)
+		}
+		if i < len(ttls)-1 {
+			elapsed += ttl / 2
+		}
+	}
+	if last := ttls[len(ttls)-1]; elapsed+last > p.MaxLifetime {
+		t.Errorf("final renewal of %v after %v overran max lifetime", last, elapsed)
+	}
+	if since := time.Since(start); since < p.MaxLifetime-p.MaxTTL {
+		t.Errorf("renewal stopped early after %v", since)
+	}
+}
+
+func TestKeepAliveStop(t *testing.T) {
+	l := &renewRecorder{fail: 1}
+	p := RenewalPolicy{InitialTTL: 10 * time.Millisecond}
+	if err := <-KeepAlive(l, p, make(chan struct{})); err == nil || err == ErrMaxLifetimeExceeded {
+		t.Errorf("expected renewal error, got %v", err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := <-KeepAlive(&renewRecorder{}, p, stop); err != nil {
+		t.Errorf("unexpected error after stop: %v", err)
+	}
+}
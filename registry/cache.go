@@ -0,0 +1,232 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/log"
+	"github.com/coreos/fleet/machine"
+)
+
+// NewCachedRegistry wraps the given EtcdRegistry in a CachedRegistry. The
+// returned CachedRegistry watches the keyspace in the background until the
+// provided channel is closed.
+func NewCachedRegistry(reg *EtcdRegistry, stop <-chan struct{}) *CachedRegistry {
+	c := &CachedRegistry{
+		EtcdRegistry: reg,
+		units:        make(map[string]*job.Unit),
+	}
+	go c.watch(stop)
+	return c
+}
+
+// CachedRegistry serves Machines and Unit from an in-memory cache, falling
+// back to etcd on a miss. Cache entries are invalidated as soon as the
+// background watch observes a change to the underlying keys, so a stale
+// read can only occur within the latency of that watch. While the watch is
+// not established (e.g. at startup or while recovering from an etcd error)
+// nothing is cached and all reads go directly to etcd. All other methods
+// are passed through to the wrapped EtcdRegistry.
+type CachedRegistry struct {
+	*EtcdRegistry
+
+	mu       sync.Mutex
+	watching bool
+	// gen is incremented on every invalidation so that a read racing
+	// with an invalidation does not repopulate the cache with stale data
+	gen      uint64
+	machines []machine.MachineState
+	cachedMS bool
+	units    map[string]*job.Unit
+}
+
+func (c *CachedRegistry) Machines() ([]machine.MachineState, error) {
+	c.mu.Lock()
+	if c.cachedMS {
+		machines := copyMachineStates(c.machines)
+		c.mu.Unlock()
+		return machines, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	machines, err := c.EtcdRegistry.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.watching && c.gen == gen {
+		c.machines = copyMachineStates(machines)
+		c.cachedMS = true
+	}
+	c.mu.Unlock()
+
+	return machines, nil
+}
+
+func (c *CachedRegistry) Unit(name string) (*job.Unit, error) {
+	c.mu.Lock()
+	if u, ok := c.units[name]; ok {
+		c.mu.Unlock()
+		return copyUnit(u), nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	u, err := c.EtcdRegistry.Unit(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.watching && c.gen == gen {
+		c.units[name] = copyUnit(u)
+	}
+	c.mu.Unlock()
+
+	return u, nil
+}
+
+// invalidate drops any cache entries affected by a change to the given key
+func (c *CachedRegistry) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	rel := strings.TrimPrefix(key, c.prefixed())
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
+	switch {
+	case parts[0] == machinePrefix:
+		c.machines = nil
+		c.cachedMS = false
+	case parts[0] == jobPrefix && len(parts) > 1:
+		delete(c.units, parts[1])
+	case parts[0] == jobPrefix, parts[0] == "":
+		c.unsafeFlush()
+	}
+}
+
+// flush drops all cache entries and stops further caching until the
+// background watch is reestablished
+func (c *CachedRegistry) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.watching = false
+	c.unsafeFlush()
+}
+
+func (c *CachedRegistry) unsafeFlush() {
+	c.machines = nil
+	c.cachedMS = false
+	c.units = make(map[string]*job.Unit)
+}
+
+func (c *CachedRegistry) watch(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	key := c.prefixed()
+	for {
+		select {
+		case <-stop:
+			log.Debugf("Gracefully closing cache watch loop: key=%s", key)
+			c.flush()
+			return
+		default:
+		}
+
+		// Determine the index from which to watch before permitting any
+		// caching, so no change can slip in between a read and the watch
+		idx, err := c.CurrentIndex()
+		if err != nil {
+			log.Errorf("Failed determining etcd index for cache watch: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		watcher := c.kAPI.Watcher(key, &etcd.WatcherOptions{AfterIndex: idx, Recursive: true})
+		c.mu.Lock()
+		c.gen++
+		c.watching = true
+		c.mu.Unlock()
+
+		for {
+			res, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("etcd watcher %v returned error: %v", key, err)
+				}
+				c.flush()
+				break
+			}
+			if res.Node != nil {
+				c.invalidate(res.Node.Key)
+			}
+		}
+
+		select {
+		case <-stop:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func copyMachineStates(machines []machine.MachineState) []machine.MachineState {
+	if machines == nil {
+		return nil
+	}
+	cp := make([]machine.MachineState, len(machines))
+	copy(cp, machines)
+	for i, ms := range machines {
+		if ms.Metadata != nil {
+			cp[i].Metadata = make(map[string]string, len(ms.Metadata))
+			for k, v := range ms.Metadata {
+				cp[i].Metadata[k] = v
+			}
+		}
+		if ms.Roles != nil {
+			cp[i].Roles = make([]string, len(ms.Roles))
+			copy(cp[i].Roles, ms.Roles)
+		}
+	}
+	return cp
+}
+
+func copyUnit(u *job.Unit) *job.Unit {
+	if u == nil {
+		return nil
+	}
+	cp := *u
+	if u.Annotations != nil {
+		cp.Annotations = make(map[string]string, len(u.Annotations))
+		for k, v := range u.Annotations {
+			cp.Annotations[k] = v
+		}
+	}
+	return &cp
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+// waitForCache repeatedly calls fn until it returns true or the watch
+// latency budget is exhausted
+func waitForCache(t *testing.T, desc string, fn func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache was not invalidated in time: %s", desc)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedRegistryInvalidation(t *testing.T) {
+	e := newMemKeysAPI()
+	writer := NewEtcdRegistry(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	c := NewCachedRegistry(NewEtcdRegistry(e, "/fleet/", time.Second), stop)
+
+	// Wait for the background watch to be established
+	waitForCache(t, "watch established", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.watching
+	})
+
+	if _, err := writer.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute); err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+	machines, err := c.Machines()
+	if err != nil || len(machines) != 1 {
+		t.Fatalf("unexpected result from Machines: %v, %v", machines, err)
+	}
+
+	// A cached read must not touch etcd
+	e.Lock()
+	gets := e.gets
+	e.Unlock()
+	if _, err = c.Machines(); err != nil {
+		t.Fatalf("unexpected error from Machines: %v", err)
+	}
+	e.Lock()
+	if e.gets != gets {
+		t.Errorf("cached read of Machines hit etcd")
+	}
+	e.Unlock()
+
+	// A write by another client must invalidate the cache
+	if _, err := writer.SetMachineState(machine.MachineState{ID: "YYY"}, time.Minute); err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+	waitForCache(t, "machine added", func() bool {
+		machines, _ := c.Machines()
+		return len(machines) == 2
+	})
+
+	uf, _ := unit.NewUnitFile("[Service]\nExecStart=/bin/true\n")
+	u := job.Unit{Name: "foo.service", Unit: *uf, TargetState: job.JobStateInactive}
+	if got, err := c.Unit("foo.service"); err != nil || got != nil {
+		t.Fatalf("unexpected result from Unit: %v, %v", got, err)
+	}
+	if err := writer.CreateUnit(&u); err != nil {
+		t.Fatalf("unexpected error from CreateUnit: %v", err)
+	}
+	waitForCache(t, "unit created", func() bool {
+		got, _ := c.Unit("foo.service")
+		return got != nil && got.TargetState == job.JobStateInactive
+	})
+
+	if err := writer.SetUnitTargetState("foo.service", job.JobStateLaunched); err != nil {
+		t.Fatalf("unexpected error from SetUnitTargetState: %v", err)
+	}
+	waitForCache(t, "target state changed", func() bool {
+		got, _ := c.Unit("foo.service")
+		return got != nil && got.TargetState == job.JobStateLaunched
+	})
+
+	if err := writer.DestroyUnit("foo.service"); err != nil {
+		t.Fatalf("unexpected error from DestroyUnit: %v", err)
+	}
+	waitForCache(t, "unit destroyed", func() bool {
+		got, _ := c.Unit("foo.service")
+		return got == nil
+	})
+}
+
+func TestCachedRegistryMachinesCopied(t *testing.T) {
+	e := newMemKeysAPI()
+	stop := make(chan struct{})
+	defer close(stop)
+	c := NewCachedRegistry(NewEtcdRegistry(e, "/fleet/", time.Second), stop)
+	waitForCache(t, "watch established", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.watching
+	})
+
+	ms := machine.MachineState{ID: "XXX", Metadata: map[string]string{"region": "us-east"}, Roles: []string{"web"}}
+	if _, err := c.SetMachineState(ms, time.Minute); err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+
+	// Mutating the result of one read must not affect later ones, whether
+	// the first populated the cache or was served from it
+	for i := 0; i < 2; i++ {
+		machines, err := c.Machines()
+		if err != nil || len(machines) != 1 {
+			t.Fatalf("unexpected result from Machines: %v, %v", machines, err)
+		}
+		machines[0].Metadata["region"] = "us-west"
+		machines[0].Roles[0] = "db"
+	}
+	machines, err := c.Machines()
+	if err != nil || len(machines) != 1 {
+		t.Fatalf("unexpected result from Machines: %v, %v", machines, err)
+	}
+	if machines[0].Metadata["region"] != "us-east" || machines[0].Roles[0] != "web" {
+		t.Errorf("cached MachineState modified through a previous read: %#v", machines[0])
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/job"
+)
+
+// ClaimUnitIfState claims the named Unit for the holder described by context,
+// such as the name of a recovery controller, but only if the Unit is
+// currently in the required JobState; an unscheduled Unit, or one whose
+// machine has not reported its state, is inactive. Only one holder can
+// claim a Unit at a time, so of several controllers reacting to the same
+// Unit only one takes it over. The claim lapses after the given TTL,
+// unless it is zero, or is released earlier with ReleaseUnitClaim. False is
+// returned if the Unit is not in the required state or is already claimed.
+// As the claim cannot be taken in the same write as the state is read,
+// the state is checked again once claimed, and the claim withdrawn if the
+// state changed in the meantime.
+func (r *EtcdRegistry) ClaimUnitIfState(name string, requiredState job.JobState, context string, ttl time.Duration) (bool, error) {
+	inState := func() (bool, error) {
+		u, js, err := r.UnitWithState(name)
+		if err != nil {
+			return false, err
+		}
+		if u == nil {
+			return false, errors.New("job does not exist")
+		}
+		state := job.JobStateInactive
+		if js != nil {
+			state = *js
+		}
+		return state == requiredState, nil
+	}
+
+	if ok, err := inState(); err != nil || !ok {
+		return false, err
+	}
+
+	key := r.jobClaimPath(name)
+	opts := &etcd.SetOptions{
+		PrevExist: etcd.PrevNoExist,
+		TTL:       ttl,
+	}
+	res, err := r.kAPI.Set(r.ctx(), key, context, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeNodeExist) {
+			return false, nil
+		}
+		return false, keyCollisionError(err, key)
+	}
+
+	ok, err := inState()
+	if err == nil && ok {
+		return true, nil
+	}
+	dopts := &etcd.DeleteOptions{
+		PrevIndex: res.Node.ModifiedIndex,
+	}
+	if _, derr := r.kAPI.Delete(r.ctx(), key, dopts); derr != nil && !isEtcdError(derr, etcd.ErrorCodeKeyNotFound) && !isEtcdError(derr, etcd.ErrorCodeTestFailed) {
+		return false, keyCollisionError(derr, key)
+	}
+	return false, err
+}
+
+// UnitClaim returns the context of the holder of the named Unit's claim, or
+// an empty string if the Unit is not claimed
+func (r *EtcdRegistry) UnitClaim(name string) (string, error) {
+	holder, _, err := r.getRaw(r.jobClaimPath(name))
+	return holder, err
+}
+
+// ReleaseUnitClaim releases a claim taken with ClaimUnitIfState. The claim is
+// only released if it is still held by the given context; releasing a
+// claim which has lapsed or been taken by another holder has no effect.
+func (r *EtcdRegistry) ReleaseUnitClaim(name, context string) error {
+	key := r.jobClaimPath(name)
+	opts := &etcd.DeleteOptions{
+		PrevValue: context,
+	}
+	_, err := r.kAPI.Delete(r.ctx(), key, opts)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) || isEtcdError(err, etcd.ErrorCodeTestFailed) {
+		err = nil
+	}
+	return keyCollisionError(err, key)
+}
+
+func (r *EtcdRegistry) jobClaimPath(jobName string) string {
+	return r.prefixed(jobPrefix, jobName, "claim")
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/unit"
+)
+
+func TestClaimUnitIfState(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "dead.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "running.service", ""), "XXX")
+	r.SaveUnitState("running.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+	if err := r.UnitHeartbeat("running.service", "XXX", time.Minute); err != nil {
+		t.Fatalf("unexpected error from UnitHeartbeat: %v", err)
+	}
+
+	// A Unit in the wrong state is not claimed
+	if ok, err := r.ClaimUnitIfState("running.service", job.JobStateInactive, "recovery-a", time.Minute); err != nil || ok {
+		t.Errorf("unexpected result claiming launched Unit: %v, %v", ok, err)
+	}
+	if holder, err := r.UnitClaim("running.service"); err != nil || holder != "" {
+		t.Errorf("unexpected claim of launched Unit: %q, %v", holder, err)
+	}
+
+	// Only one of several holders claims a Unit
+	if ok, err := r.ClaimUnitIfState("dead.service", job.JobStateInactive, "recovery-a", time.Minute); err != nil || !ok {
+		t.Fatalf("unexpected result claiming inactive Unit: %v, %v", ok, err)
+	}
+	if ok, err := r.ClaimUnitIfState("dead.service", job.JobStateInactive, "recovery-b", time.Minute); err != nil || ok {
+		t.Errorf("unexpected result claiming claimed Unit: %v, %v", ok, err)
+	}
+	if holder, err := r.UnitClaim("dead.service"); err != nil || holder != "recovery-a" {
+		t.Errorf("unexpected claim of inactive Unit: %q, %v", holder, err)
+	}
+
+	// A claim is only released by its holder
+	if err := r.ReleaseUnitClaim("dead.service", "recovery-b"); err != nil {
+		t.Fatalf("unexpected error from ReleaseUnitClaim: %v", err)
+	}
+	if holder, _ := r.UnitClaim("dead.service"); holder != "recovery-a" {
+		t.Errorf("claim released by another holder, now held by %q", holder)
+	}
+	if err := r.ReleaseUnitClaim("dead.service", "recovery-a"); err != nil {
+		t.Fatalf("unexpected error from ReleaseUnitClaim: %v", err)
+	}
+	if ok, err := r.ClaimUnitIfState("dead.service", job.JobStateInactive, "recovery-b", time.Minute); err != nil || !ok {
+		t.Errorf("unexpected result claiming released Unit: %v, %v", ok, err)
+	}
+
+	if _, err := r.ClaimUnitIfState("missing.service", job.JobStateInactive, "recovery-a", time.Minute); err == nil {
+		t.Errorf("expected error claiming nonexistent Unit")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/log"
+)
+
+// ClusterState summarizes the contents of the Registry
+type ClusterState struct {
+	// Machines is the number of machines present in the cluster
+	Machines int
+	// Units is the number of Units in the Registry, including global
+	// Units
+	Units int
+	// ActiveStates counts the UnitStates reported by machines by their
+	// ActiveState, e.g. "active" or "failed"
+	ActiveStates map[string]int
+	// Orphaned is the number of Units scheduled to machines which are no
+	// longer present, as returned by OrphanedUnits
+	Orphaned int
+}
+
+// ClusterSummary returns a ClusterState describing the current contents of
+// the Registry
+func (r *EtcdRegistry) ClusterSummary() (*ClusterState, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+	states, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &ClusterState{
+		Machines:     len(machines),
+		Units:        len(units),
+		ActiveStates: make(map[string]int),
+	}
+	for _, us := range states {
+		cs.ActiveStates[us.ActiveState]++
+	}
+	for _, orphans := range orphanedUnits(units, sUnits, machines) {
+		cs.Orphaned += len(orphans)
+	}
+	return cs, nil
+}
+
+// WatchClusterState returns a channel emitting a ClusterState as soon as it
+// is called, and again at every interval, until stop is closed. In between,
+// the Registry is watched for changes, and a new ClusterState is emitted
+// whenever the summary changes. Changes made while a summary is being
+// computed are coalesced into a single recomputation. A summary which
+// cannot be computed is skipped.
+func (r *EtcdRegistry) WatchClusterState(interval time.Duration, stop <-chan struct{}) <-chan ClusterState {
+	stop = r.watchStop(stop)
+	out := make(chan ClusterState)
+	q := r.newWatchQueue("cluster-state", stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(ClusterState):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+
+	changed := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.watchPrefix(r.prefixed(), stop, func(*etcd.Response) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last *ClusterState
+		emit := func(always bool) {
+			cs, err := r.ClusterSummary()
+			if err != nil {
+				log.Errorf("Failed summarizing cluster state: %v", err)
+				return
+			}
+			if always || last == nil || !reflect.DeepEqual(cs, last) {
+				q.push(*cs)
+				last = cs
+			}
+		}
+
+		emit(true)
+		for {
+			select {
+			case <-ticker.C:
+				emit(true)
+			case <-changed:
+				emit(false)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		q.close(func() { close(out) })
+	}()
+
+	return out
+}
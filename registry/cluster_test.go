@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func nextClusterState(t *testing.T, ch <-chan ClusterState) ClusterState {
+	select {
+	case cs := <-ch:
+		return cs
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for ClusterState")
+	}
+	return ClusterState{}
+}
+
+func TestWatchClusterState(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// The interval is long enough that every update must be driven by a
+	// change
+	ch := r.WatchClusterState(time.Hour, stop)
+	want := ClusterState{Machines: 1, ActiveStates: map[string]int{}}
+	if cs := nextClusterState(t, ch); !reflect.DeepEqual(cs, want) {
+		t.Errorf("got initial ClusterState %#v, want %#v", cs, want)
+	}
+	e.waitForWatchers(t, 1)
+
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	r.SaveUnitState("a.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "YYY")
+
+	want = ClusterState{Machines: 1, Units: 2, ActiveStates: map[string]int{"active": 1}, Orphaned: 1}
+	for {
+		cs := nextClusterState(t, ch)
+		if reflect.DeepEqual(cs, want) {
+			break
+		}
+		if cs.Units > want.Units || cs.Orphaned > want.Orphaned {
+			t.Fatalf("unexpected ClusterState %#v, want %#v", cs, want)
+		}
+	}
+
+	// A change which leaves the summary as it was emits nothing
+	r.SaveUnitState("a.service", unit.NewUnitState("loaded", "active", "exited", "XXX"), time.Minute)
+	select {
+	case cs := <-ch:
+		t.Errorf("unexpected ClusterState after unsummarized change: %#v", cs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"path"
+	"sort"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+)
+
+// UnitMachine identifies a Unit in relation to a particular machine
+type UnitMachine struct {
+	Name      string
+	MachineID string
+}
+
+// ConsistencyReport describes disagreements between the schedule and the
+// UnitStates reported by machines. Global Units have no schedule and are
+// therefore never reported. All lists are sorted by Unit name, and then
+// by machine ID.
+type ConsistencyReport struct {
+	// ScheduledWithoutState lists Units scheduled to a machine which has
+	// not reported any state for them
+	ScheduledWithoutState []UnitMachine
+	// StateWithoutSchedule lists UnitStates reported by machines to which
+	// the Unit is not scheduled, including those for Units which are not
+	// scheduled at all
+	StateWithoutSchedule []UnitMachine
+	// MultipleMachines lists the names of Units for which state has been
+	// reported by more than one machine
+	MultipleMachines []string
+}
+
+// Consistent returns true if the report found no problems
+func (cr *ConsistencyReport) Consistent() bool {
+	return len(cr.ScheduledWithoutState) == 0 && len(cr.StateWithoutSchedule) == 0 && len(cr.MultipleMachines) == 0
+}
+
+// CheckConsistency compares the schedule against the UnitStates reported by
+// machines and returns a report of any discrepancies. The Registry is not
+// modified. As machines only report state periodically, a Unit which was
+// scheduled or unscheduled very recently may briefly appear in the report.
+func (r *EtcdRegistry) CheckConsistency() (*ConsistencyReport, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	states, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+
+	global := make(map[string]bool)
+	for _, u := range units {
+		if u.IsGlobal() {
+			global[u.Name] = true
+		}
+	}
+	targets := make(map[string]string)
+	for _, su := range sUnits {
+		if su.TargetMachineID != "" {
+			targets[su.Name] = su.TargetMachineID
+		}
+	}
+
+	var keys MUSKeys
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+
+	cr := &ConsistencyReport{}
+	reporters := make(map[string]int)
+	for _, key := range keys {
+		if global[key.name] {
+			continue
+		}
+		reporters[key.name]++
+		if reporters[key.name] == 2 {
+			cr.MultipleMachines = append(cr.MultipleMachines, key.name)
+		}
+		if targets[key.name] != key.machID {
+			cr.StateWithoutSchedule = append(cr.StateWithoutSchedule, UnitMachine{Name: key.name, MachineID: key.machID})
+		}
+	}
+
+	// Schedule is already ordered by name
+	for _, su := range sUnits {
+		if su.TargetMachineID == "" || global[su.Name] {
+			continue
+		}
+		if _, ok := states[MUSKey{name: su.Name, machID: su.TargetMachineID}]; !ok {
+			cr.ScheduledWithoutState = append(cr.ScheduledWithoutState, UnitMachine{Name: su.Name, MachineID: su.TargetMachineID})
+		}
+	}
+
+	return cr, nil
+}
+
+// StuckUnits returns the ScheduledUnits which are meant to be launched but
+// whose target machine has not reported them running, despite having been
+// scheduled to it for longer than the given threshold. This includes Units
+// for which the machine has reported no state at all. Units with no
+// recorded scheduling time are never reported, as it cannot be determined
+// how long they have been stuck.
+func (r *EtcdRegistry) StuckUnits(threshold time.Duration) ([]job.ScheduledUnit, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	states, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+
+	launched := make(map[string]bool)
+	for _, u := range units {
+		if !u.IsGlobal() && u.TargetState == job.JobStateLaunched {
+			launched[u.Name] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-threshold)
+	var stuck []job.ScheduledUnit
+	for _, su := range sUnits {
+		if !launched[su.Name] || su.TargetMachineID == "" || su.ScheduledAt.IsZero() || su.ScheduledAt.After(cutoff) {
+			continue
+		}
+		us := states[MUSKey{name: su.Name, machID: su.TargetMachineID}]
+		if us == nil || us.SubState != "running" {
+			stuck = append(stuck, su)
+		}
+	}
+	return stuck, nil
+}
+
+// OrphanedUnits returns the Units scheduled to machines which are no longer
+// present in the cluster, i.e. whose machine state has expired or was never
+// published, indexed by the ID of the absent machine. These are the Units
+// the engine will reschedule once it notices the machines are gone. The
+// Units for each machine are sorted by name. The Registry is not modified.
+func (r *EtcdRegistry) OrphanedUnits() (map[string][]job.Unit, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+	return orphanedUnits(units, sUnits, machines), nil
+}
+
+// orphanedUnits finds the orphaned Units, as described by OrphanedUnits,
+// among the given contents of the Registry
+func orphanedUnits(units []job.Unit, sUnits []job.ScheduledUnit, machines []machine.MachineState) map[string][]job.Unit {
+	present := make(map[string]bool, len(machines))
+	for _, ms := range machines {
+		present[ms.ID] = true
+	}
+	byName := make(map[string]job.Unit, len(units))
+	for _, u := range units {
+		byName[u.Name] = u
+	}
+
+	orphans := make(map[string][]job.Unit)
+	// Schedule is sorted by Unit name, so each list is too
+	for _, su := range sUnits {
+		if su.TargetMachineID == "" || present[su.TargetMachineID] {
+			continue
+		}
+		if u, ok := byName[su.Name]; ok {
+			orphans[su.TargetMachineID] = append(orphans[su.TargetMachineID], u)
+		}
+	}
+	return orphans
+}
+
+// UnitsOnUnknownMachines returns the Units scheduled to machines which have
+// never been part of the cluster, indexed by the ID of the unknown machine.
+// Unlike OrphanedUnits, machines whose state has merely expired are not
+// included: a machine is known once it has published its state, as the
+// Registry keeps a machine's namespace after its state expires. A Unit
+// scheduled to an unknown machine therefore points to a bug or a manual
+// edit of the schedule rather than a machine failure. The Units for each
+// machine are sorted by name. The Registry is not modified.
+func (r *EtcdRegistry) UnitsOnUnknownMachines() (map[string][]job.Unit, error) {
+	known, err := r.knownMachines()
+	if err != nil {
+		return nil, err
+	}
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]job.Unit, len(units))
+	for _, u := range units {
+		byName[u.Name] = u
+	}
+
+	unknown := make(map[string][]job.Unit)
+	// Schedule is sorted by Unit name, so each list is too
+	for _, su := range sUnits {
+		if su.TargetMachineID == "" || known[su.TargetMachineID] {
+			continue
+		}
+		if u, ok := byName[su.Name]; ok {
+			unknown[su.TargetMachineID] = append(unknown[su.TargetMachineID], u)
+		}
+	}
+	return unknown, nil
+}
+
+// UnitsEligibleForCleanup returns the launched Units which have opted into
+// removal with the RemoveAfter option and whose target machine has reported
+// them dead, having been active, for at least that long as of the given
+// time, sorted by name. Units which were loaded but never ran are not
+// eligible, although they report the same state. A cleanup loop can
+// destroy the Units returned; the Registry is not modified. Failed Units
+// are never eligible, so they remain for inspection, and neither are
+// global Units, which have no single machine to report them dead.
+func (r *EtcdRegistry) UnitsEligibleForCleanup(now time.Time) ([]job.Unit, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make(map[string]string, len(sUnits))
+	for _, su := range sUnits {
+		scheduled[su.Name] = su.TargetMachineID
+	}
+
+	var eligible []job.Unit
+	for _, u := range units {
+		removeAfter := u.RemoveAfter()
+		if removeAfter == 0 || u.IsGlobal() || u.TargetState != job.JobStateLaunched {
+			continue
+		}
+		machID := scheduled[u.Name]
+		if machID == "" {
+			continue
+		}
+		usm, err := r.unitStateModel(r.unitStatePath(machID, u.Name))
+		if err != nil {
+			return nil, err
+		}
+		if usm == nil || !usm.dead() || usm.DeadSince == nil || now.Sub(*usm.DeadSince) < removeAfter {
+			continue
+		}
+		eligible = append(eligible, u)
+	}
+	return eligible, nil
+}
+
+// knownMachines returns the IDs of all machines which have a namespace in
+// the Registry, whether or not their state is still present
+func (r *EtcdRegistry) knownMachines() (map[string]bool, error) {
+	res, err := r.kAPI.Get(r.ctx(), r.prefixed(machinePrefix), nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return map[string]bool{}, err
+	}
+	known := make(map[string]bool, len(res.Node.Nodes))
+	for _, node := range res.Node.Nodes {
+		known[path.Base(node.Key)] = true
+	}
+	return known, nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	cr, err := r.CheckConsistency()
+	if err != nil || !cr.Consistent() {
+		t.Fatalf("unexpected result for empty Registry: %#v, %v", cr, err)
+	}
+
+	saveState := func(name, machID string) {
+		r.SaveUnitState(name, unit.NewUnitState("loaded", "active", "running", machID), time.Minute)
+	}
+
+	// Consistent
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	saveState("a.service", "XXX")
+	// Scheduled, but no state reported
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "XXX")
+	// State reported, but not scheduled
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "")
+	saveState("c.service", "YYY")
+	// State reported by the target and another machine
+	addTestUnit(t, r, newTestUnit(t, "d.service", ""), "XXX")
+	saveState("d.service", "XXX")
+	saveState("d.service", "YYY")
+	// Global Units are never scheduled
+	addTestUnit(t, r, newTestUnit(t, "e.service", "[X-Fleet]\nGlobal=true\n"), "")
+	saveState("e.service", "XXX")
+	saveState("e.service", "YYY")
+
+	before, _ := r.DumpKeys()
+	cr, err = r.CheckConsistency()
+	if err != nil {
+		t.Fatalf("unexpected error from CheckConsistency: %v", err)
+	}
+	want := &ConsistencyReport{
+		ScheduledWithoutState: []UnitMachine{{"b.service", "XXX"}},
+		StateWithoutSchedule:  []UnitMachine{{"c.service", "YYY"}, {"d.service", "YYY"}},
+		MultipleMachines:      []string{"d.service"},
+	}
+	if !reflect.DeepEqual(want, cr) {
+		t.Errorf("unexpected ConsistencyReport:\nwant %#v\ngot  %#v", want, cr)
+	}
+	if cr.Consistent() {
+		t.Errorf("inconsistent Registry reported as consistent")
+	}
+
+	after, _ := r.DumpKeys()
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("CheckConsistency modified the Registry")
+	}
+}
+
+func TestStuckUnits(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	long := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	scheduledLongAgo := func(name string) {
+		e.Set(nil, "/fleet/job/"+name+"/scheduled-at", long, nil)
+	}
+	saveState := func(name, sub string) {
+		r.SaveUnitState(name, unit.NewUnitState("loaded", "active", sub, "XXX"), time.Minute)
+	}
+
+	// Stuck in loaded
+	addTestUnit(t, r, newTestUnit(t, "loaded.service", ""), "XXX")
+	scheduledLongAgo("loaded.service")
+	saveState("loaded.service", "dead")
+	// Never reported at all
+	addTestUnit(t, r, newTestUnit(t, "silent.service", ""), "XXX")
+	scheduledLongAgo("silent.service")
+	// Running as expected
+	addTestUnit(t, r, newTestUnit(t, "running.service", ""), "XXX")
+	scheduledLongAgo("running.service")
+	saveState("running.service", "running")
+	// Not yet past the threshold
+	addTestUnit(t, r, newTestUnit(t, "recent.service", ""), "XXX")
+	// Not meant to be running
+	u := newTestUnit(t, "idle.service", "")
+	u.TargetState = job.JobStateLoaded
+	addTestUnit(t, r, u, "XXX")
+	scheduledLongAgo("idle.service")
+	// Scheduled before scheduling times were recorded
+	addTestUnit(t, r, newTestUnit(t, "old.service", ""), "")
+	e.Set(nil, "/fleet/job/old.service/target", "XXX", nil)
+
+	stuck, err := r.StuckUnits(10 * time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from StuckUnits: %v", err)
+	}
+	var got []string
+	for _, su := range stuck {
+		got = append(got, su.Name)
+	}
+	if want := []string{"loaded.service", "silent.service"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected stuck Units: got %v, want %v", got, want)
+	}
+}
+
+func TestOrphanedUnits(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+
+	addTestUnit(t, r, newTestUnit(t, "alive.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "ZZZ")
+	addTestUnit(t, r, newTestUnit(t, "unscheduled.service", ""), "")
+
+	orphans, err := r.OrphanedUnits()
+	if err != nil {
+		t.Fatalf("unexpected error from OrphanedUnits: %v", err)
+	}
+	got := make(map[string][]string)
+	for machID, units := range orphans {
+		for _, u := range units {
+			got[machID] = append(got[machID], u.Name)
+		}
+	}
+	want := map[string][]string{
+		"YYY": []string{"a.service", "b.service"},
+		"ZZZ": []string{"c.service"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected orphaned Units: got %v, want %v", got, want)
+	}
+}
+
+func TestUnitsOnUnknownMachines(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	// YYY has died, which is not the concern of this check
+	e.expire("/fleet/machines/YYY/object")
+
+	addTestUnit(t, r, newTestUnit(t, "alive.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "dead.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "BOGUS")
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "BOGUS")
+	addTestUnit(t, r, newTestUnit(t, "unscheduled.service", ""), "")
+
+	units, err := r.UnitsOnUnknownMachines()
+	if err != nil {
+		t.Fatalf("unexpected error from UnitsOnUnknownMachines: %v", err)
+	}
+	got := make(map[string][]string)
+	for machID, us := range units {
+		for _, u := range us {
+			got[machID] = append(got[machID], u.Name)
+		}
+	}
+	want := map[string][]string{
+		"BOGUS": []string{"a.service", "b.service"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected Units on unknown machines: got %v, want %v", got, want)
+	}
+
+	// The dead machine is still reported as orphaning its Units
+	orphans, err := r.OrphanedUnits()
+	if err != nil {
+		t.Fatalf("unexpected error from OrphanedUnits: %v", err)
+	}
+	if len(orphans["YYY"]) != 1 || len(orphans["BOGUS"]) != 2 {
+		t.Errorf("unexpected orphaned Units: %v", orphans)
+	}
+}
+
+func TestUnitsEligibleForCleanup(t *testing.T) {
+	mk := NewMetricsKeysAPI(newMemKeysAPI())
+	r := NewEtcdRegistry(mk, "/fleet/", time.Second)
+	running := func(machID string) *unit.UnitState {
+		return unit.NewUnitState("loaded", "active", "running", machID)
+	}
+	for _, tt := range []struct {
+		name     string
+		contents string
+		machID   string
+		target   job.JobState
+		states   []*unit.UnitState
+	}{
+		{"batch.service", "[X-Fleet]\nRemoveAfter=1h\n", "XXX", job.JobStateLaunched, []*unit.UnitState{running("XXX"), unit.NewUnitState("loaded", "inactive", "dead", "XXX")}},
+		{"later.service", "[X-Fleet]\nRemoveAfter=3h\n", "XXX", job.JobStateLaunched, []*unit.UnitState{running("XXX"), unit.NewUnitState("loaded", "inactive", "dead", "XXX")}},
+		{"kept.service", "", "XXX", job.JobStateLaunched, []*unit.UnitState{running("XXX"), unit.NewUnitState("loaded", "inactive", "dead", "XXX")}},
+		{"failed.service", "[X-Fleet]\nRemoveAfter=1h\n", "XXX", job.JobStateLaunched, []*unit.UnitState{running("XXX"), unit.NewUnitState("loaded", "failed", "failed", "XXX")}},
+		{"running.service", "[X-Fleet]\nRemoveAfter=1h\n", "XXX", job.JobStateLaunched, []*unit.UnitState{running("XXX")}},
+		{"unscheduled.service", "[X-Fleet]\nRemoveAfter=1h\n", "", job.JobStateLaunched, nil},
+		// Loaded units report the same state as finished ones
+		{"neverran.service", "[X-Fleet]\nRemoveAfter=1h\n", "XXX", job.JobStateLaunched, []*unit.UnitState{unit.NewUnitState("loaded", "inactive", "dead", "XXX")}},
+		{"loaded.service", "[X-Fleet]\nRemoveAfter=1h\n", "XXX", job.JobStateLoaded, []*unit.UnitState{running("XXX"), unit.NewUnitState("loaded", "inactive", "dead", "XXX")}},
+	} {
+		u := newTestUnit(t, tt.name, tt.contents)
+		u.TargetState = tt.target
+		addTestUnit(t, r, u, tt.machID)
+		gets := mk.RequestStats()["get"].Requests
+		for _, us := range tt.states {
+			r.SaveUnitState(tt.name, us, 24*time.Hour)
+		}
+		// Publishing UnitStates never reads them back
+		if n := mk.RequestStats()["get"].Requests - gets; n != 0 {
+			t.Errorf("expected no reads while saving UnitStates of %s, got %d", tt.name, n)
+		}
+	}
+
+	names := func(now time.Time) []string {
+		units, err := r.UnitsEligibleForCleanup(now)
+		if err != nil {
+			t.Fatalf("unexpected error from UnitsEligibleForCleanup: %v", err)
+		}
+		var names []string
+		for _, u := range units {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+	if got := names(time.Now()); len(got) != 0 {
+		t.Errorf("Units eligible for cleanup as soon as they are dead: %v", got)
+	}
+
+	// Republishing a dead state does not reset how long it has been dead,
+	// even from a Registry which did not see the Unit run, such as that of
+	// a restarted agent
+	r = NewEtcdRegistry(mk, "/fleet/", time.Second)
+	r.SaveUnitState("batch.service", unit.NewUnitState("loaded", "inactive", "dead", "XXX"), 24*time.Hour)
+	if got, want := names(time.Now().Add(2*time.Hour)), []string{"batch.service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Units eligible for cleanup %v, want %v", got, want)
+	}
+
+	// A Unit passing through other states on its way to dead still ran
+	for _, us := range []*unit.UnitState{
+		running("XXX"),
+		unit.NewUnitState("loaded", "deactivating", "stop", "XXX"),
+		unit.NewUnitState("loaded", "inactive", "dead", "XXX"),
+	} {
+		r.SaveUnitState("neverran.service", us, 24*time.Hour)
+	}
+	if got, want := names(time.Now().Add(2*time.Hour)), []string{"batch.service", "neverran.service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Units eligible for cleanup %v, want %v", got, want)
+	}
+	r.RemoveUnitState("neverran.service")
+
+	// A Unit which ran again is dead anew once it finishes
+	r.SaveUnitState("batch.service", unit.NewUnitState("loaded", "active", "running", "XXX"), 24*time.Hour)
+	if got := names(time.Now().Add(2 * time.Hour)); len(got) != 0 {
+		t.Errorf("running Units eligible for cleanup: %v", got)
+	}
+	if err := r.SaveUnitStateIfNewer("batch.service", unit.NewUnitState("loaded", "inactive", "dead", "XXX"), time.Now(), 24*time.Hour); err != nil {
+		t.Fatalf("unexpected error from SaveUnitStateIfNewer: %v", err)
+	}
+	if got, want := names(time.Now().Add(4*time.Hour)), []string{"batch.service", "later.service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Units eligible for cleanup %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"strconv"
+)
+
+const (
+	counterPrefix = "counters"
+)
+
+// IncrementCounter atomically increments the named counter and returns its
+// new value. A counter which does not yet exist starts at zero, so the first
+// call returns 1. No two callers will ever receive the same value from the
+// same counter.
+func (r *EtcdRegistry) IncrementCounter(name string) (uint64, error) {
+	key := r.prefixed(counterPrefix, name)
+	for {
+		val, idx, err := r.getRaw(key)
+		if err != nil {
+			return 0, err
+		}
+
+		var n uint64
+		if val != "" {
+			if n, err = strconv.ParseUint(val, 10, 64); err != nil {
+				return 0, &ParseError{Key: key, Err: err}
+			}
+		}
+		n++
+
+		_, err = r.setAtIndex(key, strconv.FormatUint(n, 10), idx)
+		if err == nil {
+			return n, nil
+		} else if err != ErrIndexMismatch {
+			return 0, err
+		}
+		// Another caller incremented the counter first, try again
+	}
+}
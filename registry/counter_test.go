@@ -0,0 +1,64 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncrementCounterConcurrent(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	const callers, calls = 8, 25
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				n, err := r.IncrementCounter("ids")
+				if err != nil {
+					t.Errorf("unexpected error from IncrementCounter: %v", err)
+					return
+				}
+				mu.Lock()
+				if seen[n] {
+					t.Errorf("value %d returned more than once", n)
+				}
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for n := uint64(1); n <= callers*calls; n++ {
+		if !seen[n] {
+			t.Errorf("value %d never returned", n)
+		}
+	}
+	if len(seen) != callers*calls {
+		t.Errorf("expected %d values, got %d", callers*calls, len(seen))
+	}
+
+	// Counters are independent of each other
+	if n, err := r.IncrementCounter("other"); err != nil || n != 1 {
+		t.Errorf("unexpected result from fresh counter: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+// DumpKeys recursively lists everything stored beneath the Registry's key
+// prefix and returns a flat map of etcd key to raw value. Values are not
+// deserialized in any way, so this can be used to inspect the keyspace when
+// the structured getters fail due to corrupt data. DumpKeys is a diagnostic
+// tool and should not be used by regular Registry consumers.
+func (r *EtcdRegistry) DumpKeys() (map[string]string, error) {
+	opts := &etcd.GetOptions{
+		Recursive: true,
+		Sort:      true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), r.prefixed(), opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	flattenNode(res.Node, keys)
+	return keys, nil
+}
+
+// flattenNode walks the given node and all of its children, recording the
+// value of every non-directory node in the provided map
+func flattenNode(node *etcd.Node, keys map[string]string) {
+	if node == nil {
+		return
+	}
+	if !node.Dir {
+		keys[node.Key] = node.Value
+		return
+	}
+	for _, child := range node.Nodes {
+		flattenNode(child, keys)
+	}
+}
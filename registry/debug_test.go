@@ -0,0 +1,100 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+func TestDumpKeys(t *testing.T) {
+	res := &etcd.Response{
+		Node: &etcd.Node{
+			Key: "/fleet",
+			Dir: true,
+			Nodes: []*etcd.Node{
+				&etcd.Node{
+					Key: "/fleet/job",
+					Dir: true,
+					Nodes: []*etcd.Node{
+						&etcd.Node{
+							Key: "/fleet/job/foo.service",
+							Dir: true,
+							Nodes: []*etcd.Node{
+								&etcd.Node{
+									Key:   "/fleet/job/foo.service/object",
+									Value: `not even close to json`,
+								},
+								&etcd.Node{
+									Key:   "/fleet/job/foo.service/target",
+									Value: "XXX",
+								},
+							},
+						},
+					},
+				},
+				&etcd.Node{
+					Key:   "/fleet/engine/version",
+					Value: "1",
+				},
+				&etcd.Node{
+					Key: "/fleet/empty",
+					Dir: true,
+				},
+			},
+		},
+	}
+	e := &testEtcdKeysAPI{res: []*etcd.Response{res}}
+	r := &EtcdRegistry{kAPI: e, keyPrefix: "/fleet/"}
+
+	got, err := r.DumpKeys()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpKeys: %v", err)
+	}
+	want := map[string]string{
+		"/fleet/job/foo.service/object": `not even close to json`,
+		"/fleet/job/foo.service/target": "XXX",
+		"/fleet/engine/version":         "1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad result from DumpKeys:\ngot\n%#v\nwant\n%#v", got, want)
+	}
+
+	wantGets := []action{action{key: "/fleet", rec: true}}
+	if !reflect.DeepEqual(e.gets, wantGets) {
+		t.Errorf("bad gets from DumpKeys:\ngot\n%#v\nwant\n%#v", e.gets, wantGets)
+	}
+
+	for i, tt := range []struct {
+		err  error
+		fail bool
+	}{
+		{etcd.Error{Code: etcd.ErrorCodeKeyNotFound}, false},
+		{errors.New("ur registry don't work"), true},
+	} {
+		e = &testEtcdKeysAPI{err: []error{tt.err}}
+		r = &EtcdRegistry{kAPI: e, keyPrefix: "/fleet/"}
+		got, err = r.DumpKeys()
+		if (err != nil) != tt.fail {
+			t.Errorf("case %d: unexpected error state calling DumpKeys(): got %v, want %v", i, err, tt.fail)
+		}
+		if len(got) != 0 {
+			t.Errorf("case %d: DumpKeys() returned unexpected non-empty result: %v", i, got)
+		}
+	}
+}
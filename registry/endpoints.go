@@ -0,0 +1,200 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"sync"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/log"
+)
+
+// KeysAPIFactory creates a KeysAPI which reaches etcd through the given
+// endpoints
+type KeysAPIFactory func(endpoints []string) (etcd.KeysAPI, error)
+
+// EndpointsKeysAPI is a KeysAPI whose etcd endpoints can be changed while
+// it is in use. Each request is served by the KeysAPI created for the most
+// recent set of endpoints.
+type EndpointsKeysAPI struct {
+	factory KeysAPIFactory
+
+	mu   sync.RWMutex
+	kAPI etcd.KeysAPI
+	// updated is closed when kAPI is replaced
+	updated chan struct{}
+}
+
+// NewEndpointsKeysAPI creates an EndpointsKeysAPI initially reaching etcd
+// through the given endpoints, using the given factory to create a KeysAPI
+// for these and any subsequent endpoints.
+func NewEndpointsKeysAPI(endpoints []string, factory KeysAPIFactory) (*EndpointsKeysAPI, error) {
+	kAPI, err := factory(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return &EndpointsKeysAPI{
+		factory: factory,
+		kAPI:    kAPI,
+		updated: make(chan struct{}),
+	}, nil
+}
+
+// UpdateEndpoints replaces the endpoints through which etcd is reached.
+// Requests made afterwards use the new endpoints. Requests already in
+// flight complete, or fail, against the endpoints they were started with;
+// these include the long-poll of any Watcher, which is interrupted and
+// transparently resumed against the new endpoints from the last index it
+// returned, so no events are lost. If a KeysAPI cannot be created for the
+// new endpoints, the current endpoints remain in use.
+func (k *EndpointsKeysAPI) UpdateEndpoints(endpoints []string) error {
+	kAPI, err := k.factory(endpoints)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.kAPI = kAPI
+	close(k.updated)
+	k.updated = make(chan struct{})
+	k.mu.Unlock()
+
+	log.Infof("Updated etcd endpoints to %v", endpoints)
+	return nil
+}
+
+// current returns the KeysAPI for the current endpoints, along with a
+// channel which is closed once it has been replaced
+func (k *EndpointsKeysAPI) current() (etcd.KeysAPI, <-chan struct{}) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.kAPI, k.updated
+}
+
+func (k *EndpointsKeysAPI) wrapped() etcd.KeysAPI {
+	kAPI, _ := k.current()
+	return kAPI
+}
+
+func (k *EndpointsKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.Get(ctx, key, opts)
+}
+
+func (k *EndpointsKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.Set(ctx, key, value, opts)
+}
+
+func (k *EndpointsKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.Delete(ctx, key, opts)
+}
+
+func (k *EndpointsKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.Create(ctx, key, value)
+}
+
+func (k *EndpointsKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (k *EndpointsKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	kAPI, _ := k.current()
+	return kAPI.Update(ctx, key, value)
+}
+
+// Watcher returns a Watcher which follows endpoint updates. A Watcher
+// started without an AfterIndex only resumes without loss once it has
+// returned its first event.
+func (k *EndpointsKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	w := &endpointsWatcher{k: k, key: key}
+	if opts != nil {
+		w.opts = *opts
+	}
+	return w
+}
+
+type endpointsWatcher struct {
+	k    *EndpointsKeysAPI
+	key  string
+	opts etcd.WatcherOptions
+
+	watcher etcd.Watcher
+	updated <-chan struct{}
+}
+
+func (w *endpointsWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	for {
+		if w.watcher != nil {
+			select {
+			case <-w.updated:
+				log.Debugf("Resuming etcd watcher %s against updated endpoints", w.key)
+				w.watcher = nil
+			default:
+			}
+		}
+		if w.watcher == nil {
+			var kAPI etcd.KeysAPI
+			kAPI, w.updated = w.k.current()
+			opts := w.opts
+			w.watcher = kAPI.Watcher(w.key, &opts)
+		}
+
+		wctx, cancel := context.WithCancel(ctx)
+		go func(updated <-chan struct{}) {
+			select {
+			case <-updated:
+				cancel()
+			case <-wctx.Done():
+			}
+		}(w.updated)
+		res, err := w.watcher.Next(wctx)
+		cancel()
+
+		if err != nil {
+			select {
+			case <-w.updated:
+				if ctx.Err() == nil {
+					continue
+				}
+			default:
+			}
+			return nil, err
+		}
+
+		if res.Node != nil {
+			w.opts.AfterIndex = res.Node.ModifiedIndex
+		}
+		return res, nil
+	}
+}
+
+// UpdateEndpoints replaces the etcd endpoints used by the Registry, as
+// described by EndpointsKeysAPI.UpdateEndpoints. It fails unless the
+// KeysAPI of the Registry is, or wraps, an EndpointsKeysAPI.
+func (r *EtcdRegistry) UpdateEndpoints(machines []string) error {
+	for _, k := range r.keysAPIs() {
+		if ek, ok := k.(*EndpointsKeysAPI); ok {
+			return ek.UpdateEndpoints(machines)
+		}
+	}
+	return errors.New("registry does not support updating etcd endpoints")
+}
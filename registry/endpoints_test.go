@@ -0,0 +1,103 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+func TestUpdateEndpointsWatchSurvives(t *testing.T) {
+	e := newMemKeysAPI()
+	var mu sync.Mutex
+	var created [][]string
+	factory := func(endpoints []string) (etcd.KeysAPI, error) {
+		if len(endpoints) == 0 {
+			return nil, errors.New("no endpoints")
+		}
+		mu.Lock()
+		created = append(created, endpoints)
+		mu.Unlock()
+		return e, nil
+	}
+
+	k, err := NewEndpointsKeysAPI([]string{"http://a:2379"}, factory)
+	if err != nil {
+		t.Fatalf("unexpected error from NewEndpointsKeysAPI: %v", err)
+	}
+	r := NewEtcdRegistry(k, "/fleet/", time.Second)
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch := r.WatchLeases(stop)
+	e.waitForWatchers(t, 1)
+	next := func() LeaseEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for LeaseEvent")
+		}
+		return LeaseEvent{}
+	}
+
+	if _, err := lm.AcquireLease("a", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	if ev := next(); ev.Name != "a" {
+		t.Errorf("unexpected event before update: %#v", ev)
+	}
+
+	if err := r.UpdateEndpoints([]string{"http://b:2379", "http://c:2379"}); err != nil {
+		t.Fatalf("unexpected error from UpdateEndpoints: %v", err)
+	}
+	// A change made while the watch is being resumed is not lost
+	if _, err := lm.AcquireLease("b", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	if ev := next(); ev.Name != "b" {
+		t.Errorf("unexpected event after update: %#v", ev)
+	}
+	e.waitForWatchers(t, 2)
+	if _, err := lm.AcquireLease("c", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	if ev := next(); ev.Name != "c" {
+		t.Errorf("unexpected event after update: %#v", ev)
+	}
+
+	// A failed update keeps the current endpoints
+	if err := r.UpdateEndpoints(nil); err == nil {
+		t.Errorf("expected error updating to no endpoints")
+	}
+	mu.Lock()
+	want := [][]string{{"http://a:2379"}, {"http://b:2379", "http://c:2379"}}
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("expected KeysAPIs created for %v, got %v", want, created)
+	}
+	mu.Unlock()
+
+	plain := NewEtcdRegistry(e, "/fleet/", time.Second)
+	if err := plain.UpdateEndpoints([]string{"http://b:2379"}); err == nil {
+		t.Errorf("expected error updating endpoints of a fixed KeysAPI")
+	}
+}
@@ -15,7 +15,10 @@
 package registry
 
 import (
+	"errors"
+	"fmt"
 	"path"
+	"sync"
 	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
@@ -24,6 +27,16 @@ import (
 
 const DefaultKeyPrefix = "/_coreos.com/fleet/"
 
+var (
+	// ErrIndexMismatch is returned by compare-and-swap operations when the
+	// targeted key has been modified since the provided index was read
+	ErrIndexMismatch = errors.New("registry: key modified since index was read")
+
+	// ErrScheduleChanged is returned when a Unit is no longer scheduled
+	// to the machine an operation expected it to be scheduled to
+	ErrScheduleChanged = errors.New("registry: unit is not scheduled to the expected machine")
+)
+
 func NewEtcdRegistry(kAPI etcd.KeysAPI, keyPrefix string, reqTimeout time.Duration) *EtcdRegistry {
 	return &EtcdRegistry{
 		kAPI:       kAPI,
@@ -37,6 +50,102 @@ type EtcdRegistry struct {
 	kAPI       etcd.KeysAPI
 	keyPrefix  string
 	reqTimeout time.Duration
+	strict     bool
+	// machineGrace is how long a machine remains degraded after its
+	// state expires
+	machineGrace time.Duration
+	// compactMachines selects the compact encoding for the MachineStates
+	// written by SetMachineState
+	compactMachines bool
+	// placementHistory enables the recording of placement history by
+	// scheduling decisions
+	placementHistory bool
+
+	// watchMu guards the watch delivery settings and the active watches
+	watchMu       sync.Mutex
+	watchBuffer   int
+	watchOverflow WatchOverflow
+	watches       map[*watchQueue]struct{}
+	watchTotals   map[string]*watchTotals
+	stopWatches   chan struct{}
+
+	// scheduleMu guards the rate limit of scheduling decisions
+	scheduleMu    sync.Mutex
+	scheduleLimit *rateLimit
+}
+
+// SetStrictDecoding controls whether objects read from etcd must match
+// fleet's models exactly. By default unknown fields are ignored, so that
+// objects written by newer versions of fleet can still be read. In strict
+// mode they are instead reported as a ParseError, which catches misspelled
+// fields when validating hand-written or migrated data. This must not be
+// changed while the Registry is in use.
+func (r *EtcdRegistry) SetStrictDecoding(strict bool) {
+	r.strict = strict
+}
+
+// SetMachineGracePeriod makes machines whose published state expires less
+// than the given grace period ago continue to be reported by Machines, with
+// Degraded set, so a brief network partition does not immediately make a
+// machine disappear. To that end the Registry keeps a copy of each state it
+// publishes which outlives it by the grace period. A zero grace period, the
+// default, reports machines only while their state is present. Explicitly
+// removed or expired machines are never reported as degraded. This must not
+// be changed while the Registry is in use.
+func (r *EtcdRegistry) SetMachineGracePeriod(grace time.Duration) {
+	r.machineGrace = grace
+}
+
+// SetCompactMachineEncoding controls whether SetMachineState writes the
+// MachineState in a compact encoding rather than as JSON. MachineStates
+// are written on every heartbeat of every machine, so this noticeably
+// reduces the volume written to etcd in large clusters. Both encodings are
+// always accepted on read, but versions of fleet predating the compact
+// encoding cannot read it, so it should only be enabled once every daemon
+// sharing the keyspace has been upgraded. This must not be changed while
+// the Registry is in use.
+func (r *EtcdRegistry) SetCompactMachineEncoding(compact bool) {
+	r.compactMachines = compact
+}
+
+// SetPlacementHistory controls whether the Registry records the machines to
+// which each Unit is scheduled or moved, as returned by PlacementHistory.
+// Recording costs every scheduling decision an additional etcd write and
+// read, plus a delete once the history is full, so it is disabled by
+// default. This must not be changed while the
+// Registry is in use.
+func (r *EtcdRegistry) SetPlacementHistory(enabled bool) {
+	r.placementHistory = enabled
+}
+
+// unmarshal deserializes a value read from etcd, honoring the decoding
+// mode of the Registry
+func (r *EtcdRegistry) unmarshal(val string, obj interface{}) error {
+	if r.strict {
+		return unmarshalStrict(val, obj)
+	}
+	return unmarshal(val, obj)
+}
+
+// keysAPIWrapper is implemented by the KeysAPIs of this package which wrap
+// another KeysAPI, so that any of them can be found however they are stacked
+type keysAPIWrapper interface {
+	wrapped() etcd.KeysAPI
+}
+
+// keysAPIs returns the KeysAPI of the Registry followed by each KeysAPI it
+// wraps, outermost first
+func (r *EtcdRegistry) keysAPIs() []etcd.KeysAPI {
+	var chain []etcd.KeysAPI
+	for k := r.kAPI; k != nil; {
+		chain = append(chain, k)
+		w, ok := k.(keysAPIWrapper)
+		if !ok {
+			break
+		}
+		k = w.wrapped()
+	}
+	return chain
 }
 
 func (r *EtcdRegistry) ctx() context.Context {
@@ -48,7 +157,178 @@ func (r *EtcdRegistry) prefixed(p ...string) string {
 	return path.Join(r.keyPrefix, path.Join(p...))
 }
 
+// EnsureKeyspace creates the directories in which the Registry stores its
+// Units, schedule, machines, UnitStates and leases, if they do not already
+// exist. Reads of a missing directory fail where reads of an empty one do
+// not, so this gives a brand-new etcd cluster a consistent starting point
+// rather than relying on the first write to each directory. It is safe to
+// call repeatedly, including concurrently from several fleet daemons.
+func (r *EtcdRegistry) EnsureKeyspace() error {
+	for _, dir := range []string{jobPrefix, unitPrefix, machinePrefix, statesPrefix, leasePrefix} {
+		key := r.prefixed(dir)
+		opts := &etcd.SetOptions{
+			Dir:       true,
+			PrevExist: etcd.PrevNoExist,
+		}
+		if _, err := r.kAPI.Set(r.ctx(), key, "", opts); err != nil && !isEtcdError(err, etcd.ErrorCodeNodeExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRaw retrieves the raw value stored at the given key along with the
+// etcd ModifiedIndex of that value. If the key does not exist, an empty
+// value and a zero index are returned, since etcd never assigns a zero
+// ModifiedIndex to an existing key.
+func (r *EtcdRegistry) getRaw(key string) (string, uint64, error) {
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return "", 0, err
+	}
+	return res.Node.Value, res.Node.ModifiedIndex, nil
+}
+
+// setAtIndex writes the given value to the given key only if the key has
+// not been modified since the provided index. An index of zero requires
+// that the key does not yet exist. ErrIndexMismatch is returned if the
+// condition does not hold.
+func (r *EtcdRegistry) setAtIndex(key, val string, idx uint64) (uint64, error) {
+	opts := &etcd.SetOptions{
+		PrevIndex: idx,
+	}
+	if idx == 0 {
+		opts.PrevExist = etcd.PrevNoExist
+	}
+	res, err := r.kAPI.Set(r.ctx(), key, val, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeTestFailed) || isEtcdError(err, etcd.ErrorCodeNodeExist) || isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = ErrIndexMismatch
+		}
+		return 0, keyCollisionError(err, key)
+	}
+	return res.Node.ModifiedIndex, nil
+}
+
+// NoTTL is returned in place of the remaining TTL of a key which does not
+// expire
+const NoTTL = time.Duration(-1)
+
+// keyTTL returns the value stored at the given key along with the time
+// remaining until the key expires, or NoTTL if it does not expire. If the
+// key does not exist, an empty value and a zero duration are returned.
+func (r *EtcdRegistry) keyTTL(key string) (string, time.Duration, error) {
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return "", 0, err
+	}
+
+	switch {
+	case res.Node.Expiration != nil:
+		rem := res.Node.Expiration.Sub(time.Now())
+		if rem < 0 {
+			rem = 0
+		}
+		return res.Node.Value, rem, nil
+	case res.Node.TTL > 0:
+		return res.Node.Value, res.Node.TTLDuration(), nil
+	default:
+		return res.Node.Value, NoTTL, nil
+	}
+}
+
+// setKeyTTL changes the TTL of the existing value at the given key without
+// changing the value itself. A zero TTL makes the key permanent. As etcd
+// can only change a TTL by rewriting the value, the current value is read
+// and written back with a compare-and-swap, retrying if it changes in the
+// meantime.
+func (r *EtcdRegistry) setKeyTTL(key string, ttl time.Duration) error {
+	return r.setKeyTTLIf(key, ttl, nil)
+}
+
+// setKeyTTLIf behaves like setKeyTTL, but first passes the current value to
+// the given check, if any, giving up with the error it returns. A missing
+// key is passed as an empty value. The check is repeated whenever the value
+// changes before it can be written back.
+func (r *EtcdRegistry) setKeyTTLIf(key string, ttl time.Duration, check func(val string) error) error {
+	for {
+		val, idx, err := r.getRaw(key)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(val); err != nil {
+				return err
+			}
+		}
+		if idx == 0 {
+			return fmt.Errorf("registry key %s does not exist", key)
+		}
+
+		opts := &etcd.SetOptions{
+			PrevIndex: idx,
+			TTL:       ttl,
+		}
+		_, err = r.kAPI.Set(r.ctx(), key, val, opts)
+		if !isEtcdError(err, etcd.ErrorCodeTestFailed) && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			return keyCollisionError(err, key)
+		}
+	}
+}
+
 func isEtcdError(err error, code int) bool {
 	eerr, ok := err.(etcd.Error)
 	return ok && eerr.Code == code
 }
+
+// ParseError describes a failure to deserialize an object stored in the
+// Registry. It identifies the etcd key holding the offending value and, where
+// relevant, the ID of the machine the object relates to, so an operator can
+// locate the bad data. The value itself is deliberately omitted as it may
+// not be printable.
+type ParseError struct {
+	Key       string
+	MachineID string
+	Err       error
+}
+
+func (e *ParseError) Error() string {
+	if e.MachineID != "" {
+		return fmt.Sprintf("failed parsing object at key %s (machine %s): %v", e.Key, e.MachineID, e.Err)
+	}
+	return fmt.Sprintf("failed parsing object at key %s: %v", e.Key, e.Err)
+}
+
+// CapacityError is returned when a Unit cannot be scheduled to a machine
+// because the machine already runs the maximum number of Units it allows
+type CapacityError struct {
+	MachineID string
+	MaxUnits  int
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("machine %s already runs its maximum of %d units", e.MachineID, e.MaxUnits)
+}
+
+// keyCollisionError translates the etcd errors returned when a key and a
+// directory collide at (or above) the given key into a descriptive error.
+// Such collisions only occur if the keyspace has been corrupted, so the
+// returned error is intended to point an operator at the offending key.
+// All other errors are returned unchanged.
+func keyCollisionError(err error, key string) error {
+	switch {
+	case isEtcdError(err, etcd.ErrorCodeNotFile):
+		return fmt.Errorf("registry key %s is a directory but fleet expects a value; the offending directory must be removed manually", key)
+	case isEtcdError(err, etcd.ErrorCodeDirNotEmpty):
+		return fmt.Errorf("registry key %s is a non-empty directory but fleet expects a value; the offending directory must be removed manually", key)
+	case isEtcdError(err, etcd.ErrorCodeNotDir):
+		return fmt.Errorf("a parent of registry key %s is a value but fleet expects a directory; the offending value must be removed manually", key)
+	}
+	return err
+}
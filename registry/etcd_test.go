@@ -0,0 +1,617 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+// memKeysAPI is a stateful, in-memory implementation of etcd.KeysAPI which
+// mimics the etcd v2 semantics the Registry relies upon: directories,
+// compare-and-swap conditions, TTLs, indexes and watches.
+type memKeysAPI struct {
+	sync.Mutex
+	root   *memNode
+	index  uint64
+	events []*etcd.Response
+	notify chan struct{}
+	// gets counts the calls made to Get
+	gets int
+	// watchers counts the calls made to Watcher
+	watchers int
+}
+
+type memNode struct {
+	key        string
+	dir        bool
+	value      string
+	children   map[string]*memNode
+	created    uint64
+	modified   uint64
+	expiration *time.Time
+}
+
+func newMemKeysAPI() *memKeysAPI {
+	return &memKeysAPI{
+		root:   &memNode{key: "/", dir: true, children: map[string]*memNode{}},
+		notify: make(chan struct{}),
+	}
+}
+
+func memError(code int, key string, idx uint64) error {
+	return etcd.Error{Code: code, Message: fmt.Sprintf("error %d", code), Cause: key, Index: idx}
+}
+
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+func splitKey(key string) []string {
+	key = strings.Trim(cleanKey(key), "/")
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "/")
+}
+
+func (n *memNode) toNode(recursive, top bool) *etcd.Node {
+	node := &etcd.Node{
+		Key:           n.key,
+		Dir:           n.dir,
+		Value:         n.value,
+		CreatedIndex:  n.created,
+		ModifiedIndex: n.modified,
+	}
+	if n.expiration != nil {
+		exp := *n.expiration
+		node.Expiration = &exp
+		node.TTL = int64((exp.Sub(time.Now()) + time.Second - 1) / time.Second)
+		if node.TTL < 1 {
+			node.TTL = 1
+		}
+	}
+	if n.dir && (top || recursive) {
+		var names []string
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			node.Nodes = append(node.Nodes, n.children[name].toNode(recursive, false))
+		}
+	}
+	return node
+}
+
+// find returns the node stored at the given key, or nil if none exists. An
+// error is returned if a non-directory node is encountered along the way.
+func (m *memKeysAPI) find(key string) (*memNode, error) {
+	n := m.root
+	for _, part := range splitKey(key) {
+		if !n.dir {
+			return nil, memError(etcd.ErrorCodeNotDir, n.key, m.index)
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, nil
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (m *memKeysAPI) record(action string, node, prev *etcd.Node) *etcd.Response {
+	res := &etcd.Response{
+		Action:   action,
+		Node:     node,
+		PrevNode: prev,
+		Index:    m.index,
+	}
+	m.events = append(m.events, res)
+	close(m.notify)
+	m.notify = make(chan struct{})
+	return res
+}
+
+// expireKeys removes all nodes whose TTL has lapsed
+func (m *memKeysAPI) expireKeys() {
+	now := time.Now()
+	var walk func(n *memNode)
+	walk = func(n *memNode) {
+		var names []string
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := n.children[name]
+			if child.expiration != nil && !now.Before(*child.expiration) {
+				m.unsafeExpire(n, name)
+				continue
+			}
+			if child.dir {
+				walk(child)
+			}
+		}
+	}
+	walk(m.root)
+}
+
+func (m *memKeysAPI) unsafeExpire(parent *memNode, name string) {
+	child := parent.children[name]
+	prev := child.toNode(true, true)
+	delete(parent.children, name)
+	m.index++
+	m.record("expire", &etcd.Node{Key: child.key, Dir: child.dir, CreatedIndex: child.created, ModifiedIndex: m.index}, prev)
+}
+
+// expire forcibly lapses the TTL of the given key, as if time had passed
+func (m *memKeysAPI) expire(key string) {
+	m.Lock()
+	defer m.Unlock()
+
+	key = cleanKey(key)
+	parent, err := m.find(path.Dir(key))
+	if err != nil || parent == nil || !parent.dir {
+		return
+	}
+	if _, ok := parent.children[path.Base(key)]; ok {
+		m.unsafeExpire(parent, path.Base(key))
+	}
+}
+
+func (m *memKeysAPI) Get(_ context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.expireKeys()
+	m.gets++
+
+	n, err := m.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, memError(etcd.ErrorCodeKeyNotFound, cleanKey(key), m.index)
+	}
+	recursive := opts != nil && opts.Recursive
+	return &etcd.Response{Action: "get", Node: n.toNode(recursive, true), Index: m.index}, nil
+}
+
+func (m *memKeysAPI) Set(_ context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.expireKeys()
+
+	if opts == nil {
+		opts = &etcd.SetOptions{}
+	}
+	key = cleanKey(key)
+	n, err := m.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	action := "set"
+	switch {
+	case opts.PrevExist == etcd.PrevNoExist:
+		action = "create"
+		if n != nil {
+			return nil, memError(etcd.ErrorCodeNodeExist, key, m.index)
+		}
+	case opts.PrevValue != "" || opts.PrevIndex != 0:
+		action = "compareAndSwap"
+		if n == nil {
+			return nil, memError(etcd.ErrorCodeKeyNotFound, key, m.index)
+		}
+		if n.dir {
+			return nil, memError(etcd.ErrorCodeNotFile, key, m.index)
+		}
+		if (opts.PrevValue != "" && opts.PrevValue != n.value) || (opts.PrevIndex != 0 && opts.PrevIndex != n.modified) {
+			return nil, memError(etcd.ErrorCodeTestFailed, key, m.index)
+		}
+	case opts.PrevExist == etcd.PrevExist:
+		action = "update"
+		if n == nil {
+			return nil, memError(etcd.ErrorCodeKeyNotFound, key, m.index)
+		}
+	}
+	if n != nil && n.dir != opts.Dir {
+		if n.dir {
+			return nil, memError(etcd.ErrorCodeNotFile, key, m.index)
+		}
+		return nil, memError(etcd.ErrorCodeNotDir, key, m.index)
+	}
+
+	m.index++
+	var prev *etcd.Node
+	if n != nil {
+		prev = n.toNode(false, false)
+	} else {
+		parent := m.root
+		parts := splitKey(key)
+		for i, part := range parts[:len(parts)-1] {
+			child, ok := parent.children[part]
+			if !ok {
+				child = &memNode{
+					key:      "/" + strings.Join(parts[:i+1], "/"),
+					dir:      true,
+					children: map[string]*memNode{},
+					created:  m.index,
+					modified: m.index,
+				}
+				parent.children[part] = child
+			}
+			parent = child
+		}
+		n = &memNode{key: key, dir: opts.Dir, created: m.index}
+		if opts.Dir {
+			n.children = map[string]*memNode{}
+		}
+		parent.children[parts[len(parts)-1]] = n
+	}
+
+	if action == "set" {
+		n.created = m.index
+	}
+	n.modified = m.index
+	if !opts.Dir {
+		n.value = value
+	}
+	n.expiration = nil
+	if opts.TTL > 0 {
+		exp := time.Now().Add(opts.TTL)
+		n.expiration = &exp
+	}
+
+	return m.record(action, n.toNode(false, false), prev), nil
+}
+
+func (m *memKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return m.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+}
+
+func (m *memKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return m.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevExist})
+}
+
+func (m *memKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	m.Lock()
+	key := path.Join(cleanKey(dir), fmt.Sprintf("%020d", m.index+1))
+	m.Unlock()
+
+	sopts := &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	if opts != nil {
+		sopts.TTL = opts.TTL
+	}
+	return m.Set(ctx, key, value, sopts)
+}
+
+func (m *memKeysAPI) Delete(_ context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.expireKeys()
+
+	if opts == nil {
+		opts = &etcd.DeleteOptions{}
+	}
+	key = cleanKey(key)
+	n, err := m.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil || n == m.root {
+		return nil, memError(etcd.ErrorCodeKeyNotFound, key, m.index)
+	}
+
+	action := "delete"
+	if n.dir {
+		if !opts.Dir && !opts.Recursive {
+			return nil, memError(etcd.ErrorCodeNotFile, key, m.index)
+		}
+		if !opts.Recursive && len(n.children) > 0 {
+			return nil, memError(etcd.ErrorCodeDirNotEmpty, key, m.index)
+		}
+	}
+	if opts.PrevValue != "" || opts.PrevIndex != 0 {
+		action = "compareAndDelete"
+		if n.dir {
+			return nil, memError(etcd.ErrorCodeNotFile, key, m.index)
+		}
+		if (opts.PrevValue != "" && opts.PrevValue != n.value) || (opts.PrevIndex != 0 && opts.PrevIndex != n.modified) {
+			return nil, memError(etcd.ErrorCodeTestFailed, key, m.index)
+		}
+	}
+
+	parent, _ := m.find(path.Dir(key))
+	delete(parent.children, path.Base(key))
+	m.index++
+	prev := n.toNode(false, false)
+	node := &etcd.Node{Key: key, Dir: n.dir, CreatedIndex: n.created, ModifiedIndex: m.index}
+	return m.record(action, node, prev), nil
+}
+
+func (m *memKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	m.Lock()
+	defer m.Unlock()
+	m.watchers++
+
+	w := &memWatcher{
+		api:   m,
+		key:   cleanKey(key),
+		after: m.index,
+	}
+	if opts != nil {
+		w.recursive = opts.Recursive
+		if opts.AfterIndex != 0 {
+			w.after = opts.AfterIndex
+		}
+	}
+	return w
+}
+
+type memWatcher struct {
+	api       *memKeysAPI
+	key       string
+	recursive bool
+	after     uint64
+}
+
+// waitForWatchers blocks until at least n watchers have been created
+func (m *memKeysAPI) waitForWatchers(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.Lock()
+		count := m.watchers
+		m.Unlock()
+		if count >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d watchers, have %d", n, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (w *memWatcher) matches(key string) bool {
+	if key == w.key {
+		return true
+	}
+	return w.recursive && strings.HasPrefix(key, strings.TrimSuffix(w.key, "/")+"/")
+}
+
+func (w *memWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	for {
+		w.api.Lock()
+		for _, ev := range w.api.events {
+			if ev.Index > w.after && w.matches(ev.Node.Key) {
+				w.after = ev.Index
+				w.api.Unlock()
+				return ev, nil
+			}
+		}
+		notify := w.api.notify
+		w.api.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestKeyCollisionErrors(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	// A prior bug left directories where values are expected
+	for _, key := range []string{"/fleet/job/foo.service/target", "/fleet/job/foo.service/target-state", "/fleet/machines/XXX/object"} {
+		if _, err := e.Set(nil, key, "", &etcd.SetOptions{Dir: true}); err != nil {
+			t.Fatalf("failed creating directory %s: %v", key, err)
+		}
+	}
+	// ...and a value where a directory is expected
+	if _, err := e.Set(nil, "/fleet/job/bar.service", "garbage", nil); err != nil {
+		t.Fatalf("failed creating key: %v", err)
+	}
+
+	for i, tt := range []struct {
+		op   func() error
+		want string
+	}{
+		{
+			op:   func() error { return r.SetUnitTargetState("foo.service", job.JobStateLaunched) },
+			want: "registry key /fleet/job/foo.service/target-state is a directory",
+		},
+		{
+			op:   func() error { return r.UnscheduleUnit("foo.service", "XXX") },
+			want: "registry key /fleet/job/foo.service/target is a directory",
+		},
+		{
+			op:   func() error { return r.RemoveMachineState("XXX") },
+			want: "registry key /fleet/machines/XXX/object is a directory",
+		},
+		{
+			op: func() error {
+				_, err := r.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute)
+				return err
+			},
+			want: "registry key /fleet/machines/XXX/object is a directory",
+		},
+		{
+			op:   func() error { return r.SetUnitTargetState("bar.service", job.JobStateLaunched) },
+			want: "a parent of registry key /fleet/job/bar.service/target-state is a value",
+		},
+	} {
+		err := tt.op()
+		if err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("case %d: unexpected error: got %q, want prefix %q", i, err, tt.want)
+		}
+	}
+
+	// Errors unrelated to the structure of the keyspace are left alone
+	err := memError(etcd.ErrorCodeKeyNotFound, "/fleet/foo", 0)
+	if got := keyCollisionError(err, "/fleet/foo"); got != err {
+		t.Errorf("unexpected translation of unrelated error: %v", got)
+	}
+	if got := keyCollisionError(nil, "/fleet/foo"); got != nil {
+		t.Errorf("unexpected translation of nil error: %v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	// Binary garbage must not leak into the error, but the key must
+	binary := "\x00\xff\xfe garbage"
+	e.Set(nil, "/fleet/machines/XXX/object", binary, nil)
+	e.Set(nil, "/fleet/states/foo.service/YYY", binary, nil)
+	e.Set(nil, "/fleet/job/foo.service/object", binary, nil)
+	e.Set(nil, "/fleet/job/foo.service/target", "YYY", nil)
+
+	_, err := r.Machines()
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected *ParseError from Machines, got %T: %v", err, err)
+	}
+	if perr.Key != "/fleet/machines/XXX/object" || perr.MachineID != "XXX" {
+		t.Errorf("unexpected ParseError from Machines: %#v", perr)
+	}
+
+	_, err = r.getUnitState("foo.service", "YYY")
+	perr, ok = err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected *ParseError from getUnitState, got %T: %v", err, err)
+	}
+	if perr.Key != "/fleet/states/foo.service/YYY" || perr.MachineID != "YYY" {
+		t.Errorf("unexpected ParseError from getUnitState: %#v", perr)
+	}
+
+	_, err = r.Unit("foo.service")
+	perr, ok = err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected *ParseError from Unit, got %T: %v", err, err)
+	}
+	if perr.Key != "/fleet/job/foo.service/object" || perr.MachineID != "YYY" {
+		t.Errorf("unexpected ParseError from Unit: %#v", perr)
+	}
+	if strings.Contains(perr.Error(), binary) {
+		t.Errorf("ParseError leaked raw value: %q", perr.Error())
+	}
+	want := "failed parsing object at key /fleet/job/foo.service/object (machine YYY): "
+	if !strings.HasPrefix(perr.Error(), want) {
+		t.Errorf("unexpected ParseError message: got %q, want prefix %q", perr.Error(), want)
+	}
+}
+
+func TestSetKeyTTL(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	if err := r.RefreshMachineStateTTL("XXX", time.Minute); err == nil {
+		t.Errorf("expected error refreshing TTL of nonexistent key")
+	}
+
+	if _, err := r.SetMachineState(machine.MachineState{ID: "XXX", PublicIP: "1.2.3.4"}, 10*time.Second); err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+	before, _, _ := r.getRaw("/fleet/machines/XXX/object")
+
+	for i, tt := range []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{time.Hour, 3600},
+		{0, 0},
+	} {
+		if err := r.RefreshMachineStateTTL("XXX", tt.ttl); err != nil {
+			t.Errorf("case %d: unexpected error from RefreshMachineStateTTL: %v", i, err)
+			continue
+		}
+		res, err := e.Get(nil, "/fleet/machines/XXX/object", nil)
+		if err != nil {
+			t.Errorf("case %d: unexpected error from Get: %v", i, err)
+			continue
+		}
+		if res.Node.Value != before {
+			t.Errorf("case %d: value changed from %q to %q", i, before, res.Node.Value)
+		}
+		if res.Node.TTL != tt.want {
+			t.Errorf("case %d: TTL is %d, want %d", i, res.Node.TTL, tt.want)
+		}
+	}
+
+	r.SaveUnitState("foo.service", unit.NewUnitState("loaded", "active", "running", "XXX"), 10*time.Second)
+	if err := r.RefreshUnitStateTTL("foo.service", "XXX", time.Hour); err != nil {
+		t.Errorf("unexpected error from RefreshUnitStateTTL: %v", err)
+	}
+	if err := r.UnitHeartbeat("foo.service", "XXX", 10*time.Second); err != nil {
+		t.Fatalf("unexpected error from UnitHeartbeat: %v", err)
+	}
+	if err := r.RefreshUnitHeartbeatTTL("foo.service", time.Hour); err != nil {
+		t.Errorf("unexpected error from RefreshUnitHeartbeatTTL: %v", err)
+	}
+	if res, _ := e.Get(nil, "/fleet/job/foo.service/job-state", nil); res == nil || res.Node.Value != "XXX" || res.Node.TTL != 3600 {
+		t.Errorf("unexpected heartbeat after TTL refresh: %#v", res)
+	}
+}
+
+func TestEnsureKeyspace(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	for i := 0; i < 2; i++ {
+		if err := r.EnsureKeyspace(); err != nil {
+			t.Fatalf("case %d: unexpected error from EnsureKeyspace: %v", i, err)
+		}
+		for _, dir := range []string{"/fleet/job", "/fleet/unit", "/fleet/machines", "/fleet/states", "/fleet/lease"} {
+			res, err := e.Get(nil, dir, nil)
+			if err != nil || !res.Node.Dir {
+				t.Errorf("case %d: expected directory %s, got %#v, %v", i, dir, res, err)
+			}
+		}
+		if units, err := r.Units(); err != nil || len(units) != 0 {
+			t.Errorf("case %d: expected no Units, got %v, %v", i, units, err)
+		}
+	}
+
+	// Existing contents are left untouched
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	if err := r.EnsureKeyspace(); err != nil {
+		t.Fatalf("unexpected error from EnsureKeyspace: %v", err)
+	}
+	if units, err := r.Units(); err != nil || len(units) != 1 {
+		t.Errorf("expected 1 Unit, got %v, %v", units, err)
+	}
+}
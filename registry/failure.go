@@ -0,0 +1,59 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"path"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+const (
+	failurePrefix = "failures"
+)
+
+// RecordScheduleFailure records why the named Unit could not be scheduled,
+// replacing any reason previously recorded for it. The record expires after
+// the given TTL, so a Unit which is eventually scheduled does not keep
+// reporting a stale failure for long.
+func (r *EtcdRegistry) RecordScheduleFailure(name, reason string, ttl time.Duration) error {
+	key := r.prefixed(failurePrefix, name)
+	opts := &etcd.SetOptions{
+		TTL: ttl,
+	}
+	_, err := r.kAPI.Set(r.ctx(), key, reason, opts)
+	return keyCollisionError(err, key)
+}
+
+// ScheduleFailures returns the reasons recorded by RecordScheduleFailure
+// which have not yet expired, keyed by Unit name
+func (r *EtcdRegistry) ScheduleFailures() (map[string]string, error) {
+	failures := make(map[string]string)
+	res, err := r.kAPI.Get(r.ctx(), r.prefixed(failurePrefix), nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return failures, err
+	}
+
+	for _, node := range res.Node.Nodes {
+		if !node.Dir {
+			failures[path.Base(node.Key)] = node.Value
+		}
+	}
+	return failures, nil
+}
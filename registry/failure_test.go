@@ -0,0 +1,58 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleFailures(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	if got, err := r.ScheduleFailures(); err != nil || len(got) != 0 {
+		t.Errorf("unexpected failures in empty Registry: %v, %v", got, err)
+	}
+
+	for _, f := range []struct {
+		name, reason string
+	}{
+		{"a.service", "no machine able to run Unit"},
+		{"b.service", "machine XXX already runs its maximum of 2 units"},
+		// the latest reason wins
+		{"a.service", "required peer Unit(c.service) is not scheduled"},
+	} {
+		if err := r.RecordScheduleFailure(f.name, f.reason, time.Minute); err != nil {
+			t.Fatalf("unexpected error from RecordScheduleFailure: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		"a.service": "required peer Unit(c.service) is not scheduled",
+		"b.service": "machine XXX already runs its maximum of 2 units",
+	}
+	got, err := r.ScheduleFailures()
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got failures %v, %v, want %v", got, err, want)
+	}
+
+	e.expire("/fleet/failures/b.service")
+	delete(want, "b.service")
+	if got, err := r.ScheduleFailures(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got failures %v, %v after expiry, want %v", got, err, want)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coreos/fleet/machine"
+)
+
+// MachinesMissingUnit returns the machines which are expected to run the
+// named global Unit, as their metadata satisfies its requirements, but
+// which have not yet reported running its current UnitFile. A machine is
+// considered to be missing the Unit if it has reported no state for it, or
+// state for a different UnitFile (e.g. one since replaced). An empty list
+// indicates the Unit has converged across the cluster.
+func (r *EtcdRegistry) MachinesMissingUnit(name string) ([]machine.MachineState, error) {
+	u, err := r.Unit(name)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("job does not exist")
+	}
+	if !u.IsGlobal() {
+		return nil, fmt.Errorf("Unit(%s) is not a global unit", name)
+	}
+
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := u.Unit.Hash().String()
+	var missing []machine.MachineState
+	for _, ms := range machines {
+		ms := ms
+		if !machine.HasMetadata(&ms, u.RequiredTargetMetadata()) || !machine.HasRoles(&ms, u.RequiredRoles()) || !machine.HasConstraints(&ms, u.RequiredConstraints()) {
+			continue
+		}
+		us, err := r.getUnitState(name, ms.ID)
+		if err != nil {
+			return nil, err
+		}
+		if us == nil || (us.UnitHash != "" && us.UnitHash != hash) {
+			missing = append(missing, ms)
+		}
+	}
+	return missing, nil
+}
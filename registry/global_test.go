@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func TestMachinesMissingUnit(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, id := range []string{"AAA", "BBB", "CCC"} {
+		addTestMachine(t, r, machine.MachineState{ID: id, Metadata: map[string]string{"role": "web"}})
+	}
+	addTestMachine(t, r, machine.MachineState{ID: "DDD", Metadata: map[string]string{"role": "db"}})
+
+	if _, err := r.MachinesMissingUnit("nope.service"); err == nil {
+		t.Errorf("expected error for nonexistent Unit")
+	}
+	addTestUnit(t, r, newTestUnit(t, "local.service", ""), "AAA")
+	if _, err := r.MachinesMissingUnit("local.service"); err == nil {
+		t.Errorf("expected error for non-global Unit")
+	}
+
+	u := newTestUnit(t, "web.service", "[X-Fleet]\nGlobal=true\nMachineMetadata=role=web\n")
+	addTestUnit(t, r, u, "")
+
+	saveState := func(machID, hash string) {
+		us := unit.NewUnitState("loaded", "active", "running", machID)
+		us.UnitHash = hash
+		r.SaveUnitState("web.service", us, time.Minute)
+	}
+	// Up to date
+	saveState("AAA", u.Unit.Hash().String())
+	// Running a previous UnitFile
+	saveState("BBB", "0123456789")
+	// CCC has reported nothing, and DDD is not expected to run the Unit
+
+	missing, err := r.MachinesMissingUnit("web.service")
+	if err != nil {
+		t.Fatalf("unexpected error from MachinesMissingUnit: %v", err)
+	}
+	var got []string
+	for _, ms := range missing {
+		got = append(got, ms.ID)
+	}
+	if want := []string{"BBB", "CCC"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected machines missing Unit: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/fleet/log"
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+const (
+	// groupLeaseHolder identifies ScheduleGroup as the holder of the
+	// leases it takes on the Units of a group
+	groupLeaseHolder = "schedule-group"
+
+	// groupLeaseTTL bounds how long the Units of a group remain leased if
+	// ScheduleGroup fails to release them
+	groupLeaseTTL = 30 * time.Second
+)
+
+// ErrGroupContended is returned by ScheduleGroup when some of the Units of
+// the group are being scheduled by another ScheduleGroup
+var ErrGroupContended = errors.New("registry: units of the group are being scheduled by another party")
+
+// GroupScheduleError is returned by ScheduleGroup when one of the Units of
+// the group cannot be scheduled
+type GroupScheduleError struct {
+	Name   string
+	Reason string
+}
+
+func (e *GroupScheduleError) Error() string {
+	return fmt.Sprintf("unable to schedule Unit(%s): %s", e.Name, e.Reason)
+}
+
+// ScheduleGroup schedules all of the named Units, or none of them. A
+// machine is first chosen for every Unit using the given Placement, or the
+// least-loaded machine if none is given, taking into account the other
+// Units of the group; peers within the group are placed before the Units
+// which require them. Nothing is written unless every Unit can be placed.
+// The decisions are then written one at a time, and if any write fails the
+// decisions already written are withdrawn again, along with the scheduling
+// time and placement history recorded for them, leaving the schedule as it
+// was. A lease is held on every Unit of the group throughout, so
+// concurrent calls for overlapping groups do not interleave; if any of them
+// is held by another party, ErrGroupContended is returned. The decisions are guarded in the same way as ScheduleUnit, so a Unit
+// scheduled by another party in the meantime, such as the engine, fails the
+// group rather than being overwritten. Units of the group which are
+// already scheduled are left where they are. If a Unit cannot be scheduled,
+// a GroupScheduleError naming it is returned.
+func (r *EtcdRegistry) ScheduleGroup(names []string, placement Placement) error {
+	if placement == nil {
+		placement = NewLeastLoadedPlacement()
+	}
+
+	leaseNames := make([]string, len(names))
+	for i, name := range names {
+		leaseNames[i] = groupLeaseName(name)
+	}
+	mgr := lease.NewEtcdLeaseManager(r.kAPI, r.keyPrefix, r.reqTimeout)
+	leases, err := lease.AcquireLeases(mgr, leaseNames, groupLeaseHolder, 0, groupLeaseTTL)
+	if err != nil {
+		return err
+	}
+	if leases == nil {
+		return ErrGroupContended
+	}
+	defer func() {
+		for _, l := range leases {
+			if err := l.Release(); err != nil {
+				log.Errorf("Failed releasing scheduling lease: %v", err)
+			}
+		}
+	}()
+
+	ps, err := r.placementState()
+	if err != nil {
+		return err
+	}
+
+	inGroup := make(map[string]bool)
+	var pending []string
+	for _, name := range names {
+		if inGroup[name] {
+			continue
+		}
+		inGroup[name] = true
+
+		u, ok := ps.units[name]
+		if !ok {
+			return &GroupScheduleError{Name: name, Reason: "Unit does not exist"}
+		}
+		if u.IsGlobal() {
+			return &GroupScheduleError{Name: name, Reason: "global Units are not scheduled"}
+		}
+		if ps.targets[name] == "" {
+			pending = append(pending, name)
+		}
+	}
+
+	// Place Units only once the peers they require from the group have
+	// been placed, passing over the rest until no further progress is made
+	planned := make(map[string]string)
+	var order []string
+	for len(pending) > 0 {
+		var deferred []string
+		for _, name := range pending {
+			u := ps.units[name]
+			ready := true
+			for _, peer := range u.Peers() {
+				if inGroup[peer] && ps.targets[peer] == "" {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				deferred = append(deferred, name)
+				continue
+			}
+
+			machID, err := ps.place(u, placement, false, -1)
+			if err != nil {
+				return err
+			}
+			if machID == "" {
+				return &GroupScheduleError{Name: name, Reason: ps.unplaceableReason(name)}
+			}
+			ps.schedule(name, machID)
+			planned[name] = machID
+			order = append(order, name)
+		}
+		if len(deferred) == len(pending) {
+			return &GroupScheduleError{Name: deferred[0], Reason: "required peer Units form a cycle"}
+		}
+		pending = deferred
+	}
+
+	records := make(map[string]string)
+	for i, name := range order {
+		_, record, err := r.scheduleUnit(name, planned[name])
+		if err != nil {
+			for _, done := range order[:i] {
+				r.withdrawGroupUnit(done, planned[done], records[done])
+			}
+			return &GroupScheduleError{Name: name, Reason: err.Error()}
+		}
+		records[name] = record
+	}
+	return nil
+}
+
+// withdrawGroupUnit undoes the scheduling decision ScheduleGroup wrote for
+// the named Unit, including its scheduling time and the given record of its
+// placement history. Failures are logged, as the group has already failed.
+func (r *EtcdRegistry) withdrawGroupUnit(name, machID, record string) {
+	if err := r.UnscheduleUnit(name, machID); err != nil {
+		log.Errorf("Failed withdrawing scheduling decision of Unit(%s) to Machine(%s): %v", name, machID, err)
+		return
+	}
+	if record != "" {
+		r.removePlacementRecord(name, record)
+	}
+}
+
+// groupLeaseName returns the name of the lease ScheduleGroup holds on the
+// named Unit
+func groupLeaseName(name string) string {
+	return "schedule-" + name
+}
+
+// unplaceableReason describes why no machine is able to run the named Unit,
+// listing the unmet requirement of each machine in order of machine ID
+func (ps *placementState) unplaceableReason(name string) string {
+	var ids sort.StringSlice
+	for id, ml := range ps.machines {
+		if !ml.cordoned {
+			ids = append(ids, id)
+		}
+	}
+	ids.Sort()
+	if len(ids) == 0 {
+		return "no machines available"
+	}
+
+	reasons := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if able, reason := ps.ableToRun(ps.units[name], id); !able {
+			reasons = append(reasons, fmt.Sprintf("machine %s: %s", id, reason))
+		}
+	}
+	if len(reasons) == 0 {
+		return "placement accepted no machine"
+	}
+	return strings.Join(reasons, "; ")
+}
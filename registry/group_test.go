@@ -0,0 +1,144 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+// scheduleOf returns the machine each scheduled Unit is scheduled to
+func scheduleOf(t *testing.T, r *EtcdRegistry) map[string]string {
+	sUnits, err := r.Schedule()
+	if err != nil {
+		t.Fatalf("unexpected error from Schedule: %v", err)
+	}
+	targets := make(map[string]string)
+	for _, su := range sUnits {
+		if su.TargetMachineID != "" {
+			targets[su.Name] = su.TargetMachineID
+		}
+	}
+	return targets
+}
+
+func TestScheduleGroup(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: map[string]string{"region": "us-east"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	for _, u := range []*job.Unit{
+		newTestUnit(t, "a.service", ""),
+		newTestUnit(t, "b.service", "[X-Fleet]\nMachineOf=c.service\n"),
+		newTestUnit(t, "c.service", "[X-Fleet]\nMachineMetadata=region=us-east\n"),
+		newTestUnit(t, "d.service", "[X-Fleet]\nMachineMetadata=region=us-west\n"),
+	} {
+		addTestUnit(t, r, u, "")
+	}
+
+	// d.service cannot be placed, so nothing is scheduled
+	err := r.ScheduleGroup([]string{"a.service", "c.service", "d.service"}, nil)
+	if gerr, ok := err.(*GroupScheduleError); !ok || gerr.Name != "d.service" {
+		t.Fatalf("expected GroupScheduleError for d.service, got %v", err)
+	}
+	if got := scheduleOf(t, r); len(got) != 0 {
+		t.Errorf("failed group left Units scheduled: %v", got)
+	}
+
+	// Peers are placed before the Units requiring them
+	if err := r.ScheduleGroup([]string{"b.service", "c.service"}, NewFirstFitPlacement()); err != nil {
+		t.Fatalf("unexpected error from ScheduleGroup: %v", err)
+	}
+	want := map[string]string{"b.service": "XXX", "c.service": "XXX"}
+	if got := scheduleOf(t, r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got schedule %v, want %v", got, want)
+	}
+}
+
+func TestScheduleGroupRollback(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	r.SetPlacementHistory(true)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "")
+
+	// b.service is scheduled elsewhere while the group is being placed,
+	// so the decision already written for a.service is withdrawn
+	placement := PlacementFunc(func(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+		if u.Name == "b.service" {
+			if err := r.ScheduleUnit(u.Name, "YYY"); err != nil {
+				t.Fatalf("failed scheduling Unit(%s): %v", u.Name, err)
+			}
+		}
+		return "XXX", nil
+	})
+	err := r.ScheduleGroup([]string{"a.service", "b.service"}, placement)
+	if gerr, ok := err.(*GroupScheduleError); !ok || gerr.Name != "b.service" {
+		t.Fatalf("expected GroupScheduleError for b.service, got %v", err)
+	}
+	want := map[string]string{"b.service": "YYY"}
+	if got := scheduleOf(t, r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got schedule %v, want %v", got, want)
+	}
+
+	// Nothing recorded for the withdrawn decision survives it
+	if _, idx, err := r.getRaw(r.jobScheduledAtPath("a.service")); err != nil || idx != 0 {
+		t.Errorf("withdrawn decision left scheduling time of a.service: idx=%d err=%v", idx, err)
+	}
+	if records, err := r.PlacementHistory("a.service", 0); err != nil || len(records) != 0 {
+		t.Errorf("withdrawn decision left placement history of a.service: %v err=%v", records, err)
+	}
+}
+
+func TestScheduleGroupContended(t *testing.T) {
+	kAPI := newMemKeysAPI()
+	r := NewEtcdRegistry(kAPI, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "")
+
+	// Another party scheduling a group including b.service holds its lease
+	mgr := lease.NewEtcdLeaseManager(kAPI, "/fleet/", time.Second)
+	l, err := mgr.AcquireLease(groupLeaseName("b.service"), "other", 0, time.Minute)
+	if err != nil || l == nil {
+		t.Fatalf("failed acquiring lease: %v", err)
+	}
+	if err := r.ScheduleGroup([]string{"a.service", "b.service"}, nil); err != ErrGroupContended {
+		t.Fatalf("expected ErrGroupContended, got %v", err)
+	}
+	if got := scheduleOf(t, r); len(got) != 0 {
+		t.Errorf("contended group scheduled Units: %v", got)
+	}
+	if held, err := mgr.GetLease(groupLeaseName("a.service")); err != nil || held != nil {
+		t.Errorf("contended group left a.service leased: %v err=%v", held, err)
+	}
+
+	if err := l.Release(); err != nil {
+		t.Fatalf("failed releasing lease: %v", err)
+	}
+	if err := r.ScheduleGroup([]string{"a.service", "b.service"}, nil); err != nil {
+		t.Fatalf("unexpected error from ScheduleGroup: %v", err)
+	}
+	for _, name := range []string{"a.service", "b.service"} {
+		if held, err := mgr.GetLease(groupLeaseName(name)); err != nil || held != nil {
+			t.Errorf("ScheduleGroup left %s leased: %v err=%v", name, held, err)
+		}
+	}
+}
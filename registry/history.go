@@ -0,0 +1,150 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/log"
+)
+
+const (
+	historyPrefix = "history"
+
+	// placementHistoryDepth is the number of PlacementRecords retained
+	// for each Unit; older records are discarded as new ones are added
+	placementHistoryDepth = 16
+)
+
+// PlacementRecord describes a Unit being scheduled or moved to a machine
+type PlacementRecord struct {
+	MachineID string
+	Time      time.Time
+}
+
+// recordPlacement appends a PlacementRecord for the named Unit and machine
+// to the Unit's placement history, if enabled with SetPlacementHistory,
+// and discards the oldest records beyond placementHistoryDepth. Like
+// recordScheduledAt, a failure is logged rather than failing an otherwise
+// successful scheduling operation. The key of the record is returned, or
+// an empty string if none was written.
+func (r *EtcdRegistry) recordPlacement(name, machID string) string {
+	if !r.placementHistory {
+		return ""
+	}
+	val, err := marshal(PlacementRecord{MachineID: machID, Time: time.Now().UTC()})
+	if err != nil {
+		log.Warningf("Failed recording placement of Unit(%s): %v", name, err)
+		return ""
+	}
+	dir := r.prefixed(historyPrefix, name)
+	res, err := r.kAPI.CreateInOrder(r.ctx(), dir, val, nil)
+	if err != nil {
+		log.Warningf("Failed recording placement of Unit(%s): %v", name, keyCollisionError(err, dir))
+		return ""
+	}
+	r.trimPlacementHistory(name)
+	return res.Node.Key
+}
+
+// trimPlacementHistory discards the oldest records of the named Unit's
+// placement history beyond placementHistoryDepth. A single record is added
+// at a time, so at most one is usually discarded.
+func (r *EtcdRegistry) trimPlacementHistory(name string) {
+	nodes, err := r.placementNodes(name)
+	if err != nil {
+		log.Warningf("Failed trimming placement history of Unit(%s): %v", name, err)
+		return
+	}
+	for len(nodes) > placementHistoryDepth {
+		_, err := r.kAPI.Delete(r.ctx(), nodes[0].Key, nil)
+		if err != nil && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			log.Warningf("Failed trimming placement history of Unit(%s): %v", name, err)
+			return
+		}
+		nodes = nodes[1:]
+	}
+}
+
+// placementNodes returns the nodes of the named Unit's placement history,
+// oldest first
+func (r *EtcdRegistry) placementNodes(name string) ([]*etcd.Node, error) {
+	opts := &etcd.GetOptions{
+		Sort: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), r.prefixed(historyPrefix, name), opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+	return res.Node.Nodes, nil
+}
+
+// PlacementHistory returns up to limit of the most recent machines the
+// named Unit was scheduled or moved to, newest first. A limit of zero or
+// less, or beyond 16, returns the entire history retained, which covers
+// the last 16 placements. The history is kept after a Unit is unscheduled,
+// so it also shows where a Unit ran before it was last rescheduled, and is
+// removed along with the Unit. The history is only recorded if enabled
+// with SetPlacementHistory.
+func (r *EtcdRegistry) PlacementHistory(name string, limit int) ([]PlacementRecord, error) {
+	nodes, err := r.placementNodes(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 || limit > placementHistoryDepth {
+		// Records beyond the depth remain if trimming them failed
+		limit = placementHistoryDepth
+	}
+	var records []PlacementRecord
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if len(records) == limit {
+			break
+		}
+		var pr PlacementRecord
+		if err := r.unmarshal(nodes[i].Value, &pr); err != nil {
+			return nil, &ParseError{Key: nodes[i].Key, Err: err}
+		}
+		records = append(records, pr)
+	}
+	return records, nil
+}
+
+// removePlacementRecord removes a single record, identified by its key,
+// from the named Unit's placement history
+func (r *EtcdRegistry) removePlacementRecord(name, key string) {
+	_, err := r.kAPI.Delete(r.ctx(), key, nil)
+	if err != nil && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		log.Warningf("Failed removing placement record of Unit(%s): %v", name, keyCollisionError(err, key))
+	}
+}
+
+// removePlacementHistory removes the placement history of the named Unit
+func (r *EtcdRegistry) removePlacementHistory(name string) error {
+	key := r.prefixed(historyPrefix, name)
+	opts := &etcd.DeleteOptions{
+		Recursive: true,
+	}
+	_, err := r.kAPI.Delete(r.ctx(), key, opts)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = nil
+	}
+	return keyCollisionError(err, key)
+}
@@ -19,11 +19,14 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"strings"
+	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
 
 	"github.com/coreos/fleet/job"
 	"github.com/coreos/fleet/log"
+	"github.com/coreos/fleet/machine"
 	"github.com/coreos/fleet/unit"
 )
 
@@ -54,6 +57,7 @@ func (r *EtcdRegistry) Schedule() ([]job.ScheduledUnit, error) {
 		u := &job.ScheduledUnit{
 			Name:            name,
 			TargetMachineID: dirToTargetMachineID(dir),
+			ScheduledAt:     dirToScheduledAt(dir),
 		}
 		heartbeats[name] = dirToHeartbeat(dir)
 		uMap[name] = u
@@ -162,6 +166,62 @@ func (r *EtcdRegistry) Unit(name string) (*job.Unit, error) {
 	return r.dirToUnit(res.Node, r.getUnitByHash)
 }
 
+// UnitFile retrieves only the UnitFile of the Unit by the given name from
+// the Registry, without the bookkeeping consulted to build a full job.Unit.
+// Returns nil if no such Unit exists, and any error encountered.
+func (r *EtcdRegistry) UnitFile(name string) (*unit.UnitFile, error) {
+	key := r.prefixed(jobPrefix, name, "object")
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var jm jobModel
+	if err = r.unmarshal(res.Node.Value, &jm); err != nil {
+		return nil, &ParseError{Key: key, Err: err}
+	}
+	uf := r.getUnitByHash(jm.UnitHash)
+	if uf == nil {
+		return nil, &ParseError{Key: key, Err: errors.New("associated unit file not found")}
+	}
+	return uf, nil
+}
+
+// UnitMatchesScheduled determines whether the given Unit, as declared by an
+// operator, matches the one stored in the Registry. It returns false if no
+// Unit of that name is stored, or if its unit file differs from the
+// declared one. Unless machID is empty, it also returns false if a
+// non-global Unit is not scheduled to the identified machine. Only the
+// hashes of the unit files are compared, so the stored unit file itself is
+// never fetched.
+func (r *EtcdRegistry) UnitMatchesScheduled(u *job.Unit, machID string) (bool, error) {
+	key := r.prefixed(jobPrefix, u.Name, "object")
+	val, idx, err := r.getRaw(key)
+	if err != nil || idx == 0 {
+		return false, err
+	}
+
+	var jm jobModel
+	if err = r.unmarshal(val, &jm); err != nil {
+		return false, &ParseError{Key: key, Err: err}
+	}
+	if jm.UnitHash != u.Unit.Hash() {
+		return false, nil
+	}
+
+	if machID == "" || u.IsGlobal() {
+		return true, nil
+	}
+	target, _, err := r.UnitTarget(u.Name)
+	if err != nil {
+		return false, err
+	}
+	return target == machID, nil
+}
+
 // dirToUnit takes a Node containing a Job's constituent objects (in child
 // nodes) and returns a *job.Unit, or any error encountered
 func (r *EtcdRegistry) dirToUnit(dir *etcd.Node, unitHashLookupFunc func(unit.Hash) *unit.UnitFile) (*job.Unit, error) {
@@ -176,20 +236,23 @@ func (r *EtcdRegistry) dirToUnit(dir *etcd.Node, unitHashLookupFunc func(unit.Ha
 	if objNode == nil {
 		return nil, nil
 	}
+	machID := dirToTargetMachineID(dir)
 	u, err := r.getUnitFromObjectNode(objNode, unitHashLookupFunc)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Key: objKey, MachineID: machID, Err: err}
 	}
 	if u == nil {
-		return nil, fmt.Errorf("unable to parse Unit in Registry at key %s", objKey)
+		return nil, &ParseError{Key: objKey, MachineID: machID, Err: errors.New("associated unit file not found")}
 	}
 	if tgtstate := dirToTargetState(dir); tgtstate != "" {
 		ts, err := job.ParseJobState(tgtstate)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse Unit(%s) target-state: %v", u.Name, err)
+			key := path.Join(dir.Key, "target-state")
+			return nil, &ParseError{Key: key, MachineID: machID, Err: fmt.Errorf("invalid target-state of Unit(%s): %v", u.Name, err)}
 		}
 		u.TargetState = ts
 	}
+	u.Annotations = dirToAnnotations(dir)
 
 	return u, nil
 }
@@ -212,6 +275,7 @@ func (r *EtcdRegistry) ScheduledUnit(name string) (*job.ScheduledUnit, error) {
 	su := job.ScheduledUnit{
 		Name:            name,
 		TargetMachineID: dirToTargetMachineID(res.Node),
+		ScheduledAt:     dirToScheduledAt(res.Node),
 	}
 
 	var us *unit.UnitState
@@ -228,6 +292,43 @@ func (r *EtcdRegistry) ScheduledUnit(name string) (*job.ScheduledUnit, error) {
 	return &su, nil
 }
 
+// UnitWithState retrieves the Unit by the given name from the Registry along
+// with its current JobState. Both are derived from a single read of the
+// Unit's objects, so they are consistent with one another. The JobState is
+// nil if the Unit is not scheduled, or its target machine has not yet
+// reported its state. Returns a nil Unit if no such Unit exists, and any
+// error encountered.
+func (r *EtcdRegistry) UnitWithState(name string) (*job.Unit, *job.JobState, error) {
+	key := r.prefixed(jobPrefix, name)
+	opts := &etcd.GetOptions{
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), key, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, nil, err
+	}
+
+	u, err := r.dirToUnit(res.Node, r.getUnitByHash)
+	if err != nil || u == nil {
+		return nil, nil, err
+	}
+
+	tgt := dirToTargetMachineID(res.Node)
+	if tgt == "" {
+		return u, nil, nil
+	}
+	us, err := r.getUnitState(name, tgt)
+	if err != nil || us == nil {
+		return u, nil, err
+	}
+
+	js := determineJobState(dirToHeartbeat(res.Node), tgt, us)
+	return u, &js, nil
+}
+
 func (r *EtcdRegistry) UnscheduleUnit(name, machID string) error {
 	key := r.jobTargetAgentPath(name)
 	opts := &etcd.DeleteOptions{
@@ -237,8 +338,159 @@ func (r *EtcdRegistry) UnscheduleUnit(name, machID string) error {
 	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
 		err = nil
 	}
+	if err == nil {
+		r.clearScheduledAt(name)
+	}
 
-	return err
+	return keyCollisionError(err, key)
+}
+
+// MoveUnit atomically reschedules the named Unit from one machine to
+// another. ErrScheduleChanged is returned if the Unit is not scheduled to
+// the machine identified by from at the time of the move.
+func (r *EtcdRegistry) MoveUnit(name, from, to string) error {
+	if err := r.throttleSchedule(); err != nil {
+		return err
+	}
+	key := r.jobTargetAgentPath(name)
+	opts := &etcd.SetOptions{
+		PrevValue: from,
+	}
+	_, err := r.kAPI.Set(r.ctx(), key, to, opts)
+	if isEtcdError(err, etcd.ErrorCodeTestFailed) || isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = ErrScheduleChanged
+	}
+	if err == nil {
+		r.recordScheduledAt(name)
+		r.recordPlacement(name, to)
+	}
+	return keyCollisionError(err, key)
+}
+
+// UnitsScheduledBetween returns the ScheduledUnits which were last scheduled
+// to their current target machine at or after start, and before end,
+// ordered by name. Units with no recorded scheduling time are excluded.
+func (r *EtcdRegistry) UnitsScheduledBetween(start, end time.Time) ([]job.ScheduledUnit, error) {
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []job.ScheduledUnit
+	for _, su := range sUnits {
+		if su.ScheduledAt.IsZero() || su.ScheduledAt.Before(start) || !su.ScheduledAt.Before(end) {
+			continue
+		}
+		matching = append(matching, su)
+	}
+	return matching, nil
+}
+
+// UnitsWhere returns the Units expected to run on machines satisfying
+// machPred, filtered by unitPred, indexed by machine ID. A Unit is expected
+// to run on a machine if it is scheduled to it or, for global Units, if
+// the machine meets its requirements. Only machines currently present in
+// the cluster are considered, and machines without any matching Unit are
+// omitted. The Units for each machine are sorted by name. A nil predicate
+// matches everything.
+func (r *EtcdRegistry) UnitsWhere(machPred func(machine.MachineState) bool, unitPred func(job.Unit) bool) (map[string][]job.Unit, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]string, len(sUnits))
+	for _, su := range sUnits {
+		targets[su.Name] = su.TargetMachineID
+	}
+
+	matching := make(map[string][]job.Unit)
+	for _, ms := range machines {
+		ms := ms
+		if machPred != nil && !machPred(ms) {
+			continue
+		}
+		for _, u := range units {
+			if u.IsGlobal() {
+				if !machine.HasMetadata(&ms, u.RequiredTargetMetadata()) || !machine.HasRoles(&ms, u.RequiredRoles()) || !machine.HasConstraints(&ms, u.RequiredConstraints()) {
+					continue
+				}
+			} else if targets[u.Name] != ms.ID {
+				continue
+			}
+			if unitPred != nil && !unitPred(u) {
+				continue
+			}
+			matching[ms.ID] = append(matching[ms.ID], u)
+		}
+	}
+	return matching, nil
+}
+
+// DependentUnits returns the Units which would be affected by destroying
+// the named Unit: those naming it as a peer with MachineOf, and those
+// conflicting with it, whether by name or by a pattern matching it. The
+// Units are sorted by name, and a Unit is not considered dependent on
+// itself. The named Unit need not exist, so dependents left behind by a
+// Unit already destroyed can be found too.
+func (r *EtcdRegistry) DependentUnits(name string) ([]job.Unit, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+
+	var dependents []job.Unit
+	for _, u := range units {
+		if u.Name != name && dependsOn(&u, name) {
+			dependents = append(dependents, u)
+		}
+	}
+	return dependents, nil
+}
+
+// dependsOn reports whether the given Unit names the named Unit as a peer,
+// or conflicts with it
+func dependsOn(u *job.Unit, name string) bool {
+	for _, peer := range u.Peers() {
+		if peer == name {
+			return true
+		}
+	}
+	for _, conflict := range u.Conflicts() {
+		if globMatches(conflict, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordScheduledAt records the current time as the time at which the named
+// Unit was scheduled. This is written separately from, and therefore not
+// atomically with, the scheduling decision itself; a failure is logged
+// rather than failing an otherwise successful scheduling operation.
+func (r *EtcdRegistry) recordScheduledAt(name string) {
+	key := r.jobScheduledAtPath(name)
+	val := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := r.kAPI.Set(r.ctx(), key, val, nil); err != nil {
+		log.Warningf("Failed recording scheduling time of Unit(%s): %v", name, keyCollisionError(err, key))
+	}
+}
+
+// clearScheduledAt removes the scheduling time of the named Unit
+func (r *EtcdRegistry) clearScheduledAt(name string) {
+	key := r.jobScheduledAtPath(name)
+	_, err := r.kAPI.Delete(r.ctx(), key, nil)
+	if err != nil && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		log.Warningf("Failed clearing scheduling time of Unit(%s): %v", name, keyCollisionError(err, key))
+	}
 }
 
 // getValueInDir takes a *etcd.Node containing a job, and returns the value of
@@ -263,6 +515,38 @@ func dirToTargetState(dir *etcd.Node) (tgtState string) {
 	return getValueInDir(dir, "target-state")
 }
 
+// dirToAnnotations extracts the annotations of a Unit from its directory,
+// returning nil if it has none
+func dirToAnnotations(dir *etcd.Node) map[string]string {
+	annoKey := path.Join(dir.Key, "annotations")
+	for _, node := range dir.Nodes {
+		if node.Key != annoKey || len(node.Nodes) == 0 {
+			continue
+		}
+		annotations := make(map[string]string, len(node.Nodes))
+		for _, anno := range node.Nodes {
+			annotations[path.Base(anno.Key)] = anno.Value
+		}
+		return annotations
+	}
+	return nil
+}
+
+// dirToScheduledAt returns the time at which the Unit in the given
+// directory was scheduled, or the zero time if it is not known
+func dirToScheduledAt(dir *etcd.Node) time.Time {
+	val := getValueInDir(dir, "scheduled-at")
+	if val == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		log.Debugf("Ignoring invalid scheduled-at in %s: %v", dir.Key, err)
+		return time.Time{}
+	}
+	return t
+}
+
 func dirToHeartbeat(dir *etcd.Node) (heartbeat string) {
 	return getValueInDir(dir, "job-state")
 }
@@ -273,7 +557,7 @@ func dirToHeartbeat(dir *etcd.Node) (heartbeat string) {
 func (r *EtcdRegistry) getUnitFromObjectNode(node *etcd.Node, unitHashLookupFunc func(unit.Hash) *unit.UnitFile) (*job.Unit, error) {
 	var err error
 	var jm jobModel
-	if err = unmarshal(node.Value, &jm); err != nil {
+	if err = r.unmarshal(node.Value, &jm); err != nil {
 		return nil, err
 	}
 
@@ -312,7 +596,11 @@ func (r *EtcdRegistry) DestroyUnit(name string) error {
 			err = errors.New("job does not exist")
 		}
 
-		return err
+		return keyCollisionError(err, key)
+	}
+
+	if err := r.removePlacementHistory(name); err != nil {
+		log.Warningf("Failed removing placement history of Unit(%s): %v", name, err)
 	}
 
 	// TODO(jonboulle): add unit reference counting and actually destroying Units
@@ -321,6 +609,12 @@ func (r *EtcdRegistry) DestroyUnit(name string) error {
 
 // CreateUnit attempts to store a Unit and its associated unit file in the registry
 func (r *EtcdRegistry) CreateUnit(u *job.Unit) (err error) {
+	for key := range u.Annotations {
+		if err := validateAnnotationKey(key); err != nil {
+			return err
+		}
+	}
+
 	if err := r.storeOrGetUnitFile(u.Unit); err != nil {
 		return err
 	}
@@ -343,24 +637,281 @@ func (r *EtcdRegistry) CreateUnit(u *job.Unit) (err error) {
 		if isEtcdError(err, etcd.ErrorCodeNodeExist) {
 			err = errors.New("job already exists")
 		}
+		err = keyCollisionError(err, key)
 		return
 	}
 
+	for k, v := range u.Annotations {
+		annoKey := r.jobAnnotationPath(u.Name, k)
+		if _, err = r.kAPI.Set(r.ctx(), annoKey, v, nil); err != nil {
+			err = keyCollisionError(err, annoKey)
+			return
+		}
+	}
+
 	return r.SetUnitTargetState(u.Name, u.TargetState)
 }
 
+// SetUnitAnnotation sets a single annotation on an existing Unit, replacing
+// any previous value for the same key. Annotations are stored alongside,
+// rather than within, the Unit's object, so this neither reschedules the
+// Unit nor is affected by ReplaceUnitFile.
+func (r *EtcdRegistry) SetUnitAnnotation(name, key, value string) error {
+	if err := validateAnnotationKey(key); err != nil {
+		return err
+	}
+
+	obj := r.prefixed(jobPrefix, name, "object")
+	if _, err := r.kAPI.Get(r.ctx(), obj, nil); err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = errors.New("job does not exist")
+		}
+		return err
+	}
+
+	annoKey := r.jobAnnotationPath(name, key)
+	_, err := r.kAPI.Set(r.ctx(), annoKey, value, nil)
+	return keyCollisionError(err, annoKey)
+}
+
+// validateAnnotationKey ensures an annotation key can be stored as a single
+// etcd key
+func validateAnnotationKey(key string) error {
+	if key == "" || strings.Contains(key, "/") || key == "." || key == ".." {
+		return fmt.Errorf("invalid annotation key %q", key)
+	}
+	return nil
+}
+
+// ReplaceUnitFile swaps the UnitFile of an existing Unit for the given one.
+// Only the Unit's object is rewritten; its target machine, target state,
+// heartbeat and reported UnitStates are all left untouched. This differs
+// from DestroyUnit followed by CreateUnit, which loses all of that state.
+func (r *EtcdRegistry) ReplaceUnitFile(name string, uf *unit.UnitFile) error {
+	j := job.NewJob(name, *uf)
+	if err := j.ValidateRequirements(); err != nil {
+		return err
+	}
+
+	if err := r.storeOrGetUnitFile(*uf); err != nil {
+		return err
+	}
+
+	jm := jobModel{
+		Name:     name,
+		UnitHash: uf.Hash(),
+	}
+	val, err := marshal(jm)
+	if err != nil {
+		return err
+	}
+
+	opts := &etcd.SetOptions{
+		PrevExist: etcd.PrevExist,
+	}
+	key := r.prefixed(jobPrefix, name, "object")
+	_, err = r.kAPI.Set(r.ctx(), key, val, opts)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = errors.New("job does not exist")
+	}
+	return keyCollisionError(err, key)
+}
+
 func (r *EtcdRegistry) SetUnitTargetState(name string, state job.JobState) error {
 	key := r.jobTargetStatePath(name)
 	_, err := r.kAPI.Set(r.ctx(), key, string(state), nil)
-	return err
+	return keyCollisionError(err, key)
 }
 
 func (r *EtcdRegistry) ScheduleUnit(name string, machID string) error {
+	_, err := r.ScheduleUnitWithIndex(name, machID)
+	return err
+}
+
+// ScheduleUnitIfMachinePresent schedules the named Unit to the given machine
+// only if that machine is currently present in the cluster, i.e. its state
+// has been published and has not expired. It returns false, without
+// scheduling the Unit, if the machine is absent. This is best-effort: the
+// machine may still disappear between the check and the scheduling
+// decision, in which case the Unit is rescheduled as usual once its absence
+// is noticed. A CapacityError is returned if the machine already runs the
+// maximum number of Units it allows.
+func (r *EtcdRegistry) ScheduleUnitIfMachinePresent(name, machID string) (bool, error) {
+	key := r.prefixed(machinePrefix, machID, "object")
+	val, idx, err := r.getRaw(key)
+	if err != nil {
+		return false, err
+	}
+	if idx == 0 {
+		return false, nil
+	}
+	ms, err := r.decodeMachineState(val)
+	if err != nil {
+		return false, &ParseError{Key: key, MachineID: machID, Err: err}
+	}
+	if ms.MaxUnits > 0 {
+		full, err := r.MachineAtCapacity(machID)
+		if err != nil {
+			return false, err
+		}
+		if full {
+			return false, &CapacityError{MachineID: machID, MaxUnits: ms.MaxUnits}
+		}
+	}
+	if err := r.ScheduleUnit(name, machID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ScheduleUnitWithIndex behaves like ScheduleUnit, additionally returning
+// the etcd index of the scheduling decision. Passing that index to
+// WaitForIndex before reading the schedule guarantees the read reflects
+// the decision, even if it is served by a lagging etcd member.
+func (r *EtcdRegistry) ScheduleUnitWithIndex(name string, machID string) (uint64, error) {
+	idx, _, err := r.scheduleUnit(name, machID)
+	return idx, err
+}
+
+// scheduleUnit behaves like ScheduleUnitWithIndex, additionally returning
+// the key of the PlacementRecord written for the decision, if any
+func (r *EtcdRegistry) scheduleUnit(name string, machID string) (uint64, string, error) {
+	if err := r.throttleSchedule(); err != nil {
+		return 0, "", err
+	}
 	key := r.jobTargetAgentPath(name)
 	opts := &etcd.SetOptions{
 		PrevExist: etcd.PrevNoExist,
 	}
-	_, err := r.kAPI.Set(r.ctx(), key, machID, opts)
+	res, err := r.kAPI.Set(r.ctx(), key, machID, opts)
+	if err != nil {
+		return 0, "", keyCollisionError(err, key)
+	}
+	r.recordScheduledAt(name)
+	record := r.recordPlacement(name, machID)
+	return res.Node.ModifiedIndex, record, nil
+}
+
+// UnitTarget returns the ID of the machine to which the named Unit is
+// scheduled, along with the etcd index at which that decision was last
+// modified. An empty machine ID and a zero index are returned if the Unit
+// is not scheduled. The index may be passed to ScheduleUnitAtIndex.
+func (r *EtcdRegistry) UnitTarget(name string) (string, uint64, error) {
+	return r.getRaw(r.jobTargetAgentPath(name))
+}
+
+// UnitTargetTTL returns the time remaining until the scheduling decision of
+// the named Unit expires, or NoTTL if the decision is permanent, which is
+// the case unless the schedule is managed with a TTL outside of fleet.
+// ErrScheduleChanged is returned if the Unit is not scheduled to the given
+// machine.
+func (r *EtcdRegistry) UnitTargetTTL(name, machID string) (time.Duration, error) {
+	tgt, ttl, err := r.keyTTL(r.jobTargetAgentPath(name))
+	if err != nil {
+		return 0, err
+	}
+	if tgt != machID {
+		return 0, ErrScheduleChanged
+	}
+	return ttl, nil
+}
+
+// NodeInfo describes the etcd node holding a value, rather than the value
+// itself
+type NodeInfo struct {
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+	// TTL is the time remaining until the node expires, or NoTTL if it
+	// does not expire
+	TTL time.Duration
+	// Expiration is the time at which the node expires, or the zero
+	// time if it does not expire
+	Expiration time.Time
+}
+
+// ScheduleNodeInfo returns the etcd node metadata of the scheduling
+// decision of the named Unit, such as for fencing writes with the indexes
+// or for inspecting a schedule managed with a TTL outside of fleet.
+// ErrScheduleChanged is returned if the Unit is not scheduled to the given
+// machine.
+func (r *EtcdRegistry) ScheduleNodeInfo(name, machID string) (*NodeInfo, error) {
+	res, err := r.kAPI.Get(r.ctx(), r.jobTargetAgentPath(name), nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = ErrScheduleChanged
+		}
+		return nil, err
+	}
+	if res.Node.Value != machID {
+		return nil, ErrScheduleChanged
+	}
+
+	info := &NodeInfo{
+		CreatedIndex:  res.Node.CreatedIndex,
+		ModifiedIndex: res.Node.ModifiedIndex,
+		TTL:           NoTTL,
+	}
+	switch {
+	case res.Node.Expiration != nil:
+		info.Expiration = *res.Node.Expiration
+		info.TTL = info.Expiration.Sub(time.Now())
+		if info.TTL < 0 {
+			info.TTL = 0
+		}
+	case res.Node.TTL > 0:
+		info.TTL = res.Node.TTLDuration()
+		info.Expiration = time.Now().Add(info.TTL)
+	}
+	return info, nil
+}
+
+// MakeSchedulePermanent removes any TTL from the scheduling decision of the
+// named Unit, so a Unit scheduled with a TTL outside of fleet stays on its
+// machine rather than being rescheduled when the TTL lapses. The decision
+// itself is preserved. ErrScheduleChanged is returned if the Unit is not
+// scheduled to the given machine, including if it is rescheduled while
+// the TTL is being removed.
+func (r *EtcdRegistry) MakeSchedulePermanent(name, machID string) error {
+	return r.setKeyTTLIf(r.jobTargetAgentPath(name), 0, func(tgt string) error {
+		if tgt != machID {
+			return ErrScheduleChanged
+		}
+		return nil
+	})
+}
+
+// ScheduleUnitAtIndex schedules the named Unit to the given machine only if
+// its scheduling decision has not changed since the provided index, as
+// returned by UnitTarget. An index of zero requires that the Unit is not
+// currently scheduled. ErrIndexMismatch is returned if the condition does
+// not hold.
+func (r *EtcdRegistry) ScheduleUnitAtIndex(name, machID string, idx uint64) error {
+	if err := r.throttleSchedule(); err != nil {
+		return err
+	}
+	_, err := r.setAtIndex(r.jobTargetAgentPath(name), machID, idx)
+	if err == nil {
+		r.recordScheduledAt(name)
+		r.recordPlacement(name, machID)
+	}
+	return err
+}
+
+// UnitTargetState returns the target state of the named Unit along with
+// the etcd index at which it was last modified. An empty state and a zero
+// index are returned if no target state is set. The index may be passed to
+// SetUnitTargetStateAtIndex.
+func (r *EtcdRegistry) UnitTargetState(name string) (job.JobState, uint64, error) {
+	val, idx, err := r.getRaw(r.jobTargetStatePath(name))
+	return job.JobState(val), idx, err
+}
+
+// SetUnitTargetStateAtIndex sets the target state of the named Unit only if
+// it has not changed since the provided index, as returned by
+// UnitTargetState. ErrIndexMismatch is returned if the condition does not
+// hold.
+func (r *EtcdRegistry) SetUnitTargetStateAtIndex(name string, state job.JobState, idx uint64) error {
+	_, err := r.setAtIndex(r.jobTargetStatePath(name), string(state), idx)
 	return err
 }
 
@@ -371,3 +922,194 @@ func (r *EtcdRegistry) jobTargetAgentPath(jobName string) string {
 func (r *EtcdRegistry) jobTargetStatePath(jobName string) string {
 	return r.prefixed(jobPrefix, jobName, "target-state")
 }
+
+func (r *EtcdRegistry) jobScheduledAtPath(jobName string) string {
+	return r.prefixed(jobPrefix, jobName, "scheduled-at")
+}
+
+func (r *EtcdRegistry) jobAnnotationPath(jobName, key string) string {
+	return r.prefixed(jobPrefix, jobName, "annotations", key)
+}
+
+// MachineUnit is a Unit scheduled to a machine, along with the UnitState
+// which that machine last reported for it, if any
+type MachineUnit struct {
+	job.ScheduledUnit
+	UnitState *unit.UnitState
+}
+
+// MachineUnitsWithStates returns the Units scheduled to the given machine,
+// keyed by name, each combined with the UnitState the machine reported for
+// it. The schedule and the UnitStates are each read with a single request,
+// rather than one request per Unit. Global Units are not included, as they
+// are never scheduled to a particular machine.
+func (r *EtcdRegistry) MachineUnitsWithStates(machID string) (map[string]MachineUnit, error) {
+	key := r.prefixed(jobPrefix)
+	opts := &etcd.GetOptions{
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), key, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	units := make(map[string]MachineUnit)
+	heartbeats := make(map[string]string)
+	for _, dir := range res.Node.Nodes {
+		if dirToTargetMachineID(dir) != machID {
+			continue
+		}
+		_, name := path.Split(dir.Key)
+		units[name] = MachineUnit{
+			ScheduledUnit: job.ScheduledUnit{
+				Name:            name,
+				TargetMachineID: machID,
+				ScheduledAt:     dirToScheduledAt(dir),
+			},
+		}
+		heartbeats[name] = dirToHeartbeat(dir)
+	}
+	if len(units) == 0 {
+		return units, nil
+	}
+
+	states, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+	for name, mu := range units {
+		mu.UnitState = states[MUSKey{name: name, machID: machID}]
+		js := determineJobState(heartbeats[name], machID, mu.UnitState)
+		mu.State = &js
+		units[name] = mu
+	}
+	return units, nil
+}
+
+// UnitSummary describes a Unit stored in the Registry without the contents
+// of its unit file. Properties derived from the unit file, such as its
+// requirements or Priority, are therefore not included; UnitHash allows
+// the unit file to be fetched with Unit or UnitFile when it is needed.
+type UnitSummary struct {
+	job.ScheduledUnit
+	UnitHash    unit.Hash
+	TargetState job.JobState
+	Annotations map[string]string
+}
+
+// UnitSummaries returns a summary of every Unit scheduled to the given
+// machine, or of every Unit if machID is empty, ordered by name. Unlike
+// Units, the unit files are never read, making this suitable for listing
+// many Units at once.
+func (r *EtcdRegistry) UnitSummaries(machID string) ([]UnitSummary, error) {
+	key := r.prefixed(jobPrefix)
+	opts := &etcd.GetOptions{
+		Sort:      true,
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), key, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var summaries []UnitSummary
+	heartbeats := make(map[string]string)
+	for _, dir := range res.Node.Nodes {
+		tgt := dirToTargetMachineID(dir)
+		if machID != "" && tgt != machID {
+			continue
+		}
+		objVal := getValueInDir(dir, "object")
+		if objVal == "" {
+			continue
+		}
+		var jm jobModel
+		if err := r.unmarshal(objVal, &jm); err != nil {
+			log.Errorf("Failed to parse Unit from etcd: %v", &ParseError{Key: path.Join(dir.Key, "object"), MachineID: tgt, Err: err})
+			continue
+		}
+
+		us := UnitSummary{
+			ScheduledUnit: job.ScheduledUnit{
+				Name:            jm.Name,
+				TargetMachineID: tgt,
+				ScheduledAt:     dirToScheduledAt(dir),
+			},
+			UnitHash:    jm.UnitHash,
+			Annotations: dirToAnnotations(dir),
+		}
+		if tgtstate := dirToTargetState(dir); tgtstate != "" {
+			ts, err := job.ParseJobState(tgtstate)
+			if err != nil {
+				key := path.Join(dir.Key, "target-state")
+				log.Errorf("Failed to parse Unit from etcd: %v", &ParseError{Key: key, MachineID: tgt, Err: fmt.Errorf("invalid target-state of Unit(%s): %v", jm.Name, err)})
+				continue
+			}
+			us.TargetState = ts
+		}
+		heartbeats[jm.Name] = dirToHeartbeat(dir)
+		summaries = append(summaries, us)
+	}
+	if len(summaries) == 0 {
+		return summaries, nil
+	}
+
+	states, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+	for i := range summaries {
+		su := &summaries[i].ScheduledUnit
+		us := states[MUSKey{name: su.Name, machID: su.TargetMachineID}]
+		js := determineJobState(heartbeats[su.Name], su.TargetMachineID, us)
+		su.State = &js
+	}
+	return summaries, nil
+}
+
+// UnitsByPriority returns the Units scheduled to the given machine, in the
+// order in which they should be launched: by descending Priority, and by
+// name among Units of equal Priority. Global Units are not included, as
+// they are never scheduled to a particular machine.
+func (r *EtcdRegistry) UnitsByPriority(machID string) ([]job.Unit, error) {
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make(map[string]bool)
+	for _, su := range sUnits {
+		if su.TargetMachineID == machID {
+			scheduled[su.Name] = true
+		}
+	}
+	if len(scheduled) == 0 {
+		return nil, nil
+	}
+
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	var ordered []job.Unit
+	for _, u := range units {
+		if scheduled[u.Name] {
+			ordered = append(ordered, u)
+		}
+	}
+	// Units are returned sorted by name, which a stable sort preserves
+	// among Units of equal Priority
+	sort.Stable(unitsByPriority(ordered))
+	return ordered, nil
+}
+
+type unitsByPriority []job.Unit
+
+func (up unitsByPriority) Len() int           { return len(up) }
+func (up unitsByPriority) Less(i, j int) bool { return up[i].Priority() > up[j].Priority() }
+func (up unitsByPriority) Swap(i, j int)      { up[i], up[j] = up[j], up[i] }
@@ -52,7 +52,7 @@ func (r *EtcdRegistry) UnitHeartbeat(name, machID string, ttl time.Duration) err
 		TTL: ttl,
 	}
 	_, err := r.kAPI.Set(r.ctx(), key, machID, opts)
-	return err
+	return keyCollisionError(err, key)
 }
 
 func (r *EtcdRegistry) ClearUnitHeartbeat(name string) {
@@ -60,6 +60,13 @@ func (r *EtcdRegistry) ClearUnitHeartbeat(name string) {
 	r.kAPI.Delete(r.ctx(), key, nil)
 }
 
+// RefreshUnitHeartbeatTTL extends (or shortens) the TTL of the heartbeat of
+// the named Unit without changing which machine it attributes the Unit to.
+// An error is returned if the Unit has no heartbeat.
+func (r *EtcdRegistry) RefreshUnitHeartbeatTTL(name string, ttl time.Duration) error {
+	return r.setKeyTTL(r.jobHeartbeatPath(name), ttl)
+}
+
 func (r *EtcdRegistry) jobHeartbeatPath(jobName string) string {
 	return r.prefixed(jobPrefix, jobName, "job-state")
 }
@@ -0,0 +1,809 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func TestScheduleUnitAtIndex(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	machID, idx, err := r.UnitTarget("foo.service")
+	if err != nil || machID != "" || idx != 0 {
+		t.Fatalf("unexpected result for unscheduled unit: machID=%q idx=%d err=%v", machID, idx, err)
+	}
+
+	if err := r.ScheduleUnitAtIndex("foo.service", "XXX", 0); err != nil {
+		t.Fatalf("unexpected error scheduling unscheduled unit: %v", err)
+	}
+	if err := r.ScheduleUnitAtIndex("foo.service", "YYY", 0); err != ErrIndexMismatch {
+		t.Fatalf("expected ErrIndexMismatch scheduling already-scheduled unit, got %v", err)
+	}
+
+	machID, idx, err = r.UnitTarget("foo.service")
+	if err != nil || machID != "XXX" || idx == 0 {
+		t.Fatalf("unexpected result for scheduled unit: machID=%q idx=%d err=%v", machID, idx, err)
+	}
+
+	if err := r.ScheduleUnitAtIndex("foo.service", "YYY", idx); err != nil {
+		t.Fatalf("unexpected error rescheduling unit at current index: %v", err)
+	}
+	if err := r.ScheduleUnitAtIndex("foo.service", "ZZZ", idx); err != ErrIndexMismatch {
+		t.Fatalf("expected ErrIndexMismatch rescheduling unit at stale index, got %v", err)
+	}
+
+	machID, newIdx, err := r.UnitTarget("foo.service")
+	if err != nil || machID != "YYY" || newIdx <= idx {
+		t.Fatalf("unexpected result for rescheduled unit: machID=%q idx=%d err=%v", machID, newIdx, err)
+	}
+}
+
+func TestSetUnitTargetStateAtIndex(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	if err := r.SetUnitTargetState("foo.service", job.JobStateLoaded); err != nil {
+		t.Fatalf("unexpected error setting target state: %v", err)
+	}
+	state, idx, err := r.UnitTargetState("foo.service")
+	if err != nil || state != job.JobStateLoaded || idx == 0 {
+		t.Fatalf("unexpected target state: state=%q idx=%d err=%v", state, idx, err)
+	}
+
+	// Another writer intervenes
+	if err := r.SetUnitTargetState("foo.service", job.JobStateInactive); err != nil {
+		t.Fatalf("unexpected error setting target state: %v", err)
+	}
+	if err := r.SetUnitTargetStateAtIndex("foo.service", job.JobStateLaunched, idx); err != ErrIndexMismatch {
+		t.Fatalf("expected ErrIndexMismatch at stale index, got %v", err)
+	}
+
+	_, idx, _ = r.UnitTargetState("foo.service")
+	if err := r.SetUnitTargetStateAtIndex("foo.service", job.JobStateLaunched, idx); err != nil {
+		t.Fatalf("unexpected error at current index: %v", err)
+	}
+	state, _, _ = r.UnitTargetState("foo.service")
+	if state != job.JobStateLaunched {
+		t.Fatalf("unexpected target state after CAS: %q", state)
+	}
+}
+
+func TestReplaceUnitFile(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	uf1, _ := unit.NewUnitFile("[Service]\nExecStart=/bin/true\n")
+	uf2, _ := unit.NewUnitFile("[Service]\nExecStart=/bin/false\n")
+	if err := r.ReplaceUnitFile("foo.service", uf2); err == nil {
+		t.Fatalf("expected error replacing UnitFile of nonexistent Unit")
+	}
+
+	u := job.Unit{Name: "foo.service", Unit: *uf1, TargetState: job.JobStateLaunched}
+	if err := r.CreateUnit(&u); err != nil {
+		t.Fatalf("unexpected error from CreateUnit: %v", err)
+	}
+	if err := r.ScheduleUnit("foo.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+	}
+	us := unit.NewUnitState("loaded", "active", "running", "XXX")
+	us.UnitHash = uf1.Hash().String()
+	r.SaveUnitState("foo.service", us, time.Minute)
+
+	before, err := r.DumpKeys()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpKeys: %v", err)
+	}
+
+	if err := r.ReplaceUnitFile("foo.service", uf2); err != nil {
+		t.Fatalf("unexpected error from ReplaceUnitFile: %v", err)
+	}
+
+	got, err := r.Unit("foo.service")
+	if err != nil || got == nil {
+		t.Fatalf("unexpected result from Unit: %v, %v", got, err)
+	}
+	if got.Unit.Hash() != uf2.Hash() {
+		t.Errorf("UnitFile was not replaced")
+	}
+	if got.TargetState != job.JobStateLaunched {
+		t.Errorf("target state changed to %q", got.TargetState)
+	}
+
+	after, err := r.DumpKeys()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpKeys: %v", err)
+	}
+	for _, key := range []string{
+		"/fleet/job/foo.service/target",
+		"/fleet/job/foo.service/target-state",
+		"/fleet/state/foo.service",
+		"/fleet/states/foo.service/XXX",
+	} {
+		if before[key] == "" || before[key] != after[key] {
+			t.Errorf("key %s changed: before %q, after %q", key, before[key], after[key])
+		}
+	}
+
+	bad, _ := unit.NewUnitFile("[X-Fleet]\nBogus=true\n")
+	if err := r.ReplaceUnitFile("foo.service", bad); err == nil {
+		t.Errorf("expected error replacing UnitFile with invalid requirements")
+	}
+}
+
+func TestUnitFile(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	uf, err := r.UnitFile("foo.service")
+	if uf != nil || err != nil {
+		t.Fatalf("unexpected result for nonexistent Unit: %v, %v", uf, err)
+	}
+
+	want, _ := unit.NewUnitFile("[Service]\nExecStart=/bin/true\n")
+	u := job.Unit{Name: "foo.service", Unit: *want, TargetState: job.JobStateLoaded}
+	if err := r.CreateUnit(&u); err != nil {
+		t.Fatalf("unexpected error from CreateUnit: %v", err)
+	}
+	uf, err = r.UnitFile("foo.service")
+	if err != nil || uf == nil {
+		t.Fatalf("unexpected result from UnitFile: %v, %v", uf, err)
+	}
+	if uf.Hash() != want.Hash() {
+		t.Errorf("unexpected UnitFile: got %q, want %q", uf.String(), want.String())
+	}
+
+	// An object referencing a missing unit file is a parse failure
+	e.Set(nil, "/fleet/job/bar.service/object", `{"Name":"bar.service","UnitHash":[1,2,3,4,5,6,7,8,9,0,1,2,3,4,5,6,7,8,9,0]}`, nil)
+	if _, err = r.UnitFile("bar.service"); err == nil {
+		t.Errorf("expected error for Unit with missing unit file")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Errorf("expected *ParseError, got %T: %v", err, err)
+	}
+}
+
+func TestMoveUnit(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	if err := r.MoveUnit("foo.service", "XXX", "YYY"); err != ErrScheduleChanged {
+		t.Fatalf("expected ErrScheduleChanged moving unscheduled unit, got %v", err)
+	}
+	if err := r.ScheduleUnit("foo.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+	}
+	if err := r.MoveUnit("foo.service", "ZZZ", "YYY"); err != ErrScheduleChanged {
+		t.Fatalf("expected ErrScheduleChanged moving from wrong machine, got %v", err)
+	}
+	if err := r.MoveUnit("foo.service", "XXX", "YYY"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+	if machID, _, _ := r.UnitTarget("foo.service"); machID != "YYY" {
+		t.Errorf("unit scheduled to %q after move, want YYY", machID)
+	}
+}
+
+func TestUnitAnnotations(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	if err := r.SetUnitAnnotation("foo.service", "owner", "ops@example.com"); err == nil {
+		t.Errorf("expected error annotating nonexistent Unit")
+	}
+
+	u := newTestUnit(t, "foo.service", "[Service]\nExecStart=/bin/true\n")
+	u.Annotations = map[string]string{"owner": "dev@example.com"}
+	addTestUnit(t, r, u, "XXX")
+
+	if err := r.SetUnitAnnotation("foo.service", "owner", "ops@example.com"); err != nil {
+		t.Fatalf("unexpected error from SetUnitAnnotation: %v", err)
+	}
+	if err := r.SetUnitAnnotation("foo.service", "ticket", "https://example.com/T1"); err != nil {
+		t.Fatalf("unexpected error from SetUnitAnnotation: %v", err)
+	}
+	for _, key := range []string{"", "a/b", ".."} {
+		if err := r.SetUnitAnnotation("foo.service", key, "x"); err == nil {
+			t.Errorf("expected error for annotation key %q", key)
+		}
+	}
+
+	uf, _ := unit.NewUnitFile("[Service]\nExecStart=/bin/false\n")
+	if err := r.ReplaceUnitFile("foo.service", uf); err != nil {
+		t.Fatalf("unexpected error from ReplaceUnitFile: %v", err)
+	}
+
+	want := map[string]string{"owner": "ops@example.com", "ticket": "https://example.com/T1"}
+	got, err := r.Unit("foo.service")
+	if err != nil || got == nil {
+		t.Fatalf("unexpected result from Unit: %v, %v", got, err)
+	}
+	if !reflect.DeepEqual(want, got.Annotations) {
+		t.Errorf("unexpected annotations: got %v, want %v", got.Annotations, want)
+	}
+	if machID, _, _ := r.UnitTarget("foo.service"); machID != "XXX" {
+		t.Errorf("annotating Unit changed its target to %q", machID)
+	}
+
+	units, err := r.Units()
+	if err != nil || len(units) != 1 || !reflect.DeepEqual(want, units[0].Annotations) {
+		t.Errorf("unexpected result from Units: %v, %v", units, err)
+	}
+}
+
+func TestUnitsScheduledBetween(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	// Scheduled before scheduling times were recorded
+	addTestUnit(t, r, newTestUnit(t, "old.service", ""), "")
+	e.Set(nil, "/fleet/job/old.service/target", "XXX", nil)
+
+	start := time.Now()
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "YYY")
+	end := time.Now().Add(time.Millisecond)
+
+	su, err := r.ScheduledUnit("old.service")
+	if err != nil || su == nil || !su.ScheduledAt.IsZero() {
+		t.Errorf("unexpected ScheduledUnit without recorded time: %#v, %v", su, err)
+	}
+	su, err = r.ScheduledUnit("a.service")
+	if err != nil || su == nil || su.ScheduledAt.Before(start) || su.ScheduledAt.After(end) {
+		t.Errorf("unexpected ScheduledUnit with recorded time: %#v, %v", su, err)
+	}
+
+	for i, tt := range []struct {
+		start, end time.Time
+		want       []string
+	}{
+		{start, end, []string{"a.service", "b.service"}},
+		{start.Add(-time.Hour), start.Add(-time.Minute), nil},
+		{end, end.Add(time.Hour), nil},
+	} {
+		sUnits, err := r.UnitsScheduledBetween(tt.start, tt.end)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		var got []string
+		for _, su := range sUnits {
+			got = append(got, su.Name)
+		}
+		if !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("case %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+
+	if err := r.UnscheduleUnit("a.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from UnscheduleUnit: %v", err)
+	}
+	sUnits, _ := r.UnitsScheduledBetween(start, end)
+	if len(sUnits) != 1 || sUnits[0].Name != "b.service" {
+		t.Errorf("unscheduled Unit still reported: %v", sUnits)
+	}
+}
+
+func TestUnitWithState(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	u, js, err := r.UnitWithState("foo.service")
+	if u != nil || js != nil || err != nil {
+		t.Fatalf("unexpected result for nonexistent Unit: %v, %v, %v", u, js, err)
+	}
+
+	addTestUnit(t, r, newTestUnit(t, "foo.service", "[Service]\nExecStart=/bin/true\n"), "")
+	u, js, err = r.UnitWithState("foo.service")
+	if err != nil || u == nil || u.Name != "foo.service" || js != nil {
+		t.Fatalf("unexpected result for unscheduled Unit: %v, %v, %v", u, js, err)
+	}
+
+	// Scheduled, but no state reported yet
+	if err := r.ScheduleUnit("foo.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+	}
+	u, js, err = r.UnitWithState("foo.service")
+	if err != nil || u == nil || js != nil {
+		t.Fatalf("unexpected result for Unit without state: %v, %v, %v", u, js, err)
+	}
+
+	r.SaveUnitState("foo.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+	if err := r.UnitHeartbeat("foo.service", "XXX", time.Minute); err != nil {
+		t.Fatalf("unexpected error from UnitHeartbeat: %v", err)
+	}
+	u, js, err = r.UnitWithState("foo.service")
+	if err != nil || u == nil || js == nil || *js != job.JobStateLaunched {
+		t.Errorf("unexpected result for launched Unit: %v, %v, %v", u, js, err)
+	}
+}
+
+func TestScheduleUnitIfMachinePresent(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	if err := r.ExpireMachine("YYY"); err != nil {
+		t.Fatalf("unexpected error from ExpireMachine: %v", err)
+	}
+
+	for i, tt := range []struct {
+		name      string
+		machID    string
+		scheduled bool
+	}{
+		{"alive.service", "XXX", true},
+		{"expired.service", "YYY", false},
+		{"unknown.service", "ZZZ", false},
+	} {
+		ok, err := r.ScheduleUnitIfMachinePresent(tt.name, tt.machID)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if ok != tt.scheduled {
+			t.Errorf("case %d: expected scheduled=%t, got %t", i, tt.scheduled, ok)
+		}
+		machID, _, _ := r.UnitTarget(tt.name)
+		if tt.scheduled != (machID == tt.machID) {
+			t.Errorf("case %d: Unit unexpectedly scheduled to %q", i, machID)
+		}
+	}
+}
+
+func TestUnitsWhere(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: map[string]string{"gpu": "true"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Metadata: map[string]string{"gpu": "true"}})
+	addTestMachine(t, r, machine.MachineState{ID: "ZZZ"})
+
+	addTestUnit(t, r, newTestUnit(t, "train.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "web.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "infer.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "cpu.service", ""), "ZZZ")
+	addTestUnit(t, r, newTestUnit(t, "ghost.service", ""), "AAA")
+	addTestUnit(t, r, newTestUnit(t, "gpu-exporter.service", "[X-Fleet]\nGlobal=true\nMachineMetadata=gpu=true\n"), "")
+
+	gpu := func(ms machine.MachineState) bool { return ms.Metadata["gpu"] == "true" }
+	notWeb := func(u job.Unit) bool { return u.Name != "web.service" }
+
+	for i, tt := range []struct {
+		machPred func(machine.MachineState) bool
+		unitPred func(job.Unit) bool
+		want     map[string][]string
+	}{
+		{
+			nil, nil,
+			map[string][]string{
+				"XXX": {"gpu-exporter.service", "train.service", "web.service"},
+				"YYY": {"gpu-exporter.service", "infer.service"},
+				"ZZZ": {"cpu.service"},
+			},
+		},
+		{
+			gpu, notWeb,
+			map[string][]string{
+				"XXX": {"gpu-exporter.service", "train.service"},
+				"YYY": {"gpu-exporter.service", "infer.service"},
+			},
+		},
+		{
+			nil, func(u job.Unit) bool { return u.Name == "web.service" },
+			map[string][]string{
+				"XXX": {"web.service"},
+			},
+		},
+		{
+			func(machine.MachineState) bool { return false }, nil,
+			map[string][]string{},
+		},
+	} {
+		matching, err := r.UnitsWhere(tt.machPred, tt.unitPred)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error from UnitsWhere: %v", i, err)
+		}
+		got := make(map[string][]string)
+		for machID, units := range matching {
+			for _, u := range units {
+				got[machID] = append(got[machID], u.Name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestDependentUnits(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "db.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "web.service", "[X-Fleet]\nMachineOf=db.service\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "backup.service", "[X-Fleet]\nMachineOf=db.service\n"), "")
+	addTestUnit(t, r, newTestUnit(t, "cache.service", "[X-Fleet]\nConflicts=d*.service\n"), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "other.service", "[X-Fleet]\nMachineOf=web.service\n"), "")
+
+	for i, tt := range []struct {
+		name string
+		want []string
+	}{
+		// Peers and conflicting Units are both dependents
+		{"db.service", []string{"backup.service", "cache.service", "web.service"}},
+		// Dependents are not transitive
+		{"web.service", []string{"other.service"}},
+		{"other.service", nil},
+		{"deleted.service", []string{"cache.service"}},
+	} {
+		units, err := r.DependentUnits(tt.name)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error from DependentUnits: %v", i, err)
+		}
+		var got []string
+		for _, u := range units {
+			got = append(got, u.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestUnitMatchesScheduled(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	declared := newTestUnit(t, "foo.service", "[Service]\nExecStart=/bin/true\n")
+	addTestUnit(t, r, declared, "XXX")
+	global := newTestUnit(t, "global.service", "[X-Fleet]\nGlobal=true\n")
+	addTestUnit(t, r, global, "")
+
+	for i, tt := range []struct {
+		u      *job.Unit
+		machID string
+		want   bool
+	}{
+		{declared, "XXX", true},
+		{declared, "", true},
+		// scheduled elsewhere
+		{declared, "YYY", false},
+		// drifted unit file
+		{newTestUnit(t, "foo.service", "[Service]\nExecStart=/bin/false\n"), "XXX", false},
+		// never submitted
+		{newTestUnit(t, "bar.service", ""), "", false},
+		// global Units have no target
+		{global, "XXX", true},
+	} {
+		got, err := r.UnitMatchesScheduled(tt.u, tt.machID)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		} else if got != tt.want {
+			t.Errorf("case %d: got %t, want %t", i, got, tt.want)
+		}
+	}
+}
+
+func TestMachineUnitsWithStates(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "d.service", ""), "")
+	us := unit.NewUnitState("loaded", "active", "running", "XXX")
+	r.SaveUnitState("a.service", us, time.Minute)
+	if err := r.UnitHeartbeat("a.service", "XXX", time.Minute); err != nil {
+		t.Fatalf("unexpected error from UnitHeartbeat: %v", err)
+	}
+	// States reported by other machines are ignored
+	r.SaveUnitState("b.service", unit.NewUnitState("loaded", "active", "running", "YYY"), time.Minute)
+
+	gets := e.gets
+	units, err := r.MachineUnitsWithStates("XXX")
+	if err != nil {
+		t.Fatalf("unexpected error from MachineUnitsWithStates: %v", err)
+	}
+	if n := e.gets - gets; n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if len(units) != 2 {
+		t.Fatalf("expected 2 Units, got %v", units)
+	}
+
+	a := units["a.service"]
+	if a.TargetMachineID != "XXX" || a.UnitState == nil || a.UnitState.ActiveState != us.ActiveState || a.State == nil || *a.State != job.JobStateLaunched {
+		t.Errorf("unexpected a.service: %#v", a)
+	}
+	b := units["b.service"]
+	if b.TargetMachineID != "XXX" || b.UnitState != nil || b.State == nil || *b.State != job.JobStateInactive {
+		t.Errorf("unexpected b.service: %#v", b)
+	}
+
+	if units, err := r.MachineUnitsWithStates("ZZZ"); err != nil || len(units) != 0 {
+		t.Errorf("expected no Units on ZZZ, got %v, %v", units, err)
+	}
+}
+
+func TestUnitSummaries(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	a := newTestUnit(t, "a.service", "[Service]\nExecStart=/bin/true\n")
+	addTestUnit(t, r, a, "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "")
+	if err := r.SetUnitAnnotation("a.service", "owner", "web"); err != nil {
+		t.Fatalf("unexpected error from SetUnitAnnotation: %v", err)
+	}
+
+	// Only the Units and their states are read, not the unit files
+	gets := e.gets
+	summaries, err := r.UnitSummaries("")
+	if err != nil {
+		t.Fatalf("unexpected error from UnitSummaries: %v", err)
+	}
+	if n := e.gets - gets; n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	var names []string
+	for _, us := range summaries {
+		names = append(names, us.Name)
+	}
+	if want := []string{"a.service", "b.service", "c.service"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got summaries of %v, want %v", names, want)
+	}
+
+	got := summaries[0]
+	if got.UnitHash != a.Unit.Hash() || got.TargetMachineID != "XXX" || got.TargetState != job.JobStateLaunched || got.State == nil || *got.State != job.JobStateInactive {
+		t.Errorf("unexpected summary of a.service: %#v", got)
+	}
+	if want := map[string]string{"owner": "web"}; !reflect.DeepEqual(got.Annotations, want) {
+		t.Errorf("got annotations %v, want %v", got.Annotations, want)
+	}
+
+	summaries, err = r.UnitSummaries("YYY")
+	if err != nil || len(summaries) != 1 || summaries[0].Name != "b.service" {
+		t.Errorf("unexpected summaries of Units on YYY: %v, %v", summaries, err)
+	}
+}
+
+func TestUnitsByPriority(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, tt := range []struct {
+		name     string
+		priority string
+		machID   string
+	}{
+		{"a.service", "", "XXX"},
+		{"b.service", "10", "XXX"},
+		{"c.service", "-5", "XXX"},
+		{"d.service", "10", "XXX"},
+		{"e.service", "0", "XXX"},
+		{"f.service", "100", "YYY"},
+		{"g.service", "100", ""},
+	} {
+		contents := "[Service]\nExecStart=/bin/true\n"
+		if tt.priority != "" {
+			contents += "[X-Fleet]\nPriority=" + tt.priority + "\n"
+		}
+		addTestUnit(t, r, newTestUnit(t, tt.name, contents), tt.machID)
+	}
+
+	units, err := r.UnitsByPriority("XXX")
+	if err != nil {
+		t.Fatalf("unexpected error from UnitsByPriority: %v", err)
+	}
+	var names []string
+	for _, u := range units {
+		names = append(names, u.Name)
+	}
+	want := []string{"b.service", "d.service", "a.service", "e.service", "c.service"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected Units in order %v, got %v", want, names)
+	}
+
+	if units, err := r.UnitsByPriority("ZZZ"); err != nil || len(units) != 0 {
+		t.Errorf("expected no Units on ZZZ, got %v, %v", units, err)
+	}
+}
+
+func TestUnitTargetTTL(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "permanent.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "ephemeral.service", ""), "")
+	if _, err := e.Set(nil, "/fleet/job/ephemeral.service/target", "XXX", &etcd.SetOptions{TTL: time.Minute}); err != nil {
+		t.Fatalf("failed scheduling ephemeral.service: %v", err)
+	}
+
+	if ttl, err := r.UnitTargetTTL("permanent.service", "XXX"); err != nil || ttl != NoTTL {
+		t.Errorf("expected NoTTL for permanent.service, got %v, %v", ttl, err)
+	}
+	if ttl, err := r.UnitTargetTTL("ephemeral.service", "XXX"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected remaining TTL of at most a minute for ephemeral.service, got %v, %v", ttl, err)
+	}
+
+	for i, tt := range []struct {
+		name   string
+		machID string
+	}{
+		{"permanent.service", "YYY"},
+		{"unscheduled.service", "XXX"},
+	} {
+		if _, err := r.UnitTargetTTL(tt.name, tt.machID); err != ErrScheduleChanged {
+			t.Errorf("case %d: expected ErrScheduleChanged, got %v", i, err)
+		}
+	}
+
+	// An expired decision is no longer scheduled
+	e.expire("/fleet/job/ephemeral.service/target")
+	if _, err := r.UnitTargetTTL("ephemeral.service", "XXX"); err != ErrScheduleChanged {
+		t.Errorf("expected ErrScheduleChanged after expiry, got %v", err)
+	}
+}
+
+func TestMakeSchedulePermanent(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "ephemeral.service", ""), "")
+	if _, err := e.Set(nil, "/fleet/job/ephemeral.service/target", "XXX", &etcd.SetOptions{TTL: time.Minute}); err != nil {
+		t.Fatalf("failed scheduling ephemeral.service: %v", err)
+	}
+
+	for i, tt := range []struct {
+		name   string
+		machID string
+	}{
+		{"ephemeral.service", "YYY"},
+		{"unscheduled.service", "XXX"},
+	} {
+		if err := r.MakeSchedulePermanent(tt.name, tt.machID); err != ErrScheduleChanged {
+			t.Errorf("case %d: expected ErrScheduleChanged, got %v", i, err)
+		}
+	}
+	if ttl, _ := r.UnitTargetTTL("ephemeral.service", "XXX"); ttl == NoTTL {
+		t.Errorf("failed MakeSchedulePermanent removed TTL")
+	}
+
+	if err := r.MakeSchedulePermanent("ephemeral.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from MakeSchedulePermanent: %v", err)
+	}
+	if ttl, err := r.UnitTargetTTL("ephemeral.service", "XXX"); err != nil || ttl != NoTTL {
+		t.Errorf("expected NoTTL after MakeSchedulePermanent, got %v, %v", ttl, err)
+	}
+	if machID, _, err := r.UnitTarget("ephemeral.service"); err != nil || machID != "XXX" {
+		t.Errorf("unexpected target after MakeSchedulePermanent: %q, %v", machID, err)
+	}
+}
+
+func TestPlacementHistory(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	r.SetPlacementHistory(true)
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	if err := r.MoveUnit("foo.service", "XXX", "YYY"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+	if err := r.MoveUnit("foo.service", "YYY", "XXX"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+
+	machines := func(limit int) []string {
+		records, err := r.PlacementHistory("foo.service", limit)
+		if err != nil {
+			t.Fatalf("unexpected error from PlacementHistory: %v", err)
+		}
+		var ids []string
+		for _, pr := range records {
+			if pr.Time.IsZero() {
+				t.Errorf("PlacementRecord of %s has no time", pr.MachineID)
+			}
+			ids = append(ids, pr.MachineID)
+		}
+		return ids
+	}
+	if got, want := machines(0), []string{"XXX", "YYY", "XXX"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got history %v, want %v", got, want)
+	}
+	if got, want := machines(2), []string{"XXX", "YYY"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got limited history %v, want %v", got, want)
+	}
+
+	// Only the most recent placements are retained
+	from := "XXX"
+	for i := 0; i < placementHistoryDepth; i++ {
+		to := fmt.Sprintf("M%02d", i)
+		if err := r.MoveUnit("foo.service", from, to); err != nil {
+			t.Fatalf("unexpected error from MoveUnit: %v", err)
+		}
+		from = to
+	}
+	got := machines(0)
+	if len(got) != placementHistoryDepth || got[0] != from || got[len(got)-1] != "M00" {
+		t.Errorf("unexpected history after %d moves: %v", placementHistoryDepth, got)
+	}
+	// Older records are discarded as new ones are added
+	nodes, err := r.placementNodes("foo.service")
+	if err != nil {
+		t.Fatalf("unexpected error reading placement history: %v", err)
+	}
+	if len(nodes) != placementHistoryDepth {
+		t.Errorf("placement history not trimmed: %d records", len(nodes))
+	}
+
+	if err := r.DestroyUnit("foo.service"); err != nil {
+		t.Fatalf("unexpected error from DestroyUnit: %v", err)
+	}
+	if got := machines(0); len(got) != 0 {
+		t.Errorf("history remains after DestroyUnit: %v", got)
+	}
+}
+
+func TestPlacementHistoryDisabled(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	if err := r.MoveUnit("foo.service", "XXX", "YYY"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+	records, err := r.PlacementHistory("foo.service", 0)
+	if err != nil {
+		t.Fatalf("unexpected error from PlacementHistory: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("placement history recorded without being enabled: %v", records)
+	}
+}
+
+func TestScheduleNodeInfo(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+
+	_, idx, err := r.UnitTarget("foo.service")
+	if err != nil {
+		t.Fatalf("unexpected error from UnitTarget: %v", err)
+	}
+	info, err := r.ScheduleNodeInfo("foo.service", "XXX")
+	if err != nil {
+		t.Fatalf("unexpected error from ScheduleNodeInfo: %v", err)
+	}
+	if info.CreatedIndex != idx || info.ModifiedIndex != idx || info.TTL != NoTTL || !info.Expiration.IsZero() {
+		t.Errorf("unexpected NodeInfo after scheduling at index %d: %#v", idx, info)
+	}
+
+	// An update moves the modified index only
+	res, err := e.Set(nil, "/fleet/job/foo.service/target", "XXX", &etcd.SetOptions{PrevIndex: idx, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("failed updating schedule: %v", err)
+	}
+	updated, err := r.ScheduleNodeInfo("foo.service", "XXX")
+	if err != nil {
+		t.Fatalf("unexpected error from ScheduleNodeInfo: %v", err)
+	}
+	if updated.CreatedIndex != idx || updated.ModifiedIndex != res.Node.ModifiedIndex || updated.ModifiedIndex <= idx {
+		t.Errorf("unexpected indexes after update at index %d: %#v", res.Node.ModifiedIndex, updated)
+	}
+	if updated.TTL <= 0 || updated.TTL > time.Minute || updated.Expiration.IsZero() {
+		t.Errorf("unexpected TTL after update: %#v", updated)
+	}
+
+	for i, tt := range []struct {
+		name   string
+		machID string
+	}{
+		{"foo.service", "YYY"},
+		{"unscheduled.service", "XXX"},
+	} {
+		if _, err := r.ScheduleNodeInfo(tt.name, tt.machID); err != ErrScheduleChanged {
+			t.Errorf("case %d: expected ErrScheduleChanged, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+const (
+	// leasePrefix is the namespace in which pkg/lease stores its leases
+	leasePrefix = "lease"
+)
+
+// LeaseEventType describes what happened to a lease
+type LeaseEventType string
+
+const (
+	// The lease was acquired by a new holder, including by stealing it
+	LeaseAcquired = LeaseEventType("acquired")
+	// The lease was renewed by its current holder
+	LeaseRenewed = LeaseEventType("renewed")
+	// The lease was released by its holder
+	LeaseReleased = LeaseEventType("released")
+	// The lease was not renewed before its TTL lapsed
+	LeaseExpired = LeaseEventType("expired")
+)
+
+// LeaseEvent describes a change to one of the leases managed by pkg/lease
+type LeaseEvent struct {
+	Name string
+	Type LeaseEventType
+
+	// MachineID and Version identify the holder of the lease or, for
+	// released and expired leases, its last holder
+	MachineID string
+	Version   int
+
+	// TTL is the time remaining on the lease when it was acquired or
+	// renewed
+	TTL time.Duration
+}
+
+// leaseHolder mirrors the metadata pkg/lease stores as the value of a lease
+type leaseHolder struct {
+	MachineID string
+	Version   int
+}
+
+// WatchLeases returns a channel emitting a LeaseEvent each time a lease is
+// acquired, renewed, released or expires, until stop is closed. Frequent
+// changes of holder, or renewals by a holder which is otherwise making no
+// progress, are indications of contention.
+func (r *EtcdRegistry) WatchLeases(stop <-chan struct{}) <-chan LeaseEvent {
+	stop = r.watchStop(stop)
+	out := make(chan LeaseEvent)
+	q := r.newWatchQueue("leases", stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(LeaseEvent):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	go func() {
+		defer q.close(func() { close(out) })
+		r.watchPrefix(r.prefixed(leasePrefix), stop, func(res *etcd.Response) {
+			if ev, ok := r.leaseEventFromResponse(res); ok {
+				q.push(ev)
+			}
+		})
+	}()
+	return out
+}
+
+// HeldLeases returns the ID of the machine holding each lease currently
+// managed by pkg/lease, keyed by lease name. Names are relative to the
+// lease namespace, so a lease named within a sub-namespace (e.g.
+// "unit/foo.service") retains that namespace in its key.
+func (r *EtcdRegistry) HeldLeases() (map[string]string, error) {
+	key := r.prefixed(leasePrefix)
+	opts := &etcd.GetOptions{
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), key, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	held := make(map[string]string)
+	var walk func(*etcd.Node)
+	walk = func(node *etcd.Node) {
+		if !node.Dir {
+			name := strings.TrimPrefix(node.Key, key+"/")
+			held[name] = parseLeaseHolder(node.Value).MachineID
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(res.Node)
+	return held, nil
+}
+
+func (r *EtcdRegistry) leaseEventFromResponse(res *etcd.Response) (ev LeaseEvent, ok bool) {
+	if res == nil || res.Node == nil || res.Node.Dir {
+		return
+	}
+
+	ev.Name = strings.TrimPrefix(res.Node.Key, r.prefixed(leasePrefix)+"/")
+	var prev *leaseHolder
+	if res.PrevNode != nil {
+		h := parseLeaseHolder(res.PrevNode.Value)
+		prev = &h
+	}
+
+	if isDeletion(res) {
+		ev.Type = LeaseReleased
+		if res.Action == "expire" {
+			ev.Type = LeaseExpired
+		}
+		if prev != nil {
+			ev.MachineID, ev.Version = prev.MachineID, prev.Version
+		}
+		return ev, true
+	}
+
+	h := parseLeaseHolder(res.Node.Value)
+	ev.MachineID, ev.Version = h.MachineID, h.Version
+	ev.TTL = res.Node.TTLDuration()
+	ev.Type = LeaseAcquired
+	if prev != nil && prev.MachineID == h.MachineID {
+		ev.Type = LeaseRenewed
+	}
+	return ev, true
+}
+
+// parseLeaseHolder extracts the holder from the value of a lease, treating
+// the entire value as the MachineID for compatibility with leases written
+// by engines unaware of lease versioning, as pkg/lease does
+func parseLeaseHolder(val string) leaseHolder {
+	var h leaseHolder
+	if err := json.Unmarshal([]byte(val), &h); err != nil {
+		h = leaseHolder{MachineID: val}
+	}
+	return h
+}
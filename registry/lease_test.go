@@ -0,0 +1,123 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+func TestWatchLeases(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch := r.WatchLeases(stop)
+	e.waitForWatchers(t, 1)
+
+	next := func() LeaseEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for LeaseEvent")
+		}
+		return LeaseEvent{}
+	}
+
+	l, err := lm.AcquireLease("engine-leader", "XXX", 1, time.Minute)
+	if err != nil || l == nil {
+		t.Fatalf("unexpected result from AcquireLease: %v, %v", l, err)
+	}
+	if ev := next(); ev.Name != "engine-leader" || ev.Type != LeaseAcquired || ev.MachineID != "XXX" || ev.Version != 1 || ev.TTL == 0 {
+		t.Errorf("unexpected acquire event: %#v", ev)
+	}
+
+	if err := l.Renew(time.Minute); err != nil {
+		t.Fatalf("unexpected error from Renew: %v", err)
+	}
+	if ev := next(); ev.Type != LeaseRenewed || ev.MachineID != "XXX" {
+		t.Errorf("unexpected renew event: %#v", ev)
+	}
+
+	l, err = lm.StealLease("engine-leader", "YYY", 2, time.Minute, l.Index())
+	if err != nil || l == nil {
+		t.Fatalf("unexpected result from StealLease: %v, %v", l, err)
+	}
+	if ev := next(); ev.Type != LeaseAcquired || ev.MachineID != "YYY" || ev.Version != 2 {
+		t.Errorf("unexpected steal event: %#v", ev)
+	}
+
+	if err := l.Release(); err != nil {
+		t.Fatalf("unexpected error from Release: %v", err)
+	}
+	if ev := next(); ev.Type != LeaseReleased || ev.MachineID != "YYY" {
+		t.Errorf("unexpected release event: %#v", ev)
+	}
+
+	// Leases written by older engines hold only the machine ID
+	if _, err := lm.AcquireLease("engine-leader", "ZZZ", 0, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	next()
+	e.Set(nil, "/fleet/lease/engine-leader", "ZZZ", nil)
+	next()
+	e.expire("/fleet/lease/engine-leader")
+	if ev := next(); ev.Type != LeaseExpired || ev.MachineID != "ZZZ" || ev.Version != 0 {
+		t.Errorf("unexpected expire event: %#v", ev)
+	}
+}
+
+func TestHeldLeases(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+
+	if held, err := r.HeldLeases(); err != nil || len(held) != 0 {
+		t.Fatalf("expected no leases held, got %v, %v", held, err)
+	}
+
+	if _, err := lm.AcquireLease("engine-leader", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	if _, err := lm.AcquireLease("unit/foo.service", "YYY", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	// Leases written by older engines hold only the machine ID
+	e.Set(nil, "/fleet/lease/legacy", "ZZZ", nil)
+	// Expired leases are no longer held
+	if _, err := lm.AcquireLease("expired", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	e.expire("/fleet/lease/expired")
+
+	held, err := r.HeldLeases()
+	if err != nil {
+		t.Fatalf("unexpected error from HeldLeases: %v", err)
+	}
+	want := map[string]string{
+		"engine-leader":    "XXX",
+		"unit/foo.service": "YYY",
+		"legacy":           "ZZZ",
+	}
+	if !reflect.DeepEqual(held, want) {
+		t.Errorf("expected held leases %v, got %v", want, held)
+	}
+}
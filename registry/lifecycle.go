@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/unit"
+)
+
+// UnitEventSource identifies which part of the Registry a
+// UnitLifecycleEvent originates from
+type UnitEventSource string
+
+const (
+	// The Unit was scheduled to or unscheduled from a machine
+	UnitEventSourceSchedule = UnitEventSource("schedule")
+	// A machine reported or removed the state of the Unit
+	UnitEventSourceState = UnitEventSource("state")
+)
+
+// UnitLifecycleEvent describes a change to either the scheduling or the
+// reported state of a single Unit
+type UnitLifecycleEvent struct {
+	Name   string
+	Source UnitEventSource
+
+	// MachineID identifies the machine the Unit was scheduled to or
+	// unscheduled from, or the machine which reported its state. It
+	// may be empty if the Unit was destroyed or all of its states were
+	// removed at once.
+	MachineID string
+
+	// Scheduled indicates, for schedule events, whether the Unit is
+	// now scheduled to MachineID
+	Scheduled bool
+
+	// State holds, for state events, the newly reported UnitState, or
+	// nil if it was removed
+	State *unit.UnitState
+
+	// Index is the etcd index at which the change was made. Events
+	// from the schedule and from reported states are watched
+	// separately and may be delivered out of order, but ordering them
+	// by Index recovers the order in which the changes were made.
+	Index uint64
+}
+
+// WatchUnit returns a channel emitting a UnitLifecycleEvent each time the
+// named Unit is scheduled or unscheduled, or has its state reported or
+// removed by any machine, until stop is closed. This saves consumers from
+// wiring up separate watches of the schedule and of the reported states.
+func (r *EtcdRegistry) WatchUnit(name string, stop <-chan struct{}) <-chan UnitLifecycleEvent {
+	stop = r.watchStop(stop)
+	out := make(chan UnitLifecycleEvent)
+	q := r.newWatchQueue("unit/"+name, stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(UnitLifecycleEvent):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	send := func(ev UnitLifecycleEvent) {
+		q.push(ev)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.watchPrefix(r.prefixed(jobPrefix, name), stop, func(res *etcd.Response) {
+			if ev, ok := r.scheduleEventFromResponse(name, res); ok {
+				send(ev)
+			}
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		r.watchPrefix(r.unitStatesNamespace(name), stop, func(res *etcd.Response) {
+			use, ok := r.unitStateEventFromResponse(res)
+			if !ok || use.Name != name {
+				return
+			}
+			send(UnitLifecycleEvent{
+				Name:      name,
+				Source:    UnitEventSourceState,
+				MachineID: use.MachineID,
+				State:     use.State,
+				Index:     res.Node.ModifiedIndex,
+			})
+		})
+	}()
+	go func() {
+		wg.Wait()
+		q.close(func() { close(out) })
+	}()
+
+	return out
+}
+
+// WatchUnitOrdered behaves like WatchUnit, but holds each event back for the
+// given window so that events made at a lower etcd index, which are still
+// on their way through the other watch, can be emitted before it. Events
+// are then emitted in order of their Index, as long as none is delayed by
+// more than the window. This costs every event a delay of up to window.
+func (r *EtcdRegistry) WatchUnitOrdered(name string, window time.Duration, stop <-chan struct{}) <-chan UnitLifecycleEvent {
+	return orderLifecycleEvents(r.WatchUnit(name, stop), window, stop)
+}
+
+// orderLifecycleEvents reorders the events from in by their Index, as
+// described by WatchUnitOrdered. The returned channel is closed once in is
+// closed and all held events have been emitted, or once stop is closed.
+func orderLifecycleEvents(in <-chan UnitLifecycleEvent, window time.Duration, stop <-chan struct{}) <-chan UnitLifecycleEvent {
+	type held struct {
+		ev       UnitLifecycleEvent
+		deadline time.Time
+	}
+
+	out := make(chan UnitLifecycleEvent)
+	go func() {
+		defer close(out)
+
+		// pending is kept sorted by Index
+		var pending []held
+		var timer <-chan time.Time
+		for in != nil || len(pending) > 0 {
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					// Whatever is held is flushed without waiting
+					in = nil
+					break
+				}
+				i := sort.Search(len(pending), func(i int) bool { return pending[i].ev.Index > ev.Index })
+				pending = append(pending, held{})
+				copy(pending[i+1:], pending[i:])
+				pending[i] = held{ev, time.Now().Add(window)}
+			case <-timer:
+			case <-stop:
+				return
+			}
+
+			// Every event whose window has passed is released, along
+			// with all events preceding it
+			now := time.Now()
+			release := 0
+			next := time.Time{}
+			for i, h := range pending {
+				if in == nil || !now.Before(h.deadline) {
+					release = i + 1
+				} else if next.IsZero() || h.deadline.Before(next) {
+					next = h.deadline
+				}
+			}
+			for _, h := range pending[:release] {
+				select {
+				case out <- h.ev:
+				case <-stop:
+					return
+				}
+			}
+			pending = pending[release:]
+
+			timer = nil
+			if len(pending) > 0 && !next.IsZero() {
+				timer = time.After(next.Sub(now))
+			}
+		}
+	}()
+	return out
+}
+
+// scheduleEventFromResponse translates a response from a watch of the named
+// Unit's namespace into a UnitLifecycleEvent, if it affects the schedule
+func (r *EtcdRegistry) scheduleEventFromResponse(name string, res *etcd.Response) (ev UnitLifecycleEvent, ok bool) {
+	if res == nil || res.Node == nil {
+		return
+	}
+
+	ev = UnitLifecycleEvent{
+		Name:   name,
+		Source: UnitEventSourceSchedule,
+		Index:  res.Node.ModifiedIndex,
+	}
+	switch res.Node.Key {
+	case r.jobTargetAgentPath(name):
+		if isDeletion(res) {
+			if res.PrevNode != nil {
+				ev.MachineID = res.PrevNode.Value
+			}
+		} else {
+			ev.MachineID = res.Node.Value
+			ev.Scheduled = true
+		}
+	case r.prefixed(jobPrefix, name):
+		// The entire Unit was destroyed
+		if !isDeletion(res) {
+			return
+		}
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
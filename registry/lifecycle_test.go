@@ -0,0 +1,139 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/unit"
+)
+
+func nextLifecycleEvent(t *testing.T, ch <-chan UnitLifecycleEvent) UnitLifecycleEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for UnitLifecycleEvent")
+	}
+	return UnitLifecycleEvent{}
+}
+
+func TestWatchUnit(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+
+	ch := r.WatchUnit("foo.service", stop)
+	e.waitForWatchers(t, 2)
+
+	// Changes to other Units must be ignored
+	addTestUnit(t, r, newTestUnit(t, "bar.service", ""), "XXX")
+	r.SaveUnitState("bar.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	ev := nextLifecycleEvent(t, ch)
+	if ev.Name != "foo.service" || ev.Source != UnitEventSourceSchedule || ev.MachineID != "XXX" || !ev.Scheduled {
+		t.Fatalf("unexpected schedule event: %#v", ev)
+	}
+
+	r.SaveUnitState("foo.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+	ev = nextLifecycleEvent(t, ch)
+	if ev.Source != UnitEventSourceState || ev.MachineID != "XXX" || ev.State == nil || ev.State.SubState != "running" {
+		t.Fatalf("unexpected state event: %#v", ev)
+	}
+
+	if err := r.UnscheduleUnit("foo.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from UnscheduleUnit: %v", err)
+	}
+	ev = nextLifecycleEvent(t, ch)
+	if ev.Source != UnitEventSourceSchedule || ev.MachineID != "XXX" || ev.Scheduled {
+		t.Fatalf("unexpected unschedule event: %#v", ev)
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("unexpected event after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("channel not closed after stop")
+	}
+}
+
+func TestWatchUnitIndexes(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch := r.WatchUnitOrdered("foo.service", 50*time.Millisecond, stop)
+	e.waitForWatchers(t, 2)
+
+	// Scheduled, then immediately running, then unscheduled
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	r.SaveUnitState("foo.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+	if err := r.UnscheduleUnit("foo.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from UnscheduleUnit: %v", err)
+	}
+
+	var last uint64
+	for i, want := range []UnitEventSource{UnitEventSourceSchedule, UnitEventSourceState, UnitEventSourceSchedule} {
+		ev := nextLifecycleEvent(t, ch)
+		if ev.Source != want {
+			t.Errorf("event %d: got source %s, want %s", i, ev.Source, want)
+		}
+		if ev.Index <= last {
+			t.Errorf("event %d: index %d does not follow %d", i, ev.Index, last)
+		}
+		last = ev.Index
+	}
+}
+
+func TestOrderLifecycleEvents(t *testing.T) {
+	in := make(chan UnitLifecycleEvent)
+	stop := make(chan struct{})
+	defer close(stop)
+	out := orderLifecycleEvents(in, 100*time.Millisecond, stop)
+
+	// Events arriving within the window are reordered
+	for _, idx := range []uint64{5, 3, 4} {
+		in <- UnitLifecycleEvent{Name: "foo.service", Index: idx}
+	}
+	for _, want := range []uint64{3, 4, 5} {
+		if ev := nextLifecycleEvent(t, out); ev.Index != want {
+			t.Errorf("got event with index %d, want %d", ev.Index, want)
+		}
+	}
+
+	// Held events are flushed once the input closes
+	in <- UnitLifecycleEvent{Name: "foo.service", Index: 7}
+	in <- UnitLifecycleEvent{Name: "foo.service", Index: 6}
+	close(in)
+	for _, want := range []uint64{6, 7} {
+		if ev := nextLifecycleEvent(t, out); ev.Index != want {
+			t.Errorf("got event with index %d, want %d", ev.Index, want)
+		}
+	}
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Errorf("unexpected event after input closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("channel not closed after input closed")
+	}
+}
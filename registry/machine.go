@@ -15,12 +15,17 @@
 package registry
 
 import (
+	"fmt"
+	"path"
 	"strings"
 	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
 
+	"github.com/coreos/fleet/log"
 	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg"
 )
 
 const (
@@ -43,18 +48,36 @@ func (r *EtcdRegistry) Machines() (machines []machine.MachineState, err error) {
 	}
 
 	for _, node := range resp.Node.Nodes {
+		var mach, lastSeen *machine.MachineState
+		var cordoned bool
+		var status string
 		for _, obj := range node.Nodes {
-			if !strings.HasSuffix(obj.Key, "/object") {
-				continue
-			}
-
-			var mach machine.MachineState
-			err = unmarshal(obj.Value, &mach)
-			if err != nil {
-				return
+			switch {
+			case strings.HasSuffix(obj.Key, "/object"):
+				mach, err = r.parseMachineState(obj, path.Base(node.Key))
+				if err != nil {
+					return
+				}
+			case strings.HasSuffix(obj.Key, "/lastseen"):
+				lastSeen, err = r.parseMachineState(obj, path.Base(node.Key))
+				if err != nil {
+					return
+				}
+			case strings.HasSuffix(obj.Key, "/cordon"):
+				cordoned = true
+			case strings.HasSuffix(obj.Key, "/status"):
+				status = obj.Value
 			}
+		}
 
-			machines = append(machines, mach)
+		if mach == nil && lastSeen != nil {
+			mach = lastSeen
+			mach.Degraded = true
+		}
+		if mach != nil {
+			mach.Cordoned = cordoned
+			mach.StatusMessage = status
+			machines = append(machines, *mach)
 		}
 	}
 
@@ -62,7 +85,7 @@ func (r *EtcdRegistry) Machines() (machines []machine.MachineState, err error) {
 }
 
 func (r *EtcdRegistry) SetMachineState(ms machine.MachineState, ttl time.Duration) (uint64, error) {
-	val, err := marshal(ms)
+	val, err := r.encodeMachineState(ms)
 	if err != nil {
 		return uint64(0), err
 	}
@@ -73,27 +96,447 @@ func (r *EtcdRegistry) SetMachineState(ms machine.MachineState, ttl time.Duratio
 		TTL:       ttl,
 	}
 	resp, err := r.kAPI.Set(r.ctx(), key, val, opts)
-	if err == nil {
-		return resp.Node.ModifiedIndex, nil
-	}
+	if err != nil {
+		if cerr := keyCollisionError(err, key); cerr != err {
+			return uint64(0), cerr
+		}
 
-	// If state was not present, explicitly create it so the other members
-	// in the cluster know this is a new member
-	opts.PrevExist = etcd.PrevNoExist
+		// If state was not present, explicitly create it so the other members
+		// in the cluster know this is a new member
+		opts.PrevExist = etcd.PrevNoExist
 
-	resp, err = r.kAPI.Set(r.ctx(), key, val, opts)
-	if err != nil {
-		return uint64(0), err
+		resp, err = r.kAPI.Set(r.ctx(), key, val, opts)
+		if err != nil {
+			return uint64(0), err
+		}
+	}
+
+	if r.machineGrace > 0 {
+		key := r.prefixed(machinePrefix, ms.ID, "lastseen")
+		opts := &etcd.SetOptions{
+			TTL: ttl + r.machineGrace,
+		}
+		if _, err := r.kAPI.Set(r.ctx(), key, val, opts); err != nil {
+			log.Errorf("Failed recording last seen state of Machine(%s): %v", ms.ID, keyCollisionError(err, key))
+		}
 	}
 
 	return resp.Node.ModifiedIndex, nil
 }
 
+// MachineHealth describes whether a machine is present in the cluster
+type MachineHealth string
+
+const (
+	// The machine's published state is present
+	MachineActive = MachineHealth("active")
+	// The machine's published state expired within the grace period
+	// set by SetMachineGracePeriod
+	MachineDegraded = MachineHealth("degraded")
+	// The machine is not present at all
+	MachineGone = MachineHealth("gone")
+)
+
+// MachineHealth reports whether the identified machine is active, degraded
+// or gone, as described by SetMachineGracePeriod
+func (r *EtcdRegistry) MachineHealth(machID string) (MachineHealth, error) {
+	for _, tt := range []struct {
+		key    string
+		health MachineHealth
+	}{
+		{"object", MachineActive},
+		{"lastseen", MachineDegraded},
+	} {
+		_, err := r.kAPI.Get(r.ctx(), r.prefixed(machinePrefix, machID, tt.key), nil)
+		if err == nil {
+			return tt.health, nil
+		} else if !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			return "", err
+		}
+	}
+	return MachineGone, nil
+}
+
+// WaitForMachine blocks until the identified machine has published its
+// state, returning that state. It returns immediately if the machine is
+// already present. Rather than polling, it watches for the machine's state
+// to appear. An error is returned if that does not happen within the given
+// timeout.
+func (r *EtcdRegistry) WaitForMachine(machID string, timeout time.Duration) (*machine.MachineState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	key := r.prefixed(machinePrefix, machID, "object")
+	timedOut := fmt.Errorf("timed out waiting for machine %s", machID)
+	for {
+		var idx uint64
+		res, err := r.kAPI.Get(ctx, key, nil)
+		if err == nil {
+			return r.parseMachineState(res.Node, machID)
+		} else if eerr, ok := err.(etcd.Error); ok && eerr.Code == etcd.ErrorCodeKeyNotFound {
+			idx = eerr.Index
+		} else if ctx.Err() != nil {
+			return nil, timedOut
+		} else {
+			return nil, err
+		}
+
+		watcher := r.kAPI.Watcher(key, &etcd.WatcherOptions{AfterIndex: idx})
+		for {
+			res, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, timedOut
+				}
+				if isEtcdError(err, etcd.ErrorCodeEventIndexCleared) {
+					// Events were lost, so check again from scratch
+					break
+				}
+				return nil, err
+			}
+			if res.Node != nil && !isDeletion(res) {
+				return r.parseMachineState(res.Node, machID)
+			}
+		}
+	}
+}
+
+func (r *EtcdRegistry) parseMachineState(node *etcd.Node, machID string) (*machine.MachineState, error) {
+	ms, err := r.decodeMachineState(node.Value)
+	if err != nil {
+		return nil, &ParseError{Key: node.Key, MachineID: machID, Err: err}
+	}
+	return ms, nil
+}
+
 func (r *EtcdRegistry) RemoveMachineState(machID string) error {
+	if err := r.forgetLastSeen(machID); err != nil {
+		return err
+	}
+
+	key := r.prefixed(machinePrefix, machID, "object")
+	_, err := r.kAPI.Delete(r.ctx(), key, nil)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = nil
+	}
+	return keyCollisionError(err, key)
+}
+
+// forgetLastSeen removes the copy of the identified machine's state kept
+// for its grace period, if any, so the machine is not reported as degraded
+func (r *EtcdRegistry) forgetLastSeen(machID string) error {
+	key := r.prefixed(machinePrefix, machID, "lastseen")
+	_, err := r.kAPI.Delete(r.ctx(), key, nil)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = nil
+	}
+	return keyCollisionError(err, key)
+}
+
+// RefreshMachineStateTTL changes the TTL of the published state of the
+// identified machine without rewriting that state. An error is returned if
+// the machine has no published state.
+func (r *EtcdRegistry) RefreshMachineStateTTL(machID string, ttl time.Duration) error {
+	if err := r.setKeyTTL(r.prefixed(machinePrefix, machID, "object"), ttl); err != nil {
+		return err
+	}
+	if r.machineGrace > 0 {
+		key := r.prefixed(machinePrefix, machID, "lastseen")
+		if err := r.setKeyTTL(key, ttl+r.machineGrace); err != nil {
+			log.Errorf("Failed refreshing last seen state of Machine(%s): %v", machID, err)
+		}
+	}
+	return nil
+}
+
+// ExpireMachine immediately removes the presence of the identified machine
+// from the Registry, exactly as if its TTL had lapsed, so the engine will
+// reschedule its Units without waiting out the TTL. The Units scheduled to
+// the machine are not touched here. This is intended for machines known to
+// be dead: a machine which is still running will simply reappear the next
+// time it publishes its state.
+func (r *EtcdRegistry) ExpireMachine(machID string) error {
+	if err := r.forgetLastSeen(machID); err != nil {
+		return err
+	}
+
 	key := r.prefixed(machinePrefix, machID, "object")
 	_, err := r.kAPI.Delete(r.ctx(), key, nil)
+	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		return fmt.Errorf("machine %s does not exist", machID)
+	}
+	return keyCollisionError(err, key)
+}
+
+// CordonMachine marks the identified machine as unschedulable. Units already
+// scheduled to the machine are left in place, but the placement helpers of
+// the Registry will no longer select it for new placements. The flag is
+// stored separately from the machine object so it is not lost when the
+// machine next publishes its state.
+func (r *EtcdRegistry) CordonMachine(machID string) error {
+	obj := r.prefixed(machinePrefix, machID, "object")
+	if _, err := r.kAPI.Get(r.ctx(), obj, nil); err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = fmt.Errorf("machine %s does not exist", machID)
+		}
+		return err
+	}
+
+	key := r.prefixed(machinePrefix, machID, "cordon")
+	_, err := r.kAPI.Set(r.ctx(), key, "true", nil)
+	return keyCollisionError(err, key)
+}
+
+// UncordonMachine makes the identified machine schedulable again. It is not
+// an error to uncordon a machine which is not cordoned.
+func (r *EtcdRegistry) UncordonMachine(machID string) error {
+	key := r.prefixed(machinePrefix, machID, "cordon")
+	_, err := r.kAPI.Delete(r.ctx(), key, nil)
 	if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
 		err = nil
 	}
-	return err
+	return keyCollisionError(err, key)
+}
+
+// SetMachineStatus leaves the given free-form message on the identified
+// machine, which is reported as the StatusMessage of its MachineState. Like
+// the cordon flag, the message is stored separately from the machine object
+// so it survives the machine publishing its state. It has no effect on
+// scheduling. An empty message clears any existing one.
+func (r *EtcdRegistry) SetMachineStatus(machID, message string) error {
+	key := r.prefixed(machinePrefix, machID, "status")
+	if message == "" {
+		_, err := r.kAPI.Delete(r.ctx(), key, nil)
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return keyCollisionError(err, key)
+	}
+
+	obj := r.prefixed(machinePrefix, machID, "object")
+	if _, err := r.kAPI.Get(r.ctx(), obj, nil); err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = fmt.Errorf("machine %s does not exist", machID)
+		}
+		return err
+	}
+
+	_, err := r.kAPI.Set(r.ctx(), key, message, nil)
+	return keyCollisionError(err, key)
+}
+
+// IsMachineCordoned reports whether the identified machine is cordoned. It
+// is not an error to ask about a machine which does not exist.
+func (r *EtcdRegistry) IsMachineCordoned(machID string) (bool, error) {
+	key := r.prefixed(machinePrefix, machID, "cordon")
+	_, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err == nil {
+		return true, nil
+	} else if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// MachinesInRole returns all machines which have been assigned the given
+// role, including cordoned ones
+func (r *EtcdRegistry) MachinesInRole(role string) ([]machine.MachineState, error) {
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	var inRole []machine.MachineState
+	for _, ms := range machines {
+		ms := ms
+		if machine.HasRoles(&ms, []string{role}) {
+			inRole = append(inRole, ms)
+		}
+	}
+	return inRole, nil
+}
+
+// MachinesMatching returns all machines whose metadata satisfies the given
+// requirements, in the same form as job.Unit.RequiredTargetMetadata.
+// Cordoned machines are omitted unless includeCordoned is set.
+func (r *EtcdRegistry) MachinesMatching(metadata map[string]pkg.Set, includeCordoned bool) ([]machine.MachineState, error) {
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []machine.MachineState
+	for _, ms := range machines {
+		ms := ms
+		if ms.Cordoned && !includeCordoned {
+			continue
+		}
+		if machine.HasMetadata(&ms, metadata) {
+			matching = append(matching, ms)
+		}
+	}
+	return matching, nil
+}
+
+// MachineEventType describes how a machine's membership of a watched set
+// of machines changed
+type MachineEventType string
+
+const (
+	// The machine joined the set, either by appearing in the cluster or
+	// by changing its metadata to match
+	MachineEntered = MachineEventType("entered")
+	// The machine remained in the set but changed its published state
+	MachineUpdated = MachineEventType("updated")
+	// The machine left the set, either by disappearing from the cluster
+	// or by changing its metadata to no longer match
+	MachineLeft = MachineEventType("left")
+)
+
+// MachineEvent describes a change to a machine within a watched set
+type MachineEvent struct {
+	Type      MachineEventType
+	MachineID string
+	// State is the newly published state of the machine, or nil if the
+	// machine left the set by disappearing from the cluster
+	State *machine.MachineState
+}
+
+// WatchMachinesMatching returns a channel emitting a MachineEvent each time
+// a machine whose metadata satisfies the given requirements, in the same
+// form as MachinesMatching, enters or leaves the cluster, changes its
+// metadata so as to enter or leave the set, or otherwise changes its
+// published state, until stop is closed. Events for all other machines are
+// filtered out, as are republications of an unchanged state. Membership is
+// determined from each change alone, so machines already in the set when
+// the watch starts are only reported once they change. Every change made
+// once WatchMachinesMatching has returned is observed; an error is
+// returned if the point from which to watch cannot be determined.
+func (r *EtcdRegistry) WatchMachinesMatching(metadata map[string]pkg.Set, stop <-chan struct{}) (<-chan MachineEvent, error) {
+	key := r.prefixed(machinePrefix)
+	idx, err := r.etcdIndex(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stop = r.watchStop(stop)
+	out := make(chan MachineEvent)
+	q := r.newWatchQueue("machines", stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(MachineEvent):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	go func() {
+		defer q.close(func() { close(out) })
+		r.watchPrefixAfter(key, idx, stop, func(res *etcd.Response) {
+			if ev, ok := r.machineEventFromResponse(res, metadata); ok {
+				q.push(ev)
+			}
+		})
+	}()
+	return out, nil
+}
+
+func (r *EtcdRegistry) machineEventFromResponse(res *etcd.Response, metadata map[string]pkg.Set) (ev MachineEvent, ok bool) {
+	if res == nil || res.Node == nil || !strings.HasSuffix(res.Node.Key, "/object") {
+		return
+	}
+	ev.MachineID = path.Base(path.Dir(res.Node.Key))
+
+	matches := func(node *etcd.Node) (*machine.MachineState, bool) {
+		if node == nil {
+			return nil, false
+		}
+		ms, err := r.parseMachineState(node, ev.MachineID)
+		if err != nil {
+			log.Errorf("Error unmarshalling MachineState(%s): %v", ev.MachineID, err)
+			return nil, false
+		}
+		return ms, machine.HasMetadata(ms, metadata)
+	}
+
+	_, prevMatch := matches(res.PrevNode)
+	if isDeletion(res) {
+		ev.Type = MachineLeft
+		return ev, prevMatch
+	}
+
+	ms, match := matches(res.Node)
+	ev.State = ms
+	switch {
+	case match && !prevMatch:
+		ev.Type = MachineEntered
+	case match && res.PrevNode.Value != res.Node.Value:
+		ev.Type = MachineUpdated
+	case !match && prevMatch:
+		ev.Type = MachineLeft
+	default:
+		return
+	}
+	return ev, true
+}
+
+// CapacityEvent describes a change to the capacity a machine advertises
+type CapacityEvent struct {
+	MachineID string
+	// OldMaxUnits and NewMaxUnits are the MaxUnits of the machine
+	// before and after the change; zero means no limit
+	OldMaxUnits int
+	NewMaxUnits int
+	// State is the newly published state of the machine
+	State *machine.MachineState
+}
+
+// WatchMachineCapacity returns a channel emitting a CapacityEvent each time
+// a machine publishes a state whose capacity differs from the one it last
+// published, until stop is closed. Changes to any other part of a machine's
+// state are filtered out. The capacity of machines already present when the
+// watch starts is known, so their first change is reported, while a new
+// machine is only reported once it changes its capacity after appearing. A
+// machine which disappears and later returns with a different capacity,
+// e.g. after being reconfigured, is reported on its return.
+func (r *EtcdRegistry) WatchMachineCapacity(stop <-chan struct{}) (<-chan CapacityEvent, error) {
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[string]int, len(machines))
+	for _, ms := range machines {
+		last[ms.ID] = ms.MaxUnits
+	}
+
+	stop = r.watchStop(stop)
+	out := make(chan CapacityEvent)
+	q := r.newWatchQueue("machine-capacity", stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(CapacityEvent):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	go func() {
+		defer q.close(func() { close(out) })
+		r.watchPrefix(r.prefixed(machinePrefix), stop, func(res *etcd.Response) {
+			if res == nil || res.Node == nil || isDeletion(res) || !strings.HasSuffix(res.Node.Key, "/object") {
+				return
+			}
+			machID := path.Base(path.Dir(res.Node.Key))
+			ms, err := r.parseMachineState(res.Node, machID)
+			if err != nil {
+				log.Errorf("Error unmarshalling MachineState(%s): %v", machID, err)
+				return
+			}
+
+			prev, seen := last[machID]
+			last[machID] = ms.MaxUnits
+			if seen && prev != ms.MaxUnits {
+				q.push(CapacityEvent{MachineID: machID, OldMaxUnits: prev, NewMaxUnits: ms.MaxUnits, State: ms})
+			}
+		})
+	}()
+	return out, nil
 }
@@ -0,0 +1,132 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/fleet/machine"
+)
+
+const (
+	// compactMachinePrefix marks a MachineState in the compact encoding.
+	// A JSON-encoded MachineState always begins with a brace, so the two
+	// can be told apart on read.
+	compactMachinePrefix = "m1|"
+
+	// compactMachineFields is the number of fields of the compact
+	// encoding: ID, PublicIP, Version, MaxUnits, Metadata and Roles
+	compactMachineFields = 6
+)
+
+var (
+	compactEscaper   = strings.NewReplacer("%", "%25", "|", "%7C", ",", "%2C", "=", "%3D")
+	compactUnescaper = strings.NewReplacer("%25", "%", "%7C", "|", "%2C", ",", "%3D", "=")
+)
+
+// encodeCompactMachineState serializes the given MachineState as its fields
+// in a fixed order, separated by '|', which is considerably smaller than
+// JSON as no field names are written. Metadata is written as sorted
+// key=value pairs and Roles as a list, both separated by ','. Separators
+// occurring within values are percent-escaped. The fields kept by the
+// Registry rather than published by the machine, such as Cordoned, are not
+// encoded.
+func encodeCompactMachineState(ms machine.MachineState) string {
+	var keys sort.StringSlice
+	for k := range ms.Metadata {
+		keys = append(keys, k)
+	}
+	keys.Sort()
+	metadata := make([]string, 0, len(keys))
+	for _, k := range keys {
+		metadata = append(metadata, compactEscaper.Replace(k)+"="+compactEscaper.Replace(ms.Metadata[k]))
+	}
+	roles := make([]string, 0, len(ms.Roles))
+	for _, role := range ms.Roles {
+		roles = append(roles, compactEscaper.Replace(role))
+	}
+
+	fields := []string{
+		compactEscaper.Replace(ms.ID),
+		compactEscaper.Replace(ms.PublicIP),
+		compactEscaper.Replace(ms.Version),
+		strconv.Itoa(ms.MaxUnits),
+		strings.Join(metadata, ","),
+		strings.Join(roles, ","),
+	}
+	return compactMachinePrefix + strings.Join(fields, "|")
+}
+
+// decodeCompactMachineState deserializes a MachineState written by
+// encodeCompactMachineState. Fields beyond those known, as a newer version
+// of fleet might append, are ignored unless strict is set.
+func decodeCompactMachineState(val string, strict bool) (*machine.MachineState, error) {
+	fields := strings.Split(strings.TrimPrefix(val, compactMachinePrefix), "|")
+	if len(fields) < compactMachineFields || (strict && len(fields) > compactMachineFields) {
+		return nil, fmt.Errorf("unable to decode compact machine state: expected %d fields, found %d", compactMachineFields, len(fields))
+	}
+
+	maxUnits, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode compact machine state: invalid MaxUnits %q", fields[3])
+	}
+	ms := &machine.MachineState{
+		ID:       compactUnescaper.Replace(fields[0]),
+		PublicIP: compactUnescaper.Replace(fields[1]),
+		Version:  compactUnescaper.Replace(fields[2]),
+		MaxUnits: maxUnits,
+	}
+	if fields[4] != "" {
+		ms.Metadata = make(map[string]string)
+		for _, pair := range strings.Split(fields[4], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("unable to decode compact machine state: invalid Metadata %q", pair)
+			}
+			ms.Metadata[compactUnescaper.Replace(kv[0])] = compactUnescaper.Replace(kv[1])
+		}
+	}
+	if fields[5] != "" {
+		for _, role := range strings.Split(fields[5], ",") {
+			ms.Roles = append(ms.Roles, compactUnescaper.Replace(role))
+		}
+	}
+	return ms, nil
+}
+
+// encodeMachineState serializes a MachineState for storage, in the compact
+// encoding if the Registry has been configured to use it
+func (r *EtcdRegistry) encodeMachineState(ms machine.MachineState) (string, error) {
+	if r.compactMachines {
+		return encodeCompactMachineState(ms), nil
+	}
+	return marshal(ms)
+}
+
+// decodeMachineState deserializes a stored MachineState, detecting which
+// encoding it was written in regardless of how the Registry is configured
+func (r *EtcdRegistry) decodeMachineState(val string) (*machine.MachineState, error) {
+	if strings.HasPrefix(val, compactMachinePrefix) {
+		return decodeCompactMachineState(val, r.strict)
+	}
+	var ms machine.MachineState
+	if err := r.unmarshal(val, &ms); err != nil {
+		return nil, err
+	}
+	return &ms, nil
+}
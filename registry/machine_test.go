@@ -0,0 +1,471 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg"
+)
+
+func TestExpireMachine(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+
+	if err := r.ExpireMachine("ZZZ"); err == nil {
+		t.Errorf("expected error expiring unknown machine")
+	}
+	if err := r.ExpireMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from ExpireMachine: %v", err)
+	}
+
+	machines, err := r.Machines()
+	if err != nil || len(machines) != 1 || machines[0].ID != "YYY" {
+		t.Errorf("unexpected result from Machines: %v, %v", machines, err)
+	}
+
+	// The schedule is left for the engine to repair
+	machID, _, err := r.UnitTarget("a.service")
+	if err != nil || machID != "XXX" {
+		t.Errorf("unexpected target after ExpireMachine: %q, %v", machID, err)
+	}
+
+	// ...and the Unit no longer counts against any live machine
+	ps, err := r.placementState()
+	if err != nil {
+		t.Fatalf("unexpected error from placementState: %v", err)
+	}
+	if _, ok := ps.machines["XXX"]; ok {
+		t.Errorf("expired machine still considered for placement")
+	}
+	if able, _ := ps.ableToRun(ps.units["a.service"], "YYY"); !able {
+		t.Errorf("Unit of expired machine not able to run elsewhere")
+	}
+}
+
+func TestMachinesInRole(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Roles: []string{"web"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Roles: []string{"db", "web"}})
+	addTestMachine(t, r, machine.MachineState{ID: "ZZZ"})
+
+	for i, tt := range []struct {
+		role string
+		want []string
+	}{
+		{"web", []string{"XXX", "YYY"}},
+		{"db", []string{"YYY"}},
+		{"cache", nil},
+	} {
+		machines, err := r.MachinesInRole(tt.role)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error from MachinesInRole: %v", i, err)
+		}
+		var got []string
+		for _, ms := range machines {
+			got = append(got, ms.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got machines %v, want %v", i, got, tt.want)
+		}
+	}
+
+	// Placement refuses machines lacking the required role
+	u := newTestUnit(t, "db.service", "[X-Fleet]\nMachineRole=db\n")
+	if machID, err := r.LeastLoadedMachine(u, false); err != nil || machID != "YYY" {
+		t.Errorf("unexpected placement of Unit requiring role: %q, %v", machID, err)
+	}
+	u = newTestUnit(t, "cache.service", "[X-Fleet]\nMachineRole=cache\n")
+	if machID, err := r.LeastLoadedMachine(u, false); err != nil || machID != "" {
+		t.Errorf("unexpected placement of Unit requiring absent role: %q, %v", machID, err)
+	}
+}
+
+func TestSetMachineStatus(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+
+	if err := r.SetMachineStatus("ZZZ", "gone fishing"); err == nil {
+		t.Errorf("expected error annotating unknown machine")
+	}
+	msg := "draining for kernel upgrade, back at 3pm"
+	if err := r.SetMachineStatus("XXX", msg); err != nil {
+		t.Fatalf("unexpected error from SetMachineStatus: %v", err)
+	}
+
+	status := func() map[string]string {
+		machines, err := r.Machines()
+		if err != nil {
+			t.Fatalf("unexpected error from Machines: %v", err)
+		}
+		got := make(map[string]string)
+		for _, ms := range machines {
+			got[ms.ID] = ms.StatusMessage
+		}
+		return got
+	}
+	if got, want := status(), map[string]string{"XXX": msg, "YYY": ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got status %v, want %v", got, want)
+	}
+
+	// The machine publishing its state again does not clear the message
+	if _, err := r.SetMachineState(machine.MachineState{ID: "XXX", PublicIP: "10.0.0.1"}, time.Minute); err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+	if err := r.RefreshMachineStateTTL("XXX", time.Minute); err != nil {
+		t.Fatalf("unexpected error from RefreshMachineStateTTL: %v", err)
+	}
+	if got := status(); got["XXX"] != msg {
+		t.Errorf("status lost after heartbeat: got %q", got["XXX"])
+	}
+
+	if err := r.SetMachineStatus("XXX", ""); err != nil {
+		t.Fatalf("unexpected error clearing status: %v", err)
+	}
+	if got := status(); got["XXX"] != "" {
+		t.Errorf("status not cleared: got %q", got["XXX"])
+	}
+	// Clearing is idempotent
+	if err := r.SetMachineStatus("XXX", ""); err != nil {
+		t.Errorf("unexpected error clearing status again: %v", err)
+	}
+}
+
+func TestIsMachineCordoned(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	if err := r.CordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from CordonMachine: %v", err)
+	}
+
+	for i, tt := range []struct {
+		machID string
+		want   bool
+	}{
+		{"XXX", true},
+		{"YYY", false},
+		{"ZZZ", false},
+	} {
+		got, err := r.IsMachineCordoned(tt.machID)
+		if err != nil || got != tt.want {
+			t.Errorf("case %d: IsMachineCordoned(%s) returned %t, %v, want %t", i, tt.machID, got, err, tt.want)
+		}
+	}
+
+	machines, err := r.Machines()
+	if err != nil {
+		t.Fatalf("unexpected error from Machines: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, ms := range machines {
+		got[ms.ID] = ms.Cordoned
+	}
+	if want := map[string]bool{"XXX": true, "YYY": false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got cordon flags %v, want %v", got, want)
+	}
+}
+
+func TestMachineGracePeriod(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	r.SetMachineGracePeriod(time.Minute)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestMachine(t, r, machine.MachineState{ID: "ZZZ"})
+	if err := r.RefreshMachineStateTTL("XXX", time.Minute); err != nil {
+		t.Fatalf("unexpected error from RefreshMachineStateTTL: %v", err)
+	}
+
+	e.expire("/fleet/machines/XXX/object")
+	e.expire("/fleet/machines/YYY/object")
+	e.expire("/fleet/machines/YYY/lastseen")
+	if err := r.ExpireMachine("ZZZ"); err != nil {
+		t.Fatalf("unexpected error from ExpireMachine: %v", err)
+	}
+	addTestMachine(t, r, machine.MachineState{ID: "AAA"})
+
+	machines, err := r.Machines()
+	if err != nil {
+		t.Fatalf("unexpected error from Machines: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, ms := range machines {
+		got[ms.ID] = ms.Degraded
+	}
+	if want := map[string]bool{"AAA": false, "XXX": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got degraded flags %v, want %v", got, want)
+	}
+
+	for i, tt := range []struct {
+		machID string
+		want   MachineHealth
+	}{
+		{"AAA", MachineActive},
+		{"XXX", MachineDegraded},
+		{"YYY", MachineGone},
+		{"ZZZ", MachineGone},
+		{"BBB", MachineGone},
+	} {
+		got, err := r.MachineHealth(tt.machID)
+		if err != nil || got != tt.want {
+			t.Errorf("case %d: MachineHealth(%s) returned %q, %v, want %q", i, tt.machID, got, err, tt.want)
+		}
+	}
+
+	// Degraded machines receive no new Units
+	if machID, err := r.LeastLoadedMachine(newTestUnit(t, "foo.service", ""), true); err != nil || machID != "AAA" {
+		t.Errorf("LeastLoadedMachine returned %q, %v, want AAA", machID, err)
+	}
+
+	// Without a grace period no copy is kept
+	r = NewEtcdRegistry(e, "/other/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	e.expire("/other/machines/XXX/object")
+	if h, err := r.MachineHealth("XXX"); err != nil || h != MachineGone {
+		t.Errorf("MachineHealth without grace period returned %q, %v, want %q", h, err, MachineGone)
+	}
+}
+
+func TestWaitForMachine(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+
+	// Already present
+	ms, err := r.WaitForMachine("XXX", time.Second)
+	if err != nil || ms == nil || ms.ID != "XXX" {
+		t.Fatalf("unexpected result waiting for present machine: %#v, %v", ms, err)
+	}
+
+	// Never appears
+	start := time.Now()
+	if ms, err = r.WaitForMachine("ZZZ", 50*time.Millisecond); err == nil {
+		t.Fatalf("expected error waiting for absent machine, got %#v", ms)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("WaitForMachine did not honor timeout, took %v", elapsed)
+	}
+
+	// Appears while waiting
+	type result struct {
+		ms  *machine.MachineState
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		ms, err := r.WaitForMachine("YYY", 5*time.Second)
+		done <- result{ms, err}
+	}()
+	e.waitForWatchers(t, 2)
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", PublicIP: "1.2.3.4"})
+	res := <-done
+	if res.err != nil || res.ms == nil || res.ms.ID != "YYY" || res.ms.PublicIP != "1.2.3.4" {
+		t.Fatalf("unexpected result waiting for new machine: %#v, %v", res.ms, res.err)
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	// PubicIP is a misspelling of PublicIP
+	e.Set(nil, "/fleet/machines/XXX/object", `{"ID":"XXX","PubicIP":"1.2.3.4"}`, nil)
+
+	machines, err := r.Machines()
+	if err != nil || len(machines) != 1 || machines[0].ID != "XXX" {
+		t.Fatalf("unexpected result from lenient Machines: %v, %v", machines, err)
+	}
+
+	r.SetStrictDecoding(true)
+	if _, err = r.Machines(); err == nil {
+		t.Fatalf("expected error from strict Machines")
+	}
+	if perr, ok := err.(*ParseError); !ok || perr.MachineID != "XXX" {
+		t.Errorf("expected ParseError for machine XXX, got %#v", err)
+	}
+
+	e.Set(nil, "/fleet/machines/XXX/object", `{"ID":"XXX","PublicIP":"1.2.3.4"}`, nil)
+	if machines, err = r.Machines(); err != nil || len(machines) != 1 || machines[0].PublicIP != "1.2.3.4" {
+		t.Errorf("unexpected result from strict Machines: %v, %v", machines, err)
+	}
+}
+
+func TestCompactMachineEncoding(t *testing.T) {
+	states := []machine.MachineState{
+		{ID: "XXX"},
+		{
+			ID:       "YYY",
+			PublicIP: "1.2.3.4",
+			Metadata: map[string]string{"region": "us-east", "odd|key": "a=b,c%7C"},
+			Roles:    []string{"web", "db"},
+			MaxUnits: 3,
+			Version:  "0.11.0",
+		},
+	}
+	for i, ms := range states {
+		val := encodeCompactMachineState(ms)
+		asJSON, _ := marshal(ms)
+		if len(val) >= len(asJSON) {
+			t.Errorf("case %d: compact encoding %q no smaller than JSON %q", i, val, asJSON)
+		}
+		got, err := decodeCompactMachineState(val, true)
+		if err != nil || !reflect.DeepEqual(*got, ms) {
+			t.Errorf("case %d: round trip of %q returned %#v, %v, want %#v", i, val, got, err, ms)
+		}
+	}
+
+	// Fields appended by a newer version are only rejected when strict
+	val := encodeCompactMachineState(states[0]) + "|extra"
+	if _, err := decodeCompactMachineState(val, false); err != nil {
+		t.Errorf("unexpected error decoding extra field: %v", err)
+	}
+	if _, err := decodeCompactMachineState(val, true); err == nil {
+		t.Errorf("expected error strictly decoding extra field")
+	}
+	if _, err := decodeCompactMachineState(compactMachinePrefix+"XXX|", false); err == nil {
+		t.Errorf("expected error decoding truncated state")
+	}
+
+	// Both encodings are read regardless of configuration
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	r.SetCompactMachineEncoding(true)
+	addTestMachine(t, r, states[1])
+	addTestMachine(t, NewEtcdRegistry(e, "/fleet/", time.Second), states[0])
+	res, err := e.Get(nil, "/fleet/machines/YYY/object", nil)
+	if err != nil || !strings.HasPrefix(res.Node.Value, compactMachinePrefix) {
+		t.Fatalf("machine state not written compactly: %v, %v", res, err)
+	}
+	for _, reader := range []*EtcdRegistry{r, NewEtcdRegistry(e, "/fleet/", time.Second)} {
+		machines, err := reader.Machines()
+		if err != nil || !reflect.DeepEqual(machines, states) {
+			t.Errorf("unexpected result from Machines: %#v, %v", machines, err)
+		}
+	}
+}
+
+func TestWatchMachinesMatching(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch, err := r.WatchMachinesMatching(map[string]pkg.Set{"gpu": pkg.NewUnsafeSet("true")}, stop)
+	if err != nil {
+		t.Fatalf("unexpected error from WatchMachinesMatching: %v", err)
+	}
+	e.waitForWatchers(t, 1)
+
+	next := func() MachineEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for MachineEvent")
+		}
+		return MachineEvent{}
+	}
+	gpu := map[string]string{"gpu": "true"}
+
+	// Machines outside the set are filtered out entirely
+	addTestMachine(t, r, machine.MachineState{ID: "CPU"})
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: gpu})
+	if ev := next(); ev.Type != MachineEntered || ev.MachineID != "XXX" || ev.State == nil {
+		t.Errorf("unexpected event for new machine: %#v", ev)
+	}
+
+	// Republishing an unchanged state is not reported
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: gpu})
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: gpu, PublicIP: "1.2.3.4"})
+	if ev := next(); ev.Type != MachineUpdated || ev.State == nil || ev.State.PublicIP != "1.2.3.4" {
+		t.Errorf("unexpected event for updated machine: %#v", ev)
+	}
+
+	// Metadata changes move machines into and out of the set
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	if ev := next(); ev.Type != MachineLeft || ev.MachineID != "XXX" {
+		t.Errorf("unexpected event for machine losing metadata: %#v", ev)
+	}
+	addTestMachine(t, r, machine.MachineState{ID: "CPU", Metadata: gpu})
+	if ev := next(); ev.Type != MachineEntered || ev.MachineID != "CPU" {
+		t.Errorf("unexpected event for machine gaining metadata: %#v", ev)
+	}
+
+	// Disappearing from the cluster leaves the set
+	e.expire("/fleet/machines/CPU/object")
+	if ev := next(); ev.Type != MachineLeft || ev.MachineID != "CPU" || ev.State != nil {
+		t.Errorf("unexpected event for expired machine: %#v", ev)
+	}
+	if err := r.RemoveMachineState("XXX"); err != nil {
+		t.Fatalf("unexpected error from RemoveMachineState: %v", err)
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event for machine outside the set: %#v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchMachineCapacity(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", MaxUnits: 4})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch, err := r.WatchMachineCapacity(stop)
+	if err != nil {
+		t.Fatalf("unexpected error from WatchMachineCapacity: %v", err)
+	}
+	e.waitForWatchers(t, 1)
+	next := func() CapacityEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for CapacityEvent")
+		}
+		return CapacityEvent{}
+	}
+
+	// New machines and changes unrelated to capacity are not reported
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", MaxUnits: 2})
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", MaxUnits: 4, Metadata: map[string]string{"region": "us-east"}})
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", MaxUnits: 8, Metadata: map[string]string{"region": "us-east"}})
+	if ev := next(); ev.MachineID != "XXX" || ev.OldMaxUnits != 4 || ev.NewMaxUnits != 8 || ev.State == nil || ev.State.Metadata["region"] != "us-east" {
+		t.Errorf("unexpected event for capacity change: %#v", ev)
+	}
+
+	// A machine returning with a different capacity is reported
+	e.expire("/fleet/machines/YYY/object")
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	if ev := next(); ev.MachineID != "YYY" || ev.OldMaxUnits != 2 || ev.NewMaxUnits != 0 {
+		t.Errorf("unexpected event for returning machine: %#v", ev)
+	}
+
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", PublicIP: "1.2.3.4"})
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event for unchanged capacity: %#v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// RequestStats accumulates the requests of one kind made through a
+// MetricsKeysAPI
+type RequestStats struct {
+	// Requests counts all requests, including those which failed
+	Requests uint64
+	// Errors counts the requests which failed for any reason
+	Errors uint64
+	// Conflicts counts the failed requests whose precondition did not
+	// hold, i.e. compare-and-swap writes which lost out to another
+	// writer; they are also counted as Errors
+	Conflicts uint64
+	// Duration is the total time spent waiting for the requests
+	Duration time.Duration
+}
+
+// MetricsKeysAPI is a KeysAPI which accounts for the requests made through
+// it, by kind: "get", "set", "delete", "create", "create_in_order",
+// "update" and "watch", the latter counting each long-poll of a Watcher.
+type MetricsKeysAPI struct {
+	kAPI etcd.KeysAPI
+
+	mu    sync.Mutex
+	stats map[string]*RequestStats
+}
+
+// NewMetricsKeysAPI wraps the given KeysAPI such that its requests are
+// accounted for
+func NewMetricsKeysAPI(kAPI etcd.KeysAPI) *MetricsKeysAPI {
+	return &MetricsKeysAPI{kAPI: kAPI, stats: make(map[string]*RequestStats)}
+}
+
+// RequestStats returns the statistics of every kind of request made so far,
+// keyed by kind. The counts accumulate for the lifetime of the KeysAPI.
+func (k *MetricsKeysAPI) RequestStats() map[string]RequestStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stats := make(map[string]RequestStats, len(k.stats))
+	for op, s := range k.stats {
+		stats[op] = *s
+	}
+	return stats
+}
+
+func (k *MetricsKeysAPI) wrapped() etcd.KeysAPI {
+	return k.kAPI
+}
+
+// record accounts for a request of the given kind started at the given
+// time, which resulted in the given error
+func (k *MetricsKeysAPI) record(op string, start time.Time, err error) {
+	elapsed := time.Now().Sub(start)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.stats[op]
+	if !ok {
+		s = &RequestStats{}
+		k.stats[op] = s
+	}
+	s.Requests++
+	s.Duration += elapsed
+	if err != nil {
+		s.Errors++
+		if isEtcdError(err, etcd.ErrorCodeTestFailed) || isEtcdError(err, etcd.ErrorCodeNodeExist) {
+			s.Conflicts++
+		}
+	}
+}
+
+func (k *MetricsKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.Get(ctx, key, opts)
+	k.record("get", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.Set(ctx, key, value, opts)
+	k.record("set", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.Delete(ctx, key, opts)
+	k.record("delete", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.Create(ctx, key, value)
+	k.record("create", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.CreateInOrder(ctx, dir, value, opts)
+	k.record("create_in_order", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := k.kAPI.Update(ctx, key, value)
+	k.record("update", start, err)
+	return res, err
+}
+
+func (k *MetricsKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	return &metricsWatcher{k: k, watcher: k.kAPI.Watcher(key, opts)}
+}
+
+type metricsWatcher struct {
+	k       *MetricsKeysAPI
+	watcher etcd.Watcher
+}
+
+func (w *metricsWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	start := time.Now()
+	res, err := w.watcher.Next(ctx)
+	w.k.record("watch", start, err)
+	return res, err
+}
+
+// WriteMetrics renders the statistics accumulated by the Registry in the
+// Prometheus text exposition format, so they can be served to a Prometheus
+// server without depending upon its client library. The delivery of watches
+// is always included, aggregated by kind of watch, e.g. "unit" for the
+// watches of individual units; the counts of delivered and dropped events
+// include watches which have since stopped, and the lag of a watch is how
+// long its consumer has left buffered events unread. The
+// requests made to etcd, including the compare-and-swap conflicts which
+// indicate contention between writers, are included if the KeysAPI of the
+// Registry is, or wraps, a MetricsKeysAPI.
+func (r *EtcdRegistry) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	mw := &metricsWriter{w: bw}
+
+	if k := r.metricsKeysAPI(); k != nil {
+		stats := k.RequestStats()
+		var ops sort.StringSlice
+		for op := range stats {
+			ops = append(ops, op)
+		}
+		ops.Sort()
+
+		mw.family("fleet_registry_etcd_requests_total", "counter", "Requests made to etcd, by kind.")
+		for _, op := range ops {
+			mw.sample("fleet_registry_etcd_requests_total", "op", op, float64(stats[op].Requests))
+		}
+		mw.family("fleet_registry_etcd_request_errors_total", "counter", "Requests made to etcd which failed, by kind.")
+		for _, op := range ops {
+			mw.sample("fleet_registry_etcd_request_errors_total", "op", op, float64(stats[op].Errors))
+		}
+		mw.family("fleet_registry_etcd_request_conflicts_total", "counter", "Conditional writes to etcd which lost out to another writer, by kind.")
+		for _, op := range ops {
+			mw.sample("fleet_registry_etcd_request_conflicts_total", "op", op, float64(stats[op].Conflicts))
+		}
+		mw.family("fleet_registry_etcd_request_duration_seconds", "summary", "Time spent waiting for requests to etcd, by kind.")
+		for _, op := range ops {
+			mw.sample("fleet_registry_etcd_request_duration_seconds_sum", "op", op, stats[op].Duration.Seconds())
+			mw.sample("fleet_registry_etcd_request_duration_seconds_count", "op", op, float64(stats[op].Requests))
+		}
+	}
+
+	type watchGauges struct {
+		buffered uint64
+		lag      time.Duration
+	}
+	now := time.Now()
+	totals := r.watchTotalsByKind()
+	gauges := make(map[string]*watchGauges, len(totals))
+	var kinds sort.StringSlice
+	for kind := range totals {
+		gauges[kind] = &watchGauges{}
+		kinds = append(kinds, kind)
+	}
+	kinds.Sort()
+	for _, ws := range r.WatchStats() {
+		wg, ok := gauges[watchKind(ws.Name)]
+		if !ok {
+			continue
+		}
+		wg.buffered += uint64(ws.Buffered)
+		if lag := now.Sub(ws.LastDelivered); ws.Buffered > 0 && lag > wg.lag {
+			wg.lag = lag
+		}
+	}
+
+	mw.family("fleet_registry_watch_buffered_events", "gauge", "Events waiting for the consumers of active watches, by kind.")
+	for _, kind := range kinds {
+		mw.sample("fleet_registry_watch_buffered_events", "kind", kind, float64(gauges[kind].buffered))
+	}
+	mw.family("fleet_registry_watch_delivered_events_total", "counter", "Events received by the consumers of watches, by kind.")
+	for _, kind := range kinds {
+		mw.sample("fleet_registry_watch_delivered_events_total", "kind", kind, float64(totals[kind].delivered))
+	}
+	mw.family("fleet_registry_watch_dropped_events_total", "counter", "Events discarded because the consumer of a watch fell behind, by kind.")
+	for _, kind := range kinds {
+		mw.sample("fleet_registry_watch_dropped_events_total", "kind", kind, float64(totals[kind].dropped))
+	}
+	mw.family("fleet_registry_watch_lag_seconds", "gauge", "Longest time for which the consumer of an active watch has left events unread, by kind.")
+	for _, kind := range kinds {
+		mw.sample("fleet_registry_watch_lag_seconds", "kind", kind, gauges[kind].lag.Seconds())
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return bw.Flush()
+}
+
+func (r *EtcdRegistry) metricsKeysAPI() *MetricsKeysAPI {
+	for _, k := range r.keysAPIs() {
+		if mk, ok := k.(*MetricsKeysAPI); ok {
+			return mk
+		}
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the Prometheus text exposition format, remembering
+// the first error encountered
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *metricsWriter) sample(name, label, value string, v float64) {
+	mw.printf("%s{%s=\"%s\"} %s\n", name, label, labelEscaper.Replace(value), strconv.FormatFloat(v, 'g', -1, 64))
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+)
+
+var (
+	metricsCommentRE = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	metricsSampleRE  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+// parseMetrics checks that the given text follows the Prometheus text
+// exposition format, returning the value of each sample by name and labels
+func parseMetrics(t *testing.T, text string) map[string]float64 {
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if m := metricsCommentRE.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				switch m[3] {
+				case "counter", "gauge", "summary", "histogram", "untyped":
+				default:
+					t.Errorf("line %d: unknown metric type %q", i, m[3])
+				}
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := metricsSampleRE.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %d: invalid sample %q", i, line)
+			continue
+		}
+		family := m[1]
+		if types[family] == "" {
+			family = strings.TrimSuffix(strings.TrimSuffix(family, "_sum"), "_count")
+		}
+		if types[family] == "" {
+			t.Errorf("line %d: sample of %s precedes its TYPE", i, m[1])
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("line %d: invalid value %q", i, m[3])
+		}
+		samples[m[1]+m[2]] = v
+	}
+	return samples
+}
+
+func TestWriteMetrics(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(NewMetricsKeysAPI(e), "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	r.WatchLeases(stop)
+	unitStop := make(chan struct{})
+	unitCh := r.WatchUnit("foo.service", unitStop)
+	e.waitForWatchers(t, 3)
+
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestUnit(t, r, newTestUnit(t, "foo.service", ""), "XXX")
+	nextLifecycleEvent(t, unitCh)
+	// Events delivered by a watch are still counted once it stops
+	close(unitStop)
+	for range unitCh {
+	}
+	// A conditional write which loses out to another is a conflict
+	if err := r.ScheduleUnitAtIndex("foo.service", "YYY", 0); err != ErrIndexMismatch {
+		t.Fatalf("expected ErrIndexMismatch, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteMetrics(&buf); err != nil {
+		t.Fatalf("unexpected error from WriteMetrics: %v", err)
+	}
+	samples := parseMetrics(t, buf.String())
+
+	for _, name := range []string{
+		`fleet_registry_etcd_requests_total{op="get"}`,
+		`fleet_registry_etcd_requests_total{op="set"}`,
+		`fleet_registry_etcd_request_errors_total{op="set"}`,
+		`fleet_registry_etcd_request_duration_seconds_sum{op="set"}`,
+		`fleet_registry_etcd_request_duration_seconds_count{op="set"}`,
+		`fleet_registry_etcd_request_conflicts_total{op="set"}`,
+		`fleet_registry_watch_buffered_events{kind="leases"}`,
+		`fleet_registry_watch_delivered_events_total{kind="leases"}`,
+		`fleet_registry_watch_dropped_events_total{kind="leases"}`,
+		`fleet_registry_watch_lag_seconds{kind="leases"}`,
+	} {
+		if _, ok := samples[name]; !ok {
+			t.Errorf("missing sample %s in:\n%s", name, buf.String())
+		}
+	}
+	if v := samples[`fleet_registry_etcd_request_conflicts_total{op="set"}`]; v != 1 {
+		t.Errorf("expected 1 conflicting set, got %v", v)
+	}
+	if v := samples[`fleet_registry_watch_delivered_events_total{kind="unit"}`]; v != 1 {
+		t.Errorf("expected 1 event delivered by unit watches, got %v", v)
+	}
+	if strings.Contains(buf.String(), "foo.service") {
+		t.Errorf("unexpected per-unit watch label:\n%s", buf.String())
+	}
+
+	// Without a MetricsKeysAPI only the watches are reported
+	buf.Reset()
+	plain := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	if err := plain.WriteMetrics(&buf); err != nil {
+		t.Fatalf("unexpected error from WriteMetrics: %v", err)
+	}
+	parseMetrics(t, buf.String())
+	if strings.Contains(buf.String(), "fleet_registry_etcd_") {
+		t.Errorf("unexpected etcd metrics without a MetricsKeysAPI:\n%s", buf.String())
+	}
+}
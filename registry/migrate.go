@@ -0,0 +1,86 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+// MigratePrefix copies every value stored under the Registry's key prefix
+// to the same relative key under newPrefix, returning the number of values
+// copied. Values which carry a TTL are written with their remaining TTL.
+// Keys which already exist under newPrefix are left untouched, so an
+// interrupted migration may safely be run again. The Registry's own keys
+// are not modified, and empty directories are not copied. The keyspace may
+// keep changing while the migration runs, so all fleet daemons should be
+// stopped beforehand.
+func (r *EtcdRegistry) MigratePrefix(newPrefix string) (int, error) {
+	oldPrefix := r.prefixed()
+	newPrefix = path.Join("/", newPrefix)
+	if within(newPrefix, oldPrefix) || within(oldPrefix, newPrefix) {
+		return 0, fmt.Errorf("cannot migrate between nested prefixes %s and %s", oldPrefix, newPrefix)
+	}
+
+	opts := &etcd.GetOptions{
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), oldPrefix, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return 0, err
+	}
+
+	var migrated int
+	var walk func(*etcd.Node) error
+	walk = func(node *etcd.Node) error {
+		if node.Dir {
+			for _, child := range node.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		key := path.Join(newPrefix, strings.TrimPrefix(node.Key, oldPrefix))
+		opts := &etcd.SetOptions{
+			PrevExist: etcd.PrevNoExist,
+			TTL:       time.Duration(node.TTL) * time.Second,
+		}
+		if _, err := r.kAPI.Set(r.ctx(), key, node.Value, opts); err != nil {
+			if isEtcdError(err, etcd.ErrorCodeNodeExist) {
+				return nil
+			}
+			return keyCollisionError(err, key)
+		}
+		migrated++
+		return nil
+	}
+
+	err = walk(res.Node)
+	return migrated, err
+}
+
+// within reports whether key is equal to, or nested below, the given prefix
+func within(key, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+}
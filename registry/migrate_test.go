@@ -0,0 +1,83 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+)
+
+func TestMigratePrefix(t *testing.T) {
+	e := newMemKeysAPI()
+	old := NewEtcdRegistry(e, "/coreos.com/coreinit/", time.Second)
+	addTestMachine(t, old, machine.MachineState{ID: "XXX"})
+	addTestUnit(t, old, newTestUnit(t, "foo.service", "[Service]\nExecStart=/bin/true\n"), "XXX")
+	// Keys outside the prefix are not migrated
+	e.Set(nil, "/unrelated", "value", nil)
+
+	for _, prefix := range []string{"/coreos.com/coreinit/sub", "/coreos.com", "/"} {
+		if _, err := old.MigratePrefix(prefix); err == nil {
+			t.Errorf("expected error migrating to nested prefix %s", prefix)
+		}
+	}
+
+	// machine object, unit file, unit object, target and target state
+	n, err := old.MigratePrefix("/fleet/")
+	if err != nil {
+		t.Fatalf("unexpected error from MigratePrefix: %v", err)
+	}
+	if n < 5 {
+		t.Errorf("expected at least 5 keys migrated, got %d", n)
+	}
+
+	migrated := NewEtcdRegistry(e, "/fleet/", time.Second)
+	for _, r := range []*EtcdRegistry{old, migrated} {
+		machines, err := r.Machines()
+		if err != nil || len(machines) != 1 || machines[0].ID != "XXX" {
+			t.Errorf("unexpected machines under %s: %v, %v", r.keyPrefix, machines, err)
+		}
+	}
+	oldSched, _ := old.Schedule()
+	newSched, _ := migrated.Schedule()
+	if !reflect.DeepEqual(oldSched, newSched) {
+		t.Errorf("schedule not migrated: got %v, want %v", newSched, oldSched)
+	}
+	u, err := migrated.Unit("foo.service")
+	if err != nil || u == nil || u.Unit.Hash() != newTestUnit(t, "", "[Service]\nExecStart=/bin/true\n").Unit.Hash() {
+		t.Errorf("unit not migrated: %#v, %v", u, err)
+	}
+
+	res, err := e.Get(nil, "/fleet/machines/XXX/object", nil)
+	if err != nil || res.Node.TTL <= 0 {
+		t.Errorf("TTL of machine state not preserved: %#v, %v", res, err)
+	}
+	if _, err := e.Get(nil, "/fleet/unrelated", nil); err == nil {
+		t.Errorf("key outside prefix unexpectedly migrated")
+	}
+
+	// Re-running skips everything already migrated, without overwriting
+	if err := migrated.SetUnitTargetState("foo.service", "loaded"); err != nil {
+		t.Fatalf("unexpected error from SetUnitTargetState: %v", err)
+	}
+	if n, err = old.MigratePrefix("/fleet"); err != nil || n != 0 {
+		t.Errorf("expected no keys migrated on re-run, got %d, %v", n, err)
+	}
+	if ts, _, _ := migrated.UnitTargetState("foo.service"); ts != "loaded" {
+		t.Errorf("re-run overwrote migrated key: target state %q", ts)
+	}
+}
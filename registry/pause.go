@@ -0,0 +1,266 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"sync"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/log"
+)
+
+// ErrPaused is returned for requests rejected because the KeysAPI serving
+// them has been paused
+var ErrPaused = errors.New("registry: paused for maintenance")
+
+// PausableKeysAPI is a KeysAPI which can be paused, e.g. for the duration
+// of an etcd upgrade. While paused, every write fails with ErrPaused
+// without reaching etcd, as do reads if so configured. Watchers neither
+// poll etcd nor attempt to reconnect while paused: a long-poll in flight
+// is interrupted, and the next event is only awaited once resumed, from
+// the last index returned, so no events are lost.
+type PausableKeysAPI struct {
+	kAPI       etcd.KeysAPI
+	pauseReads bool
+
+	mu     sync.RWMutex
+	paused bool
+	// pausing is closed when the KeysAPI is paused, and resuming when it
+	// is resumed; each is replaced once the other is closed
+	pausing  chan struct{}
+	resuming chan struct{}
+}
+
+// NewPausableKeysAPI wraps the given KeysAPI such that it can be paused.
+// If pauseReads is set, reads are rejected while paused as well as writes.
+func NewPausableKeysAPI(kAPI etcd.KeysAPI, pauseReads bool) *PausableKeysAPI {
+	resuming := make(chan struct{})
+	close(resuming)
+	return &PausableKeysAPI{
+		kAPI:       kAPI,
+		pauseReads: pauseReads,
+		pausing:    make(chan struct{}),
+		resuming:   resuming,
+	}
+}
+
+// Pause rejects further requests as described by PausableKeysAPI, until
+// Resume is called. Requests already in flight, other than the long-polls
+// of Watchers, are allowed to complete. Pausing a paused KeysAPI has no
+// effect.
+func (k *PausableKeysAPI) Pause() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.paused {
+		return
+	}
+	k.paused = true
+	close(k.pausing)
+	k.resuming = make(chan struct{})
+	log.Infof("Paused etcd requests")
+}
+
+// Resume allows requests to be made again, and lets Watchers resume.
+// Resuming a KeysAPI which is not paused has no effect.
+func (k *PausableKeysAPI) Resume() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.paused {
+		return
+	}
+	k.paused = false
+	close(k.resuming)
+	k.pausing = make(chan struct{})
+	log.Infof("Resumed etcd requests")
+}
+
+// Paused reports whether the KeysAPI is currently paused
+func (k *PausableKeysAPI) Paused() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.paused
+}
+
+func (k *PausableKeysAPI) wrapped() etcd.KeysAPI {
+	return k.kAPI
+}
+
+// state returns the channels closed when the KeysAPI is next paused and
+// resumed, respectively
+func (k *PausableKeysAPI) state() (pausing, resuming <-chan struct{}) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.pausing, k.resuming
+}
+
+func (k *PausableKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	if k.pauseReads && k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.Get(ctx, key, opts)
+}
+
+func (k *PausableKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.Set(ctx, key, value, opts)
+}
+
+func (k *PausableKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	if k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.Delete(ctx, key, opts)
+}
+
+func (k *PausableKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	if k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.Create(ctx, key, value)
+}
+
+func (k *PausableKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	if k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (k *PausableKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	if k.Paused() {
+		return nil, ErrPaused
+	}
+	return k.kAPI.Update(ctx, key, value)
+}
+
+// Watcher returns a Watcher which is suspended while the KeysAPI is
+// paused. A Watcher started without an AfterIndex only resumes without
+// loss once it has returned its first event.
+func (k *PausableKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	w := &pausableWatcher{k: k, key: key}
+	if opts != nil {
+		w.opts = *opts
+	}
+	return w
+}
+
+type pausableWatcher struct {
+	k    *PausableKeysAPI
+	key  string
+	opts etcd.WatcherOptions
+
+	watcher etcd.Watcher
+	// pending holds an event which arrived as the KeysAPI was paused,
+	// to be returned once it is resumed
+	pending *etcd.Response
+}
+
+func (w *pausableWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	for {
+		pausing, resuming := w.k.state()
+		select {
+		case <-resuming:
+		default:
+			log.Debugf("Suspending etcd watcher %s while paused", w.key)
+			w.watcher = nil
+			select {
+			case <-resuming:
+				log.Debugf("Resuming etcd watcher %s", w.key)
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if w.pending != nil {
+			res := w.pending
+			w.pending = nil
+			return res, nil
+		}
+		if w.watcher == nil {
+			opts := w.opts
+			w.watcher = w.k.kAPI.Watcher(w.key, &opts)
+		}
+
+		wctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-pausing:
+				cancel()
+			case <-wctx.Done():
+			}
+		}()
+		res, err := w.watcher.Next(wctx)
+		cancel()
+
+		if err != nil {
+			select {
+			case <-pausing:
+				if ctx.Err() == nil {
+					continue
+				}
+			default:
+			}
+			return nil, err
+		}
+
+		if res.Node != nil {
+			w.opts.AfterIndex = res.Node.ModifiedIndex
+		}
+		select {
+		case <-pausing:
+			w.pending = res
+			continue
+		default:
+		}
+		return res, nil
+	}
+}
+
+// Pause pauses the etcd requests of the Registry, as described by
+// PausableKeysAPI.Pause. It fails unless the KeysAPI of the Registry is,
+// or wraps, a PausableKeysAPI.
+func (r *EtcdRegistry) Pause() error {
+	k := r.pausableKeysAPI()
+	if k == nil {
+		return errors.New("registry does not support pausing")
+	}
+	k.Pause()
+	return nil
+}
+
+// Resume resumes the etcd requests of a Registry paused with Pause
+func (r *EtcdRegistry) Resume() error {
+	k := r.pausableKeysAPI()
+	if k == nil {
+		return errors.New("registry does not support pausing")
+	}
+	k.Resume()
+	return nil
+}
+
+func (r *EtcdRegistry) pausableKeysAPI() *PausableKeysAPI {
+	for _, k := range r.keysAPIs() {
+		if pk, ok := k.(*PausableKeysAPI); ok {
+			return pk
+		}
+	}
+	return nil
+}
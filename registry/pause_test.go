@@ -0,0 +1,135 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+func TestPauseRegistry(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(NewPausableKeysAPI(e, false), "/fleet/", time.Second)
+	// Leases are written by another party, unaffected by the pause
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch := r.WatchLeases(stop)
+	e.waitForWatchers(t, 1)
+	next := func() LeaseEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for LeaseEvent")
+		}
+		return LeaseEvent{}
+	}
+
+	if _, err := lm.AcquireLease("a", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	if ev := next(); ev.Name != "a" {
+		t.Errorf("unexpected event before pause: %#v", ev)
+	}
+
+	if err := r.Pause(); err != nil {
+		t.Fatalf("unexpected error from Pause: %v", err)
+	}
+	if _, err := r.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute); err != ErrPaused {
+		t.Errorf("expected ErrPaused from write while paused, got %v", err)
+	}
+	if _, err := r.Machines(); err != nil {
+		t.Errorf("unexpected error from read while paused: %v", err)
+	}
+
+	// Changes made while paused are delivered once resumed
+	if _, err := lm.AcquireLease("b", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event while paused: %#v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := r.Resume(); err != nil {
+		t.Fatalf("unexpected error from Resume: %v", err)
+	}
+	if ev := next(); ev.Name != "b" {
+		t.Errorf("unexpected event after resume: %#v", ev)
+	}
+	if _, err := r.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute); err != nil {
+		t.Errorf("unexpected error from write after resume: %v", err)
+	}
+
+	// Reads may be paused too
+	r = NewEtcdRegistry(NewPausableKeysAPI(e, true), "/fleet/", time.Second)
+	r.Pause()
+	if _, err := r.Machines(); err != ErrPaused {
+		t.Errorf("expected ErrPaused from read while paused, got %v", err)
+	}
+	r.Resume()
+	if machines, err := r.Machines(); err != nil || len(machines) != 1 {
+		t.Errorf("unexpected result from read after resume: %v, %v", machines, err)
+	}
+
+	plain := NewEtcdRegistry(e, "/fleet/", time.Second)
+	if err := plain.Pause(); err == nil {
+		t.Errorf("expected error pausing a plain KeysAPI")
+	}
+}
+
+func TestPauseWrappedRegistry(t *testing.T) {
+	e := newMemKeysAPI()
+	factory := func(endpoints []string) (etcd.KeysAPI, error) {
+		return NewLeaderRetryKeysAPI(e, nil), nil
+	}
+	ek, err := NewEndpointsKeysAPI([]string{"http://a:2379"}, factory)
+	if err != nil {
+		t.Fatalf("unexpected error from NewEndpointsKeysAPI: %v", err)
+	}
+	// Each feature is reachable wherever it sits in the stack
+	r := NewEtcdRegistry(NewMetricsKeysAPI(NewPausableKeysAPI(ek, false)), "/fleet/", time.Second)
+
+	if err := r.Pause(); err != nil {
+		t.Fatalf("unexpected error from Pause: %v", err)
+	}
+	if _, err := r.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute); err != ErrPaused {
+		t.Errorf("expected ErrPaused from write while paused, got %v", err)
+	}
+	if err := r.Resume(); err != nil {
+		t.Fatalf("unexpected error from Resume: %v", err)
+	}
+	if err := r.UpdateEndpoints([]string{"http://b:2379"}); err != nil {
+		t.Errorf("unexpected error from UpdateEndpoints: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteMetrics(&buf); err != nil {
+		t.Fatalf("unexpected error from WriteMetrics: %v", err)
+	}
+	if want := `fleet_registry_etcd_requests_total{op="set"}`; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected metrics to contain %q, got:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,464 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/log"
+	"github.com/coreos/fleet/machine"
+)
+
+// machineLoad describes a machine and the Units it is expected to run
+type machineLoad struct {
+	ms    *machine.MachineState
+	units map[string]*job.Unit
+	// cordoned machines must not be selected for new placements
+	cordoned bool
+}
+
+// atCapacity determines whether the machine already runs the maximum number
+// of Units it allows, not counting the named Unit itself
+func (ml *machineLoad) atCapacity(name string) bool {
+	if ml.ms.MaxUnits <= 0 {
+		return false
+	}
+	if _, ok := ml.units[name]; ok {
+		return false
+	}
+	return len(ml.units) >= ml.ms.MaxUnits
+}
+
+// placementState is a point-in-time view of the cluster used by the
+// placement helpers of the Registry. It follows the same rules as the
+// engine's clusterState and AgentState, which cannot be used from here
+// as both packages depend upon the registry.
+type placementState struct {
+	machines map[string]*machineLoad
+	// units holds all non-global Units, indexed by name
+	units map[string]*job.Unit
+	// targets holds the ID of the machine each scheduled Unit is
+	// currently scheduled to, indexed by Unit name
+	targets map[string]string
+}
+
+func newPlacementState(units []job.Unit, sUnits []job.ScheduledUnit, machines []machine.MachineState) *placementState {
+	ps := &placementState{
+		machines: make(map[string]*machineLoad, len(machines)),
+		units:    make(map[string]*job.Unit),
+		targets:  make(map[string]string),
+	}
+	for _, ms := range machines {
+		ms := ms
+		ps.machines[ms.ID] = &machineLoad{ms: &ms, units: make(map[string]*job.Unit)}
+	}
+
+	for _, su := range sUnits {
+		if su.TargetMachineID != "" {
+			ps.targets[su.Name] = su.TargetMachineID
+		}
+	}
+
+	for _, u := range units {
+		u := u
+		if u.IsGlobal() {
+			for _, ml := range ps.machines {
+				if machine.HasMetadata(ml.ms, u.RequiredTargetMetadata()) && machine.HasRoles(ml.ms, u.RequiredRoles()) && machine.HasConstraints(ml.ms, u.RequiredConstraints()) {
+					ml.units[u.Name] = &u
+				}
+			}
+			continue
+		}
+
+		ps.units[u.Name] = &u
+		if u.TargetState == job.JobStateInactive {
+			continue
+		}
+		if ml, ok := ps.machines[ps.targets[u.Name]]; ok {
+			ml.units[u.Name] = &u
+		}
+	}
+
+	return ps
+}
+
+// placementState builds a placementState from the current contents of the
+// Registry
+func (r *EtcdRegistry) placementState() (*placementState, error) {
+	units, err := r.Units()
+	if err != nil {
+		return nil, err
+	}
+	sUnits, err := r.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	ps := newPlacementState(units, sUnits, machines)
+	for _, ms := range machines {
+		if ms.Cordoned || ms.Degraded {
+			ps.cordon(ms.ID)
+		}
+	}
+	return ps, nil
+}
+
+// cordon marks the given machine as unavailable for new placements
+func (ps *placementState) cordon(machID string) {
+	if ml, ok := ps.machines[machID]; ok {
+		ml.cordoned = true
+	}
+}
+
+// schedule records that the named Unit is now scheduled to the given machine
+func (ps *placementState) schedule(name, machID string) {
+	u, ok := ps.units[name]
+	if !ok {
+		return
+	}
+	if ml, ok := ps.machines[ps.targets[name]]; ok {
+		delete(ml.units, name)
+	}
+	ps.targets[name] = machID
+	if ml, ok := ps.machines[machID]; ok && u.TargetState != job.JobStateInactive {
+		ml.units[name] = u
+	}
+}
+
+// add records a new, unscheduled Unit
+func (ps *placementState) add(u *job.Unit) {
+	ps.units[u.Name] = u
+}
+
+// remove forgets the named Unit entirely, as if it had been destroyed
+func (ps *placementState) remove(name string) {
+	if ml, ok := ps.machines[ps.targets[name]]; ok {
+		delete(ml.units, name)
+	}
+	delete(ps.targets, name)
+	delete(ps.units, name)
+}
+
+// sortedMachines returns all known machines sorted ascending by the number
+// of Units they are expected to run, and then by ID. Cordoned machines are
+// omitted unless includeCordoned is set.
+func (ps *placementState) sortedMachines(includeCordoned bool) []*machineLoad {
+	mls := make(sortableMachineLoads, 0, len(ps.machines))
+	for _, ml := range ps.machines {
+		if ml.cordoned && !includeCordoned {
+			continue
+		}
+		mls = append(mls, ml)
+	}
+	sort.Sort(mls)
+	return []*machineLoad(mls)
+}
+
+type sortableMachineLoads []*machineLoad
+
+func (mls sortableMachineLoads) Len() int      { return len(mls) }
+func (mls sortableMachineLoads) Swap(i, j int) { mls[i], mls[j] = mls[j], mls[i] }
+
+func (mls sortableMachineLoads) Less(i, j int) bool {
+	ni := len(mls[i].units)
+	nj := len(mls[j].units)
+	return ni < nj || (ni == nj && mls[i].ms.ID < mls[j].ms.ID)
+}
+
+// LeastLoadedMachine returns the ID of the machine expected to run the fewest
+// Units among those able to run the given Unit, or an empty string if no
+// machine is able to run it. Cordoned machines are not considered unless
+// includeCordoned is set.
+func (r *EtcdRegistry) LeastLoadedMachine(u *job.Unit, includeCordoned bool) (string, error) {
+	ps, err := r.placementState()
+	if err != nil {
+		return "", err
+	}
+	return ps.place(u, NewLeastLoadedPlacement(), includeCordoned, -1)
+}
+
+// MachineAtCapacity determines whether the given machine already runs the
+// maximum number of Units it allows, as published in its MaxUnits. Global
+// Units the machine is expected to run are counted. Machines without a
+// limit, and machines which are not present, are never at capacity.
+func (r *EtcdRegistry) MachineAtCapacity(machID string) (bool, error) {
+	ps, err := r.placementState()
+	if err != nil {
+		return false, err
+	}
+	ml, ok := ps.machines[machID]
+	if !ok {
+		return false, nil
+	}
+	return ml.atCapacity(""), nil
+}
+
+// PlacementCandidate describes a machine able to run a Unit being placed
+type PlacementCandidate struct {
+	Machine machine.MachineState
+	// Units is the number of Units the machine is currently expected
+	// to run, including global Units
+	Units int
+}
+
+// Placement decides which machine a Unit should be scheduled to. It allows
+// the placement helpers of the Registry, such as Rebalance and
+// DrainMachine, to be customized.
+type Placement interface {
+	// Place returns the ID of the machine, chosen from the given
+	// candidates, to which the Unit should be scheduled, or an empty
+	// string if none is acceptable. Candidates are only offered if they
+	// satisfy all requirements of the Unit, and are sorted by machine
+	// ID. At least one candidate is always offered.
+	Place(u *job.Unit, candidates []PlacementCandidate) (string, error)
+}
+
+// PlacementFunc allows an ordinary function to be used as a Placement
+type PlacementFunc func(u *job.Unit, candidates []PlacementCandidate) (string, error)
+
+func (f PlacementFunc) Place(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+	return f(u, candidates)
+}
+
+// NewLeastLoadedPlacement returns a Placement selecting the candidate
+// expected to run the fewest Units, using the machine ID to break ties
+func NewLeastLoadedPlacement() Placement {
+	return PlacementFunc(func(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.Units < best.Units {
+				best = c
+			}
+		}
+		return best.Machine.ID, nil
+	})
+}
+
+// NewFirstFitPlacement returns a Placement selecting the first candidate,
+// i.e. the one with the lowest machine ID, regardless of load. This packs
+// Units onto as few machines as their requirements allow.
+func NewFirstFitPlacement() Placement {
+	return PlacementFunc(func(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+		return candidates[0].Machine.ID, nil
+	})
+}
+
+// NewRoundRobinPlacement returns a Placement cycling through the candidates
+// it is offered, regardless of load. The position in the cycle is kept by
+// the returned Placement, so the same Placement should be reused for
+// successive decisions.
+func NewRoundRobinPlacement() Placement {
+	return &roundRobinPlacement{}
+}
+
+type roundRobinPlacement struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (rr *roundRobinPlacement) Place(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	c := candidates[rr.next%len(candidates)]
+	rr.next++
+	return c.Machine.ID, nil
+}
+
+// NewWeightedRoundRobinPlacement returns a Placement cycling through the
+// candidates it is offered, choosing each in proportion to the weight given
+// by its value for the metadata key weightKey, e.g. a machine with weight 2
+// is chosen twice as often as one with weight 1. Machines with a missing or
+// unparseable weight have weight 1, and machines with weight 0 are never
+// chosen. The position in the cycle is kept in the named counter of the
+// given Registry, so every Placement using the same counter, even in
+// different processes, contributes to the same distribution.
+func NewWeightedRoundRobinPlacement(r *EtcdRegistry, counter, weightKey string) Placement {
+	return PlacementFunc(func(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+		weights := make([]uint64, len(candidates))
+		var total uint64
+		for i, c := range candidates {
+			weights[i] = 1
+			if w, err := strconv.ParseUint(c.Machine.Metadata[weightKey], 10, 32); err == nil {
+				weights[i] = w
+			}
+			total += weights[i]
+		}
+		if total == 0 {
+			return "", nil
+		}
+
+		n, err := r.IncrementCounter(counter)
+		if err != nil {
+			return "", err
+		}
+		slot := (n - 1) % total
+		for i, w := range weights {
+			if slot < w {
+				return candidates[i].Machine.ID, nil
+			}
+			slot -= w
+		}
+		// unreachable, as slot < total
+		return "", nil
+	})
+}
+
+// candidates returns the machines able to run the given Unit which are
+// expected to run no more than maxUnits Units, sorted by machine ID. A
+// negative maxUnits imposes no limit. Cordoned machines are omitted unless
+// includeCordoned is set.
+func (ps *placementState) candidates(u *job.Unit, includeCordoned bool, maxUnits int) []PlacementCandidate {
+	var ids sort.StringSlice
+	for id := range ps.machines {
+		ids = append(ids, id)
+	}
+	ids.Sort()
+
+	var cands []PlacementCandidate
+	for _, id := range ids {
+		ml := ps.machines[id]
+		if ml.cordoned && !includeCordoned {
+			continue
+		}
+		if maxUnits >= 0 && len(ml.units) > maxUnits {
+			continue
+		}
+		if able, _ := ps.ableToRun(u, id); able {
+			cands = append(cands, PlacementCandidate{Machine: *ml.ms, Units: len(ml.units)})
+		}
+	}
+	return cands
+}
+
+// place uses the given Placement to choose a machine for the Unit from the
+// suitable candidates, as described by candidates and choose
+func (ps *placementState) place(u *job.Unit, p Placement, includeCordoned bool, maxUnits int) (string, error) {
+	return ps.choose(u, p, ps.candidates(u, includeCordoned, maxUnits))
+}
+
+// choose uses the given Placement to choose a machine for the Unit from the
+// provided candidates, returning an empty string if there are none. An
+// error is returned if the Placement chooses a machine it was not offered.
+func (ps *placementState) choose(u *job.Unit, p Placement, cands []PlacementCandidate) (string, error) {
+	if len(cands) == 0 {
+		return "", nil
+	}
+	machID, err := p.Place(u, cands)
+	if err != nil || machID == "" {
+		return "", err
+	}
+	for _, c := range cands {
+		if c.Machine.ID == machID {
+			return machID, nil
+		}
+	}
+	return "", fmt.Errorf("placement chose machine %s which is unable to run Unit(%s)", machID, u.Name)
+}
+
+// ableToRun determines whether the given Unit could be scheduled to the
+// indicated machine, following the same criteria as AgentState.AbleToRun.
+// If not, a description of the unmet requirement is returned.
+func (ps *placementState) ableToRun(u *job.Unit, machID string) (bool, string) {
+	ml, ok := ps.machines[machID]
+	if !ok {
+		return false, fmt.Sprintf("machine %s is not known", machID)
+	}
+
+	if tgt, ok := u.RequiredTarget(); ok && !ml.ms.MatchID(tgt) {
+		return false, fmt.Sprintf("machine ID %q does not match required %q", ml.ms.ID, tgt)
+	}
+
+	metadata := u.RequiredTargetMetadata()
+	if len(metadata) != 0 && !machine.HasMetadata(ml.ms, metadata) {
+		return false, "machine metadata insufficient"
+	}
+
+	if !machine.HasRoles(ml.ms, u.RequiredRoles()) {
+		return false, "machine lacks required roles"
+	}
+
+	if !machine.HasConstraints(ml.ms, u.RequiredConstraints()) {
+		return false, "machine metadata does not meet constraints"
+	}
+
+	if ml.atCapacity(u.Name) {
+		return false, fmt.Sprintf("machine already runs its maximum of %d Units", ml.ms.MaxUnits)
+	}
+
+	for _, peer := range u.Peers() {
+		if _, ok := ml.units[peer]; !ok {
+			return false, fmt.Sprintf("required peer Unit(%s) is not scheduled to machine", peer)
+		}
+	}
+
+	for _, eUnit := range ml.units {
+		if eUnit.Name == u.Name {
+			continue
+		}
+		for _, pConflict := range u.Conflicts() {
+			if globMatches(pConflict, eUnit.Name) {
+				return false, fmt.Sprintf("found conflict with Unit(%s)", eUnit.Name)
+			}
+		}
+		for _, eConflict := range eUnit.Conflicts() {
+			if globMatches(eConflict, u.Name) {
+				return false, fmt.Sprintf("found conflict with Unit(%s)", eUnit.Name)
+			}
+		}
+	}
+
+	return true, ""
+}
+
+// movable determines whether the named Unit may be moved away from its
+// current machine without breaking any colocation requirements
+func (ps *placementState) movable(name string) bool {
+	u, ok := ps.units[name]
+	if !ok {
+		return false
+	}
+	if _, ok := u.RequiredTarget(); ok {
+		return false
+	}
+	if len(u.Peers()) != 0 {
+		return false
+	}
+	for _, other := range ps.units {
+		for _, peer := range other.Peers() {
+			if peer == name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func globMatches(pattern, target string) bool {
+	matched, err := path.Match(pattern, target)
+	if err != nil {
+		log.Debugf("Received error while matching pattern '%s': %v", pattern, err)
+	}
+	return matched
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func newTestUnit(t *testing.T, name, contents string) *job.Unit {
+	uf, err := unit.NewUnitFile(contents)
+	if err != nil {
+		t.Fatalf("failed creating UnitFile for %s: %v", name, err)
+	}
+	return &job.Unit{Name: name, Unit: *uf, TargetState: job.JobStateLaunched}
+}
+
+// addTestUnit creates the given Unit and schedules it to the indicated
+// machine, if any
+func addTestUnit(t *testing.T, r *EtcdRegistry, u *job.Unit, machID string) {
+	if err := r.CreateUnit(u); err != nil {
+		t.Fatalf("failed creating Unit(%s): %v", u.Name, err)
+	}
+	if machID == "" {
+		return
+	}
+	if err := r.ScheduleUnit(u.Name, machID); err != nil {
+		t.Fatalf("failed scheduling Unit(%s): %v", u.Name, err)
+	}
+}
+
+func addTestMachine(t *testing.T, r *EtcdRegistry, ms machine.MachineState) {
+	if _, err := r.SetMachineState(ms, time.Minute); err != nil {
+		t.Fatalf("failed creating Machine(%s): %v", ms.ID, err)
+	}
+}
+
+func TestPlacementStateAbleToRun(t *testing.T) {
+	units := []job.Unit{
+		*newTestUnit(t, "a.service", ""),
+		*newTestUnit(t, "b.service", "[X-Fleet]\nConflicts=a.service\n"),
+		*newTestUnit(t, "c.service", "[X-Fleet]\nMachineOf=a.service\n"),
+		*newTestUnit(t, "d.service", "[X-Fleet]\nMachineMetadata=region=us-east\n"),
+		*newTestUnit(t, "e.service", "[X-Fleet]\nMachineID=YYY\n"),
+		*newTestUnit(t, "f.service", "[X-Fleet]\nMachineRole=db\n"),
+		*newTestUnit(t, "g.service", "[X-Fleet]\nMachineConstraint=region in [us-east, eu-west]\n"),
+	}
+	sUnits := []job.ScheduledUnit{
+		{Name: "a.service", TargetMachineID: "XXX"},
+	}
+	machines := []machine.MachineState{
+		{ID: "XXX", Metadata: map[string]string{"region": "us-west"}},
+		{ID: "YYY", Metadata: map[string]string{"region": "us-east"}, Roles: []string{"db"}},
+	}
+	ps := newPlacementState(units, sUnits, machines)
+
+	for i, tt := range []struct {
+		name   string
+		machID string
+		able   bool
+	}{
+		{"b.service", "XXX", false},
+		{"b.service", "YYY", true},
+		{"c.service", "XXX", true},
+		{"c.service", "YYY", false},
+		{"d.service", "XXX", false},
+		{"d.service", "YYY", true},
+		{"e.service", "XXX", false},
+		{"e.service", "YYY", true},
+		{"f.service", "XXX", false},
+		{"f.service", "YYY", true},
+		{"g.service", "XXX", false},
+		{"g.service", "YYY", true},
+		{"a.service", "ZZZ", false},
+	} {
+		able, reason := ps.ableToRun(ps.units[tt.name], tt.machID)
+		if able != tt.able {
+			t.Errorf("case %d: %s on %s: got able=%t (%s), want %t", i, tt.name, tt.machID, able, reason, tt.able)
+		}
+	}
+
+	if ps.movable("a.service") {
+		t.Errorf("a.service is a required peer and should not be movable")
+	}
+	if ps.movable("c.service") || ps.movable("e.service") {
+		t.Errorf("Units with colocation requirements should not be movable")
+	}
+	if !ps.movable("b.service") {
+		t.Errorf("b.service should be movable")
+	}
+}
+
+func TestCordonedMachinesNotSelected(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: map[string]string{"region": "us-east"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Metadata: map[string]string{"region": "us-east"}})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "YYY")
+
+	if err := r.CordonMachine("ZZZ"); err == nil {
+		t.Errorf("expected error cordoning unknown machine")
+	}
+	if err := r.CordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from CordonMachine: %v", err)
+	}
+	// Publishing the machine state must not clear the flag
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: map[string]string{"region": "us-east"}})
+
+	u := newTestUnit(t, "b.service", "")
+	for i, tt := range []struct {
+		includeCordoned bool
+		want            string
+	}{
+		{false, "YYY"},
+		{true, "XXX"},
+	} {
+		got, err := r.LeastLoadedMachine(u, tt.includeCordoned)
+		if err != nil {
+			t.Errorf("case %d: unexpected error from LeastLoadedMachine: %v", i, err)
+		} else if got != tt.want {
+			t.Errorf("case %d: LeastLoadedMachine returned %q, want %q", i, got, tt.want)
+		}
+	}
+
+	metadata := newTestUnit(t, "c.service", "[X-Fleet]\nMachineMetadata=region=us-east\n").RequiredTargetMetadata()
+	matching, err := r.MachinesMatching(metadata, false)
+	if err != nil || len(matching) != 1 || matching[0].ID != "YYY" {
+		t.Errorf("unexpected result from MachinesMatching: %v, %v", matching, err)
+	}
+	matching, err = r.MachinesMatching(metadata, true)
+	if err != nil || len(matching) != 2 {
+		t.Errorf("unexpected result from MachinesMatching including cordoned: %v, %v", matching, err)
+	}
+
+	if err := r.UncordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from UncordonMachine: %v", err)
+	}
+	if got, _ := r.LeastLoadedMachine(u, false); got != "XXX" {
+		t.Errorf("LeastLoadedMachine returned %q after uncordon, want XXX", got)
+	}
+	if err := r.UncordonMachine("XXX"); err != nil {
+		t.Errorf("unexpected error uncordoning machine twice: %v", err)
+	}
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	u := newTestUnit(t, "a.service", "")
+	cands := []PlacementCandidate{
+		{Machine: machine.MachineState{ID: "XXX"}, Units: 3},
+		{Machine: machine.MachineState{ID: "YYY"}, Units: 1},
+		{Machine: machine.MachineState{ID: "ZZZ"}, Units: 1},
+	}
+
+	for i, tt := range []struct {
+		placement Placement
+		want      []string
+	}{
+		{NewLeastLoadedPlacement(), []string{"YYY", "YYY", "YYY"}},
+		{NewFirstFitPlacement(), []string{"XXX", "XXX", "XXX"}},
+		{NewRoundRobinPlacement(), []string{"XXX", "YYY", "ZZZ", "XXX"}},
+	} {
+		for j, want := range tt.want {
+			got, err := tt.placement.Place(u, cands)
+			if err != nil {
+				t.Errorf("case %d.%d: unexpected error: %v", i, j, err)
+			} else if got != want {
+				t.Errorf("case %d.%d: got %q, want %q", i, j, got, want)
+			}
+		}
+	}
+}
+
+func TestPlacementStateCandidates(t *testing.T) {
+	units := []job.Unit{
+		*newTestUnit(t, "a.service", ""),
+		*newTestUnit(t, "b.service", ""),
+		*newTestUnit(t, "c.service", "[X-Fleet]\nConflicts=a.service\n"),
+	}
+	sUnits := []job.ScheduledUnit{
+		{Name: "a.service", TargetMachineID: "XXX"},
+		{Name: "b.service", TargetMachineID: "YYY"},
+	}
+	machines := []machine.MachineState{{ID: "ZZZ"}, {ID: "YYY"}, {ID: "XXX"}, {ID: "WWW"}}
+	ps := newPlacementState(units, sUnits, machines)
+	ps.cordon("WWW")
+
+	ids := func(cands []PlacementCandidate) (got []string) {
+		for _, c := range cands {
+			got = append(got, c.Machine.ID)
+		}
+		return
+	}
+	c := ps.units["c.service"]
+	if got, want := ids(ps.candidates(c, false, -1)), []string{"YYY", "ZZZ"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected candidates: got %v, want %v", got, want)
+	}
+	if got, want := ids(ps.candidates(c, true, 0)), []string{"WWW", "ZZZ"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected candidates including cordoned, unloaded: got %v, want %v", got, want)
+	}
+
+	// A Placement may not choose a machine it was not offered
+	bad := PlacementFunc(func(*job.Unit, []PlacementCandidate) (string, error) {
+		return "XXX", nil
+	})
+	if _, err := ps.place(c, bad, false, -1); err == nil {
+		t.Errorf("expected error from Placement choosing unsuitable machine")
+	}
+}
+
+func TestWeightedRoundRobinPlacement(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	u := newTestUnit(t, "a.service", "")
+	cands := []PlacementCandidate{
+		{Machine: machine.MachineState{ID: "XXX", Metadata: map[string]string{"weight": "2"}}},
+		{Machine: machine.MachineState{ID: "YYY", Metadata: map[string]string{"weight": "1"}}},
+		// no weight counts as 1
+		{Machine: machine.MachineState{ID: "ZZZ"}},
+		{Machine: machine.MachineState{ID: "AAA", Metadata: map[string]string{"weight": "0"}}},
+	}
+
+	// Two Placements sharing a counter act as one
+	placements := []Placement{
+		NewWeightedRoundRobinPlacement(r, "placement", "weight"),
+		NewWeightedRoundRobinPlacement(r, "placement", "weight"),
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		got, err := placements[i%2].Place(u, cands)
+		if err != nil {
+			t.Fatalf("placement %d: unexpected error: %v", i, err)
+		}
+		counts[got]++
+	}
+	want := map[string]int{"XXX": 200, "YYY": 100, "ZZZ": 100}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("unexpected distribution of placements: got %v, want %v", counts, want)
+	}
+
+	got, err := placements[0].Place(u, cands[3:])
+	if err != nil || got != "" {
+		t.Errorf("expected no machine chosen among zero weights, got %q, %v", got, err)
+	}
+}
+
+func TestMachineAtCapacity(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", MaxUnits: 2})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	for i := 0; i < 3; i++ {
+		addTestUnit(t, r, newTestUnit(t, fmt.Sprintf("y%d.service", i), ""), "YYY")
+	}
+
+	for i, tt := range []struct {
+		machID string
+		full   bool
+	}{
+		{"XXX", false},
+		// no limit
+		{"YYY", false},
+		{"ZZZ", false},
+	} {
+		if full, err := r.MachineAtCapacity(tt.machID); err != nil || full != tt.full {
+			t.Errorf("case %d: expected %t from MachineAtCapacity(%s), got %t, %v", i, tt.full, tt.machID, full, err)
+		}
+	}
+
+	// Scheduling is allowed below the limit...
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "")
+	if ok, err := r.ScheduleUnitIfMachinePresent("b.service", "XXX"); !ok || err != nil {
+		t.Fatalf("expected b.service to be scheduled, got %t, %v", ok, err)
+	}
+	if full, err := r.MachineAtCapacity("XXX"); err != nil || !full {
+		t.Errorf("expected XXX to be at capacity, got %t, %v", full, err)
+	}
+
+	// ...and refused at it
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "")
+	ok, err := r.ScheduleUnitIfMachinePresent("c.service", "XXX")
+	if cerr, isCap := err.(*CapacityError); ok || !isCap || cerr.MachineID != "XXX" || cerr.MaxUnits != 2 {
+		t.Errorf("expected CapacityError scheduling c.service, got %t, %v", ok, err)
+	}
+	if machID, _, _ := r.UnitTarget("c.service"); machID != "" {
+		t.Errorf("c.service unexpectedly scheduled to %s", machID)
+	}
+
+	// Placement skips the full machine, even though it is less loaded
+	c := newTestUnit(t, "c.service", "")
+	if machID, err := r.LeastLoadedMachine(c, false); err != nil || machID != "YYY" {
+		t.Errorf("expected c.service to be placed on YYY, got %q, %v", machID, err)
+	}
+}
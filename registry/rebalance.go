@@ -0,0 +1,266 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/fleet/job"
+)
+
+// MoveRecord describes a Unit being moved from one machine to another
+type MoveRecord struct {
+	Name string
+	From string
+	To   string
+	// Err is set if the Unit could not be moved, in which case it
+	// remains scheduled to From
+	Err error
+}
+
+// Rebalance moves Units from the most-loaded machines in the cluster to the
+// less-loaded ones until the difference in the number of Units between
+// them is no greater than maxSkew, or no further Unit can be moved. Each
+// Unit to be moved is offered to the given Placement along with the
+// machines able to run it that carry at least two fewer Units; if no
+// Placement is given, the least-loaded of those is chosen. Units with a
+// lower EvictionPriority are moved first, and Units are never moved if
+// doing so would break a colocation requirement. Each move is
+// performed atomically with MoveUnit. The moves performed are returned in
+// order, along with any error that prevented the rebalancing from
+// completing.
+func (r *EtcdRegistry) Rebalance(maxSkew int, placement Placement) ([]MoveRecord, error) {
+	if placement == nil {
+		placement = NewLeastLoadedPlacement()
+	}
+
+	ps, err := r.placementState()
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []MoveRecord
+	for {
+		// Units may be moved off cordoned machines, but never onto them
+		mls := ps.sortedMachines(true)
+		dests := ps.sortedMachines(false)
+		if len(mls) < 2 || len(dests) == 0 {
+			break
+		}
+
+		most := mls[len(mls)-1]
+		skew := len(most.units) - len(dests[0].units)
+		// A move must strictly reduce the skew, otherwise the same
+		// Unit could bounce back and forth indefinitely
+		if skew <= maxSkew || skew < 2 {
+			break
+		}
+
+		mv, err := ps.findMove(most, placement)
+		if err != nil {
+			return moves, err
+		}
+		if mv == nil {
+			break
+		}
+		if err := r.MoveUnit(mv.Name, mv.From, mv.To); err != nil {
+			return moves, err
+		}
+		ps.schedule(mv.Name, mv.To)
+		moves = append(moves, *mv)
+	}
+
+	return moves, nil
+}
+
+// findMove identifies a Unit that can be moved off the given machine onto
+// a machine carrying at least two fewer Units, as chosen by the given
+// Placement. Units are considered in eviction order; see evictionOrder.
+func (ps *placementState) findMove(from *machineLoad, placement Placement) (*MoveRecord, error) {
+	var names []string
+	for name := range from.units {
+		if ps.targets[name] == from.ms.ID && ps.movable(name) {
+			names = append(names, name)
+		}
+	}
+	ps.evictionOrder(names)
+
+	for _, name := range names {
+		to, err := ps.place(ps.units[name], placement, false, len(from.units)-2)
+		if err != nil {
+			return nil, err
+		}
+		if to != "" {
+			return &MoveRecord{Name: name, From: from.ms.ID, To: to}, nil
+		}
+	}
+	return nil, nil
+}
+
+// DrainMachine cordons the identified machine and then moves each Unit
+// scheduled to it onto the machine chosen for it by the given Placement
+// from those able to run it. If no Placement is given, the least-loaded
+// machine is chosen. Units are moved in order of ascending
+// EvictionPriority, and each move is performed atomically with MoveUnit. As
+// with Rebalance, Units are never moved if doing so would break a
+// colocation requirement. A Unit which cannot be placed or moved is left
+// where it is and its MoveRecord carries the reason; the remaining Units
+// are still moved. A
+// non-nil error is only returned if the drain could not proceed at all, in
+// which case no Units were moved.
+func (r *EtcdRegistry) DrainMachine(machID string, placement Placement) ([]MoveRecord, error) {
+	return r.DrainMachineParallel(machID, placement, 0, 0)
+}
+
+// DrainMachineParallel drains the identified machine as DrainMachine does,
+// but moves at most parallelism Units at a time; a parallelism of zero or
+// less moves them all at once. If wait is non-zero, the Units of each batch
+// are then waited for, for up to wait, to be reported active on their new
+// machines before the next batch is moved. A moved Unit which does not
+// become active in time keeps its To, but its MoveRecord carries the error
+// and the drain carries on with the next batch.
+func (r *EtcdRegistry) DrainMachineParallel(machID string, placement Placement, parallelism int, wait time.Duration) ([]MoveRecord, error) {
+	if placement == nil {
+		placement = NewLeastLoadedPlacement()
+	}
+
+	if err := r.CordonMachine(machID); err != nil {
+		return nil, err
+	}
+
+	ps, err := r.placementState()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, tgt := range ps.targets {
+		if _, ok := ps.units[name]; ok && tgt == machID {
+			names = append(names, name)
+		}
+	}
+	ps.evictionOrder(names)
+	if parallelism <= 0 || parallelism > len(names) {
+		parallelism = len(names)
+	}
+
+	moves := make([]MoveRecord, len(names))
+	for start := 0; start < len(names); start += parallelism {
+		end := start + parallelism
+		if end > len(names) {
+			end = len(names)
+		}
+		batch := moves[start:end]
+
+		// Machines are chosen one after another so that each choice
+		// accounts for the Units already placed, and the moves are then
+		// made together
+		var wg sync.WaitGroup
+		for i, name := range names[start:end] {
+			mv := &batch[i]
+			*mv = MoveRecord{Name: name, From: machID}
+			if !ps.movable(name) {
+				mv.Err = errors.New("Unit is pinned to its machine or colocated with other Units")
+				continue
+			}
+			to, err := ps.place(ps.units[name], placement, false, -1)
+			switch {
+			case err != nil:
+				mv.Err = err
+			case to == "":
+				mv.Err = errors.New("no machine able to run Unit")
+			default:
+				ps.schedule(name, to)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if mv.Err = r.MoveUnit(mv.Name, machID, to); mv.Err == nil {
+						mv.To = to
+					}
+				}()
+			}
+		}
+		wg.Wait()
+
+		for i := range batch {
+			mv := &batch[i]
+			if mv.To == "" {
+				if mv.Err != nil {
+					ps.schedule(mv.Name, machID)
+				}
+				continue
+			}
+			if wait == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, mv.Err = r.WaitForUnitState(mv.Name, mv.To, "active", wait)
+			}()
+		}
+		wg.Wait()
+	}
+
+	return moves, nil
+}
+
+// UnitsByEvictionOrder returns the Units scheduled to the given machine, in
+// the order in which DrainMachine moves them off it: by ascending
+// EvictionPriority, and by name among Units of equal EvictionPriority.
+// Global Units are not included, as they are never scheduled to a
+// particular machine.
+func (r *EtcdRegistry) UnitsByEvictionOrder(machID string) ([]job.Unit, error) {
+	ps, err := r.placementState()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, tgt := range ps.targets {
+		if _, ok := ps.units[name]; ok && tgt == machID {
+			names = append(names, name)
+		}
+	}
+	ps.evictionOrder(names)
+
+	ordered := make([]job.Unit, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, *ps.units[name])
+	}
+	return ordered, nil
+}
+
+// evictionOrder sorts the given Unit names in the order in which the Units
+// should be moved off their machine: by ascending EvictionPriority, and by
+// name among Units of equal EvictionPriority
+func (ps *placementState) evictionOrder(names []string) {
+	sort.Strings(names)
+	sort.Stable(namesByEviction{names, ps.units})
+}
+
+type namesByEviction struct {
+	names []string
+	units map[string]*job.Unit
+}
+
+func (ne namesByEviction) Len() int      { return len(ne.names) }
+func (ne namesByEviction) Swap(i, j int) { ne.names[i], ne.names[j] = ne.names[j], ne.names[i] }
+func (ne namesByEviction) Less(i, j int) bool {
+	return ne.units[ne.names[i]].EvictionPriority() < ne.units[ne.names[j]].EvictionPriority()
+}
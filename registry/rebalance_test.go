@@ -0,0 +1,302 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func machineLoads(t *testing.T, r *EtcdRegistry) map[string]int {
+	sUnits, err := r.Schedule()
+	if err != nil {
+		t.Fatalf("unexpected error from Schedule: %v", err)
+	}
+	loads := make(map[string]int)
+	for _, su := range sUnits {
+		loads[su.TargetMachineID]++
+	}
+	return loads
+}
+
+func TestRebalance(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, id := range []string{"XXX", "YYY", "ZZZ"} {
+		addTestMachine(t, r, machine.MachineState{ID: id})
+	}
+	for i := 0; i < 6; i++ {
+		addTestUnit(t, r, newTestUnit(t, fmt.Sprintf("app%d.service", i), ""), "XXX")
+	}
+	// Pinned Units must stay put
+	addTestUnit(t, r, newTestUnit(t, "pinned.service", "[X-Fleet]\nMachineID=XXX\n"), "XXX")
+
+	moves, err := r.Rebalance(1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Rebalance: %v", err)
+	}
+	loads := machineLoads(t, r)
+	if loads["XXX"] != 3 || loads["YYY"] != 2 || loads["ZZZ"] != 2 {
+		t.Errorf("unexpected loads after Rebalance: %v", loads)
+	}
+	if len(moves) != 4 {
+		t.Errorf("expected 4 moves, got %v", moves)
+	}
+	for _, mv := range moves {
+		if mv.Name == "pinned.service" {
+			t.Errorf("pinned Unit was moved: %v", mv)
+		}
+		if mv.From != "XXX" {
+			t.Errorf("unexpected move: %v", mv)
+		}
+	}
+
+	// Already balanced
+	moves, err = r.Rebalance(1, nil)
+	if err != nil || len(moves) != 0 {
+		t.Errorf("expected no moves when balanced, got %v, %v", moves, err)
+	}
+}
+
+func TestRebalanceConflicts(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Metadata: map[string]string{"disk": "ssd"}})
+
+	addTestUnit(t, r, newTestUnit(t, "db.service", ""), "YYY")
+	addTestUnit(t, r, newTestUnit(t, "a.service", "[X-Fleet]\nConflicts=db.service\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", "[X-Fleet]\nMachineMetadata=disk=hdd\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "d.service", ""), "XXX")
+
+	moves, err := r.Rebalance(0, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Rebalance: %v", err)
+	}
+	want := []MoveRecord{{Name: "c.service", From: "XXX", To: "YYY"}}
+	if len(moves) != 1 || moves[0] != want[0] {
+		t.Errorf("unexpected moves: got %v, want %v", moves, want)
+	}
+}
+
+func TestDrainMachine(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, id := range []string{"XXX", "YYY", "ZZZ"} {
+		addTestMachine(t, r, machine.MachineState{ID: id})
+	}
+	for i := 0; i < 4; i++ {
+		addTestUnit(t, r, newTestUnit(t, fmt.Sprintf("app%d.service", i), ""), "XXX")
+	}
+	addTestUnit(t, r, newTestUnit(t, "other.service", ""), "YYY")
+	// Pinned Units cannot be placed anywhere else
+	addTestUnit(t, r, newTestUnit(t, "pinned.service", "[X-Fleet]\nMachineID=XXX\n"), "XXX")
+
+	if _, err := r.DrainMachine("nope", nil); err == nil {
+		t.Errorf("expected error draining unknown machine")
+	}
+
+	moves, err := r.DrainMachine("XXX", nil)
+	if err != nil {
+		t.Fatalf("unexpected error from DrainMachine: %v", err)
+	}
+	if len(moves) != 5 {
+		t.Fatalf("expected 5 MoveRecords, got %v", moves)
+	}
+	for _, mv := range moves {
+		if mv.Name == "pinned.service" {
+			if mv.Err == nil || mv.To != "" {
+				t.Errorf("pinned Unit unexpectedly moved: %#v", mv)
+			}
+			continue
+		}
+		if mv.Err != nil || mv.From != "XXX" || (mv.To != "YYY" && mv.To != "ZZZ") {
+			t.Errorf("unexpected MoveRecord: %#v", mv)
+		}
+	}
+	loads := machineLoads(t, r)
+	if loads["XXX"] != 1 || loads["YYY"] != 3 || loads["ZZZ"] != 2 {
+		t.Errorf("unexpected loads after DrainMachine: %v", loads)
+	}
+
+	// The drained machine is cordoned against new placements
+	if got, _ := r.LeastLoadedMachine(newTestUnit(t, "new.service", ""), false); got == "XXX" {
+		t.Errorf("drained machine selected for new placement")
+	}
+
+	// Placement failures are reported without aborting the drain
+	addTestUnit(t, r, newTestUnit(t, "late.service", ""), "XXX")
+	moves, err = r.DrainMachine("XXX", PlacementFunc(func(u *job.Unit, candidates []PlacementCandidate) (string, error) {
+		if u.Name == "late.service" {
+			return "ZZZ", nil
+		}
+		return "", errors.New("no room")
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error from DrainMachine: %v", err)
+	}
+	if len(moves) != 2 || moves[0].Name != "late.service" || moves[0].To != "ZZZ" || moves[1].Err == nil {
+		t.Errorf("unexpected MoveRecords: %#v", moves)
+	}
+}
+
+func TestDrainMachineColocated(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, id := range []string{"XXX", "YYY", "ZZZ"} {
+		addTestMachine(t, r, machine.MachineState{ID: id})
+	}
+	addTestUnit(t, r, newTestUnit(t, "app.service", ""), "XXX")
+	// Moving either of these on its own would separate them
+	addTestUnit(t, r, newTestUnit(t, "db.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "web.service", "[X-Fleet]\nMachineOf=db.service\n"), "XXX")
+
+	moves, err := r.DrainMachineParallel("XXX", nil, 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from DrainMachineParallel: %v", err)
+	}
+	if len(moves) != 3 {
+		t.Fatalf("expected 3 MoveRecords, got %v", moves)
+	}
+	for _, mv := range moves {
+		if mv.Name == "app.service" {
+			if mv.Err != nil || mv.To == "" {
+				t.Errorf("unexpected MoveRecord: %#v", mv)
+			}
+			continue
+		}
+		if mv.Err == nil || mv.To != "" {
+			t.Errorf("colocated Unit unexpectedly moved: %#v", mv)
+		}
+	}
+	targets := scheduleOf(t, r)
+	if targets["db.service"] != "XXX" || targets["web.service"] != "XXX" {
+		t.Errorf("colocated Units separated: %v", targets)
+	}
+}
+
+func TestDrainMachineParallel(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	for i := 0; i < 5; i++ {
+		addTestUnit(t, r, newTestUnit(t, fmt.Sprintf("app%d.service", i), ""), "XXX")
+	}
+
+	type result struct {
+		moves []MoveRecord
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		moves, err := r.DrainMachineParallel("XXX", nil, 2, time.Second)
+		done <- result{moves, err}
+	}()
+
+	// Each batch is only moved once the previous one is active
+	for i, want := range []int{2, 4, 5} {
+		e.waitForWatchers(t, want)
+		moved := machineLoads(t, r)["YYY"]
+		if moved != want {
+			t.Fatalf("case %d: %d Units moved, want %d", i, moved, want)
+		}
+		for j := want - 2; j < want; j++ {
+			if j < 0 {
+				continue
+			}
+			r.SaveUnitState(fmt.Sprintf("app%d.service", j), unit.NewUnitState("loaded", "active", "running", "YYY"), time.Minute)
+		}
+	}
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for DrainMachineParallel")
+	}
+	if res.err != nil {
+		t.Fatalf("unexpected error from DrainMachineParallel: %v", res.err)
+	}
+	for i, mv := range res.moves {
+		if want := fmt.Sprintf("app%d.service", i); mv.Name != want || mv.To != "YYY" || mv.Err != nil {
+			t.Errorf("case %d: unexpected MoveRecord: %#v", i, mv)
+		}
+	}
+
+	// A Unit not becoming active in time is reported, though moved
+	if err := r.UncordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from UncordonMachine: %v", err)
+	}
+	addTestUnit(t, r, newTestUnit(t, "slow.service", ""), "YYY")
+	moves, err := r.DrainMachineParallel("YYY", nil, 1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error from DrainMachineParallel: %v", err)
+	}
+	if len(moves) != 6 {
+		t.Fatalf("expected 6 MoveRecords, got %v", moves)
+	}
+	for _, mv := range moves {
+		if mv.To != "XXX" || mv.Err == nil {
+			t.Errorf("unexpected MoveRecord: %#v", mv)
+		}
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", "[X-Fleet]\nEvictionPriority=10\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "c.service", "[X-Fleet]\nEvictionPriority=-5\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "d.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "e.service", ""), "YYY")
+
+	want := []string{"c.service", "b.service", "d.service", "a.service"}
+	units, err := r.UnitsByEvictionOrder("XXX")
+	if err != nil {
+		t.Fatalf("unexpected error from UnitsByEvictionOrder: %v", err)
+	}
+	var got []string
+	for _, u := range units {
+		got = append(got, u.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got eviction order %v, want %v", got, want)
+	}
+
+	// Rebalance moves the Unit with the lowest eviction priority
+	moves, err := r.Rebalance(1, nil)
+	if err != nil || len(moves) != 1 || moves[0].Name != "c.service" {
+		t.Errorf("unexpected moves from Rebalance: %v, %v", moves, err)
+	}
+
+	moves, err = r.DrainMachine("XXX", nil)
+	if err != nil {
+		t.Fatalf("unexpected error from DrainMachine: %v", err)
+	}
+	got = nil
+	for _, mv := range moves {
+		got = append(got, mv.Name)
+	}
+	if !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("DrainMachine moved %v, want %v", got, want[1:])
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/coreos/fleet/job"
+)
+
+// ReconcileScope converges the Units in the Registry matching the given
+// scope onto the desired Jobs matching it, leaving everything outside the
+// scope untouched: desired Jobs outside the scope are ignored, and Units
+// outside it are neither destroyed nor modified. Desired Jobs in scope
+// which have no Unit of the same name are created with their TargetState;
+// Units in scope which are not desired are destroyed. Units which exist
+// and are still desired are left alone, even if their unit files differ.
+// The names of the created and destroyed Units are returned, sorted, along
+// with any error that prevented the reconciliation from completing, in
+// which case the changes made so far are still reported.
+func (r *EtcdRegistry) ReconcileScope(desired []*job.Job, scope func(job.Job) bool) (added, removed []string, err error) {
+	if scope == nil {
+		return nil, nil, errors.New("no scope given")
+	}
+
+	units, err := r.Units()
+	if err != nil {
+		return nil, nil, err
+	}
+	existing := make(map[string]bool, len(units))
+	for _, u := range units {
+		if scope(job.Job{Name: u.Name, Unit: u.Unit, TargetState: u.TargetState}) {
+			existing[u.Name] = true
+		}
+	}
+
+	wanted := make(map[string]*job.Job)
+	for _, j := range desired {
+		if scope(*j) {
+			wanted[j.Name] = j
+		}
+	}
+
+	var create, destroy sort.StringSlice
+	for name := range wanted {
+		if !existing[name] {
+			create = append(create, name)
+		}
+	}
+	for name := range existing {
+		if wanted[name] == nil {
+			destroy = append(destroy, name)
+		}
+	}
+	create.Sort()
+	destroy.Sort()
+
+	for _, name := range destroy {
+		if err := r.DestroyUnit(name); err != nil {
+			return added, removed, fmt.Errorf("failed destroying Unit(%s): %v", name, err)
+		}
+		removed = append(removed, name)
+	}
+	for _, name := range create {
+		j := wanted[name]
+		u := &job.Unit{
+			Name:        j.Name,
+			Unit:        j.Unit,
+			TargetState: j.TargetState,
+		}
+		if u.TargetState == "" {
+			u.TargetState = job.JobStateInactive
+		}
+		if err := r.CreateUnit(u); err != nil {
+			return added, removed, fmt.Errorf("failed creating Unit(%s): %v", name, err)
+		}
+		added = append(added, name)
+	}
+	return added, removed, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+)
+
+func TestReconcileScope(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, name := range []string{"web-a.service", "web-old.service", "db-a.service", "db-old.service"} {
+		addTestUnit(t, r, newTestUnit(t, name, ""), "")
+	}
+
+	newJob := func(name string) *job.Job {
+		u := newTestUnit(t, name, "")
+		j := job.NewJob(u.Name, u.Unit)
+		j.TargetState = job.JobStateLaunched
+		return j
+	}
+	desired := []*job.Job{
+		newJob("web-a.service"),
+		newJob("web-new.service"),
+		// outside the scope, so neither created nor preventing
+		// db-old.service from staying
+		newJob("db-new.service"),
+	}
+	web := func(j job.Job) bool { return strings.HasPrefix(j.Name, "web-") }
+
+	added, removed, err := r.ReconcileScope(desired, web)
+	if err != nil {
+		t.Fatalf("unexpected error from ReconcileScope: %v", err)
+	}
+	if want := []string{"web-new.service"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added %v, want %v", added, want)
+	}
+	if want := []string{"web-old.service"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("got removed %v, want %v", removed, want)
+	}
+
+	units, err := r.Units()
+	if err != nil {
+		t.Fatalf("unexpected error from Units: %v", err)
+	}
+	var names []string
+	for _, u := range units {
+		names = append(names, u.Name)
+		if u.Name == "web-new.service" && u.TargetState != job.JobStateLaunched {
+			t.Errorf("created Unit has target state %q", u.TargetState)
+		}
+	}
+	if want := []string{"db-a.service", "db-old.service", "web-a.service", "web-new.service"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got Units %v, want %v", names, want)
+	}
+
+	// Reconciling again changes nothing
+	added, removed, err = r.ReconcileScope(desired, web)
+	if err != nil || len(added) != 0 || len(removed) != 0 {
+		t.Errorf("unexpected result from repeated ReconcileScope: %v, %v, %v", added, removed, err)
+	}
+}
@@ -15,6 +15,7 @@
 package registry
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 )
@@ -34,3 +35,15 @@ func unmarshal(val string, obj interface{}) error {
 	}
 	return fmt.Errorf("unable to JSON-deserialize object: %s", err)
 }
+
+// unmarshalStrict behaves like unmarshal, but additionally fails if the
+// serialized object has fields which obj does not
+func unmarshalStrict(val string, obj interface{}) error {
+	dec := json.NewDecoder(bytes.NewBufferString(val))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(obj)
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("unable to JSON-deserialize object: %s", err)
+}
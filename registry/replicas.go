@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/unit"
+)
+
+// ScheduleReplicas converges the number of instances of the given template
+// Unit (e.g. foo@.service) to the requested number of replicas. Replicas
+// are the instances named with consecutive indexes starting at one (e.g.
+// foo@1.service, foo@2.service); instances with any other name are left
+// alone. Missing replicas are created from the template and scheduled
+// immediately, each to a different machine than the other replicas, and
+// excess replicas are destroyed starting with the highest index, so
+// repeated calls with the same count are no-ops. Each new replica is
+// offered to the given Placement along with the machines able to run it
+// that are not running another replica; if no Placement is given, the
+// least-loaded of those is chosen. The replicas are returned ordered by
+// index, along with any error that prevented the convergence from
+// completing. Existing replicas are neither moved nor rescheduled. A new
+// replica which cannot be scheduled is left inactive until a later call
+// finds a machine for it.
+func (r *EtcdRegistry) ScheduleReplicas(tmpl *job.Unit, replicas int, placement Placement) ([]job.ScheduledUnit, error) {
+	nu := unit.NewUnitNameInfo(tmpl.Name)
+	if nu == nil || !nu.IsTemplate() {
+		return nil, fmt.Errorf("Unit(%s) is not a template", tmpl.Name)
+	}
+	if tmpl.IsGlobal() {
+		return nil, errors.New("global Units cannot be replicated")
+	}
+	if replicas < 0 {
+		return nil, errors.New("number of replicas must not be negative")
+	}
+	if placement == nil {
+		placement = NewLeastLoadedPlacement()
+	}
+
+	ps, err := r.placementState()
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[int]string)
+	for name := range ps.units {
+		if idx, ok := replicaIndex(nu, name); ok {
+			existing[idx] = name
+		}
+	}
+
+	// Scale down first, so the machines freed up are available to any
+	// replica that still needs placing
+	var excess []int
+	for idx := range existing {
+		if idx > replicas {
+			excess = append(excess, idx)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(excess)))
+	for _, idx := range excess {
+		if err := r.DestroyUnit(existing[idx]); err != nil {
+			return nil, err
+		}
+		ps.remove(existing[idx])
+		delete(existing, idx)
+	}
+
+	var scheduled []job.ScheduledUnit
+	for idx := 1; idx <= replicas; idx++ {
+		name := replicaName(nu, idx)
+		if _, ok := existing[idx]; !ok {
+			if err := r.createReplica(tmpl, name); err != nil {
+				return scheduled, err
+			}
+			existing[idx] = name
+			ps.add(&job.Unit{Name: name, Unit: tmpl.Unit, TargetState: job.JobStateInactive})
+		}
+
+		machID := ps.targets[name]
+		if machID == "" {
+			u := ps.units[name]
+			machID, err = ps.choose(u, placement, ps.replicaCandidates(u, nu))
+			if err != nil {
+				return scheduled, err
+			}
+			if machID == "" {
+				return scheduled, fmt.Errorf("no machine able to run Unit(%s)", name)
+			}
+			if err := r.ScheduleUnit(name, machID); err != nil {
+				return scheduled, err
+			}
+			ps.schedule(name, machID)
+		}
+
+		// A new replica is only launched once it has been scheduled,
+		// so the engine does not race to schedule it elsewhere
+		if ps.units[name].TargetState != tmpl.TargetState {
+			if err := r.SetUnitTargetState(name, tmpl.TargetState); err != nil {
+				return scheduled, err
+			}
+			ps.units[name].TargetState = tmpl.TargetState
+			ps.schedule(name, machID)
+		}
+
+		scheduled = append(scheduled, job.ScheduledUnit{Name: name, TargetMachineID: machID})
+	}
+
+	return scheduled, nil
+}
+
+// NextInstanceIndex returns the lowest index, starting at one, for which no
+// instance of the given template Unit (e.g. foo@.service) exists in the
+// Registry, so gaps left by destroyed instances are filled before the
+// highest index is exceeded. Only instances named like replicas are
+// considered; see ScheduleReplicas.
+func (r *EtcdRegistry) NextInstanceIndex(template string) (int, error) {
+	nu := unit.NewUnitNameInfo(template)
+	if nu == nil || !nu.IsTemplate() {
+		return 0, fmt.Errorf("Unit(%s) is not a template", template)
+	}
+
+	// Only the names of the Units are needed, so avoid fetching their
+	// contents
+	key := r.prefixed(jobPrefix)
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err != nil && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		return 0, err
+	}
+
+	used := make(map[int]bool)
+	if err == nil {
+		for _, node := range res.Node.Nodes {
+			if idx, ok := replicaIndex(nu, path.Base(node.Key)); ok {
+				used[idx] = true
+			}
+		}
+	}
+
+	idx := 1
+	for used[idx] {
+		idx++
+	}
+	return idx, nil
+}
+
+// createReplica stores a new, inactive instance of the given template Unit
+// under the given name
+func (r *EtcdRegistry) createReplica(tmpl *job.Unit, name string) error {
+	u := job.Unit{
+		Name:        name,
+		Unit:        tmpl.Unit,
+		TargetState: job.JobStateInactive,
+	}
+	if tmpl.Annotations != nil {
+		u.Annotations = make(map[string]string, len(tmpl.Annotations))
+		for k, v := range tmpl.Annotations {
+			u.Annotations[k] = v
+		}
+	}
+	return r.CreateUnit(&u)
+}
+
+// replicaCandidates returns the machines able to run the given replica
+// which are not currently expected to run any other replica of the same
+// template
+func (ps *placementState) replicaCandidates(u *job.Unit, nu *unit.UnitNameInfo) []PlacementCandidate {
+	var cands []PlacementCandidate
+	for _, c := range ps.candidates(u, false, -1) {
+		taken := false
+		for name := range ps.machines[c.Machine.ID].units {
+			if _, ok := replicaIndex(nu, name); ok && name != u.Name {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			cands = append(cands, c)
+		}
+	}
+	return cands
+}
+
+// replicaName returns the name of the replica of the given template with
+// the given index
+func replicaName(nu *unit.UnitNameInfo, idx int) string {
+	return strings.Replace(nu.Template, "@", fmt.Sprintf("@%d", idx), 1)
+}
+
+// replicaIndex returns the index of the given Unit if it is a replica of
+// the given template
+func replicaIndex(nu *unit.UnitNameInfo, name string) (int, bool) {
+	other := unit.NewUnitNameInfo(name)
+	if other == nil || !other.IsInstance() || other.Template != nu.Template {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(other.Instance)
+	if err != nil || idx < 1 || strconv.Itoa(idx) != other.Instance {
+		return 0, false
+	}
+	return idx, true
+}
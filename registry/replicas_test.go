@@ -0,0 +1,172 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+)
+
+func TestScheduleReplicas(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for _, id := range []string{"XXX", "YYY", "ZZZ"} {
+		addTestMachine(t, r, machine.MachineState{ID: id})
+	}
+	// Instances with non-numeric names are not replicas
+	addTestUnit(t, r, newTestUnit(t, "web@blue.service", ""), "XXX")
+	tmpl := newTestUnit(t, "web@.service", "[Service]\nExecStart=/bin/true\n")
+
+	replicas := func() map[string]string {
+		sUnits, err := r.Schedule()
+		if err != nil {
+			t.Fatalf("unexpected error from Schedule: %v", err)
+		}
+		got := make(map[string]string)
+		for _, su := range sUnits {
+			got[su.Name] = su.TargetMachineID
+		}
+		delete(got, "web@blue.service")
+		return got
+	}
+
+	for i, tt := range []struct {
+		replicas int
+		names    []string
+	}{
+		// scale up
+		{2, []string{"web@1.service", "web@2.service"}},
+		// re-running converges to the same result
+		{2, []string{"web@1.service", "web@2.service"}},
+		{3, []string{"web@1.service", "web@2.service", "web@3.service"}},
+		// scale down
+		{1, []string{"web@1.service"}},
+		{0, nil},
+	} {
+		before := replicas()
+		scheduled, err := r.ScheduleReplicas(tmpl, tt.replicas, nil)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error from ScheduleReplicas: %v", i, err)
+		}
+		var names []string
+		machines := make(map[string]bool)
+		for _, su := range scheduled {
+			names = append(names, su.Name)
+			if machines[su.TargetMachineID] {
+				t.Errorf("case %d: multiple replicas scheduled to %s", i, su.TargetMachineID)
+			}
+			machines[su.TargetMachineID] = true
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("case %d: expected replicas %v, got %v", i, tt.names, names)
+		}
+
+		after := replicas()
+		var got []string
+		for name, machID := range after {
+			got = append(got, name)
+			// existing replicas must stay where they are
+			if prev, ok := before[name]; ok && prev != machID {
+				t.Errorf("case %d: Unit(%s) moved from %s to %s", i, name, prev, machID)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.names) {
+			t.Errorf("case %d: expected registry to hold replicas %v, got %v", i, tt.names, got)
+		}
+		for _, name := range tt.names {
+			if u, _ := r.Unit(name); u == nil || u.TargetState != job.JobStateLaunched {
+				t.Errorf("case %d: replica %s not launched: %#v", i, name, u)
+			}
+		}
+	}
+
+	// The busy machine is avoided when the others are free
+	scheduled, err := r.ScheduleReplicas(tmpl, 2, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from ScheduleReplicas: %v", err)
+	}
+	for _, su := range scheduled {
+		if su.TargetMachineID == "XXX" {
+			t.Errorf("replica %s scheduled to busiest machine", su.Name)
+		}
+	}
+
+	// Replicas cannot share a machine, so there is no room for a fourth
+	if _, err := r.ScheduleReplicas(tmpl, 4, nil); err == nil {
+		t.Errorf("expected error scheduling more replicas than machines")
+	}
+	if got := replicas(); len(got) != 4 || got["web@4.service"] != "" {
+		t.Errorf("unexpected replicas after failed ScheduleReplicas: %v", got)
+	}
+
+	for _, u := range []*job.Unit{
+		newTestUnit(t, "web.service", ""),
+		newTestUnit(t, "web@1.service", ""),
+		newTestUnit(t, "global@.service", "[X-Fleet]\nGlobal=true\n"),
+	} {
+		if _, err := r.ScheduleReplicas(u, 1, nil); err == nil {
+			t.Errorf("expected error replicating Unit(%s)", u.Name)
+		}
+	}
+}
+
+func TestNextInstanceIndex(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	if idx, err := r.NextInstanceIndex("web@.service"); err != nil || idx != 1 {
+		t.Errorf("unexpected index in empty Registry: %d, %v", idx, err)
+	}
+
+	for _, name := range []string{
+		"web@0.service",
+		"web@2.service",
+		"web@3.service",
+		// neither of these are replicas of web@.service
+		"web@blue.service",
+		"api@1.service",
+	} {
+		if err := r.CreateUnit(newTestUnit(t, name, "")); err != nil {
+			t.Fatalf("unexpected error creating Unit(%s): %v", name, err)
+		}
+	}
+
+	for i, tt := range []struct {
+		create string
+		want   int
+	}{
+		// the gap at 1 is filled first
+		{"", 1},
+		{"web@1.service", 4},
+		{"web@4.service", 5},
+	} {
+		if tt.create != "" {
+			if err := r.CreateUnit(newTestUnit(t, tt.create, "")); err != nil {
+				t.Fatalf("case %d: unexpected error creating Unit(%s): %v", i, tt.create, err)
+			}
+		}
+		idx, err := r.NextInstanceIndex("web@.service")
+		if err != nil || idx != tt.want {
+			t.Errorf("case %d: got index %d, %v, want %d", i, idx, err, tt.want)
+		}
+	}
+
+	if _, err := r.NextInstanceIndex("web@1.service"); err == nil {
+		t.Errorf("expected error for non-template Unit")
+	}
+}
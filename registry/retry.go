@@ -0,0 +1,171 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/log"
+)
+
+const (
+	// leaderChangeAttempts is the number of times a request failing
+	// because of a leader change is attempted before giving up
+	leaderChangeAttempts = 4
+	// leaderChangeDelay is the initial delay between attempts, doubled
+	// after every failure
+	leaderChangeDelay = 250 * time.Millisecond
+)
+
+// isLeaderChangeError determines whether the given error is one returned
+// while the etcd cluster is electing a new leader. Such errors are routine
+// and transient. They are:
+//   - ErrorCodeLeaderElect, returned by a member with no leader, which
+//     never proposed the request
+//   - ErrorCodeRaftInternal, returned when a proposal times out, e.g.
+//     because leadership was lost, although it may yet be committed
+//   - ErrTooManyRedirects, returned by the client when it is bounced
+//     between members which disagree on the identity of the leader,
+//     possibly after one of them applied the request
+// Only the first guarantees that the request had no effect; the others
+// are ambiguous (see isAmbiguousError).
+func isLeaderChangeError(err error) bool {
+	return isEtcdError(err, etcd.ErrorCodeLeaderElect) || isAmbiguousError(err)
+}
+
+// isAmbiguousError determines whether the given leader change error leaves
+// it unknown whether the request which caused it was applied. Repeating a
+// write which was in fact applied may fail where the original succeeded,
+// e.g. a compare-and-swap whose precondition the first attempt invalidated.
+func isAmbiguousError(err error) bool {
+	return err == etcd.ErrTooManyRedirects || isEtcdError(err, etcd.ErrorCodeRaftInternal)
+}
+
+// isConditionalSet determines whether a Set made with the given options
+// only succeeds if the key is in a particular state
+func isConditionalSet(opts *etcd.SetOptions) bool {
+	return opts != nil && (opts.PrevValue != "" || opts.PrevIndex != 0 || opts.PrevExist != etcd.PrevIgnore)
+}
+
+// Syncer refreshes the set of endpoints used to reach an etcd cluster, as
+// etcd.Client does
+type Syncer interface {
+	Sync(context.Context) error
+}
+
+// NewLeaderRetryKeysAPI wraps the given KeysAPI such that requests failing
+// with a leader change error (see isLeaderChangeError) are retried a few
+// times with backoff rather than surfaced to the caller. Requests which
+// could fail spuriously or take effect twice if repeated after having been
+// applied, namely Sets with a precondition and all Deletes, Creates and
+// CreateInOrders, are only retried
+// if the error guarantees they were not; an ambiguous error is instead
+// returned to the caller, which must find out whether the request took
+// effect before deciding whether to repeat it. Before each retry
+// the cluster membership is refreshed using the provided Syncer, if any,
+// in case the election coincided with a change of endpoints. All other
+// errors, and those persisting beyond the last attempt, are returned as
+// usual. Retries never outlive the context of the original request.
+func NewLeaderRetryKeysAPI(kAPI etcd.KeysAPI, syncer Syncer) etcd.KeysAPI {
+	return &leaderRetryKeysAPI{
+		KeysAPI:  kAPI,
+		syncer:   syncer,
+		attempts: leaderChangeAttempts,
+		delay:    leaderChangeDelay,
+	}
+}
+
+type leaderRetryKeysAPI struct {
+	// The embedded KeysAPI serves Watcher directly; watches are
+	// reestablished by their callers
+	etcd.KeysAPI
+
+	syncer   Syncer
+	attempts int
+	delay    time.Duration
+}
+
+func (k *leaderRetryKeysAPI) wrapped() etcd.KeysAPI {
+	return k.KeysAPI
+}
+
+// do performs the given request, retrying it on leader change errors. A
+// request which is not repeatable is not retried on ambiguous errors.
+func (k *leaderRetryKeysAPI) do(ctx context.Context, repeatable bool, fn func() (*etcd.Response, error)) (*etcd.Response, error) {
+	delay := k.delay
+	for i := 1; ; i++ {
+		res, err := fn()
+		if err == nil || !isLeaderChangeError(err) || i >= k.attempts {
+			return res, err
+		}
+		if !repeatable && isAmbiguousError(err) {
+			log.Warningf("etcd request failed during leader change and may have been applied, not retrying: %v", err)
+			return res, err
+		}
+
+		log.Warningf("etcd request failed during leader change (attempt %d/%d), retrying in %v: %v", i, k.attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+
+		if k.syncer != nil {
+			if serr := k.syncer.Sync(ctx); serr != nil {
+				log.Debugf("Failed refreshing etcd cluster membership: %v", serr)
+			}
+		}
+	}
+}
+
+func (k *leaderRetryKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	return k.do(ctx, true, func() (*etcd.Response, error) {
+		return k.KeysAPI.Get(ctx, key, opts)
+	})
+}
+
+func (k *leaderRetryKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	return k.do(ctx, !isConditionalSet(opts), func() (*etcd.Response, error) {
+		return k.KeysAPI.Set(ctx, key, value, opts)
+	})
+}
+
+func (k *leaderRetryKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	return k.do(ctx, false, func() (*etcd.Response, error) {
+		return k.KeysAPI.Delete(ctx, key, opts)
+	})
+}
+
+func (k *leaderRetryKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return k.do(ctx, false, func() (*etcd.Response, error) {
+		return k.KeysAPI.Create(ctx, key, value)
+	})
+}
+
+func (k *leaderRetryKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	return k.do(ctx, false, func() (*etcd.Response, error) {
+		return k.KeysAPI.CreateInOrder(ctx, dir, value, opts)
+	})
+}
+
+func (k *leaderRetryKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return k.do(ctx, true, func() (*etcd.Response, error) {
+		return k.KeysAPI.Update(ctx, key, value)
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// flakyKeysAPI fails the first len(errs) requests with the given errors
+// before passing requests through to the wrapped KeysAPI
+type flakyKeysAPI struct {
+	etcd.KeysAPI
+	errs  []error
+	calls int
+}
+
+func (f *flakyKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return f.KeysAPI.Set(ctx, key, value, opts)
+}
+
+type countingSyncer struct {
+	syncs int
+}
+
+func (s *countingSyncer) Sync(context.Context) error {
+	s.syncs++
+	return nil
+}
+
+func TestIsLeaderChangeError(t *testing.T) {
+	for i, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{etcd.Error{Code: etcd.ErrorCodeLeaderElect}, true},
+		{etcd.Error{Code: etcd.ErrorCodeRaftInternal}, true},
+		{etcd.ErrTooManyRedirects, true},
+		{etcd.Error{Code: etcd.ErrorCodeKeyNotFound}, false},
+		{etcd.Error{Code: etcd.ErrorCodeTestFailed}, false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	} {
+		if got := isLeaderChangeError(tt.err); got != tt.want {
+			t.Errorf("case %d: isLeaderChangeError(%v) = %t, want %t", i, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestLeaderRetryKeysAPI(t *testing.T) {
+	leaderElect := etcd.Error{Code: etcd.ErrorCodeLeaderElect, Message: "During Leader Election"}
+	for i, tt := range []struct {
+		errs      []error
+		wantErr   error
+		wantCalls int
+		wantSyncs int
+	}{
+		// No failure
+		{nil, nil, 1, 0},
+		// Transient leader change followed by a redirect loop
+		{[]error{leaderElect, etcd.ErrTooManyRedirects}, nil, 3, 2},
+		// Leader change outlasting all attempts
+		{[]error{leaderElect, leaderElect, leaderElect, leaderElect}, leaderElect, 4, 3},
+		// Other errors are never retried
+		{[]error{etcd.ErrClusterUnavailable}, etcd.ErrClusterUnavailable, 1, 0},
+	} {
+		flaky := &flakyKeysAPI{KeysAPI: newMemKeysAPI(), errs: tt.errs}
+		syncer := &countingSyncer{}
+		kAPI := NewLeaderRetryKeysAPI(flaky, syncer)
+		kAPI.(*leaderRetryKeysAPI).delay = time.Millisecond
+
+		_, err := kAPI.Set(context.Background(), "/fleet/foo", "bar", nil)
+		if err != tt.wantErr {
+			t.Errorf("case %d: got err %v, want %v", i, err, tt.wantErr)
+		}
+		if flaky.calls != tt.wantCalls {
+			t.Errorf("case %d: request made %d times, want %d", i, flaky.calls, tt.wantCalls)
+		}
+		if syncer.syncs != tt.wantSyncs {
+			t.Errorf("case %d: membership synced %d times, want %d", i, syncer.syncs, tt.wantSyncs)
+		}
+	}
+
+	// Conditional writes are not retried on errors after which they may
+	// have been applied
+	raftInternal := etcd.Error{Code: etcd.ErrorCodeRaftInternal}
+	for i, tt := range []struct {
+		err       error
+		opts      *etcd.SetOptions
+		wantCalls int
+	}{
+		{raftInternal, nil, 2},
+		{raftInternal, &etcd.SetOptions{TTL: time.Minute}, 2},
+		{raftInternal, &etcd.SetOptions{PrevExist: etcd.PrevNoExist}, 1},
+		{etcd.ErrTooManyRedirects, &etcd.SetOptions{PrevIndex: 1}, 1},
+		{etcd.ErrTooManyRedirects, &etcd.SetOptions{PrevValue: "baz"}, 1},
+		{leaderElect, &etcd.SetOptions{PrevExist: etcd.PrevNoExist}, 2},
+	} {
+		flaky := &flakyKeysAPI{KeysAPI: newMemKeysAPI(), errs: []error{tt.err}}
+		kAPI := NewLeaderRetryKeysAPI(flaky, nil)
+		kAPI.(*leaderRetryKeysAPI).delay = time.Millisecond
+
+		kAPI.Set(context.Background(), "/fleet/foo", "bar", tt.opts)
+		if flaky.calls != tt.wantCalls {
+			t.Errorf("case %d: request made %d times, want %d", i, flaky.calls, tt.wantCalls)
+		}
+	}
+
+	// Retries stop once the request context is done
+	flaky := &flakyKeysAPI{KeysAPI: newMemKeysAPI(), errs: []error{leaderElect, leaderElect}}
+	kAPI := NewLeaderRetryKeysAPI(flaky, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := kAPI.Set(ctx, "/fleet/foo", "bar", nil); err != leaderElect || flaky.calls != 1 {
+		t.Errorf("unexpected result with cancelled context: err=%v calls=%d", err, flaky.calls)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg"
+	"github.com/coreos/fleet/unit"
+)
+
+// Snapshot is a point-in-time copy of the contents of the Registry
+type Snapshot struct {
+	// Index is the etcd index at which the Snapshot was started
+	Index      uint64
+	Units      []job.Unit
+	Schedule   []job.ScheduledUnit
+	Machines   []machine.MachineState
+	UnitStates []*unit.UnitState
+}
+
+// Snapshot captures the Units, schedule, machines and UnitStates currently
+// stored in the Registry. Each is read separately, so a change made while
+// the Snapshot is being taken may be reflected in some parts but not in
+// others.
+func (r *EtcdRegistry) Snapshot() (*Snapshot, error) {
+	var s Snapshot
+	var err error
+	if s.Index, err = r.CurrentIndex(); err != nil {
+		return nil, err
+	}
+	if s.Units, err = r.Units(); err != nil {
+		return nil, err
+	}
+	if s.Schedule, err = r.Schedule(); err != nil {
+		return nil, err
+	}
+	if s.Machines, err = r.Machines(); err != nil {
+		return nil, err
+	}
+	if s.UnitStates, err = r.UnitStates(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SnapshotDiff describes the differences between two Snapshots. In each
+// entry, Old is nil if the object was added and New is nil if it was
+// removed; otherwise it was changed. Entries are sorted by name, or by
+// machine ID.
+type SnapshotDiff struct {
+	Units      []UnitDiff
+	Schedule   []ScheduleDiff
+	Machines   []MachineDiff
+	UnitStates []UnitStateDiff
+}
+
+// Empty returns true if the compared Snapshots did not differ
+func (d *SnapshotDiff) Empty() bool {
+	return len(d.Units) == 0 && len(d.Schedule) == 0 && len(d.Machines) == 0 && len(d.UnitStates) == 0
+}
+
+// UnitDiff describes a Unit which was added, removed, or had its UnitFile,
+// target state or annotations changed
+type UnitDiff struct {
+	Name     string
+	Old, New *job.Unit
+}
+
+// ScheduleDiff describes a Unit which was scheduled, unscheduled or moved.
+// Old and New hold the IDs of the machines the Unit was scheduled to, and
+// are empty if it was not scheduled.
+type ScheduleDiff struct {
+	Name     string
+	Old, New string
+}
+
+// MachineDiff describes a machine which joined, left, or changed its
+// published state
+type MachineDiff struct {
+	ID       string
+	Old, New *machine.MachineState
+}
+
+// UnitStateDiff describes a UnitState reported by a machine which was
+// added, removed, or changed
+type UnitStateDiff struct {
+	Name      string
+	MachineID string
+	Old, New  *unit.UnitState
+}
+
+// DiffSnapshots compares Snapshot a to Snapshot b, describing the changes
+// which would turn a into b. Neither Snapshot is modified.
+func DiffSnapshots(a, b *Snapshot) *SnapshotDiff {
+	d := &SnapshotDiff{}
+
+	oldUnits, newUnits := unitsByName(a.Units), unitsByName(b.Units)
+	names := pkg.NewUnsafeSet()
+	for _, units := range [][]job.Unit{a.Units, b.Units} {
+		for _, u := range units {
+			names.Add(u.Name)
+		}
+	}
+	for _, name := range sortedValues(names) {
+		o, n := oldUnits[name], newUnits[name]
+		if o == nil || n == nil || !unitsEqual(o, n) {
+			d.Units = append(d.Units, UnitDiff{Name: name, Old: o, New: n})
+		}
+	}
+
+	oldTargets, newTargets := targetsByName(a.Schedule), targetsByName(b.Schedule)
+	names = pkg.NewUnsafeSet()
+	for _, sUnits := range [][]job.ScheduledUnit{a.Schedule, b.Schedule} {
+		for _, su := range sUnits {
+			names.Add(su.Name)
+		}
+	}
+	for _, name := range sortedValues(names) {
+		if o, n := oldTargets[name], newTargets[name]; o != n {
+			d.Schedule = append(d.Schedule, ScheduleDiff{Name: name, Old: o, New: n})
+		}
+	}
+
+	oldMachines, newMachines := machinesByID(a.Machines), machinesByID(b.Machines)
+	ids := pkg.NewUnsafeSet()
+	for _, machines := range [][]machine.MachineState{a.Machines, b.Machines} {
+		for _, ms := range machines {
+			ids.Add(ms.ID)
+		}
+	}
+	for _, id := range sortedValues(ids) {
+		o, n := oldMachines[id], newMachines[id]
+		if o == nil || n == nil || !reflect.DeepEqual(o, n) {
+			d.Machines = append(d.Machines, MachineDiff{ID: id, Old: o, New: n})
+		}
+	}
+
+	oldStates, newStates := statesByKey(a.UnitStates), statesByKey(b.UnitStates)
+	var keys MUSKeys
+	for key := range oldStates {
+		keys = append(keys, key)
+	}
+	for key := range newStates {
+		if _, ok := oldStates[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		o, n := oldStates[key], newStates[key]
+		if o == nil || n == nil || !reflect.DeepEqual(o, n) {
+			d.UnitStates = append(d.UnitStates, UnitStateDiff{Name: key.name, MachineID: key.machID, Old: o, New: n})
+		}
+	}
+
+	return d
+}
+
+func unitsEqual(a, b *job.Unit) bool {
+	if a.Unit.Hash() != b.Unit.Hash() || a.TargetState != b.TargetState || len(a.Annotations) != len(b.Annotations) {
+		return false
+	}
+	for k, v := range a.Annotations {
+		if bv, ok := b.Annotations[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func unitsByName(units []job.Unit) map[string]*job.Unit {
+	m := make(map[string]*job.Unit, len(units))
+	for _, u := range units {
+		u := u
+		m[u.Name] = &u
+	}
+	return m
+}
+
+func targetsByName(sUnits []job.ScheduledUnit) map[string]string {
+	m := make(map[string]string, len(sUnits))
+	for _, su := range sUnits {
+		if su.TargetMachineID != "" {
+			m[su.Name] = su.TargetMachineID
+		}
+	}
+	return m
+}
+
+func machinesByID(machines []machine.MachineState) map[string]*machine.MachineState {
+	m := make(map[string]*machine.MachineState, len(machines))
+	for _, ms := range machines {
+		ms := ms
+		m[ms.ID] = &ms
+	}
+	return m
+}
+
+func statesByKey(states []*unit.UnitState) map[MUSKey]*unit.UnitState {
+	m := make(map[MUSKey]*unit.UnitState, len(states))
+	for _, us := range states {
+		m[MUSKey{name: us.UnitName, machID: us.MachineID}] = us
+	}
+	return m
+}
+
+func sortedValues(set pkg.Set) []string {
+	values := sort.StringSlice(set.Values())
+	values.Sort()
+	return values
+}
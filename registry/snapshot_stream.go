@@ -0,0 +1,144 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+)
+
+const (
+	streamFormat  = "fleet-snapshot"
+	streamVersion = 1
+)
+
+// streamHeader is the first record of a streamed snapshot
+type streamHeader struct {
+	Format  string
+	Version int
+	// Index is the etcd index at which the stream was started
+	Index uint64
+}
+
+// streamEntry is a single value of a streamed snapshot. Key is relative to
+// the key prefix of the Registry the snapshot was taken from, and TTL is
+// the remaining TTL of the value in seconds, or zero if it does not expire.
+type streamEntry struct {
+	Key   string
+	Value string
+	TTL   int64 `json:",omitempty"`
+}
+
+// StreamSnapshot writes every value stored under the Registry's key prefix
+// to w as newline-delimited JSON: a header identifying the format and the
+// etcd index at which the stream was started, followed by one record per
+// value. The keyspace is read one directory at a time, so the whole
+// Registry is never held in memory at once; as with Snapshot, a change made
+// while the stream is being written may be reflected in some parts but not
+// in others. Empty directories are not written.
+func (r *EtcdRegistry) StreamSnapshot(w io.Writer) error {
+	idx, err := r.CurrentIndex()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(streamHeader{Format: streamFormat, Version: streamVersion, Index: idx}); err != nil {
+		return err
+	}
+
+	prefix := r.prefixed()
+	var walk func(string) error
+	walk = func(dir string) error {
+		res, err := r.kAPI.Get(r.ctx(), dir, &etcd.GetOptions{Sort: true})
+		if err != nil {
+			if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+				// removed since its parent was read
+				err = nil
+			}
+			return err
+		}
+
+		for _, node := range res.Node.Nodes {
+			if node.Dir {
+				if err := walk(node.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			entry := streamEntry{
+				Key:   strings.TrimPrefix(strings.TrimPrefix(node.Key, prefix), "/"),
+				Value: node.Value,
+				TTL:   node.TTL,
+			}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(prefix)
+}
+
+// RestoreSnapshot reads a snapshot written by StreamSnapshot from rd and
+// stores each of its values at the same relative key under the Registry's
+// key prefix, which need not be the prefix the snapshot was taken from.
+// Values which carried a TTL are written with the TTL remaining when the
+// snapshot was taken. Existing values are overwritten, but keys absent from
+// the snapshot are left untouched, so the Registry should be empty and all
+// fleet daemons stopped beforehand. Values are written as they are read;
+// if an error is returned, any values already restored are kept.
+func (r *EtcdRegistry) RestoreSnapshot(rd io.Reader) error {
+	dec := json.NewDecoder(rd)
+	var hdr streamHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("failed reading snapshot header: %v", err)
+	}
+	if hdr.Format != streamFormat {
+		return fmt.Errorf("unrecognized snapshot format %q", hdr.Format)
+	}
+	if hdr.Version != streamVersion {
+		return fmt.Errorf("unsupported snapshot version %d", hdr.Version)
+	}
+
+	prefix := r.prefixed()
+	for {
+		var entry streamEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed reading snapshot: %v", err)
+		}
+
+		key := path.Join(prefix, entry.Key)
+		if key == prefix || !within(key, prefix) {
+			return fmt.Errorf("snapshot key %q outside of key prefix", entry.Key)
+		}
+		opts := &etcd.SetOptions{
+			TTL: time.Duration(entry.TTL) * time.Second,
+		}
+		if _, err := r.kAPI.Set(r.ctx(), key, entry.Value, opts); err != nil {
+			return keyCollisionError(err, key)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/unit"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX"})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "c.service", ""), "")
+	r.SaveUnitState("a.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+
+	a, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error from Snapshot: %v", err)
+	}
+	if d := DiffSnapshots(a, a); !d.Empty() {
+		t.Errorf("Snapshot differs from itself: %#v", d)
+	}
+
+	// Machines
+	if err := r.ExpireMachine("YYY"); err != nil {
+		t.Fatalf("unexpected error from ExpireMachine: %v", err)
+	}
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", PublicIP: "1.2.3.4"})
+	addTestMachine(t, r, machine.MachineState{ID: "ZZZ"})
+	// Units
+	if err := r.DestroyUnit("c.service"); err != nil {
+		t.Fatalf("unexpected error from DestroyUnit: %v", err)
+	}
+	addTestUnit(t, r, newTestUnit(t, "d.service", ""), "ZZZ")
+	if err := r.SetUnitTargetState("b.service", job.JobStateLoaded); err != nil {
+		t.Fatalf("unexpected error from SetUnitTargetState: %v", err)
+	}
+	// Schedule
+	if err := r.MoveUnit("a.service", "XXX", "ZZZ"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+	// UnitStates
+	r.SaveUnitState("a.service", unit.NewUnitState("loaded", "inactive", "dead", "XXX"), time.Minute)
+	r.SaveUnitState("d.service", unit.NewUnitState("loaded", "active", "running", "ZZZ"), time.Minute)
+
+	b, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error from Snapshot: %v", err)
+	}
+	if b.Index <= a.Index {
+		t.Errorf("Snapshot index did not advance: %d then %d", a.Index, b.Index)
+	}
+	d := DiffSnapshots(a, b)
+
+	type change struct {
+		key      string
+		old, new bool
+	}
+	var got []change
+	for _, ud := range d.Units {
+		got = append(got, change{"unit " + ud.Name, ud.Old != nil, ud.New != nil})
+	}
+	for _, sd := range d.Schedule {
+		got = append(got, change{"target " + sd.Name + " " + sd.Old + "->" + sd.New, sd.Old != "", sd.New != ""})
+	}
+	for _, md := range d.Machines {
+		got = append(got, change{"machine " + md.ID, md.Old != nil, md.New != nil})
+	}
+	for _, sd := range d.UnitStates {
+		got = append(got, change{"state " + sd.Name + " " + sd.MachineID, sd.Old != nil, sd.New != nil})
+	}
+	want := []change{
+		{"unit b.service", true, true},
+		{"unit c.service", true, false},
+		{"unit d.service", false, true},
+		{"target a.service XXX->ZZZ", true, true},
+		{"target d.service ->ZZZ", false, true},
+		{"machine XXX", true, true},
+		{"machine YYY", true, false},
+		{"machine ZZZ", false, true},
+		{"state a.service XXX", true, true},
+		{"state d.service ZZZ", false, true},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected SnapshotDiff:\nwant %v\ngot  %v", want, got)
+	}
+
+	if d.Units[0].Old.TargetState != job.JobStateLaunched || d.Units[0].New.TargetState != job.JobStateLoaded {
+		t.Errorf("changed Unit does not carry old and new values: %#v", d.Units[0])
+	}
+	if d.Machines[0].New.PublicIP != "1.2.3.4" {
+		t.Errorf("changed machine does not carry new value: %#v", d.Machines[0])
+	}
+}
+
+func TestStreamSnapshotRoundTrip(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", PublicIP: "1.2.3.4"})
+	addTestUnit(t, r, newTestUnit(t, "a.service", "[Service]\nExecStart=/bin/true\n"), "XXX")
+	addTestUnit(t, r, newTestUnit(t, "b.service", ""), "")
+	r.SaveUnitState("a.service", unit.NewUnitState("loaded", "active", "running", "XXX"), time.Minute)
+
+	var buf bytes.Buffer
+	if err := r.StreamSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error from StreamSnapshot: %v", err)
+	}
+
+	// Restored into a different prefix of an empty keyspace
+	e := newMemKeysAPI()
+	restored := NewEtcdRegistry(e, "/other/", time.Second)
+	if err := restored.RestoreSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("unexpected error from RestoreSnapshot: %v", err)
+	}
+
+	want, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error from Snapshot: %v", err)
+	}
+	got, err := restored.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error from Snapshot: %v", err)
+	}
+	if d := DiffSnapshots(want, got); !d.Empty() {
+		t.Errorf("restored Registry differs: %#v", d)
+	}
+	res, err := e.Get(nil, "/other/machines/XXX/object", nil)
+	if err != nil || res.Node.TTL <= 0 {
+		t.Errorf("TTL of machine state not preserved: %#v, %v", res, err)
+	}
+
+	for i, input := range []string{
+		"",
+		`{"Format":"something-else","Version":1}`,
+		`{"Format":"fleet-snapshot","Version":2}`,
+		`{"Format":"fleet-snapshot","Version":1}` + "\n" + `{"Key":"../escape","Value":"x"}`,
+		`{"Format":"fleet-snapshot","Version":1}` + "\n" + `{"Key":`,
+	} {
+		if err := restored.RestoreSnapshot(strings.NewReader(input)); err == nil {
+			t.Errorf("case %d: expected error restoring %q", i, input)
+		}
+	}
+}
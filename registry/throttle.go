@@ -0,0 +1,128 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// ThrottleMode determines what a scheduling operation does once the rate
+// limit set with SetScheduleRate has been reached
+type ThrottleMode int
+
+const (
+	// ThrottleBlock delays the operation until it fits within the rate
+	// limit, so a burst of operations is paced rather than failed
+	ThrottleBlock ThrottleMode = iota
+	// ThrottleReject fails the operation with a ThrottledError, leaving
+	// the caller to retry it later
+	ThrottleReject
+)
+
+// ThrottledError is returned for scheduling operations rejected because
+// they exceed the rate limit of the Registry
+type ThrottledError struct {
+	// RetryAfter is how long until the operation would be allowed
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("scheduling rate limit exceeded, retry after %v", e.RetryAfter)
+}
+
+// rateLimit is a token bucket, holding up to burst tokens and refilled
+// with rate tokens per second; each operation takes a single token
+type rateLimit struct {
+	rate  float64
+	burst float64
+	mode  ThrottleMode
+
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token at the given time, returning how long the caller
+// must wait before proceeding. In ThrottleReject mode no token is taken
+// if one is not immediately available, and false is returned.
+func (l *rateLimit) reserve(now time.Time) (time.Duration, bool) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if l.mode == ThrottleReject {
+		return wait, false
+	}
+	// The token is borrowed from the future, so the callers which follow
+	// queue up behind this one
+	l.tokens--
+	return wait, true
+}
+
+// SetScheduleRate limits the scheduling decisions written by the Registry,
+// i.e. Units being scheduled or moved to a machine, to rate per second
+// across all callers sharing it. Up to burst decisions may be made at once
+// before the rate applies, and mode determines whether further decisions
+// wait their turn or are rejected with a ThrottledError. As every agent
+// reacts to the decisions concerning it, this paces the work a mass deploy
+// imposes on the agents and on etcd. A rate of zero or less removes the
+// limit, which is the default. A burst of less than one allows a single
+// decision at once.
+func (r *EtcdRegistry) SetScheduleRate(rate float64, burst int, mode ThrottleMode) {
+	r.scheduleMu.Lock()
+	defer r.scheduleMu.Unlock()
+	if rate <= 0 {
+		r.scheduleLimit = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	r.scheduleLimit = &rateLimit{
+		rate:   rate,
+		burst:  float64(burst),
+		mode:   mode,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// throttleSchedule applies the rate limit set with SetScheduleRate to a
+// scheduling decision about to be written, blocking until it may proceed
+// or returning a ThrottledError
+func (r *EtcdRegistry) throttleSchedule() error {
+	r.scheduleMu.Lock()
+	if r.scheduleLimit == nil {
+		r.scheduleMu.Unlock()
+		return nil
+	}
+	wait, ok := r.scheduleLimit.reserve(time.Now())
+	r.scheduleMu.Unlock()
+
+	if !ok {
+		return &ThrottledError{RetryAfter: wait}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetScheduleRate(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	for i := 0; i < 8; i++ {
+		addTestUnit(t, r, newTestUnit(t, fmt.Sprintf("%d.service", i), ""), "")
+	}
+
+	// The first decision is allowed by the burst, and each of the four
+	// which follow waits 50ms for a token
+	r.SetScheduleRate(20, 1, ThrottleBlock)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := r.ScheduleUnit(fmt.Sprintf("%d.service", i), "XXX"); err != nil {
+			t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 decisions at 20/s took %v, expected at least 200ms", elapsed)
+	}
+
+	// Rejected decisions are not written
+	r.SetScheduleRate(0.1, 2, ThrottleReject)
+	if err := r.ScheduleUnit("5.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+	}
+	if err := r.MoveUnit("5.service", "XXX", "YYY"); err != nil {
+		t.Fatalf("unexpected error from MoveUnit: %v", err)
+	}
+	err := r.ScheduleUnit("6.service", "XXX")
+	if terr, ok := err.(*ThrottledError); !ok || terr.RetryAfter <= 0 {
+		t.Fatalf("expected ThrottledError, got %v", err)
+	}
+	if _, ok := scheduleOf(t, r)["6.service"]; ok {
+		t.Errorf("throttled decision was written")
+	}
+
+	// Removing the limit lets decisions through immediately
+	r.SetScheduleRate(0, 0, ThrottleReject)
+	if err := r.ScheduleUnit("6.service", "XXX"); err != nil {
+		t.Fatalf("unexpected error from ScheduleUnit: %v", err)
+	}
+
+	want := map[string]string{
+		"0.service": "XXX", "1.service": "XXX", "2.service": "XXX", "3.service": "XXX",
+		"4.service": "XXX", "5.service": "YYY", "6.service": "XXX",
+	}
+	if got := scheduleOf(t, r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got schedule %v, want %v", got, want)
+	}
+}
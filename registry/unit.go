@@ -47,6 +47,7 @@ func (r *EtcdRegistry) storeOrGetUnitFile(u unit.UnitFile) (err error) {
 		// TODO(jonboulle): verify more here?
 		err = nil
 	}
+	err = keyCollisionError(err, key)
 	return
 }
 
@@ -103,14 +104,14 @@ func (r *EtcdRegistry) getAllUnitsHashMap() (map[string]*unit.UnitFile, error) {
 
 func (r *EtcdRegistry) unitFromEtcdNode(hash unit.Hash, etcdNode *etcd.Node) *unit.UnitFile {
 	var um unitModel
-	if err := unmarshal(etcdNode.Value, &um); err != nil {
-		log.Errorf("error unmarshaling Unit(%s): %v", hash, err)
+	if err := r.unmarshal(etcdNode.Value, &um); err != nil {
+		log.Errorf("error unmarshaling Unit(%s): %v", hash, &ParseError{Key: etcdNode.Key, Err: err})
 		return nil
 	}
 
 	u, err := unit.NewUnitFile(um.Raw)
 	if err != nil {
-		log.Errorf("error parsing Unit(%s): %v", hash, err)
+		log.Errorf("error parsing Unit(%s): %v", hash, &ParseError{Key: etcdNode.Key, Err: err})
 		return nil
 	}
 
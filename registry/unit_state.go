@@ -15,11 +15,15 @@
 package registry
 
 import (
+	"errors"
+	"fmt"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/coreos/fleet/log"
 	"github.com/coreos/fleet/machine"
@@ -108,8 +112,9 @@ func (r *EtcdRegistry) statesByMUSKey() (map[MUSKey]*unit.UnitState, error) {
 			for _, node := range dir.Nodes {
 				_, machID := path.Split(node.Key)
 				var usm unitStateModel
-				if err := unmarshal(node.Value, &usm); err != nil {
-					log.Errorf("Error unmarshalling UnitState(%s) from Machine(%s): %v", name, machID, err)
+				if err := r.unmarshal(node.Value, &usm); err != nil {
+					perr := &ParseError{Key: node.Key, MachineID: machID, Err: err}
+					log.Errorf("Error unmarshalling UnitState(%s): %v", name, perr)
 					continue
 				}
 				us := modelToUnitState(&usm, name)
@@ -123,6 +128,151 @@ func (r *EtcdRegistry) statesByMUSKey() (map[MUSKey]*unit.UnitState, error) {
 	return mus, nil
 }
 
+// RecentUnitStates returns the most recently written UnitState of each Unit,
+// most recent first, limited to the given number of Units if limit is
+// positive. UnitStates are ordered by the etcd index at which they were
+// last written. As machines periodically republish UnitStates which have
+// not changed, the order best reflects recent changes in between those
+// republications.
+func (r *EtcdRegistry) RecentUnitStates(limit int) ([]*unit.UnitState, error) {
+	key := r.prefixed(statesPrefix)
+	opts := &etcd.GetOptions{
+		Recursive: true,
+	}
+	res, err := r.kAPI.Get(r.ctx(), key, opts)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var latest unitStatesByRecency
+	for _, dir := range res.Node.Nodes {
+		_, name := path.Split(dir.Key)
+		var w writtenUnitState
+		for _, node := range dir.Nodes {
+			if node.ModifiedIndex <= w.idx {
+				continue
+			}
+			_, machID := path.Split(node.Key)
+			var usm unitStateModel
+			if err := r.unmarshal(node.Value, &usm); err != nil {
+				perr := &ParseError{Key: node.Key, MachineID: machID, Err: err}
+				log.Errorf("Error unmarshalling UnitState(%s): %v", name, perr)
+				continue
+			}
+			if us := modelToUnitState(&usm, name); us != nil {
+				w = writtenUnitState{us, node.ModifiedIndex}
+			}
+		}
+		if w.us != nil {
+			latest = append(latest, w)
+		}
+	}
+
+	sort.Sort(latest)
+	if limit > 0 && len(latest) > limit {
+		latest = latest[:limit]
+	}
+	states := make([]*unit.UnitState, len(latest))
+	for i, w := range latest {
+		states[i] = w.us
+	}
+	return states, nil
+}
+
+// writtenUnitState is a UnitState along with the etcd index at which it
+// was last written
+type writtenUnitState struct {
+	us  *unit.UnitState
+	idx uint64
+}
+
+type unitStatesByRecency []writtenUnitState
+
+func (l unitStatesByRecency) Len() int           { return len(l) }
+func (l unitStatesByRecency) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l unitStatesByRecency) Less(i, j int) bool { return l[i].idx > l[j].idx }
+
+// SaveUnitStateIfNewer behaves like SaveUnitState, but records when the
+// given UnitState was reported and refuses to overwrite a UnitState
+// reported later by the same machine, returning ErrStaleUnitState. This
+// guards against a delayed report clobbering a fresher one. A stored
+// UnitState without a report time, such as one saved by SaveUnitState, is
+// always overwritten. The check and the write are performed atomically
+// with compare-and-swap, retrying if the stored UnitState changes in the
+// meantime.
+func (r *EtcdRegistry) SaveUnitStateIfNewer(jobName string, unitState *unit.UnitState, reportedAt time.Time, ttl time.Duration) error {
+	usm := unitStateToModel(unitState)
+	if usm == nil {
+		return errors.New("unable to save nil UnitState model")
+	}
+	usm.ReportedAt = &reportedAt
+
+	var val string
+	key := r.unitStatePath(unitState.MachineID, jobName)
+	for {
+		cur, idx, err := r.getRaw(key)
+		if err != nil {
+			return err
+		}
+		var prev *unitStateModel
+		if idx != 0 {
+			prev = &unitStateModel{}
+			if err := r.unmarshal(cur, prev); err != nil {
+				log.Errorf("Overwriting unparseable UnitState(%s): %v", jobName, &ParseError{Key: key, MachineID: unitState.MachineID, Err: err})
+				prev = nil
+			} else if prev.ReportedAt != nil && prev.ReportedAt.After(reportedAt) {
+				return ErrStaleUnitState
+			}
+		}
+		carryOverRun(usm, prev)
+		if val, err = marshal(usm); err != nil {
+			return err
+		}
+
+		opts := &etcd.SetOptions{
+			PrevIndex: idx,
+			TTL:       ttl,
+		}
+		if idx == 0 {
+			opts.PrevExist = etcd.PrevNoExist
+		}
+		_, err = r.kAPI.Set(r.ctx(), key, val, opts)
+		if err == nil {
+			break
+		}
+		if !isEtcdError(err, etcd.ErrorCodeTestFailed) && !isEtcdError(err, etcd.ErrorCodeNodeExist) && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			return keyCollisionError(err, key)
+		}
+	}
+
+	legacyKey := r.legacyUnitStatePath(jobName)
+	if _, err := r.kAPI.Set(r.ctx(), legacyKey, val, &etcd.SetOptions{TTL: ttl}); err != nil {
+		log.Errorf("Error saving UnitState(%s): %v", jobName, keyCollisionError(err, legacyKey))
+	}
+	return nil
+}
+
+// unitStateModel retrieves the unitStateModel stored at the given key, or
+// nil if there is none
+func (r *EtcdRegistry) unitStateModel(key string) (*unitStateModel, error) {
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err != nil {
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var usm unitStateModel
+	if err := r.unmarshal(res.Node.Value, &usm); err != nil {
+		return nil, &ParseError{Key: key, Err: err}
+	}
+	return &usm, nil
+}
+
 // getUnitState retrieves the current UnitState, if any exists, for the
 // given unit that originates from the indicated machine
 func (r *EtcdRegistry) getUnitState(uName, machID string) (*unit.UnitState, error) {
@@ -136,25 +286,168 @@ func (r *EtcdRegistry) getUnitState(uName, machID string) (*unit.UnitState, erro
 	}
 
 	var usm unitStateModel
-	if err := unmarshal(res.Node.Value, &usm); err != nil {
-		return nil, err
+	if err := r.unmarshal(res.Node.Value, &usm); err != nil {
+		return nil, &ParseError{Key: key, MachineID: machID, Err: err}
 	}
 
 	return modelToUnitState(&usm, uName), nil
 }
 
+// WaitForUnitState blocks until the identified machine reports the named
+// Unit in the given ActiveState (e.g. "active"), returning the UnitState
+// reported. It returns immediately if the Unit is already in that state.
+// Like WaitForMachine, it watches for the state to change rather than
+// polling, and returns an error if that does not happen within the given
+// timeout.
+func (r *EtcdRegistry) WaitForUnitState(name, machID, activeState string, timeout time.Duration) (*unit.UnitState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	key := r.unitStatePath(machID, name)
+	timedOut := fmt.Errorf("timed out waiting for Unit(%s) to become %s on machine %s", name, activeState, machID)
+	parse := func(node *etcd.Node) (*unit.UnitState, error) {
+		var usm unitStateModel
+		if err := r.unmarshal(node.Value, &usm); err != nil {
+			return nil, &ParseError{Key: key, MachineID: machID, Err: err}
+		}
+		return modelToUnitState(&usm, name), nil
+	}
+
+	for {
+		var idx uint64
+		res, err := r.kAPI.Get(ctx, key, nil)
+		if err == nil {
+			us, err := parse(res.Node)
+			if err != nil || us.ActiveState == activeState {
+				return us, err
+			}
+			idx = res.Node.ModifiedIndex
+		} else if eerr, ok := err.(etcd.Error); ok && eerr.Code == etcd.ErrorCodeKeyNotFound {
+			idx = eerr.Index
+		} else if ctx.Err() != nil {
+			return nil, timedOut
+		} else {
+			return nil, err
+		}
+
+		watcher := r.kAPI.Watcher(key, &etcd.WatcherOptions{AfterIndex: idx})
+		for {
+			res, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, timedOut
+				}
+				if isEtcdError(err, etcd.ErrorCodeEventIndexCleared) {
+					// Events were lost, so check again from scratch
+					break
+				}
+				return nil, err
+			}
+			if res.Node == nil || isDeletion(res) {
+				continue
+			}
+			us, err := parse(res.Node)
+			if err != nil || us.ActiveState == activeState {
+				return us, err
+			}
+		}
+	}
+}
+
+// ErrStaleUnitState is returned by SaveUnitStateIfNewer when the stored
+// UnitState was reported more recently than the one being saved
+var ErrStaleUnitState = errors.New("registry: a more recent UnitState has already been saved")
+
 // SaveUnitState persists the given UnitState to the Registry
 func (r *EtcdRegistry) SaveUnitState(jobName string, unitState *unit.UnitState, ttl time.Duration) {
+	if err := r.saveUnitState(jobName, unitState, ttl); err != nil {
+		log.Errorf("Error saving UnitState(%s): %v", jobName, err)
+	}
+}
+
+// saveUnitStatesConcurrency bounds the number of UnitStates SaveUnitStates
+// writes at once
+const saveUnitStatesConcurrency = 8
+
+// UnitStatesError is returned by SaveUnitStates when some of the UnitStates
+// could not be saved. It maps the name of each affected Unit to the error
+// encountered saving its UnitState.
+type UnitStatesError struct {
+	Errs map[string]error
+}
+
+func (e *UnitStatesError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, e.Errs[name])
+	}
+	return fmt.Sprintf("failed saving UnitState of %d units: %s", len(names), strings.Join(msgs, "; "))
+}
+
+// SaveUnitStates persists the given UnitStates, keyed by the name of their
+// Unit, to the Registry. etcd offers no way to write them atomically, so
+// the writes are instead made concurrently, a bounded number at a time.
+// Every UnitState is attempted regardless of others failing; if any fail,
+// a *UnitStatesError identifying them is returned.
+func (r *EtcdRegistry) SaveUnitStates(states map[string]*unit.UnitState, ttl time.Duration) error {
+	type result struct {
+		name string
+		err  error
+	}
+
+	// The names are queued up front, so that nothing touches states once
+	// the last result has been collected and SaveUnitStates returns
+	names := make(chan string, len(states))
+	for name := range states {
+		names <- name
+	}
+	close(names)
+
+	results := make(chan result)
+	workers := saveUnitStatesConcurrency
+	if len(states) < workers {
+		workers = len(states)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for name := range names {
+				results <- result{name, r.saveUnitState(name, states[name], ttl)}
+			}
+		}()
+	}
+	errs := make(map[string]error)
+	for i := 0; i < len(states); i++ {
+		if res := <-results; res.err != nil {
+			errs[res.name] = res.err
+		}
+	}
+	if len(errs) > 0 {
+		return &UnitStatesError{Errs: errs}
+	}
+	return nil
+}
+
+// saveUnitState writes the given UnitState to both its legacy and
+// per-machine keys, returning the first error encountered. The second write
+// is attempted even if the first fails.
+func (r *EtcdRegistry) saveUnitState(jobName string, unitState *unit.UnitState, ttl time.Duration) error {
 	usm := unitStateToModel(unitState)
 	if usm == nil {
-		log.Errorf("Unable to save nil UnitState model")
-		return
+		return errors.New("unable to save nil UnitState model")
 	}
 
+	newKey := r.unitStatePath(unitState.MachineID, jobName)
+	carryOverRun(usm, nil)
+
 	val, err := marshal(usm)
 	if err != nil {
-		log.Errorf("Error marshalling UnitState: %v", err)
-		return
+		return fmt.Errorf("error marshalling UnitState: %v", err)
 	}
 
 	opts := &etcd.SetOptions{
@@ -162,10 +455,25 @@ func (r *EtcdRegistry) SaveUnitState(jobName string, unitState *unit.UnitState,
 	}
 
 	legacyKey := r.legacyUnitStatePath(jobName)
-	r.kAPI.Set(r.ctx(), legacyKey, val, opts)
+	if _, err = r.kAPI.Set(r.ctx(), legacyKey, val, opts); err != nil {
+		err = keyCollisionError(err, legacyKey)
+	}
 
-	newKey := r.unitStatePath(unitState.MachineID, jobName)
-	r.kAPI.Set(r.ctx(), newKey, val, opts)
+	res, nerr := r.kAPI.Set(r.ctx(), newKey, val, opts)
+	if nerr == nil {
+		nerr = r.restoreRun(newKey, usm, res, ttl)
+	}
+	if nerr != nil && err == nil {
+		err = keyCollisionError(nerr, newKey)
+	}
+	return err
+}
+
+// RefreshUnitStateTTL changes the TTL of the UnitState of the named Unit
+// reported by the identified machine without rewriting that UnitState. An
+// error is returned if the machine has reported no state for the Unit.
+func (r *EtcdRegistry) RefreshUnitStateTTL(jobName, machID string, ttl time.Duration) error {
+	return r.setKeyTTL(r.unitStatePath(machID, jobName), ttl)
 }
 
 // Delete the state from the Registry for the given Job's Unit
@@ -174,7 +482,7 @@ func (r *EtcdRegistry) RemoveUnitState(jobName string) error {
 	legacyKey := r.legacyUnitStatePath(jobName)
 	_, err := r.kAPI.Delete(r.ctx(), legacyKey, nil)
 	if err != nil && !isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
-		return err
+		return keyCollisionError(err, legacyKey)
 	}
 
 	// TODO(jonboulle): deal properly with multiple states
@@ -189,12 +497,289 @@ func (r *EtcdRegistry) RemoveUnitState(jobName string) error {
 	return nil
 }
 
+// UnitStateEvent describes a change to the UnitState reported for a unit
+type UnitStateEvent struct {
+	Name string
+	// MachineID identifies the machine whose UnitState changed. It is
+	// empty if the UnitStates reported by all machines for the unit
+	// were removed at once.
+	MachineID string
+	// State is the newly reported UnitState, or nil if it was removed
+	State *unit.UnitState
+}
+
+// WatchUnitStates returns a channel that emits a UnitStateEvent each time a
+// UnitState is reported or removed, until stop is closed. If window is
+// positive, events are coalesced per unit and machine: an event is only
+// emitted once the UnitState has not changed for the duration of window,
+// and it always carries the latest state. This protects consumers from the
+// storm of events produced by a unit stuck in a crash loop.
+func (r *EtcdRegistry) WatchUnitStates(window time.Duration, stop <-chan struct{}) <-chan UnitStateEvent {
+	stop = r.watchStop(stop)
+	in := make(chan UnitStateEvent)
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		r.watchPrefix(r.prefixed(statesPrefix), stop, func(res *etcd.Response) {
+			ev, ok := r.unitStateEventFromResponse(res)
+			if !ok {
+				return
+			}
+			select {
+			case in <- ev:
+			case <-stop:
+			}
+		})
+	}()
+
+	out := make(chan UnitStateEvent)
+	q := r.newWatchQueue("unit-states", stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(UnitStateEvent):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	go func() {
+		defer q.close(func() {
+			<-watched
+			close(out)
+		})
+		send := func(ev UnitStateEvent) bool {
+			return q.push(ev)
+		}
+
+		type firing struct {
+			key MUSKey
+			gen uint64
+		}
+		pending := make(map[MUSKey]UnitStateEvent)
+		gens := make(map[MUSKey]uint64)
+		fire := make(chan firing)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case ev := <-in:
+				if window <= 0 {
+					if !send(ev) {
+						return
+					}
+					continue
+				}
+				// A unit-wide removal supersedes any pending
+				// per-machine events for the same unit
+				if ev.MachineID == "" {
+					for key := range pending {
+						if key.name == ev.Name {
+							delete(pending, key)
+						}
+					}
+				}
+				key := MUSKey{name: ev.Name, machID: ev.MachineID}
+				pending[key] = ev
+				gens[key]++
+				f := firing{key: key, gen: gens[key]}
+				time.AfterFunc(window, func() {
+					select {
+					case fire <- f:
+					case <-stop:
+					}
+				})
+			case f := <-fire:
+				ev, ok := pending[f.key]
+				if !ok || gens[f.key] != f.gen {
+					continue
+				}
+				delete(pending, f.key)
+				delete(gens, f.key)
+				if !send(ev) {
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// WatchUnitsEnteringState returns a channel emitting the name of a Unit each
+// time any machine reports it entering the given ActiveState (e.g.
+// "failed"), until stop is closed. Only transitions are reported: a state
+// written again with the same ActiveState, or a Unit already in the
+// ActiveState when the watch begins, does not produce an event. A Unit
+// whose state is removed and then reported again is treated as entering
+// the reported ActiveState anew.
+func (r *EtcdRegistry) WatchUnitsEnteringState(activeState string, stop <-chan struct{}) (<-chan string, error) {
+	current, err := r.statesByMUSKey()
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[MUSKey]string, len(current))
+	for key, us := range current {
+		last[key] = us.ActiveState
+	}
+
+	stop = r.watchStop(stop)
+	out := make(chan string)
+	q := r.newWatchQueue("units-entering/"+activeState, stop, func(ev interface{}) bool {
+		select {
+		case out <- ev.(string):
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	go func() {
+		defer q.close(func() { close(out) })
+		r.watchPrefix(r.prefixed(statesPrefix), stop, func(res *etcd.Response) {
+			ev, ok := r.unitStateEventFromResponse(res)
+			if !ok {
+				return
+			}
+			if ev.MachineID == "" {
+				for key := range last {
+					if key.name == ev.Name {
+						delete(last, key)
+					}
+				}
+				return
+			}
+
+			key := MUSKey{name: ev.Name, machID: ev.MachineID}
+			if ev.State == nil {
+				delete(last, key)
+				return
+			}
+			prev, seen := last[key]
+			last[key] = ev.State.ActiveState
+			if ev.State.ActiveState == activeState && (!seen || prev != activeState) {
+				q.push(ev.Name)
+			}
+		})
+	}()
+	return out, nil
+}
+
+// unitStateEventFromResponse translates a response from a watch of the
+// UnitState namespace into a UnitStateEvent
+func (r *EtcdRegistry) unitStateEventFromResponse(res *etcd.Response) (ev UnitStateEvent, ok bool) {
+	if res == nil || res.Node == nil {
+		return
+	}
+	ns := r.prefixed(statesPrefix) + "/"
+	if !strings.HasPrefix(res.Node.Key, ns) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(res.Node.Key, ns), "/")
+	switch {
+	case len(parts) == 1 && isDeletion(res):
+		ev.Name = parts[0]
+	case len(parts) == 2:
+		ev.Name, ev.MachineID = parts[0], parts[1]
+	default:
+		return
+	}
+
+	if !isDeletion(res) {
+		var usm unitStateModel
+		if err := r.unmarshal(res.Node.Value, &usm); err != nil {
+			perr := &ParseError{Key: res.Node.Key, MachineID: ev.MachineID, Err: err}
+			log.Errorf("Error unmarshalling UnitState(%s): %v", ev.Name, perr)
+			return
+		}
+		ev.State = modelToUnitState(&usm, ev.Name)
+	}
+
+	ok = true
+	return
+}
+
 type unitStateModel struct {
 	LoadState    string                `json:"loadState"`
 	ActiveState  string                `json:"activeState"`
 	SubState     string                `json:"subState"`
 	MachineState *machine.MachineState `json:"machineState"`
 	UnitHash     string                `json:"unitHash"`
+	// Reason is omitted when empty, and absent from states saved by
+	// older versions of fleet
+	Reason string `json:"reason,omitempty"`
+	// ReportedAt is only recorded by SaveUnitStateIfNewer
+	ReportedAt *time.Time `json:"reportedAt,omitempty"`
+	// Ran records that the unit has been reported active, and is carried
+	// over by every UnitState replacing this one
+	Ran bool `json:"ran,omitempty"`
+	// DeadSince records when the unit was first reported dead after
+	// having run, and is carried over while it remains so; it is omitted
+	// otherwise, including for units which never ran
+	DeadSince *time.Time `json:"deadSince,omitempty"`
+}
+
+// dead reports whether the model describes a unit which has finished
+// running without failing
+func (usm *unitStateModel) dead() bool {
+	return usm.ActiveState == "inactive" && usm.SubState == "dead"
+}
+
+// carryOverRun sets the Ran and DeadSince of usm, which replaces prev: a
+// unit has run once it is reported active, and a unit which ran is dead
+// from the first time it is reported dead, keeping that time while it
+// remains so. prev is nil if no UnitState is being replaced, or if it is
+// not known.
+func carryOverRun(usm, prev *unitStateModel) {
+	usm.Ran = usm.ActiveState == "active"
+	if prev != nil {
+		// States saved before Ran was recorded only carry DeadSince
+		usm.Ran = usm.Ran || prev.Ran || prev.DeadSince != nil
+	}
+
+	usm.DeadSince = nil
+	if !usm.Ran || !usm.dead() {
+		return
+	}
+	if prev != nil && prev.dead() && prev.DeadSince != nil {
+		usm.DeadSince = prev.DeadSince
+	} else {
+		now := time.Now().UTC()
+		usm.DeadSince = &now
+	}
+}
+
+// restoreRun rewrites the UnitState which saveUnitState wrote to the given
+// key without knowing the UnitState it replaced, if that one, as returned
+// in the response of the write, shows that the unit has run. States which
+// are active, or of units which never ran, thus take a single write. The
+// rewrite is abandoned if the UnitState has changed again in the meantime.
+func (r *EtcdRegistry) restoreRun(key string, usm *unitStateModel, res *etcd.Response, ttl time.Duration) error {
+	if res == nil || res.PrevNode == nil {
+		return nil
+	}
+	var prev unitStateModel
+	if err := r.unmarshal(res.PrevNode.Value, &prev); err != nil {
+		// There is nothing to carry over from an unparseable UnitState
+		return nil
+	}
+
+	restored := *usm
+	carryOverRun(&restored, &prev)
+	if restored.Ran == usm.Ran && restored.DeadSince == nil {
+		return nil
+	}
+	val, err := marshal(&restored)
+	if err != nil {
+		return err
+	}
+	opts := &etcd.SetOptions{
+		PrevIndex: res.Node.ModifiedIndex,
+		TTL:       ttl,
+	}
+	_, err = r.kAPI.Set(r.ctx(), key, val, opts)
+	if isEtcdError(err, etcd.ErrorCodeTestFailed) || isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+		err = nil
+	}
+	return err
 }
 
 func modelToUnitState(usm *unitStateModel, name string) *unit.UnitState {
@@ -208,6 +793,7 @@ func modelToUnitState(usm *unitStateModel, name string) *unit.UnitState {
 		SubState:    usm.SubState,
 		UnitHash:    usm.UnitHash,
 		UnitName:    name,
+		Reason:      usm.Reason,
 	}
 
 	if usm.MachineState != nil {
@@ -233,6 +819,7 @@ func unitStateToModel(us *unit.UnitState) *unitStateModel {
 		ActiveState: us.ActiveState,
 		SubState:    us.SubState,
 		UnitHash:    us.UnitHash,
+		Reason:      us.Reason,
 	}
 
 	if us.MachineID != "" {
@@ -16,8 +16,10 @@ package registry
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -248,6 +250,23 @@ func TestUnitStateToModel(t *testing.T) {
 				UnitHash:     "miaow",
 			},
 		},
+		{
+			in: &unit.UnitState{
+				LoadState:   "loaded",
+				ActiveState: "failed",
+				SubState:    "failed",
+				MachineID:   "woof",
+				UnitName:    "name",
+				Reason:      "exit code 1",
+			},
+			want: &unitStateModel{
+				LoadState:    "loaded",
+				ActiveState:  "failed",
+				SubState:     "failed",
+				MachineState: &machine.MachineState{ID: "woof"},
+				Reason:       "exit code 1",
+			},
+		},
 	} {
 		got := unitStateToModel(tt.in)
 		if !reflect.DeepEqual(got, tt.want) {
@@ -266,7 +285,7 @@ func TestModelToUnitState(t *testing.T) {
 			want: nil,
 		},
 		{
-			in: &unitStateModel{"foo", "bar", "baz", nil, ""},
+			in: &unitStateModel{"foo", "bar", "baz", nil, "", "", nil, false, nil},
 			want: &unit.UnitState{
 				LoadState:   "foo",
 				ActiveState: "bar",
@@ -277,7 +296,7 @@ func TestModelToUnitState(t *testing.T) {
 			},
 		},
 		{
-			in: &unitStateModel{"z", "x", "y", &machine.MachineState{ID: "abcd"}, ""},
+			in: &unitStateModel{"z", "x", "y", &machine.MachineState{ID: "abcd"}, "", "", nil, false, nil},
 			want: &unit.UnitState{
 				LoadState:   "z",
 				ActiveState: "x",
@@ -530,3 +549,314 @@ func TestMUSKeys(t *testing.T) {
 		t.Errorf("bad result after sort: got\n%#v, want\n%#v", ms, want)
 	}
 }
+
+func TestWatchUnitStates(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	window := 50 * time.Millisecond
+	debounced := r.WatchUnitStates(window, stop)
+	raw := r.WatchUnitStates(0, stop)
+	e.waitForWatchers(t, 2)
+
+	// A crash-looping unit flaps rapidly between states
+	subStates := []string{"start", "running", "failed", "auto-restart", "start", "running"}
+	for _, sub := range subStates {
+		r.SaveUnitState("foo.service", unit.NewUnitState("loaded", "active", sub, "XXX"), time.Minute)
+	}
+	r.SaveUnitState("bar.service", unit.NewUnitState("loaded", "inactive", "dead", "YYY"), time.Minute)
+
+	// Without a window, every transition is delivered in order
+	for i, sub := range subStates {
+		select {
+		case ev := <-raw:
+			if ev.Name != "foo.service" || ev.MachineID != "XXX" || ev.State == nil || ev.State.SubState != sub {
+				t.Fatalf("event %d: unexpected event %#v", i, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: timed out waiting for event", i)
+		}
+	}
+
+	// With a window, only the final state of each unit is delivered
+	got := make(map[string]string)
+	for len(got) < 2 {
+		select {
+		case ev := <-debounced:
+			if _, ok := got[ev.Name]; ok {
+				t.Fatalf("received more than one event for %s", ev.Name)
+			}
+			got[ev.Name] = ev.State.SubState
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for debounced events, have %v", got)
+		}
+	}
+	want := map[string]string{"foo.service": "running", "bar.service": "dead"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected debounced events: got %v, want %v", got, want)
+	}
+	select {
+	case ev := <-debounced:
+		t.Errorf("unexpected extra debounced event: %#v", ev)
+	case <-time.After(3 * window):
+	}
+
+	// Removal of all of a unit's states is reported as a single event
+	if err := r.RemoveUnitState("foo.service"); err != nil {
+		t.Fatalf("unexpected error from RemoveUnitState: %v", err)
+	}
+	select {
+	case ev := <-debounced:
+		if ev.Name != "foo.service" || ev.MachineID != "" || ev.State != nil {
+			t.Errorf("unexpected removal event: %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for removal event")
+	}
+}
+
+func TestWatchUnitsEnteringState(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	// Already failed before the watch begins
+	r.SaveUnitState("old.service", unit.NewUnitState("loaded", "failed", "failed", "XXX"), time.Minute)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	failed, err := r.WatchUnitsEnteringState("failed", stop)
+	if err != nil {
+		t.Fatalf("unexpected error from WatchUnitsEnteringState: %v", err)
+	}
+	e.waitForWatchers(t, 1)
+
+	for _, w := range []struct {
+		name   string
+		active string
+	}{
+		{"old.service", "failed"},
+		{"foo.service", "active"},
+		{"foo.service", "failed"},
+		// repeated writes of the same state do not re-fire
+		{"foo.service", "failed"},
+		{"foo.service", "failed"},
+		{"bar.service", "failed"},
+		{"foo.service", "active"},
+		{"foo.service", "failed"},
+	} {
+		r.SaveUnitState(w.name, unit.NewUnitState("loaded", w.active, "", "XXX"), time.Minute)
+	}
+	// A removed state entering the ActiveState again re-fires
+	if err := r.RemoveUnitState("bar.service"); err != nil {
+		t.Fatalf("unexpected error from RemoveUnitState: %v", err)
+	}
+	r.SaveUnitState("bar.service", unit.NewUnitState("loaded", "failed", "", "XXX"), time.Minute)
+
+	var got []string
+	for _, want := range []string{"foo.service", "bar.service", "foo.service", "bar.service"} {
+		select {
+		case name := <-failed:
+			got = append(got, name)
+			if name != want {
+				t.Fatalf("got events %v, want %s next", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s, have %v", want, got)
+		}
+	}
+	select {
+	case name := <-failed:
+		t.Errorf("unexpected extra event for %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnitStateReasonRoundTrip(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+
+	us := unit.NewUnitState("loaded", "failed", "failed", "XXX")
+	us.Reason = "exit code 1"
+	r.SaveUnitState("foo.service", us, time.Minute)
+
+	got, err := r.getUnitState("foo.service", "XXX")
+	if err != nil || got == nil || got.Reason != "exit code 1" || got.ActiveState != "failed" {
+		t.Fatalf("unexpected UnitState after round trip: %#v, %v", got, err)
+	}
+
+	// States saved without a reason, e.g. by older versions of fleet,
+	// are read with an empty one
+	e.Set(nil, "/fleet/states/bar.service/XXX", `{"loadState":"loaded","activeState":"active","subState":"running","machineState":{"ID":"XXX"},"unitHash":""}`, nil)
+	got, err = r.getUnitState("bar.service", "XXX")
+	if err != nil || got == nil || got.Reason != "" || got.SubState != "running" {
+		t.Errorf("unexpected legacy UnitState: %#v, %v", got, err)
+	}
+}
+
+func TestSaveUnitStateIfNewer(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	now := time.Now()
+	running := unit.NewUnitState("loaded", "active", "running", "XXX")
+	loaded := unit.NewUnitState("loaded", "inactive", "dead", "XXX")
+
+	if err := r.SaveUnitStateIfNewer("foo.service", running, now, time.Minute); err != nil {
+		t.Fatalf("unexpected error from SaveUnitStateIfNewer: %v", err)
+	}
+
+	// A delayed report of an earlier state is rejected
+	if err := r.SaveUnitStateIfNewer("foo.service", loaded, now.Add(-time.Second), time.Minute); err != ErrStaleUnitState {
+		t.Errorf("expected ErrStaleUnitState saving out-of-order UnitState, got %v", err)
+	}
+	if got, err := r.getUnitState("foo.service", "XXX"); err != nil || got == nil || got.SubState != "running" {
+		t.Errorf("out-of-order save clobbered UnitState: %#v, %v", got, err)
+	}
+
+	// Later reports, and reports from other machines, are saved
+	other := unit.NewUnitState("loaded", "inactive", "dead", "YYY")
+	for i, tt := range []struct {
+		us *unit.UnitState
+		at time.Time
+	}{
+		{loaded, now.Add(time.Second)},
+		{other, now.Add(-time.Minute)},
+	} {
+		if err := r.SaveUnitStateIfNewer("foo.service", tt.us, tt.at, time.Minute); err != nil {
+			t.Errorf("case %d: unexpected error from SaveUnitStateIfNewer: %v", i, err)
+		}
+		if got, err := r.getUnitState("foo.service", tt.us.MachineID); err != nil || got == nil || got.SubState != "dead" {
+			t.Errorf("case %d: UnitState not saved: %#v, %v", i, got, err)
+		}
+	}
+
+	// States saved without a report time are always overwritten
+	r.SaveUnitState("foo.service", running, time.Minute)
+	if err := r.SaveUnitStateIfNewer("foo.service", loaded, now.Add(-time.Hour), time.Minute); err != nil {
+		t.Errorf("unexpected error overwriting UnitState without report time: %v", err)
+	}
+}
+
+func TestSaveUnitStates(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	// A directory where the per-machine state of bad.service belongs makes
+	// saving it fail
+	e.Set(nil, "/fleet/states/bad.service/XXX/oops", "x", nil)
+
+	states := make(map[string]*unit.UnitState)
+	for i := 0; i < 3*saveUnitStatesConcurrency; i++ {
+		states[fmt.Sprintf("u%d.service", i)] = unit.NewUnitState("loaded", "active", "running", "XXX")
+	}
+	states["bad.service"] = unit.NewUnitState("loaded", "active", "running", "XXX")
+
+	err := r.SaveUnitStates(states, time.Minute)
+	serr, ok := err.(*UnitStatesError)
+	if !ok {
+		t.Fatalf("expected *UnitStatesError, got %v", err)
+	}
+	if len(serr.Errs) != 1 || serr.Errs["bad.service"] == nil {
+		t.Errorf("unexpected failures: %v", serr.Errs)
+	}
+	if !strings.Contains(err.Error(), "bad.service") {
+		t.Errorf("error does not name failed Unit: %v", err)
+	}
+
+	for name := range states {
+		if name == "bad.service" {
+			continue
+		}
+		if got, err := r.getUnitState(name, "XXX"); err != nil || got == nil || got.SubState != "running" {
+			t.Errorf("UnitState of %s not saved: %#v, %v", name, got, err)
+		}
+	}
+
+	delete(states, "bad.service")
+	if err := r.SaveUnitStates(states, time.Minute); err != nil {
+		t.Errorf("unexpected error from SaveUnitStates: %v", err)
+	}
+	if err := r.SaveUnitStates(nil, time.Minute); err != nil {
+		t.Errorf("unexpected error saving no UnitStates: %v", err)
+	}
+}
+
+// slowKeysAPI delays every Set by the given latency, approximating the
+// round trip to a real etcd cluster
+type slowKeysAPI struct {
+	etcd.KeysAPI
+	latency time.Duration
+}
+
+func (s *slowKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	time.Sleep(s.latency)
+	return s.KeysAPI.Set(ctx, key, value, opts)
+}
+
+func benchmarkUnitStates(n int) (*EtcdRegistry, map[string]*unit.UnitState) {
+	r := NewEtcdRegistry(&slowKeysAPI{newMemKeysAPI(), time.Millisecond}, "/fleet/", time.Second)
+	states := make(map[string]*unit.UnitState, n)
+	for i := 0; i < n; i++ {
+		states[fmt.Sprintf("u%d.service", i)] = unit.NewUnitState("loaded", "active", "running", "XXX")
+	}
+	return r, states
+}
+
+func BenchmarkSaveUnitStates(b *testing.B) {
+	r, states := benchmarkUnitStates(50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.SaveUnitStates(states, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveUnitStateSerial(b *testing.B) {
+	r, states := benchmarkUnitStates(50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for name, us := range states {
+			r.SaveUnitState(name, us, time.Minute)
+		}
+	}
+}
+
+func TestRecentUnitStates(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	if states, err := r.RecentUnitStates(0); err != nil || len(states) != 0 {
+		t.Errorf("unexpected UnitStates in empty Registry: %v, %v", states, err)
+	}
+
+	for _, s := range []struct {
+		name, machID, sub string
+	}{
+		{"a.service", "XXX", "running"},
+		{"b.service", "XXX", "running"},
+		{"c.service", "YYY", "running"},
+		// a.service is reported again, by another machine
+		{"a.service", "YYY", "dead"},
+		{"b.service", "XXX", "failed"},
+	} {
+		r.SaveUnitState(s.name, unit.NewUnitState("loaded", "active", s.sub, s.machID), time.Minute)
+	}
+
+	for i, tt := range []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"b.service/XXX/failed", "a.service/YYY/dead", "c.service/YYY/running"}},
+		{2, []string{"b.service/XXX/failed", "a.service/YYY/dead"}},
+		{5, []string{"b.service/XXX/failed", "a.service/YYY/dead", "c.service/YYY/running"}},
+	} {
+		states, err := r.RecentUnitStates(tt.limit)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error from RecentUnitStates: %v", i, err)
+		}
+		var got []string
+		for _, us := range states {
+			got = append(got, us.UnitName+"/"+us.MachineID+"/"+us.SubState)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
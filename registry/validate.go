@@ -0,0 +1,417 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/pkg"
+)
+
+// UnitProblem describes why a Unit of a desired state cannot be applied
+type UnitProblem struct {
+	Name   string
+	Reason string
+}
+
+// ValidationReport describes the problems found in a desired state by
+// ValidateDesiredState. All lists are sorted by Unit name.
+type ValidationReport struct {
+	// Invalid lists Units which are malformed, such as those with
+	// invalid requirements or a name used more than once
+	Invalid []UnitProblem
+	// Conflicts lists Units whose requirements contradict those of
+	// other Units of the desired state, such as a Unit which must run
+	// alongside a Unit it conflicts with
+	Conflicts []UnitProblem
+	// Unplaceable lists Units which no current machine is able to run,
+	// taking into account the requirements of the peers they must run
+	// alongside
+	Unplaceable []UnitProblem
+}
+
+// Valid returns true if the report found no problems
+func (vr *ValidationReport) Valid() bool {
+	return len(vr.Invalid) == 0 && len(vr.Conflicts) == 0 && len(vr.Unplaceable) == 0
+}
+
+// ValidateDesiredState checks whether the given set of Units, intended to
+// replace the current contents of the Registry, could be applied and
+// scheduled, returning a report of any problems found. Units are grouped
+// with the peers they must run alongside, directly or transitively; a
+// group is in conflict if any of its Units conflicts with another, and is
+// unplaceable if no single machine meets the requirements of all of its
+// Units. Peers which are not part of the desired state can never be
+// satisfied and are reported as conflicts. Only the machines currently in
+// the cluster are considered, excluding those cordoned or degraded, but
+// the Units currently in the Registry are not, as the desired state
+// replaces them. Neither capacity nor global Units are taken into account.
+// The Registry is not modified.
+func (r *EtcdRegistry) ValidateDesiredState(desired []*job.Unit) (*ValidationReport, error) {
+	machines, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	vr := &ValidationReport{}
+	units := make(map[string]*job.Unit)
+	seen := make(map[string]int)
+	for _, u := range desired {
+		seen[u.Name]++
+		if seen[u.Name] == 2 {
+			vr.Invalid = append(vr.Invalid, UnitProblem{u.Name, "name used by more than one Unit"})
+		}
+		if u.Name == "" {
+			vr.Invalid = append(vr.Invalid, UnitProblem{u.Name, "name is empty"})
+			continue
+		}
+		if err := job.NewJob(u.Name, u.Unit).ValidateRequirements(); err != nil {
+			vr.Invalid = append(vr.Invalid, UnitProblem{u.Name, err.Error()})
+			continue
+		}
+		units[u.Name] = u
+	}
+
+	var names sort.StringSlice
+	for name := range units {
+		names = append(names, name)
+	}
+	names.Sort()
+
+	// Group every Unit with its peers
+	group := make(map[string]string)
+	var find func(string) string
+	find = func(name string) string {
+		if group[name] == "" || group[name] == name {
+			return name
+		}
+		root := find(group[name])
+		group[name] = root
+		return root
+	}
+	for _, name := range names {
+		u := units[name]
+		if u.IsGlobal() {
+			continue
+		}
+		for _, peer := range u.Peers() {
+			p, ok := units[peer]
+			if !ok {
+				vr.Conflicts = append(vr.Conflicts, UnitProblem{name, fmt.Sprintf("required peer Unit(%s) is not part of the desired state", peer)})
+				continue
+			}
+			if p.IsGlobal() {
+				continue
+			}
+			if a, b := find(name), find(peer); a != b {
+				group[a] = b
+			}
+		}
+	}
+	members := make(map[string][]*job.Unit)
+	for _, name := range names {
+		if !units[name].IsGlobal() {
+			root := find(name)
+			members[root] = append(members[root], units[name])
+		}
+	}
+
+	for _, name := range names {
+		u := units[name]
+		if u.IsGlobal() {
+			continue
+		}
+		peers := members[find(name)]
+
+		for _, other := range peers {
+			if other.Name == name {
+				continue
+			}
+			if conflicts(u, other) {
+				vr.Conflicts = append(vr.Conflicts, UnitProblem{name, fmt.Sprintf("must run alongside conflicting Unit(%s)", other.Name)})
+				break
+			}
+		}
+
+		placeable := false
+		for i := range machines {
+			if meetsRequirements(&machines[i], peers) {
+				placeable = true
+				break
+			}
+		}
+		if !placeable {
+			reason := "no machine is able to run it"
+			if len(peers) > 1 {
+				reason = "no machine is able to run it alongside its peers"
+			}
+			vr.Unplaceable = append(vr.Unplaceable, UnitProblem{name, reason})
+		}
+	}
+
+	for _, l := range [][]UnitProblem{vr.Invalid, vr.Conflicts} {
+		sort.Stable(unitProblemsByName(l))
+	}
+	return vr, nil
+}
+
+// ConflictPair identifies two Units which would be scheduled to the same
+// machine even though one of them conflicts with the other. A sorts
+// before B.
+type ConflictPair struct {
+	A         string
+	B         string
+	MachineID string
+}
+
+// DetectPlacementConflicts checks a proposed set of scheduling decisions,
+// mapping Unit names to machine IDs, for Units which would share a machine
+// despite conflicting with each other. Every assigned Unit must be among
+// the given Units. The conflicting pairs are returned ordered by machine,
+// then by name. This is a pure check; neither the Registry nor the Units
+// already scheduled are consulted.
+func DetectPlacementConflicts(assignments map[string]string, units []*job.Unit) ([]ConflictPair, error) {
+	byName := make(map[string]*job.Unit, len(units))
+	for _, u := range units {
+		byName[u.Name] = u
+	}
+
+	byMachine := make(map[string][]*job.Unit)
+	for name, machID := range assignments {
+		u, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("assigned Unit(%s) not found", name)
+		}
+		byMachine[machID] = append(byMachine[machID], u)
+	}
+
+	var pairs []ConflictPair
+	for machID, mUnits := range byMachine {
+		for i, a := range mUnits {
+			for _, b := range mUnits[i+1:] {
+				if !conflicts(a, b) {
+					continue
+				}
+				p := ConflictPair{A: a.Name, B: b.Name, MachineID: machID}
+				if p.B < p.A {
+					p.A, p.B = p.B, p.A
+				}
+				pairs = append(pairs, p)
+			}
+		}
+	}
+	sort.Sort(conflictPairs(pairs))
+	return pairs, nil
+}
+
+type conflictPairs []ConflictPair
+
+func (l conflictPairs) Len() int      { return len(l) }
+func (l conflictPairs) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l conflictPairs) Less(i, j int) bool {
+	if l[i].MachineID != l[j].MachineID {
+		return l[i].MachineID < l[j].MachineID
+	}
+	if l[i].A != l[j].A {
+		return l[i].A < l[j].A
+	}
+	return l[i].B < l[j].B
+}
+
+// conflicts reports whether either of the given Units conflicts with the
+// other, following the same criteria as placementState.ableToRun
+func conflicts(a, b *job.Unit) bool {
+	for _, c := range a.Conflicts() {
+		if globMatches(c, b.Name) {
+			return true
+		}
+	}
+	for _, c := range b.Conflicts() {
+		if globMatches(c, a.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// meetsRequirements reports whether the given machine satisfies the
+// machine requirements of every given Unit. Cordoned and degraded machines
+// never do.
+func meetsRequirements(ms *machine.MachineState, units []*job.Unit) bool {
+	if ms.Cordoned || ms.Degraded {
+		return false
+	}
+	for _, u := range units {
+		if tgt, ok := u.RequiredTarget(); ok && !ms.MatchID(tgt) {
+			return false
+		}
+		metadata := u.RequiredTargetMetadata()
+		if len(metadata) != 0 && !machine.HasMetadata(ms, metadata) {
+			return false
+		}
+		if !machine.HasRoles(ms, u.RequiredRoles()) {
+			return false
+		}
+		if !machine.HasConstraints(ms, u.RequiredConstraints()) {
+			return false
+		}
+	}
+	return true
+}
+
+type unitProblemsByName []UnitProblem
+
+func (l unitProblemsByName) Len() int           { return len(l) }
+func (l unitProblemsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l unitProblemsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// UnplaceableUnit identifies a Unit which no active machine is able to run
+type UnplaceableUnit struct {
+	Name string
+	// Constraint describes the requirement which rules out every
+	// active machine, in the form given in the unit file, such as
+	// "MachineRole=db". If each requirement is met by some machine but
+	// none meets them all, they are listed joined by " and ". It is
+	// empty if the Unit has no requirements but no machine is active.
+	Constraint string
+}
+
+// machineRequirement is a single requirement a machine must meet to run a
+// Unit, as evaluated by UnplaceableUnits
+type machineRequirement struct {
+	desc string
+	met  func(ms *machine.MachineState) bool
+}
+
+// unitRequirements breaks the machine requirements of the given Unit down
+// into individual requirements
+func unitRequirements(u *job.Unit) []machineRequirement {
+	var reqs []machineRequirement
+	if tgt, ok := u.RequiredTarget(); ok {
+		reqs = append(reqs, machineRequirement{
+			desc: "MachineID=" + tgt,
+			met:  func(ms *machine.MachineState) bool { return ms.MatchID(tgt) },
+		})
+	}
+
+	metadata := u.RequiredTargetMetadata()
+	var keys sort.StringSlice
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	keys.Sort()
+	for _, k := range keys {
+		values := sort.StringSlice(metadata[k].Values())
+		values.Sort()
+		pairs := make([]string, 0, len(values))
+		for _, v := range values {
+			pairs = append(pairs, "MachineMetadata="+k+"="+v)
+		}
+		required := map[string]pkg.Set{k: metadata[k]}
+		reqs = append(reqs, machineRequirement{
+			desc: strings.Join(pairs, " or "),
+			met:  func(ms *machine.MachineState) bool { return machine.HasMetadata(ms, required) },
+		})
+	}
+
+	for _, role := range u.RequiredRoles() {
+		roles := []string{role}
+		reqs = append(reqs, machineRequirement{
+			desc: "MachineRole=" + role,
+			met:  func(ms *machine.MachineState) bool { return machine.HasRoles(ms, roles) },
+		})
+	}
+
+	for _, expr := range u.RequiredConstraints() {
+		exprs := []string{expr}
+		reqs = append(reqs, machineRequirement{
+			desc: "MachineConstraint=" + expr,
+			met:  func(ms *machine.MachineState) bool { return machine.HasConstraints(ms, exprs) },
+		})
+	}
+	return reqs
+}
+
+// UnplaceableUnits evaluates the machine requirements of each given Unit
+// against the machines which are currently active, i.e. neither cordoned
+// nor degraded, and returns those Units which no active machine is able to
+// run, in the order given. As with ValidateDesiredState, only the
+// requirements of a Unit upon the machine itself are considered; capacity
+// and the placement of peers and conflicting Units are not. The first
+// requirement met by no machine is reported as the failing constraint.
+func (r *EtcdRegistry) UnplaceableUnits(units []*job.Unit) ([]UnplaceableUnit, error) {
+	all, err := r.Machines()
+	if err != nil {
+		return nil, err
+	}
+	var machines []*machine.MachineState
+	for i := range all {
+		if !all[i].Cordoned && !all[i].Degraded {
+			machines = append(machines, &all[i])
+		}
+	}
+
+	var unplaceable []UnplaceableUnit
+	for _, u := range units {
+		reqs := unitRequirements(u)
+
+		var failing string
+		for _, req := range reqs {
+			met := false
+			for _, ms := range machines {
+				if req.met(ms) {
+					met = true
+					break
+				}
+			}
+			if !met {
+				failing = req.desc
+				break
+			}
+		}
+
+		if failing == "" && len(machines) != 0 {
+			placeable := false
+			for _, ms := range machines {
+				metAll := true
+				for _, req := range reqs {
+					if !req.met(ms) {
+						metAll = false
+						break
+					}
+				}
+				if metAll {
+					placeable = true
+					break
+				}
+			}
+			if placeable {
+				continue
+			}
+			descs := make([]string, 0, len(reqs))
+			for _, req := range reqs {
+				descs = append(descs, req.desc)
+			}
+			failing = strings.Join(descs, " and ")
+		}
+
+		unplaceable = append(unplaceable, UnplaceableUnit{Name: u.Name, Constraint: failing})
+	}
+	return unplaceable, nil
+}
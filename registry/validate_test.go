@@ -0,0 +1,193 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+)
+
+func TestValidateDesiredState(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Metadata: map[string]string{"region": "us-east"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Metadata: map[string]string{"region": "us-west"}})
+	// Units already in the Registry are not considered
+	addTestUnit(t, r, newTestUnit(t, "old.service", "[X-Fleet]\nConflicts=*.service\n"), "XXX")
+	before, err := r.DumpKeys()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpKeys: %v", err)
+	}
+
+	desired := []*job.Unit{
+		newTestUnit(t, "web.service", ""),
+		// db and backup must share a machine but conflict
+		newTestUnit(t, "db.service", "[X-Fleet]\nConflicts=backup.service\n"),
+		newTestUnit(t, "backup.service", "[X-Fleet]\nMachineOf=db.service\n"),
+		// east and west must share a machine but require different ones
+		newTestUnit(t, "east.service", "[X-Fleet]\nMachineMetadata=region=us-east\n"),
+		newTestUnit(t, "west.service", "[X-Fleet]\nMachineOf=east.service\nMachineMetadata=region=us-west\n"),
+		newTestUnit(t, "mars.service", "[X-Fleet]\nMachineMetadata=region=mars\n"),
+		newTestUnit(t, "lonely.service", "[X-Fleet]\nMachineOf=missing.service\n"),
+		newTestUnit(t, "bad.service", "[X-Fleet]\nPriority=high\n"),
+		newTestUnit(t, "web.service", ""),
+	}
+	vr, err := r.ValidateDesiredState(desired)
+	if err != nil {
+		t.Fatalf("unexpected error from ValidateDesiredState: %v", err)
+	}
+	if vr.Valid() {
+		t.Errorf("desired state with problems reported valid")
+	}
+
+	names := func(l []UnitProblem) []string {
+		var names []string
+		for _, p := range l {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	for i, tt := range []struct {
+		got  []UnitProblem
+		want []string
+	}{
+		{vr.Invalid, []string{"bad.service", "web.service"}},
+		{vr.Conflicts, []string{"backup.service", "db.service", "lonely.service"}},
+		{vr.Unplaceable, []string{"east.service", "mars.service", "west.service"}},
+	} {
+		if got := names(tt.got); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got problems with %v, want %v: %v", i, got, tt.want, tt.got)
+		}
+	}
+
+	// A cordoned machine cannot run anything
+	if err := r.CordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from CordonMachine: %v", err)
+	}
+	vr, err = r.ValidateDesiredState([]*job.Unit{
+		newTestUnit(t, "web.service", ""),
+		newTestUnit(t, "east.service", "[X-Fleet]\nMachineMetadata=region=us-east\n"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from ValidateDesiredState: %v", err)
+	}
+	if got := names(vr.Unplaceable); !reflect.DeepEqual(got, []string{"east.service"}) || len(vr.Invalid)+len(vr.Conflicts) != 0 {
+		t.Errorf("unexpected report with cordoned machine: %#v", vr)
+	}
+	if err := r.UncordonMachine("XXX"); err != nil {
+		t.Fatalf("unexpected error from UncordonMachine: %v", err)
+	}
+
+	after, err := r.DumpKeys()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpKeys: %v", err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("ValidateDesiredState modified the Registry")
+	}
+}
+
+func TestDetectPlacementConflicts(t *testing.T) {
+	units := []*job.Unit{
+		newTestUnit(t, "a.service", "[X-Fleet]\nConflicts=b.service\n"),
+		newTestUnit(t, "b.service", ""),
+		newTestUnit(t, "c.service", "[X-Fleet]\nConflicts=*.service\n"),
+		newTestUnit(t, "d.service", ""),
+	}
+
+	for i, tt := range []struct {
+		assignments map[string]string
+		want        []ConflictPair
+	}{
+		{
+			map[string]string{"a.service": "XXX", "b.service": "YYY", "d.service": "XXX"},
+			nil,
+		},
+		{
+			map[string]string{"a.service": "XXX", "b.service": "XXX", "d.service": "XXX"},
+			[]ConflictPair{{"a.service", "b.service", "XXX"}},
+		},
+		// conflicts are detected whichever Unit declares them
+		{
+			map[string]string{"a.service": "YYY", "b.service": "YYY", "c.service": "XXX", "d.service": "XXX"},
+			[]ConflictPair{{"c.service", "d.service", "XXX"}, {"a.service", "b.service", "YYY"}},
+		},
+	} {
+		got, err := DetectPlacementConflicts(tt.assignments, units)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+
+	if _, err := DetectPlacementConflicts(map[string]string{"e.service": "XXX"}, units); err == nil {
+		t.Errorf("expected error for unknown Unit")
+	}
+}
+
+func TestUnplaceableUnits(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+	addTestMachine(t, r, machine.MachineState{ID: "XXX", Roles: []string{"web"}, Metadata: map[string]string{"region": "us-east"}})
+	addTestMachine(t, r, machine.MachineState{ID: "YYY", Roles: []string{"db"}, Metadata: map[string]string{"region": "us-west"}})
+	addTestMachine(t, r, machine.MachineState{ID: "ZZZ", Roles: []string{"cache"}})
+	if err := r.CordonMachine("ZZZ"); err != nil {
+		t.Fatalf("unexpected error from CordonMachine: %v", err)
+	}
+
+	units := []*job.Unit{
+		newTestUnit(t, "web.service", "[X-Fleet]\nMachineRole=web\n"),
+		newTestUnit(t, "gpu.service", "[X-Fleet]\nMachineRole=gpu\n"),
+		// only the cordoned machine has the role
+		newTestUnit(t, "cache.service", "[X-Fleet]\nMachineRole=cache\n"),
+		newTestUnit(t, "east-db.service", "[X-Fleet]\nMachineRole=db\nMachineMetadata=region=us-east\n"),
+		newTestUnit(t, "west-db.service", "[X-Fleet]\nMachineRole=db\nMachineMetadata=region=us-west\n"),
+		newTestUnit(t, "pinned.service", "[X-Fleet]\nMachineID=AAA\n"),
+		newTestUnit(t, "any.service", ""),
+	}
+	got, err := r.UnplaceableUnits(units)
+	if err != nil {
+		t.Fatalf("unexpected error from UnplaceableUnits: %v", err)
+	}
+	want := []UnplaceableUnit{
+		{"gpu.service", "MachineRole=gpu"},
+		{"cache.service", "MachineRole=cache"},
+		{"east-db.service", "MachineMetadata=region=us-east and MachineRole=db"},
+		{"pinned.service", "MachineID=AAA"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got unplaceable Units %v, want %v", got, want)
+	}
+
+	// Without active machines, nothing can be placed
+	for _, id := range []string{"XXX", "YYY"} {
+		if err := r.CordonMachine(id); err != nil {
+			t.Fatalf("unexpected error from CordonMachine: %v", err)
+		}
+	}
+	got, err = r.UnplaceableUnits(units[len(units)-1:])
+	if err != nil {
+		t.Fatalf("unexpected error from UnplaceableUnits: %v", err)
+	}
+	if want := []UnplaceableUnit{{"any.service", ""}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got unplaceable Units %v, want %v", got, want)
+	}
+}
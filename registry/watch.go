@@ -0,0 +1,174 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"time"
+
+	etcd "github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/fleet/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/fleet/log"
+)
+
+// etcdIndex returns the current etcd index as reported in response to a
+// read of the given key, whether or not that key exists
+func (r *EtcdRegistry) etcdIndex(key string) (uint64, error) {
+	res, err := r.kAPI.Get(r.ctx(), key, nil)
+	if err == nil {
+		return res.Index, nil
+	}
+	if eerr, ok := err.(etcd.Error); ok && eerr.Code == etcd.ErrorCodeKeyNotFound {
+		return eerr.Index, nil
+	}
+	return 0, err
+}
+
+// CurrentIndex returns the current etcd index. Any change made to the
+// Registry after CurrentIndex returns will be assigned a greater index, so
+// a watch started from the returned index observes every such change.
+func (r *EtcdRegistry) CurrentIndex() (uint64, error) {
+	return r.etcdIndex(r.prefixed())
+}
+
+// WaitForIndex blocks until the etcd member serving this Registry has
+// applied all changes up to and including the given index, as returned by
+// a write such as ScheduleUnitWithIndex, giving reads made afterwards
+// read-your-writes semantics. It does so by watching for a change to the
+// Registry at or after that index, which the member can only report once
+// it has caught up. An error is returned if that does not happen within
+// the request timeout.
+func (r *EtcdRegistry) WaitForIndex(idx uint64) error {
+	key := r.prefixed()
+	switch idx {
+	case 0:
+		return nil
+	case 1:
+		// A watch cannot be started from index zero, as that means
+		// "from now", so fall back to a quorum read which is only
+		// answered once every committed change has been applied
+		_, err := r.kAPI.Get(r.ctx(), key, &etcd.GetOptions{Quorum: true})
+		if isEtcdError(err, etcd.ErrorCodeKeyNotFound) {
+			err = nil
+		}
+		return err
+	}
+
+	opts := &etcd.WatcherOptions{
+		AfterIndex: idx - 1,
+		Recursive:  true,
+	}
+	_, err := r.kAPI.Watcher(key, opts).Next(r.ctx())
+	if isEtcdError(err, etcd.ErrorCodeEventIndexCleared) {
+		// The member has already discarded its history beyond the
+		// given index, so it must have applied it
+		err = nil
+	}
+	return err
+}
+
+// watchPrefix recursively watches the given key and passes every response
+// to fn, in the order etcd delivers them, until stop is closed. Should the
+// watch fail it is reestablished from the index of the last delivered
+// response, so no events are missed across reconnects. The only exception
+// is when etcd has already discarded the events following that index, in
+// which case the watch resumes from the current index.
+func (r *EtcdRegistry) watchPrefix(key string, stop <-chan struct{}, fn func(*etcd.Response)) {
+	r.watchPrefixAfter(key, 0, stop, fn)
+}
+
+// watchPrefixAfter behaves like watchPrefix, but starts watching after the
+// given etcd index rather than the current one, unless it is zero
+func (r *EtcdRegistry) watchPrefixAfter(key string, idx uint64, stop <-chan struct{}, fn func(*etcd.Response)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if idx == 0 {
+			var err error
+			if idx, err = r.etcdIndex(key); err != nil {
+				log.Errorf("Failed determining etcd index for watch of %s: %v", key, err)
+				if !sleepUnlessStopped(time.Second, stop) {
+					return
+				}
+				continue
+			}
+		}
+
+		opts := &etcd.WatcherOptions{
+			AfterIndex: idx,
+			Recursive:  true,
+		}
+		watcher := r.kAPI.Watcher(key, opts)
+		log.Debugf("Creating etcd watcher: %s", key)
+
+		for {
+			res, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Debugf("Gracefully closing etcd watch loop: key=%s", key)
+					return
+				}
+				if isEtcdError(err, etcd.ErrorCodeEventIndexCleared) {
+					log.Warningf("etcd watcher %v fell behind, events after index %d were lost", key, idx)
+					idx = 0
+				} else if isLeaderChangeError(err) {
+					log.Warningf("etcd watcher %v interrupted by leader change: %v", key, err)
+				} else {
+					log.Errorf("etcd watcher %v returned error: %v", key, err)
+				}
+				break
+			}
+			if res.Node != nil {
+				idx = res.Node.ModifiedIndex
+			}
+			fn(res)
+		}
+
+		// Let's not slam the etcd server in the event that we know
+		// an unexpected error occurred.
+		if !sleepUnlessStopped(time.Second, stop) {
+			return
+		}
+	}
+}
+
+// sleepUnlessStopped waits for the given duration, returning false early if
+// stop is closed in the meantime
+func sleepUnlessStopped(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// isDeletion reports whether the given watch response describes the removal
+// of a key, whether explicit or by TTL expiration
+func isDeletion(res *etcd.Response) bool {
+	switch res.Action {
+	case "delete", "compareAndDelete", "expire":
+		return true
+	}
+	return false
+}
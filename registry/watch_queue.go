@@ -0,0 +1,314 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchOverflow determines what a watch does with a new event once the
+// events buffered for a slow consumer reach the watch buffer size
+type WatchOverflow int
+
+const (
+	// WatchBlock stops reading from etcd until the consumer catches up.
+	// No events are lost, but etcd may compact the history the watch
+	// still has to read, in which case the events are lost anyway.
+	WatchBlock WatchOverflow = iota
+	// WatchDropOldest discards the oldest buffered event to make room
+	// for the new one, so the consumer always sees the most recent
+	// events
+	WatchDropOldest
+)
+
+// WatchStats describes the delivery of events to the consumer of a watch
+type WatchStats struct {
+	// Name identifies the watch, e.g. "leases" or "unit/foo.service"
+	Name string
+	// Buffered is the number of events waiting for the consumer
+	Buffered int
+	// Delivered and Dropped count the events received by the consumer
+	// and those discarded because the buffer was full
+	Delivered uint64
+	Dropped   uint64
+	// LastDelivered is when the consumer last received an event, or the
+	// time the watch started if it has not received any
+	LastDelivered time.Time
+}
+
+// SetWatchDelivery configures how watches started afterwards deliver their
+// events: up to buffer events are held for a consumer which falls behind,
+// and overflow determines what happens to further events. A buffer of less
+// than one holds a single event. By default watches hold a single event
+// and block.
+func (r *EtcdRegistry) SetWatchDelivery(buffer int, overflow WatchOverflow) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	r.watchBuffer = buffer
+	r.watchOverflow = overflow
+}
+
+// WatchStats returns the delivery statistics of every watch which is
+// currently active, sorted by name. A watch whose consumer is stuck can be
+// spotted by a growing Buffered or Dropped count, or by a LastDelivered
+// time which lags far behind that of other watches.
+func (r *EtcdRegistry) WatchStats() []WatchStats {
+	r.watchMu.Lock()
+	queues := make([]*watchQueue, 0, len(r.watches))
+	for q := range r.watches {
+		queues = append(queues, q)
+	}
+	r.watchMu.Unlock()
+
+	stats := make([]WatchStats, 0, len(queues))
+	for _, q := range queues {
+		stats = append(stats, q.stats())
+	}
+	sort.Sort(sortableWatchStats(stats))
+	return stats
+}
+
+// watchKind returns the kind of the named watch, which is the name up to
+// any "/", e.g. "unit" for "unit/foo.service"
+func watchKind(name string) string {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// watchTotals accumulates the delivery of every watch of one kind started
+// from a Registry, including those which have since stopped. Its fields
+// are only accessed atomically.
+type watchTotals struct {
+	delivered uint64
+	dropped   uint64
+}
+
+// watchTotalsByKind returns the delivery of every kind of watch started
+// from the Registry so far, keyed by kind
+func (r *EtcdRegistry) watchTotalsByKind() map[string]watchTotals {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	totals := make(map[string]watchTotals, len(r.watchTotals))
+	for kind, wt := range r.watchTotals {
+		totals[kind] = watchTotals{
+			delivered: atomic.LoadUint64(&wt.delivered),
+			dropped:   atomic.LoadUint64(&wt.dropped),
+		}
+	}
+	return totals
+}
+
+type sortableWatchStats []WatchStats
+
+func (s sortableWatchStats) Len() int      { return len(s) }
+func (s sortableWatchStats) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableWatchStats) Less(i, j int) bool {
+	return s[i].Name < s[j].Name || (s[i].Name == s[j].Name && s[i].LastDelivered.Before(s[j].LastDelivered))
+}
+
+// watchQueue buffers the events of a watch between the goroutine reading
+// them from etcd and the consumer, according to the Registry's watch
+// delivery settings
+type watchQueue struct {
+	r        *EtcdRegistry
+	name     string
+	totals   *watchTotals
+	size     int
+	overflow WatchOverflow
+	// send delivers an event to the consumer, returning false if the
+	// watch was stopped first
+	send func(interface{}) bool
+	// done is closed once delivery has stopped, and closed once the
+	// consumer's channel has been closed as well
+	done   chan struct{}
+	closed chan struct{}
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []interface{}
+	stopped   bool
+	delivered uint64
+	dropped   uint64
+	last      time.Time
+}
+
+// StopAllWatches stops every watch started from the Registry, as if the
+// stop channel of each had been closed, and waits until all of their
+// goroutines have exited and their channels have been closed. The Registry
+// itself remains usable, and watches started afterwards run as usual. It
+// does nothing if no watches are active.
+func (r *EtcdRegistry) StopAllWatches() {
+	r.watchMu.Lock()
+	if r.stopWatches != nil {
+		close(r.stopWatches)
+		r.stopWatches = nil
+	}
+	queues := make([]*watchQueue, 0, len(r.watches))
+	for q := range r.watches {
+		queues = append(queues, q)
+	}
+	r.watchMu.Unlock()
+
+	for _, q := range queues {
+		<-q.closed
+	}
+}
+
+// watchStop returns a channel which is closed once either the given stop
+// channel is closed or StopAllWatches is called. Every watch method uses
+// it in place of the stop channel provided by its caller.
+func (r *EtcdRegistry) watchStop(stop <-chan struct{}) <-chan struct{} {
+	r.watchMu.Lock()
+	if r.stopWatches == nil {
+		r.stopWatches = make(chan struct{})
+	}
+	all := r.stopWatches
+	r.watchMu.Unlock()
+
+	merged := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-all:
+		}
+		close(merged)
+	}()
+	return merged
+}
+
+// newWatchQueue starts delivering the events pushed to the returned
+// watchQueue using send, until stop is closed. The caller must call close
+// once it stops pushing events.
+func (r *EtcdRegistry) newWatchQueue(name string, stop <-chan struct{}, send func(interface{}) bool) *watchQueue {
+	r.watchMu.Lock()
+	q := &watchQueue{
+		r:        r,
+		name:     name,
+		size:     r.watchBuffer,
+		overflow: r.watchOverflow,
+		send:     send,
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		last:     time.Now(),
+	}
+	if q.size < 1 {
+		q.size = 1
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if r.watches == nil {
+		r.watches = make(map[*watchQueue]struct{})
+	}
+	r.watches[q] = struct{}{}
+	if r.watchTotals == nil {
+		r.watchTotals = make(map[string]*watchTotals)
+	}
+	kind := watchKind(name)
+	if r.watchTotals[kind] == nil {
+		r.watchTotals[kind] = &watchTotals{}
+	}
+	q.totals = r.watchTotals[kind]
+	r.watchMu.Unlock()
+
+	go func() {
+		<-stop
+		q.mu.Lock()
+		q.stopped = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+	go q.run()
+	return q
+}
+
+// push queues an event for delivery, blocking or dropping the oldest
+// buffered event if the buffer is full. It returns false once the watch
+// has been stopped.
+func (q *watchQueue) push(ev interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.stopped && len(q.buf) >= q.size {
+		if q.overflow == WatchDropOldest {
+			q.buf = q.buf[1:]
+			q.dropped++
+			atomic.AddUint64(&q.totals.dropped, 1)
+			continue
+		}
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return false
+	}
+	q.buf = append(q.buf, ev)
+	q.cond.Broadcast()
+	return true
+}
+
+func (q *watchQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for !q.stopped && len(q.buf) == 0 {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mu.Unlock()
+			return
+		}
+		ev := q.buf[0]
+		q.buf = q.buf[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		if !q.send(ev) {
+			return
+		}
+
+		q.mu.Lock()
+		q.delivered++
+		q.last = time.Now()
+		q.mu.Unlock()
+		atomic.AddUint64(&q.totals.delivered, 1)
+	}
+}
+
+// close blocks until the watchQueue has stopped delivering events, then
+// calls closeOut to close the consumer's channel and removes the watch
+// from those tracked by the Registry
+func (q *watchQueue) close(closeOut func()) {
+	<-q.done
+	closeOut()
+	q.r.watchMu.Lock()
+	delete(q.r.watches, q)
+	q.r.watchMu.Unlock()
+	close(q.closed)
+}
+
+func (q *watchQueue) stats() WatchStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return WatchStats{
+		Name:          q.name,
+		Buffered:      len(q.buf),
+		Delivered:     q.delivered,
+		Dropped:       q.dropped,
+		LastDelivered: q.last,
+	}
+}
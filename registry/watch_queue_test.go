@@ -0,0 +1,168 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/pkg/lease"
+)
+
+func TestWatchStatsDropOldest(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	r.SetWatchDelivery(2, WatchDropOldest)
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+	stop := make(chan struct{})
+
+	ch := r.WatchLeases(stop)
+	e.waitForWatchers(t, 1)
+	start := time.Now()
+
+	// Nothing is read from the channel while the leases are acquired
+	const total = 5
+	for i := 0; i < total; i++ {
+		if _, err := lm.AcquireLease(fmt.Sprintf("l%d", i), "XXX", 1, time.Minute); err != nil {
+			t.Fatalf("unexpected error from AcquireLease: %v", err)
+		}
+	}
+
+	// One event is held by the blocked delivery, and all others are
+	// either buffered or dropped
+	var stats WatchStats
+	deadline := time.After(time.Second)
+	for {
+		all := r.WatchStats()
+		if len(all) != 1 {
+			t.Fatalf("expected stats of 1 watch, got %v", all)
+		}
+		stats = all[0]
+		if stats.Buffered+int(stats.Dropped) == total-1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for events to be buffered: %#v", stats)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if stats.Name != "leases" || stats.Buffered < 1 || stats.Buffered > 2 || stats.Dropped < 2 || stats.Delivered != 0 || stats.LastDelivered.After(start) {
+		t.Errorf("unexpected stats of slow consumer: %#v", stats)
+	}
+
+	var got []string
+	for i := uint64(0); i < total-stats.Dropped; i++ {
+		select {
+		case ev := <-ch:
+			got = append(got, ev.Name)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for LeaseEvent")
+		}
+	}
+	// The most recent events are kept
+	if got[len(got)-2] != "l3" || got[len(got)-1] != "l4" {
+		t.Errorf("expected most recent events to be delivered, got %v", got)
+	}
+
+	stats = r.WatchStats()[0]
+	if stats.Buffered != 0 || stats.Delivered != uint64(len(got)) || !stats.LastDelivered.After(start) {
+		t.Errorf("unexpected stats after consumer caught up: %#v", stats)
+	}
+
+	close(stop)
+	for range ch {
+	}
+	if all := r.WatchStats(); len(all) != 0 {
+		t.Errorf("expected no stats after watch stopped, got %v", all)
+	}
+}
+
+func TestStopAllWatches(t *testing.T) {
+	e := newMemKeysAPI()
+	r := NewEtcdRegistry(e, "/fleet/", time.Second)
+	lm := lease.NewEtcdLeaseManager(e, "/fleet/", time.Second)
+
+	// Safe without any active watches
+	r.StopAllWatches()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	leases := r.WatchLeases(stop)
+	machines, err := r.WatchMachinesMatching(nil, stop)
+	if err != nil {
+		t.Fatalf("unexpected error from WatchMachinesMatching: %v", err)
+	}
+	lifecycle := r.WatchUnit("foo.service", stop)
+	states := r.WatchUnitStates(0, stop)
+	e.waitForWatchers(t, 5)
+	if n := len(r.WatchStats()); n != 4 {
+		t.Fatalf("expected 4 active watches, got %d", n)
+	}
+
+	r.StopAllWatches()
+	if all := r.WatchStats(); len(all) != 0 {
+		t.Errorf("expected no active watches, got %v", all)
+	}
+	// Every channel has already been closed
+	select {
+	case _, ok := <-leases:
+		if ok {
+			t.Errorf("unexpected LeaseEvent after StopAllWatches")
+		}
+	default:
+		t.Errorf("WatchLeases channel not closed")
+	}
+	select {
+	case _, ok := <-machines:
+		if ok {
+			t.Errorf("unexpected MachineEvent after StopAllWatches")
+		}
+	default:
+		t.Errorf("WatchMachinesMatching channel not closed")
+	}
+	select {
+	case _, ok := <-lifecycle:
+		if ok {
+			t.Errorf("unexpected UnitLifecycleEvent after StopAllWatches")
+		}
+	default:
+		t.Errorf("WatchUnit channel not closed")
+	}
+	select {
+	case _, ok := <-states:
+		if ok {
+			t.Errorf("unexpected UnitStateEvent after StopAllWatches")
+		}
+	default:
+		t.Errorf("WatchUnitStates channel not closed")
+	}
+
+	// Watches started afterwards are unaffected
+	leases = r.WatchLeases(stop)
+	e.waitForWatchers(t, 6)
+	if _, err := lm.AcquireLease("engine-leader", "XXX", 1, time.Minute); err != nil {
+		t.Fatalf("unexpected error from AcquireLease: %v", err)
+	}
+	select {
+	case ev := <-leases:
+		if ev.Name != "engine-leader" {
+			t.Errorf("unexpected LeaseEvent: %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for LeaseEvent")
+	}
+}
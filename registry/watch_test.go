@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+)
+
+func TestCurrentIndex(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", time.Second)
+
+	// The index is available before anything has been written
+	before, err := r.CurrentIndex()
+	if err != nil {
+		t.Fatalf("unexpected error from CurrentIndex: %v", err)
+	}
+
+	written, err := r.SetMachineState(machine.MachineState{ID: "XXX"}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from SetMachineState: %v", err)
+	}
+	after, err := r.CurrentIndex()
+	if err != nil {
+		t.Fatalf("unexpected error from CurrentIndex: %v", err)
+	}
+	if written <= before || after < written {
+		t.Errorf("index did not advance with write: before=%d written=%d after=%d", before, written, after)
+	}
+}
+
+func TestWaitForIndex(t *testing.T) {
+	r := NewEtcdRegistry(newMemKeysAPI(), "/fleet/", 50*time.Millisecond)
+
+	// The very first write to etcd cannot be waited for with a watch
+	idx, err := r.ScheduleUnitWithIndex("bar.service", "XXX")
+	if err != nil || idx != 1 {
+		t.Fatalf("unexpected result from ScheduleUnitWithIndex: %d, %v", idx, err)
+	}
+	if err := r.WaitForIndex(idx); err != nil {
+		t.Errorf("unexpected error waiting for first index: %v", err)
+	}
+
+	idx, err = r.ScheduleUnitWithIndex("foo.service", "XXX")
+	if err != nil || idx <= 1 {
+		t.Fatalf("unexpected result from ScheduleUnitWithIndex: %d, %v", idx, err)
+	}
+	if err := r.WaitForIndex(idx); err != nil {
+		t.Errorf("unexpected error waiting for applied index: %v", err)
+	}
+	if machID, _, _ := r.UnitTarget("foo.service"); machID != "XXX" {
+		t.Errorf("read after WaitForIndex did not observe write: %q", machID)
+	}
+
+	if _, err := r.ScheduleUnitWithIndex("foo.service", "YYY"); err == nil {
+		t.Errorf("expected error scheduling already-scheduled Unit")
+	}
+
+	// An index from the future is never reached
+	cur, _ := r.CurrentIndex()
+	if err := r.WaitForIndex(cur + 100); err == nil {
+		t.Errorf("expected error waiting for unreached index")
+	}
+}
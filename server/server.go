@@ -56,10 +56,12 @@ type Server struct {
 	mach          *machine.CoreOSMachine
 	hrt           heart.Heart
 	mon           *Monitor
+	reg           *registry.EtcdRegistry
 	api           *api.Server
 	disableEngine bool
 
 	engineReconcileInterval time.Duration
+	ensureKeyspace          bool
 
 	killc chan struct{}  // used to signal monitor to shutdown server
 	stopc chan struct{}  // used to terminate all other goroutines
@@ -97,7 +99,7 @@ func New(cfg config.Config) (*Server, error) {
 	}
 
 	etcdRequestTimeout := time.Duration(cfg.EtcdRequestTimeout*1000) * time.Millisecond
-	kAPI := etcd.NewKeysAPI(eClient)
+	kAPI := registry.NewLeaderRetryKeysAPI(etcd.NewKeysAPI(eClient), eClient)
 	reg := registry.NewEtcdRegistry(kAPI, cfg.EtcdKeyPrefix, etcdRequestTimeout)
 
 	pub := agent.NewUnitStatePublisher(reg, mach, agentTTL)
@@ -137,11 +139,13 @@ func New(cfg config.Config) (*Server, error) {
 		mach:        mach,
 		hrt:         hrt,
 		mon:         mon,
+		reg:         reg,
 		api:         apiServer,
 		killc:       make(chan struct{}),
 		stopc:       nil,
 		engineReconcileInterval: eIval,
 		disableEngine:           cfg.DisableEngine,
+		ensureKeyspace:          cfg.EnsureKeyspace,
 	}
 
 	return &srv, nil
@@ -151,6 +155,8 @@ func newMachineFromConfig(cfg config.Config, mgr unit.UnitManager) (*machine.Cor
 	state := machine.MachineState{
 		PublicIP: cfg.PublicIP,
 		Metadata: cfg.Metadata(),
+		Roles:    cfg.Roles(),
+		MaxUnits: cfg.MaxUnits,
 		Version:  version.Version,
 	}
 
@@ -176,6 +182,12 @@ func (s *Server) Run() {
 		time.Sleep(sleep)
 	}
 
+	if s.ensureKeyspace {
+		if err := s.reg.EnsureKeyspace(); err != nil {
+			log.Warningf("Failed initializing etcd keyspace: %v", err)
+		}
+	}
+
 	go s.Supervise()
 
 	log.Infof("Starting server components")
@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"sync"
 
 	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/dbus"
@@ -166,9 +167,31 @@ func (m *systemdUnitManager) getUnitState(name string) (*unit.UnitState, error)
 		ActiveState: info["ActiveState"].(string),
 		SubState:    info["SubState"].(string),
 	}
+	if us.ActiveState == "failed" {
+		us.Reason = m.failureReason(name)
+	}
 	return &us, nil
 }
 
+// failureReason describes why the named unit failed, as reported by
+// systemd. An empty string is returned if this cannot be determined, which
+// is always the case for units which are not services.
+func (m *systemdUnitManager) failureReason(name string) string {
+	if !strings.HasSuffix(name, ".service") {
+		return ""
+	}
+	info, err := m.systemd.GetUnitTypeProperties(name, "Service")
+	if err != nil {
+		log.Debugf("Failed determining failure reason of Unit(%s): %v", name, err)
+		return ""
+	}
+	result, _ := info["Result"].(string)
+	if code, ok := info["ExecMainStatus"].(int32); ok && result == "exit-code" {
+		return fmt.Sprintf("exit code %d", code)
+	}
+	return result
+}
+
 func (m *systemdUnitManager) readUnit(name string) (string, error) {
 	path := m.getUnitFilePath(name)
 	contents, err := ioutil.ReadFile(path)
@@ -215,6 +238,9 @@ func (m *systemdUnitManager) GetUnitStates(filter pkg.Set) (map[string]*unit.Uni
 			ActiveState: dus.ActiveState,
 			SubState:    dus.SubState,
 		}
+		if us.ActiveState == "failed" {
+			us.Reason = m.failureReason(dus.Name)
+		}
 		if h, ok := m.hashes[dus.Name]; ok {
 			us.UnitHash = h.String()
 		}
@@ -191,6 +191,9 @@ type UnitState struct {
 	MachineID   string
 	UnitHash    string
 	UnitName    string
+	// Reason optionally explains why the unit is in its current state,
+	// e.g. "exit code 1" for a failed service
+	Reason string `json:",omitempty"`
 }
 
 func NewUnitState(loadState, activeState, subState, mID string) *UnitState {